@@ -0,0 +1,68 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errPoolExhausted  = errors.New("connection pool exhausted: too many callers waiting")
+	errAcquireTimeout = errors.New("timed out waiting for a pooled connection")
+)
+
+// IsPoolExhausted reports whether err was returned because Pool.MaxWaiters
+// callers were waiting for a connection already.
+func IsPoolExhausted(err error) bool {
+	return errors.Is(err, errPoolExhausted)
+}
+
+// IsAcquireTimeout reports whether err was returned because no
+// connection became available within Pool.AcquireTimeoutMs.
+func IsAcquireTimeout(err error) bool {
+	return errors.Is(err, errAcquireTimeout)
+}
+
+// AcquireWaiters returns how many callers are waiting in
+// GetConnectionCtx for a connection of the primary.
+func (session *DB_Session) AcquireWaiters() int32 {
+	return session.waiters.Load()
+}
+
+// admitWaiter counts the caller as waiting for a connection, unless
+// MaxWaiters are already and the pool has none left to hand out. The
+// caller must call session.waiters.Add(-1) once admitted.
+func (session *DB_Session) admitWaiter() error {
+	n := session.waiters.Add(1)
+	limit := session.Params().Pool.MaxWaiters
+	if limit <= 0 || int(n) <= limit {
+		return nil
+	}
+	if pool := session.pool.Load(); pool != nil {
+		if s := pool.Stat(); s.IdleConns() > 0 || s.TotalConns() < s.MaxConns() {
+			return nil
+		}
+	}
+	session.waiters.Add(-1)
+	return errPoolExhausted
+}
+
+// acquireContext bounds the wait of GetConnectionCtx by AcquireTimeoutMs.
+func (session *DB_Session) acquireContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(session.Params().Pool.AcquireTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// waitError is the error of a wait for a connection that ended with
+// the context of acquireContext: the caller's own error, or the
+// acquire timeout.
+func (session *DB_Session) waitError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w after %dms", errAcquireTimeout, session.Params().Pool.AcquireTimeoutMs)
+}
@@ -0,0 +1,230 @@
+// Package admin answers "why is the database slow" for the bot's /admin
+// command: table and index sizes, estimated index bloat, long-running
+// queries, contended locks, what the server's connections are doing and
+// the session's own pools. Everything is read from the statistics views
+// of the primary; nothing is changed.
+package admin
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+type TableSize struct {
+	Table string `db:"table"`
+	// Rows is the planner's estimate, as of the last ANALYZE.
+	Rows            int64      `db:"rows"`
+	TotalBytes      int64      `db:"total_bytes"`
+	TableBytes      int64      `db:"table_bytes"`
+	IndexBytes      int64      `db:"index_bytes"`
+	DeadRows        int64      `db:"dead_rows"`
+	LastAutovacuum  *time.Time `db:"last_autovacuum"`
+	LastAutoanalyze *time.Time `db:"last_autoanalyze"`
+}
+
+// IndexBloat is the estimated space a B-tree index takes beyond what its
+// entries need. The estimate comes from the column statistics, so it is
+// rough, and too high for expression indexes; REINDEX CONCURRENTLY
+// reclaims the space of one that is really bloated.
+type IndexBloat struct {
+	Index      string `db:"index"`
+	Table      string `db:"table"`
+	IndexBytes int64  `db:"index_bytes"`
+	BloatBytes int64  `db:"bloat_bytes"`
+	// Scans counts the uses of the index since the statistics were reset;
+	// a big index never scanned is a candidate for dropping.
+	Scans int64 `db:"scans"`
+}
+
+// Ratio is the share of the index estimated to be bloat.
+func (b IndexBloat) Ratio() float64 {
+	if b.IndexBytes == 0 {
+		return 0
+	}
+	return float64(b.BloatBytes) / float64(b.IndexBytes)
+}
+
+// Activity is a connection of pg_stat_activity. WaitEvent is
+// "<type>:<event>" while the backend waits, e.g. "Lock:transactionid".
+type Activity struct {
+	PID         int32         `db:"pid"`
+	User        string        `db:"user"`
+	Application string        `db:"application"`
+	Client      string        `db:"client"`
+	State       string        `db:"state"`
+	WaitEvent   string        `db:"wait_event"`
+	QueryAge    time.Duration `db:"query_age"`
+	XactAge     time.Duration `db:"xact_age"`
+	Query       string        `db:"query"`
+}
+
+// Lock is a lock held or awaited by a connection. BlockedBy lists the
+// PIDs the connection waits for.
+type Lock struct {
+	PID         int32         `db:"pid"`
+	Application string        `db:"application"`
+	LockType    string        `db:"lock_type"`
+	Mode        string        `db:"mode"`
+	Granted     bool          `db:"granted"`
+	Relation    string        `db:"relation"`
+	BlockedBy   []int32       `db:"blocked_by"`
+	XactAge     time.Duration `db:"xact_age"`
+	Query       string        `db:"query"`
+}
+
+// ActivityGroup counts the connections to the database in one state.
+type ActivityGroup struct {
+	Application   string        `db:"application"`
+	State         string        `db:"state"`
+	WaitEventType string        `db:"wait_event_type"`
+	Connections   int64         `db:"connections"`
+	OldestXact    time.Duration `db:"oldest_xact"`
+}
+
+// ActivitySummary is what the connections of the server are doing.
+// Connections counts those of every database against MaxConnections.
+type ActivitySummary struct {
+	MaxConnections int
+	Connections    int
+	Groups         []ActivityGroup
+}
+
+type Admin struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Admin {
+	return &Admin{session: session}
+}
+
+// TableSizes returns the limit biggest tables of the session's schema,
+// indexes and TOAST included. Partitions are listed on their own.
+func (a *Admin) TableSizes(ctx context.Context, limit int) ([]TableSize, error) {
+	rows, err := a.session.Query(ctx, `SELECT c.oid::regclass::text AS table, greatest(c.reltuples, 0)::bigint AS rows,
+			pg_total_relation_size(c.oid) AS total_bytes, pg_relation_size(c.oid) AS table_bytes, pg_indexes_size(c.oid) AS index_bytes,
+			coalesce(s.n_dead_tup, 0) AS dead_rows, s.last_autovacuum, s.last_autoanalyze
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE c.relkind IN ('r', 'm') AND n.nspname = current_schema()
+		ORDER BY total_bytes DESC, 1 LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[TableSize])
+}
+
+// IndexBloat returns the limit B-tree indexes of the session's schema
+// with the most estimated bloat.
+func (a *Admin) IndexBloat(ctx context.Context, limit int) ([]IndexBloat, error) {
+	// An entry takes its key, the 8 byte tuple header and its 4 byte line
+	// pointer; a page has a 24 byte header and is filled to fillfactor.
+	rows, err := a.session.Query(ctx, `WITH idx AS (
+			SELECT i.indexrelid, i.indrelid, c.relpages, greatest(c.reltuples, 0) AS tuples,
+				current_setting('block_size')::numeric AS block_size,
+				coalesce(substring(array_to_string(c.reloptions, ' ') FROM 'fillfactor=([0-9]+)')::numeric, 90) AS fillfactor,
+				(SELECT coalesce(sum(s.avg_width), 0) FROM pg_attribute att
+					JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = t.relname AND s.attname = att.attname
+					WHERE att.attrelid = i.indrelid AND att.attnum = ANY(i.indkey::int2[])) AS key_width
+			FROM pg_index i
+			JOIN pg_class c ON c.oid = i.indexrelid
+			JOIN pg_class t ON t.oid = i.indrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_am am ON am.oid = c.relam
+			WHERE am.amname = 'btree' AND n.nspname = current_schema() AND c.relpages > 1
+		)
+		SELECT idx.indexrelid::regclass::text AS index, idx.indrelid::regclass::text AS table,
+			(relpages * block_size)::bigint AS index_bytes,
+			(greatest(0, relpages - 1 - ceil(tuples * (key_width + 12) / ((block_size - 24) * fillfactor / 100))) * block_size)::bigint AS bloat_bytes,
+			coalesce(st.idx_scan, 0) AS scans
+		FROM idx
+		LEFT JOIN pg_stat_user_indexes st ON st.indexrelid = idx.indexrelid
+		ORDER BY bloat_bytes DESC, 1 LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[IndexBloat])
+}
+
+// LongQueries returns the connections to the database whose query, or
+// transaction, has been running for at least min, oldest first. Idle in
+// transaction connections are included; they hold back vacuum and keep
+// their locks.
+func (a *Admin) LongQueries(ctx context.Context, min time.Duration) ([]Activity, error) {
+	rows, err := a.session.Query(ctx, `SELECT pid, coalesce(usename, '') AS user, application_name AS application,
+			coalesce(host(client_addr), '') AS client, coalesce(state, '') AS state,
+			coalesce(wait_event_type || ':' || wait_event, '') AS wait_event,
+			coalesce(now() - query_start, '0') AS query_age, coalesce(now() - xact_start, '0') AS xact_age, query
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND backend_type = 'client backend' AND pid <> pg_backend_pid()
+			AND state <> 'idle' AND now() - coalesce(xact_start, query_start) >= $1::interval
+		ORDER BY coalesce(xact_start, query_start)`, min)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Activity])
+}
+
+// Locks returns the contended locks of the database: those awaited, and
+// those held by a connection another one waits for. Waiting locks come
+// first, then by transaction age.
+func (a *Admin) Locks(ctx context.Context) ([]Lock, error) {
+	rows, err := a.session.Query(ctx, `WITH blocking AS (
+			SELECT DISTINCT unnest(pg_blocking_pids(pid)) AS pid FROM pg_stat_activity
+		)
+		SELECT l.pid, coalesce(act.application_name, '') AS application, l.locktype AS lock_type, l.mode, l.granted,
+			coalesce(l.relation::regclass::text, '') AS relation, pg_blocking_pids(l.pid) AS blocked_by,
+			coalesce(now() - act.xact_start, '0') AS xact_age, coalesce(act.query, '') AS query
+		FROM pg_locks l
+		JOIN pg_stat_activity act ON act.pid = l.pid
+		WHERE act.datname = current_database() AND l.pid <> pg_backend_pid()
+			AND (NOT l.granted OR l.pid IN (SELECT pid FROM blocking))
+		ORDER BY l.granted, xact_age DESC, l.pid`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Lock])
+}
+
+// Activity summarizes the connections of the server, those to the
+// database grouped by application, state and wait event type, busiest
+// first.
+func (a *Admin) Activity(ctx context.Context) (*ActivitySummary, error) {
+	conn, err := a.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	summary := &ActivitySummary{}
+	err = conn.QueryRow(ctx, `SELECT current_setting('max_connections')::int,
+		(SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend')`).Scan(&summary.MaxConnections, &summary.Connections)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `SELECT application_name AS application, coalesce(state, '') AS state,
+			coalesce(wait_event_type, '') AS wait_event_type, count(*) AS connections,
+			coalesce(max(now() - xact_start), '0') AS oldest_xact
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND backend_type = 'client backend'
+		GROUP BY 1, 2, 3
+		ORDER BY connections DESC, 1, 2, 3`)
+	if err != nil {
+		return nil, err
+	}
+	summary.Groups, err = pgx.CollectRows(rows, pgx.RowToStructByName[ActivityGroup])
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// Pools returns the session's own connection pools; a pool with all
+// connections acquired and EmptyAcquires growing is the bot waiting on
+// itself rather than on the server.
+func (a *Admin) Pools() []database.PoolStats {
+	return a.session.PoolStats()
+}
@@ -0,0 +1,189 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var errLockLost = errors.New("advisory lock lost")
+
+// IsLockLost reports whether err was returned because the connection
+// holding an advisory lock failed, so the lock was released and another
+// instance may hold it now.
+func IsLockLost(err error) bool {
+	return errors.Is(err, errLockLost)
+}
+
+// AdvisoryKey derives a lock key from a name such as "crawl:litres", so
+// coordinating instances don't need to agree on numbers.
+func AdvisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// AdvisoryLock is a session-level advisory lock held on a connection of
+// its own, outside the pool, so reconnects of the pool don't touch it.
+// The connection is checked with the session's health checks; if it
+// fails, the server has released the lock and Lost is closed.
+type AdvisoryLock struct {
+	session  *DB_Session
+	key      int64
+	conn     *pgx.Conn
+	lost     chan struct{}
+	released chan struct{}
+	mu       sync.Mutex
+	err      error
+	once     sync.Once
+}
+
+// AcquireAdvisoryLock waits until the lock key is free, or ctx is done,
+// and takes it; release it with Release.
+func (session *DB_Session) AcquireAdvisoryLock(ctx context.Context, key int64) (*AdvisoryLock, error) {
+	lock, ok, err := session.advisoryLock(ctx, key, "SELECT true FROM pg_advisory_lock($1)")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errLockLost
+	}
+	return lock, nil
+}
+
+// TryAdvisoryLock takes the lock key if it is free, returning false when
+// another session holds it.
+func (session *DB_Session) TryAdvisoryLock(ctx context.Context, key int64) (*AdvisoryLock, bool, error) {
+	return session.advisoryLock(ctx, key, "SELECT pg_try_advisory_lock($1)")
+}
+
+func (session *DB_Session) advisoryLock(ctx context.Context, key int64, sql string) (*AdvisoryLock, bool, error) {
+	if session.State() == StateClosed {
+		return nil, false, errShutdown
+	}
+	conn, err := pgx.ConnectConfig(ctx, session.primaryConfig().ConnConfig.Copy())
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	if err := conn.QueryRow(ctx, sql, key).Scan(&ok); err != nil || !ok {
+		conn.Close(context.Background())
+		return nil, false, err
+	}
+	lock := &AdvisoryLock{session: session, key: key, conn: conn, lost: make(chan struct{}), released: make(chan struct{})}
+	go lock.watch()
+	return lock, true, nil
+}
+
+// watch checks the lock's connection along with the pool's health checks
+// and closes it when the lock is released, lost or the session stops.
+func (l *AdvisoryLock) watch() {
+	ticker := l.session.clock.NewTicker(healthCheckDelay)
+	defer ticker.Stop()
+	defer l.conn.Close(context.Background())
+	for {
+		select {
+		case <-l.released:
+			return
+		case <-l.session.done:
+			l.fail(errShutdown)
+			return
+		case <-ticker.C():
+		}
+		l.mu.Lock()
+		err := l.conn.Ping(context.Background())
+		l.mu.Unlock()
+		if err != nil {
+			l.session.logger.Log(LevelError, "DB advisory lock lost", F("key", l.key), F("error", err))
+			l.fail(err)
+			return
+		}
+	}
+}
+
+func (l *AdvisoryLock) fail(cause error) {
+	l.once.Do(func() {
+		l.mu.Lock()
+		l.err = cause
+		l.mu.Unlock()
+		close(l.lost)
+	})
+}
+
+// Lost is closed when the lock is lost; see Err.
+func (l *AdvisoryLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns nil while the lock is held, and an error IsLockLost
+// reports on once it is lost.
+func (l *AdvisoryLock) Err() error {
+	select {
+	case <-l.lost:
+	default:
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if errors.Is(l.err, errLockLost) {
+		return l.err
+	}
+	return fmt.Errorf("%w: %v", errLockLost, l.err)
+}
+
+// Release gives the lock up. It returns the error of a lock lost before.
+func (l *AdvisoryLock) Release(ctx context.Context) error {
+	if err := l.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	_, err := l.conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	l.mu.Unlock()
+	l.once.Do(func() { close(l.released) })
+	return err
+}
+
+// WithAdvisoryLock runs fn holding the lock key, waiting for it first.
+// The context of fn is cancelled if the lock is lost meanwhile, and the
+// loss is returned unless fn fails first.
+func (session *DB_Session) WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error {
+	lock, err := session.AcquireAdvisoryLock(ctx, key)
+	if err != nil {
+		return err
+	}
+	held, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel()
+		case <-held.Done():
+		}
+	}()
+
+	err = fn(held)
+	if releaseErr := lock.Release(context.Background()); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+// AdvisoryTxLock waits for the lock key and holds it until tx ends, e.g.
+// to serialize a job's updates. Transaction-level locks live on the
+// connection of tx, so they end with it and can't be lost on their own.
+func AdvisoryTxLock(ctx context.Context, tx pgx.Tx, key int64) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", key)
+	return err
+}
+
+// TryAdvisoryTxLock is AdvisoryTxLock returning false instead of waiting
+// when the lock is taken.
+func TryAdvisoryTxLock(ctx context.Context, tx pgx.Tx, key int64) (bool, error) {
+	var ok bool
+	err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", key).Scan(&ok)
+	return ok, err
+}
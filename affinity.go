@@ -0,0 +1,116 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	pinnedMu         sync.Mutex
+	pinnedStatements = map[string]string{}
+)
+
+// RegisterPinnedStatement adds a hot named statement to be prepared on the
+// pinned connections. Call it from init; registering a name twice
+// panics.
+func RegisterPinnedStatement(name, sql string) {
+	pinnedMu.Lock()
+	defer pinnedMu.Unlock()
+	if _, ok := pinnedStatements[name]; ok {
+		panic(fmt.Sprintf("pinned statement %s registered twice", name))
+	}
+	pinnedStatements[name] = sql
+}
+
+func preparePinned(ctx context.Context, conn *pgx.Conn) error {
+	pinnedMu.Lock()
+	defer pinnedMu.Unlock()
+	for name, sql := range pinnedStatements {
+		if _, err := conn.Prepare(ctx, name, sql); err != nil {
+			return fmt.Errorf("prepare %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pinnedConfig derives the config of the pinned pool from the primary's:
+// PinnedConns connections that are never recycled for age or idleness,
+// so their statements are prepared once per connect instead of after
+// every pgxpool turnover.
+func (session *DB_Session) pinnedConfig() *pgxpool.Config {
+	config := session.primaryConfig().Copy()
+	config.MaxConns = int32(session.Params().PinnedConns)
+	config.MinConns = config.MaxConns
+	config.MaxConnLifetime = 0
+	config.MaxConnIdleTime = 0
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if err := session.afterConnect(ctx, conn); err != nil {
+			return err
+		}
+		return preparePinned(ctx, conn)
+	}
+	return config
+}
+
+func (session *DB_Session) connectPinned() error {
+	if session.Params().PinnedConns <= 0 {
+		return nil
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), session.pinnedConfig())
+	if err != nil {
+		return err
+	}
+	session.pinnedMu.Lock()
+	old := session.pinned
+	session.pinned = pool
+	session.pinnedMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (session *DB_Session) closePinned() {
+	session.pinnedMu.Lock()
+	defer session.pinnedMu.Unlock()
+	if session.pinned != nil {
+		session.pinned.Close()
+		session.pinned = nil
+	}
+}
+
+// WithPinned runs fn on one of the pinned connections, where every
+// registered pinned statement is already prepared and can be run by name:
+//
+//	conn.QueryRow(ctx, "books_by_id", id)
+//
+// Without PinnedConns it falls back to a regular pooled connection and
+// prepares the statements there on demand.
+func (session *DB_Session) WithPinned(ctx context.Context, fn func(conn *pgx.Conn) error) error {
+	session.pinnedMu.Lock()
+	pool := session.pinned
+	session.pinnedMu.Unlock()
+
+	if pool == nil {
+		conn, err := session.GetConnectionCtx(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		if err := preparePinned(ctx, conn.Conn()); err != nil {
+			return err
+		}
+		return fn(conn.Conn())
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return fn(conn.Conn())
+}
@@ -0,0 +1,97 @@
+package book_bot_database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Operations recorded in audit_log.
+const (
+	AuditUpdate     = "UPDATE"
+	AuditDelete     = "DELETE"
+	AuditSoftDelete = "SOFT_DELETE"
+	AuditRestore    = "RESTORE"
+)
+
+// auditRetention is how long the purge_audit_log job keeps entries.
+const auditRetention = 365 * 24 * time.Hour
+
+// AuditEntry is one change of an audited row. For an update Before and
+// After hold the columns it changed, for a delete Before holds the whole
+// row. Actor is who WithActor or TagActor named, or the database role.
+type AuditEntry struct {
+	ID     int64           `db:"id"`
+	Table  string          `db:"table_name"`
+	RowID  *string         `db:"row_id"`
+	Op     string          `db:"op"`
+	Actor  string          `db:"actor"`
+	Before json.RawMessage `db:"before"`
+	After  json.RawMessage `db:"after"`
+	At     time.Time       `db:"at"`
+}
+
+func init() {
+	RegisterJob(Job{Name: "purge_audit_log", Every: 24 * time.Hour, Run: func(ctx context.Context, session *DB_Session) (int64, error) {
+		return session.DeleteInBatches(ctx, "audit_log", "at < now() - $1::interval", 0, 0, nil, auditRetention)
+	}})
+}
+
+// AuditTriggerSQL is the migration SQL recording the updates and deletes
+// of table in audit_log, leaving out the ignored columns, e.g. derived
+// ones or those changed by background jobs; an update changing only
+// those isn't recorded. Rows are identified by their id column.
+func AuditTriggerSQL(table string, ignore ...string) string {
+	args := make([]string, len(ignore))
+	for i, column := range ignore {
+		args[i] = quoteLiteral(column)
+	}
+	return fmt.Sprintf("CREATE TRIGGER %s AFTER UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION audit_record(%s);",
+		QuoteIdentifier(table+"_audit"), QuoteIdentifier(table), strings.Join(args, ", "))
+}
+
+type actorKey struct{}
+
+// WithActor attributes the audited changes WithTx makes under ctx to
+// actor, e.g. "admin:42" for a moderator.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// TagActor attributes the audited changes made later in tx to actor, for
+// transactions not started by WithTx.
+func TagActor(ctx context.Context, tx pgx.Tx, actor string) error {
+	_, err := tx.Exec(ctx, "SELECT set_config('book_bot.audit_actor', $1, true)", actor)
+	return err
+}
+
+// AuditLog returns the last limit audited changes of the row of table
+// with id, newest first.
+func (session *DB_Session) AuditLog(ctx context.Context, table string, id any, limit int) ([]AuditEntry, error) {
+	rows, err := session.Query(ctx, `SELECT id, table_name, row_id, op, actor, before, after, at FROM audit_log
+		WHERE table_name = $1 AND row_id = $2 ORDER BY id DESC LIMIT $3`, table, fmt.Sprint(id), limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[AuditEntry])
+}
+
+// AuditLogBy returns the last limit audited changes made by actor, newest
+// first.
+func (session *DB_Session) AuditLogBy(ctx context.Context, actor string, limit int) ([]AuditEntry, error) {
+	rows, err := session.Query(ctx, `SELECT id, table_name, row_id, op, actor, before, after, at FROM audit_log
+		WHERE actor = $1 ORDER BY id DESC LIMIT $2`, actor, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[AuditEntry])
+}
@@ -0,0 +1,138 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errBatchAborted is the error of the statements queued after the one
+// that failed; the server didn't run them.
+var errBatchAborted = errors.New("not run: an earlier statement of the batch failed")
+
+// Batch is a list of statements sent to the server in one round trip by
+// SendBatch, e.g. the read progress of many chapters at once.
+type Batch struct {
+	queued []batchStatement
+}
+
+type batchStatement struct {
+	sql  string
+	args []any
+	scan func(pgx.Rows) error
+}
+
+// Queue adds a statement whose rows, if any, are discarded.
+func (b *Batch) Queue(sql string, args ...any) {
+	b.queued = append(b.queued, batchStatement{sql: sql, args: args})
+}
+
+// QueueQuery adds a query; scan is called for each row it returns.
+func (b *Batch) QueueQuery(sql string, scan func(rows pgx.Rows) error, args ...any) {
+	b.queued = append(b.queued, batchStatement{sql: sql, args: args, scan: scan})
+}
+
+func (b *Batch) Len() int {
+	return len(b.queued)
+}
+
+// BatchResult is the outcome of one statement of a batch, in the order
+// they were queued.
+type BatchResult struct {
+	Tag pgconn.CommandTag
+	Err error
+}
+
+// BatchError is the first statement of a batch that failed.
+type BatchError struct {
+	Index int
+	SQL   string
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch statement #%d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// SendBatch runs the statements of batch in one round trip on a pooled
+// connection and returns the result of each. The server runs a batch as
+// one implicit transaction: when a statement fails, the later ones aren't
+// run, the earlier ones are undone, and the error is a *BatchError naming
+// it. An error returned by a scan function stops the reading of results
+// but doesn't undo the statements; use SendBatchTx for that.
+func (session *DB_Session) SendBatch(ctx context.Context, batch *Batch) ([]BatchResult, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	return batch.send(ctx, conn)
+}
+
+// SendBatchTx is SendBatch inside WithTx, which adds its lock timeout and
+// retries and rolls the batch back on any error, including scan errors.
+func (session *DB_Session) SendBatchTx(ctx context.Context, batch *Batch) ([]BatchResult, error) {
+	var results []BatchResult
+	err := session.WithTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		results, err = batch.send(ctx, tx)
+		return err
+	})
+	return results, err
+}
+
+type batchSender interface {
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+func (b *Batch) send(ctx context.Context, sender batchSender) ([]BatchResult, error) {
+	queued := &pgx.Batch{}
+	for _, statement := range b.queued {
+		queued.Queue(statement.sql, statement.args...)
+	}
+	br := sender.SendBatch(ctx, queued)
+
+	results := make([]BatchResult, len(b.queued))
+	var failed error
+	for i, statement := range b.queued {
+		if failed != nil {
+			results[i].Err = errBatchAborted
+			continue
+		}
+		if statement.scan == nil {
+			results[i].Tag, results[i].Err = br.Exec()
+		} else {
+			results[i].Tag, results[i].Err = scanBatchRows(br, statement.scan)
+		}
+		if results[i].Err != nil {
+			failed = &BatchError{Index: i, SQL: statement.sql, Err: results[i].Err}
+		}
+	}
+	if err := br.Close(); err != nil && failed == nil {
+		failed = err
+	}
+	return results, failed
+}
+
+func scanBatchRows(br pgx.BatchResults, scan func(pgx.Rows) error) (pgconn.CommandTag, error) {
+	rows, err := br.Query()
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return pgconn.CommandTag{}, err
+		}
+	}
+	rows.Close()
+	return rows.CommandTag(), rows.Err()
+}
@@ -0,0 +1,68 @@
+package book_bot_database
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDeleteBatchSize = 5000
+
+// DeleteInBatches deletes the rows of table matching predicate, with args
+// bound to its $1, $2..., batchSize rows at a time. Each batch is its own
+// short transaction, so no single DELETE holds locks for long or writes
+// a burst of WAL, and autovacuum can reclaim the dead rows of earlier
+// batches while later ones run; pause spaces the batches out further.
+// progress, if set, is called after each batch with the rows deleted so
+// far. A failed or cancelled run keeps the batches already committed and
+// returns their count with the error.
+//
+// Rows are picked by ctid, so table must not be partitioned; delete from
+// its partitions instead.
+func (session *DB_Session) DeleteInBatches(ctx context.Context, table, predicate string, batchSize int, pause time.Duration, progress func(deleted int64), args ...any) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = defaultDeleteBatchSize
+	}
+	name := QuoteIdentifier(strings.Split(table, ".")...)
+	sql := "DELETE FROM " + name + " WHERE ctid = ANY(ARRAY(SELECT ctid FROM " + name + " WHERE " + predicate +
+		" LIMIT " + strconv.Itoa(batchSize) + "))"
+
+	var deleted int64
+	for {
+		n, err := session.deleteBatch(ctx, sql, args)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		if n > 0 && progress != nil {
+			progress(deleted)
+		}
+		if n < int64(batchSize) {
+			return deleted, nil
+		}
+		if pause > 0 {
+			select {
+			case <-ctx.Done():
+				return deleted, ctx.Err()
+			case <-session.clock.After(pause):
+			}
+		}
+	}
+}
+
+// deleteBatch runs one batch on its own connection, released during the
+// pause that follows.
+func (session *DB_Session) deleteBatch(ctx context.Context, sql string, args []any) (int64, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
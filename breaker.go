@@ -0,0 +1,103 @@
+package book_bot_database
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("database circuit open: failing fast")
+
+// IsCircuitOpen reports whether err was returned because the circuit
+// breaker is open, i.e. the database has been failing and the call was
+// not attempted.
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, errCircuitOpen)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is the circuit breaker in front of connection acquisition; see
+// BreakerParams. While it is open, GetConnectionCtx and everything built
+// on it fail at once instead of retrying until the database is back.
+type breaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+// breakerAllow returns errCircuitOpen unless a call may go ahead: always
+// while closed, and up to HalfOpenProbes calls once an open circuit has
+// waited OpenMs.
+func (session *DB_Session) breakerAllow() error {
+	params := session.Params().Breaker
+	if params.FailureThreshold <= 0 {
+		return nil
+	}
+	b := &session.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if session.clock.Now().Sub(b.openedAt) < time.Duration(params.OpenMs)*time.Millisecond {
+			return errCircuitOpen
+		}
+		b.state, b.probes = breakerHalfOpen, 0
+		session.logger.Log(LevelInfo, "DB circuit half-open, probing")
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= params.HalfOpenProbes {
+			return errCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+func (session *DB_Session) breakerSuccess() {
+	if session.Params().Breaker.FailureThreshold <= 0 {
+		return
+	}
+	b := &session.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		session.logger.Log(LevelInfo, "DB circuit closed")
+	}
+	b.state, b.failures = breakerClosed, 0
+}
+
+// breakerCancel gives back the probe of a call that ended without telling
+// whether the database works, such as one whose context was cancelled.
+func (session *DB_Session) breakerCancel() {
+	b := &session.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (session *DB_Session) breakerFailure(err error) {
+	params := session.Params().Breaker
+	if params.FailureThreshold <= 0 {
+		return
+	}
+	b := &session.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= params.FailureThreshold) {
+		b.state, b.openedAt = breakerOpen, session.clock.Now()
+		session.logger.Log(LevelWarn, "DB circuit opened", F("failures", b.failures),
+			F("open_for", time.Duration(params.OpenMs)*time.Millisecond), F("error", err))
+	}
+}
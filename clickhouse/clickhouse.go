@@ -0,0 +1,227 @@
+// Package clickhouse mirrors event rows to ClickHouse over its HTTP
+// interface. Rows are buffered in memory and inserted in batches by a
+// background goroutine; when ClickHouse is slow or down the buffer fills
+// and further rows are dropped and counted, so the bot never waits on it.
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Config struct {
+	// URL of the HTTP interface, e.g. http://localhost:8123.
+	URL      string
+	Database string
+	User     string
+	Password string
+	// BufferSize is how many rows may wait for insertion before new ones
+	// are dropped.
+	BufferSize int
+	// BatchSize is the most rows inserted per request and table.
+	BatchSize int
+	// FlushInterval is how long rows wait for a batch to fill.
+	FlushInterval time.Duration
+	Client        *http.Client
+}
+
+type row struct {
+	table  string
+	values map[string]any
+}
+
+// Writer is a database.Mirror; set it as DB_Params.Mirror.
+type Writer struct {
+	config  Config
+	rows    chan row
+	stop    chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+
+	sentDesc    *prometheus.Desc
+	droppedDesc *prometheus.Desc
+	failedDesc  *prometheus.Desc
+}
+
+// New starts a writer; Close flushes and stops it.
+func New(config Config) *Writer {
+	if config.BufferSize <= 0 {
+		config.BufferSize = 10000
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	w := &Writer{
+		config:      config,
+		rows:        make(chan row, config.BufferSize),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		sentDesc:    prometheus.NewDesc("book_bot_mirror_sent_rows", "Rows inserted into ClickHouse.", nil, nil),
+		droppedDesc: prometheus.NewDesc("book_bot_mirror_dropped_rows", "Rows dropped because the mirror buffer was full.", nil, nil),
+		failedDesc:  prometheus.NewDesc("book_bot_mirror_failed_rows", "Rows lost to failed inserts.", nil, nil),
+	}
+	go w.run()
+	return w
+}
+
+// Mirror queues values for insertion into table, or drops them if the
+// buffer is full or the writer closed.
+func (w *Writer) Mirror(table string, values map[string]any) {
+	select {
+	case <-w.stop:
+		w.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case w.rows <- row{table: table, values: values}:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Stats returns how many rows were inserted, dropped on a full buffer and
+// lost to failed inserts.
+func (w *Writer) Stats() (sent, dropped, failed int64) {
+	return w.sent.Load(), w.dropped.Load(), w.failed.Load()
+}
+
+// Close inserts the buffered rows and stops the writer, giving up when
+// ctx is done.
+func (w *Writer) Close(ctx context.Context) error {
+	w.stopped.Do(func() { close(w.stop) })
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	batches := map[string][]map[string]any{}
+	flush := func(table string) {
+		if len(batches[table]) == 0 {
+			return
+		}
+		w.insert(table, batches[table])
+		delete(batches, table)
+	}
+	add := func(r row) {
+		batches[r.table] = append(batches[r.table], r.values)
+		if len(batches[r.table]) >= w.config.BatchSize {
+			flush(r.table)
+		}
+	}
+	for {
+		select {
+		case r := <-w.rows:
+			add(r)
+		case <-ticker.C:
+			for table := range batches {
+				flush(table)
+			}
+		case <-w.stop:
+			for len(w.rows) > 0 {
+				add(<-w.rows)
+			}
+			for table := range batches {
+				flush(table)
+			}
+			return
+		}
+	}
+}
+
+func (w *Writer) insert(table string, values []map[string]any) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	n := int64(0)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			w.failed.Add(1)
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", quote(table))
+	if w.config.Database != "" {
+		query = fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", quote(w.config.Database), quote(table))
+	}
+	req, err := http.NewRequest(http.MethodPost, w.config.URL+"/?query="+url.QueryEscape(query), &body)
+	if err != nil {
+		w.failed.Add(n)
+		return
+	}
+	if w.config.User != "" {
+		req.Header.Set("X-ClickHouse-User", w.config.User)
+		req.Header.Set("X-ClickHouse-Key", w.config.Password)
+	}
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		w.failed.Add(n)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		w.failed.Add(n)
+		return
+	}
+	w.sent.Add(n)
+}
+
+// quote escapes a ClickHouse identifier.
+func quote(name string) string {
+	var b bytes.Buffer
+	b.WriteByte('`')
+	for _, r := range name {
+		if r == '`' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('`')
+	return b.String()
+}
+
+func (w *Writer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- w.sentDesc
+	ch <- w.droppedDesc
+	ch <- w.failedDesc
+}
+
+func (w *Writer) Collect(ch chan<- prometheus.Metric) {
+	sent, dropped, failed := w.Stats()
+	ch <- prometheus.MustNewConstMetric(w.sentDesc, prometheus.CounterValue, float64(sent))
+	ch <- prometheus.MustNewConstMetric(w.droppedDesc, prometheus.CounterValue, float64(dropped))
+	ch <- prometheus.MustNewConstMetric(w.failedDesc, prometheus.CounterValue, float64(failed))
+}
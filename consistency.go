@@ -0,0 +1,157 @@
+package book_bot_database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ReadYourWrites remembers the primary WAL position reached by each user's
+// last write and only hands out replica connections that have replayed past
+// it, so a user always sees their own changes (e.g. a just-enqueued task).
+type ReadYourWrites struct {
+	session *DB_Session
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	marks  map[int64]lsnMark
+	next   int
+	lastGC time.Time
+}
+
+type lsnMark struct {
+	lsn string
+	at  time.Time
+}
+
+// NewReadYourWrites creates a helper whose per-user marks are forgotten after
+// ttl; it should comfortably exceed the expected replication lag.
+func (session *DB_Session) NewReadYourWrites(ttl time.Duration) *ReadYourWrites {
+	return &ReadYourWrites{
+		session: session,
+		ttl:     ttl,
+		marks:   make(map[int64]lsnMark),
+	}
+}
+
+// RecordWrite stores the current primary LSN for userID. Call it after the
+// user's write has been committed.
+func (rw *ReadYourWrites) RecordWrite(ctx context.Context, userID int64) error {
+	conn, err := rw.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var lsn string
+	err = conn.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&lsn)
+	if err != nil {
+		return err
+	}
+	rw.MarkWrite(userID, lsn)
+	return nil
+}
+
+// MarkWrite stores an already known LSN for userID.
+func (rw *ReadYourWrites) MarkWrite(userID int64, lsn string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	now := rw.session.clock.Now()
+	rw.marks[userID] = lsnMark{lsn: lsn, at: now}
+	if now.Sub(rw.lastGC) >= rw.ttl {
+		rw.gc(now)
+	}
+}
+
+// Forget drops the mark for userID.
+func (rw *ReadYourWrites) Forget(userID int64) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	delete(rw.marks, userID)
+}
+
+// gc drops the expired marks. MarkWrite runs it once per ttl at most, as
+// mark drops the expired ones it comes across anyway; it only keeps the
+// marks of users who stopped reading from piling up.
+func (rw *ReadYourWrites) gc(now time.Time) {
+	rw.lastGC = now
+	for userID, mark := range rw.marks {
+		if now.Sub(mark.at) > rw.ttl {
+			delete(rw.marks, userID)
+		}
+	}
+}
+
+func (rw *ReadYourWrites) mark(userID int64) (string, bool) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	mark, ok := rw.marks[userID]
+	if !ok {
+		return "", false
+	}
+	if rw.session.clock.Now().Sub(mark.at) > rw.ttl {
+		delete(rw.marks, userID)
+		return "", false
+	}
+	return mark.lsn, true
+}
+
+func (rw *ReadYourWrites) start() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.next++
+	return rw.next
+}
+
+// GetReadConnection returns a connection suitable for userID's reads: a
+// replica that has caught up with the user's last write, or the primary if
+// none has.
+func (rw *ReadYourWrites) GetReadConnection(ctx context.Context, userID int64) (*pgxpool.Conn, error) {
+	conn, err := rw.replicaConnection(ctx, userID)
+	if err == nil {
+		return conn, nil
+	}
+	return rw.session.GetConnectionCtx(ctx)
+}
+
+func (rw *ReadYourWrites) replicaConnection(ctx context.Context, userID int64) (*pgxpool.Conn, error) {
+	replicas := rw.session.replicas
+	if len(replicas) == 0 {
+		return nil, errNoReplicas
+	}
+	lsn, sticky := rw.mark(userID)
+
+	now := rw.session.clock.Now()
+	offset := rw.start()
+	for i := range replicas {
+		r := replicas[(offset+i)%len(replicas)]
+		pool := r.healthyPool(now)
+		if pool == nil {
+			continue
+		}
+		conn, err := pool.Acquire(ctx)
+		if err == nil && sticky {
+			var caughtUp bool
+			err = conn.QueryRow(ctx, "SELECT COALESCE(pg_last_wal_replay_lsn() >= $1::pg_lsn, false)", lsn).Scan(&caughtUp)
+			if err != nil || !caughtUp {
+				conn.Release()
+			}
+			if err == nil && !caughtUp {
+				// Lagging behind rather than down.
+				continue
+			}
+		}
+		if err == nil {
+			rw.session.trackAcquire(conn)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		rw.session.logger.Log(LevelWarn, "DB replica acquire failed", F("host", r.config.ConnConfig.Host), F("error", err))
+		r.markDown(now.Add(replicaRetryDelay))
+	}
+	return nil, errNoReplicas
+}
@@ -0,0 +1,287 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultCopyBatchSize = 50000
+
+// CopyOptions tune a bulk import. Every batch is its own COPY, so a failed
+// import keeps the batches before the failing one; Progress is called after
+// each with the rows copied so far.
+//
+// Job names a resumable import for flaky links to the database: each batch
+// commits together with the job's progress in copy_jobs, a batch lost to a
+// dropped connection is retried up to MaxAttempts times (0 uses
+// Retries.TxMaxAttempts), and running the job again skips the rows already
+// confirmed, so its source must yield the same rows in the same order.
+// Progress then counts the rows of earlier runs too.
+type CopyOptions struct {
+	BatchSize   int
+	Progress    func(copied int64)
+	Job         string
+	MaxAttempts int
+}
+
+// CopyFrom streams rows into table with the COPY protocol, which is much
+// faster than INSERTs for large imports. It returns the rows copied.
+func (session *DB_Session) CopyFrom(ctx context.Context, table string, columns []string, src pgx.CopyFromSource) (int64, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	return conn.CopyFrom(ctx, copyTable(table), columns, src)
+}
+
+// copyTable splits a schema-qualified table name for pgx.
+func copyTable(table string) pgx.Identifier {
+	return pgx.Identifier(strings.Split(table, "."))
+}
+
+// CopyStructs imports items into table, mapping struct fields to columns by
+// their `db` tags like the row scanners do. columns picks the fields to
+// copy; nil copies every tagged one, which leaves no column to its
+// default. It returns the rows copied by this call, which for a resumed
+// Job leaves out the rows of earlier runs.
+func CopyStructs[T any](ctx context.Context, session *DB_Session, table string, columns []string, items []T, opts CopyOptions) (int64, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("copy %s: %s is not a struct", table, t)
+	}
+	fields := structFieldIndexes(t)
+	if columns == nil {
+		columns = structColumns(t)
+	}
+	indexes := make([][]int, len(columns))
+	for i, column := range columns {
+		index, ok := fields[column]
+		if !ok {
+			return 0, fmt.Errorf("copy %s: %s has no field for column %s", table, t, column)
+		}
+		indexes[i] = index
+	}
+
+	c, err := session.newCopier(ctx, table, columns, opts)
+	if err != nil {
+		return 0, err
+	}
+	if c.copied > int64(len(items)) {
+		return 0, fmt.Errorf("copy %s: job %s confirmed %d rows of %d", table, opts.Job, c.copied, len(items))
+	}
+	for start := int(c.copied); start < len(items); start += c.batchSize {
+		end := start + c.batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		batch := make([][]any, 0, end-start)
+		for i := start; i < end; i++ {
+			v := reflect.ValueOf(&items[i]).Elem()
+			values := make([]any, len(indexes))
+			for j, index := range indexes {
+				values[j] = v.FieldByIndex(index).Interface()
+			}
+			batch = append(batch, values)
+		}
+		if err := c.batch(ctx, batch); err != nil {
+			return c.copied - c.resumed, err
+		}
+	}
+	return c.copied - c.resumed, c.finish(ctx)
+}
+
+// CopyFromChunked is CopyFrom in batches of opts.BatchSize, for imports
+// too large for one COPY or over links that drop; see CopyOptions. It
+// returns the rows copied by this call.
+func (session *DB_Session) CopyFromChunked(ctx context.Context, table string, columns []string, src pgx.CopyFromSource, opts CopyOptions) (int64, error) {
+	c, err := session.newCopier(ctx, table, columns, opts)
+	if err != nil {
+		return 0, err
+	}
+	for skipped := int64(0); skipped < c.copied; skipped++ {
+		if !src.Next() {
+			if err := src.Err(); err != nil {
+				return 0, err
+			}
+			return 0, fmt.Errorf("copy %s: job %s confirmed %d rows, source has %d", table, opts.Job, c.copied, skipped)
+		}
+		if _, err := src.Values(); err != nil {
+			return 0, err
+		}
+	}
+
+	batch := make([][]any, 0, c.batchSize)
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			return c.copied - c.resumed, err
+		}
+		batch = append(batch, append([]any(nil), values...))
+		if len(batch) == c.batchSize {
+			if err := c.batch(ctx, batch); err != nil {
+				return c.copied - c.resumed, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := src.Err(); err != nil {
+		return c.copied - c.resumed, err
+	}
+	if len(batch) > 0 {
+		if err := c.batch(ctx, batch); err != nil {
+			return c.copied - c.resumed, err
+		}
+	}
+	return c.copied - c.resumed, c.finish(ctx)
+}
+
+// ForgetCopyJob removes the progress of job, so running it again starts
+// over.
+func (session *DB_Session) ForgetCopyJob(ctx context.Context, job string) error {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM copy_jobs WHERE job = $1", job)
+	return err
+}
+
+// copier copies the batches of one import. copied counts the rows
+// confirmed so far, resumed those confirmed by earlier runs of the job.
+type copier struct {
+	session   *DB_Session
+	table     string
+	columns   []string
+	opts      CopyOptions
+	batchSize int
+	copied    int64
+	resumed   int64
+}
+
+func (session *DB_Session) newCopier(ctx context.Context, table string, columns []string, opts CopyOptions) (*copier, error) {
+	c := &copier{session: session, table: table, columns: columns, opts: opts, batchSize: opts.BatchSize}
+	if c.batchSize <= 0 {
+		c.batchSize = defaultCopyBatchSize
+	}
+	if opts.Job == "" {
+		return c, nil
+	}
+	err := c.retry(ctx, func(tx pgx.Tx) error {
+		var stored string
+		err := tx.QueryRow(ctx, `INSERT INTO copy_jobs (job, table_name) VALUES ($1, $2)
+			ON CONFLICT (job) DO UPDATE SET updated_at = now()
+			RETURNING table_name, rows_copied`, opts.Job, table).Scan(&stored, &c.copied)
+		if err == nil && stored != table {
+			err = fmt.Errorf("copy %s: job %s imports into %s", table, opts.Job, stored)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.resumed = c.copied
+	if c.resumed > 0 {
+		c.session.logger.Log(LevelInfo, "DB resuming copy job", F("job", opts.Job), F("table", table), F("rows", c.resumed))
+	}
+	return c, nil
+}
+
+func (c *copier) batch(ctx context.Context, rows [][]any) error {
+	start, end := c.copied, c.copied+int64(len(rows))
+	var err error
+	if c.opts.Job == "" {
+		var n int64
+		n, err = c.session.CopyFrom(ctx, c.table, c.columns, pgx.CopyFromRows(rows))
+		c.copied += n
+	} else {
+		err = c.retry(ctx, func(tx pgx.Tx) error {
+			var confirmed int64
+			if err := tx.QueryRow(ctx, "SELECT rows_copied FROM copy_jobs WHERE job = $1 FOR UPDATE", c.opts.Job).Scan(&confirmed); err != nil {
+				return err
+			}
+			if confirmed >= end {
+				// The commit went through before the connection dropped.
+				return nil
+			}
+			if _, err := tx.CopyFrom(ctx, copyTable(c.table), c.columns, pgx.CopyFromRows(rows)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "UPDATE copy_jobs SET rows_copied = $2, updated_at = now() WHERE job = $1", c.opts.Job, end)
+			return err
+		})
+		if err == nil {
+			c.copied = end
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s: rows %d-%d: %w", c.table, start, end-1, err)
+	}
+	if c.opts.Progress != nil {
+		c.opts.Progress(c.copied)
+	}
+	return nil
+}
+
+func (c *copier) finish(ctx context.Context) error {
+	if c.opts.Job == "" {
+		return nil
+	}
+	return c.retry(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "UPDATE copy_jobs SET finished_at = now(), updated_at = now() WHERE job = $1", c.opts.Job)
+		return err
+	})
+}
+
+// retry runs fn in a transaction, again after a pause while it fails on a
+// lost connection.
+func (c *copier) retry(ctx context.Context, fn func(pgx.Tx) error) error {
+	attempts := c.opts.MaxAttempts
+	if attempts < 1 {
+		attempts = c.session.Params().Retries.TxMaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		err, retryable := c.session.runTx(ctx, fn)
+		if err == nil || !retryable || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+		c.session.logger.Log(LevelWarn, "DB copy batch failed, retrying", F("job", c.opts.Job), F("table", c.table),
+			F("attempt", attempt), F("max_attempts", attempts), F("error", err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.session.clock.After(c.session.reconnectDelay()):
+		}
+	}
+}
+
+// structFieldIndexes maps the `db` tag names of t to their field index
+// paths, following embedded structs as structColumns does.
+func structFieldIndexes(t reflect.Type) map[string][]int {
+	fields := map[string][]int{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for name, index := range structFieldIndexes(field.Type) {
+				fields[name] = append([]int{i}, index...)
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("db"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = []int{i}
+	}
+	return fields
+}
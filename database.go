@@ -3,162 +3,470 @@ package book_bot_database
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type DB_Session struct {
-	params          *DB_Params
-	logger          *log.Logger
-	pool            *pgxpool.Pool
-	config          *pgxpool.Config
-	done            chan bool
-	notifyConnClose chan bool
-	isReady         bool
+	params             atomic.Pointer[DB_Params]
+	logger             Logger
+	pool               atomic.Pointer[pgxpool.Pool]
+	target             atomic.Pointer[primaryTarget]
+	failbackCheckedAt  time.Time
+	replicas           []*replica
+	nextReplica        atomic.Uint32
+	waiters            atomic.Int32
+	pinned             *pgxpool.Pool
+	pinnedMu           sync.Mutex
+	listener           listener
+	done               chan bool
+	notifyConnClose    chan error
+	reloads            chan reloadRequest
+	healthStop         chan struct{}
+	healthStopped      chan struct{}
+	state              atomic.Int32
+	stateMu            sync.Mutex
+	connectedBefore    bool
+	ready              chan struct{}
+	failed             chan struct{}
+	failure            error
+	readyOnce          sync.Once
+	closeOnce          sync.Once
+	background         sync.WaitGroup
+	faults             faultState
+	statementsVerified atomic.Bool
+	leaks              leakTracker
+	breaker            breaker
+	clock              Clock
 }
 
+// DB_Params is the whole configuration block of the package; see
+// GenerateExampleConfig for the defaults.
 type DB_Params struct {
-	Server             string `json:"server" yaml:"server"`
-	MaxConnectAttempts int    `json:"max_connect_attempts" yaml:"max_connect_attempts"`
+	Server              string   `json:"server" yaml:"server" doc:"Connection string of the primary."`
+	Servers             []string `json:"servers" yaml:"servers" doc:"Connection strings of the other members of the primary's cluster, tried in order when Server is down or no longer the primary."`
+	Schema              string   `json:"schema" yaml:"schema" doc:"Schema of the bot's tables, created by the migrations; lets environments share a database. Empty uses the server's search_path."`
+	MaxConnectAttempts  int      `json:"max_connect_attempts" yaml:"max_connect_attempts" doc:"Failed connect attempts in a row after which the session gives up for good; 0 retries forever."`
+	Replicas            []string `json:"replicas" yaml:"replicas" doc:"Connection strings of read replicas; GetReadConnection spreads reads over them."`
+	LockTimeoutMs       int      `json:"lock_timeout_ms" yaml:"lock_timeout_ms" doc:"lock_timeout of WithTx transactions; 0 waits forever."`
+	SlowQueryMs         int      `json:"slow_query_ms" yaml:"slow_query_ms" doc:"Log queries running longer than this; 0 disables."`
+	RedactSlowQueryArgs bool     `json:"redact_slow_query_args" yaml:"redact_slow_query_args" doc:"Log only the types of slow query arguments, not their values."`
+	PinnedConns         int      `json:"pinned_conns" yaml:"pinned_conns" doc:"Connections reserved for pinned prepared statements."`
+	SkipMigrations      bool     `json:"skip_migrations" yaml:"skip_migrations" doc:"Don't apply pending migrations on connect."`
+	RequiredExtensions  []string `json:"required_extensions" yaml:"required_extensions" doc:"Extensions SelfTest expects installed, e.g. pg_trgm."`
+
+	Pool    PoolParams    `json:"pool" yaml:"pool"`
+	TLS     TLSParams     `json:"tls" yaml:"tls"`
+	Retries RetryParams   `json:"retries" yaml:"retries"`
+	Breaker BreakerParams `json:"breaker" yaml:"breaker"`
+	Queue   QueueParams   `json:"queue" yaml:"queue"`
+	Cache   CacheParams   `json:"cache" yaml:"cache"`
+	Metrics MetricsParams `json:"metrics" yaml:"metrics"`
+
+	// Clock defaults to SystemClock.
+	Clock Clock `json:"-" yaml:"-"`
+	// Logger defaults to info-level text lines on stdout.
+	Logger Logger `json:"-" yaml:"-"`
+	// Mirror, if set, gets a copy of event rows; see the clickhouse
+	// package.
+	Mirror Mirror `json:"-" yaml:"-"`
+	// ErrorReporter, if set, gets the unexpected errors of queries; see
+	// the sentry package.
+	ErrorReporter ErrorReporter `json:"-" yaml:"-"`
+	// OnReadyChange, if set, is called from the connect loop whenever the
+	// session becomes ready or stops being ready.
+	OnReadyChange func(ready bool) `json:"-" yaml:"-"`
+	// OnConnect is called once the first connect succeeds.
+	OnConnect func() `json:"-" yaml:"-"`
+	// OnFailed is called when the session gives up connecting after
+	// MaxConnectAttempts, with the last connect error. The session
+	// stays in StateFailed until it is closed.
+	OnFailed func(err error) `json:"-" yaml:"-"`
+	// OnDisconnect is called when a ready session loses its connection,
+	// with the failed health check, or with nil when it is closed.
+	OnDisconnect func(err error) `json:"-" yaml:"-"`
+	// OnReconnect is called when the session is ready again after a
+	// disconnect, e.g. to re-prime caches of data that may have changed.
+	// Listen subscriptions are restored on their own.
+	OnReconnect func() `json:"-" yaml:"-"`
+	// OnAcquire, if set, is called when GetConnectionCtx returns, with how
+	// long it took, retries included, and whether it got a connection;
+	// it runs on the caller's goroutine, so it should be quick.
+	OnAcquire func(wait time.Duration, success bool) `json:"-" yaml:"-"`
 }
 
-const (
-	reconnectDelay   = 2 * time.Second
-	healthCheckDelay = 2 * time.Second
-)
+const healthCheckDelay = 2 * time.Second
 
 var (
 	errAlreadyClosed = errors.New("already closed: not connected to the server")
 	errShutdown      = errors.New("session is shutting down")
+	errConnectFailed = errors.New("gave up connecting to the server")
 )
 
-func NewDB(params *DB_Params) *DB_Session {
+// NewDB validates params and starts connecting in the background; use
+// WaitReady to block until the first connect succeeds.
+func NewDB(params *DB_Params) (*DB_Session, error) {
+	params.SetDefaults()
 	session := DB_Session{
-		params:          params,
-		logger:          log.New(os.Stdout, "", log.LstdFlags),
+		logger:          params.Logger,
 		done:            make(chan bool),
-		notifyConnClose: make(chan bool),
+		notifyConnClose: make(chan error),
+		reloads:         make(chan reloadRequest),
+		ready:           make(chan struct{}),
+		failed:          make(chan struct{}),
+		clock:           params.Clock,
+	}
+	session.params.Store(params)
+	if session.clock == nil {
+		session.clock = SystemClock
+	}
+	if session.logger == nil {
+		session.logger = NewTextLogger(log.New(os.Stdout, "", log.LstdFlags), LevelInfo)
 	}
 
-	config, err := pgxpool.ParseConfig(session.params.Server)
+	servers, replicas, err := session.buildConfigs(params)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	session.target.Store(&primaryTarget{servers: servers})
+	session.replicas = replicas
 
-	session.logger.Println("DB config valid!")
-	session.config = config
+	session.logger.Log(LevelDebug, "DB config valid", F("host", session.primaryConfig().ConnConfig.Host))
 
-	session.logger.Println("DB starting connection")
+	session.logger.Log(LevelInfo, "DB starting connection", F("host", session.primaryConfig().ConnConfig.Host))
+	session.background.Add(1)
 	go session.handleReconnect()
+	if session.leakThreshold() > 0 {
+		session.background.Add(1)
+		go session.watchLeaks()
+	}
 
-	return &session
+	return &session, nil
+}
+
+// buildConfigs parses and validates the pool configs of the servers and
+// replicas of params.
+func (session *DB_Session) buildConfigs(params *DB_Params) ([]*pgxpool.Config, []*replica, error) {
+	if err := params.Pool.validate(); err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := params.TLS.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracer := session.slowQueryTracer(params)
+	var servers []*pgxpool.Config
+	for i, dsn := range append([]string{params.Server}, params.Servers...) {
+		config, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			if i == 0 {
+				return nil, nil, fmt.Errorf("server: %w", err)
+			}
+			return nil, nil, fmt.Errorf("server #%d: %w", i, err)
+		}
+		params.Pool.apply(config)
+		params.TLS.apply(config, tlsConfig)
+		params.applySchema(config)
+		config.ConnConfig.Tracer = tracer
+		config.AfterConnect = session.afterConnect
+		if seconds(params.Pool.LeakThresholdSec) > 0 {
+			config.AfterRelease = session.afterRelease
+		}
+		servers = append(servers, config)
+	}
+
+	var replicas []*replica
+	for i, dsn := range params.Replicas {
+		replicaConfig, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("replica #%d: %w", i, err)
+		}
+		params.Pool.apply(replicaConfig)
+		params.TLS.apply(replicaConfig, tlsConfig)
+		replicaConfig.AfterRelease = servers[0].AfterRelease
+		params.applySchema(replicaConfig)
+		replicaConfig.ConnConfig.Tracer = tracer
+		replicas = append(replicas, &replica{config: replicaConfig})
+	}
+	return servers, replicas, nil
 }
 
 func (session *DB_Session) handleReconnect() {
+	defer session.background.Done()
+	failures := 0
 	for {
-		session.isReady = false
-		session.logger.Println("DB attempting to connect")
+		session.logger.Log(LevelDebug, "DB attempting to connect", F("host", session.primaryConfig().ConnConfig.Host))
 
 		err := session.connect()
 
 		if err != nil {
-			session.logger.Printf("DB Error: %+v\n", err)
+			failures++
+			session.logger.Log(LevelError, "DB connect failed", F("host", session.primaryConfig().ConnConfig.Host), F("attempt", failures), F("error", err))
+			if limit := session.Params().MaxConnectAttempts; limit > 0 && failures >= limit {
+				session.setState(StateFailed, fmt.Errorf("%w after %d attempts: %v", errConnectFailed, failures, err))
+				return
+			}
 
 			select {
 			case <-session.done:
 				return
-			case <-time.After(reconnectDelay):
+			case <-session.clock.After(session.reconnectBackoff(failures)):
+				continue
+			case req := <-session.reloads:
+				// A reload may bring the credentials the connects
+				// were failing for.
+				err := session.applyReload(req)
+				req.result <- err
+				if err != nil {
+					continue
+				}
 			}
-			continue
 		}
+		failures = 0
+
+		if !session.serveConnected() {
+			return
+		}
+	}
+}
 
+// serveConnected applies reloads while the session is connected. It
+// returns true when the connection is lost, false when the session
+// closes.
+func (session *DB_Session) serveConnected() bool {
+	for {
 		select {
 		case <-session.done:
-			return
-		case <-session.notifyConnClose:
-			session.logger.Println("DB connection closed. Reconnecting...")
+			return false
+		case err := <-session.notifyConnClose:
+			session.logger.Log(LevelWarn, "DB connection closed, reconnecting", F("host", session.primaryConfig().ConnConfig.Host), F("error", err))
+			session.setState(StateReconnecting, err)
+			return true
+		case req := <-session.reloads:
+			req.result <- session.applyReload(req)
 		}
 	}
 }
 
 func (session *DB_Session) connect() error {
-	pool, err := pgxpool.NewWithConfig(context.Background(), session.config)
+	target := session.target.Load()
+	pool, server, err := session.openPrimary(context.Background(), target.servers)
 	if err != nil {
 		return err
 	}
-	session.pool = pool
+	if server != target.server {
+		session.logger.Log(LevelWarn, "DB failing over", F("from", target.config().ConnConfig.Host), F("to", target.servers[server].ConnConfig.Host))
+	}
+	return session.start(pool, func() {
+		session.target.Store(&primaryTarget{servers: target.servers, server: server})
+		session.failbackCheckedAt = session.clock.Now()
+	})
+}
 
-	err = session.ping()
-	if err != nil {
+// start checks a new primary pool and makes it the session's: the
+// migrations run and the registered statements must prepare on it before
+// anything changes, so a failing pool leaves the old one in place. Then
+// the health check of the old pool stops, apply updates the session to
+// match the new one and the health check starts over.
+func (session *DB_Session) start(pool *pgxpool.Pool, apply func()) error {
+	if !session.Params().SkipMigrations {
+		if err := session.migrateOn(context.Background(), pool); err != nil {
+			pool.Close()
+			return err
+		}
+	}
+	if err := session.verifyStatements(context.Background(), pool); err != nil {
+		pool.Close()
+		return err
+	}
+
+	session.stopHealthCheck()
+	apply()
+	if old := session.pool.Swap(pool); old != nil {
+		// Callers still holding connections of the old pool keep them
+		// until they release them; Close waits for that.
+		go old.Close()
+	}
+	session.startHealthCheck()
+
+	if err := session.connectPinned(); err != nil {
 		return err
 	}
 
+	session.connectReplicas()
+
+	session.logger.Log(LevelInfo, "DB connected", F("host", session.primaryConfig().ConnConfig.Host))
+	session.setState(StateReady, nil)
+
+	return nil
+}
+
+// startHealthCheck checks the primary, and the replicas with it, every
+// healthCheckDelay until stopHealthCheck, and tells the connect loop when
+// the primary fails.
+func (session *DB_Session) startHealthCheck() {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	session.healthStop, session.healthStopped = stop, stopped
+	session.background.Add(1)
 	go func() {
-		ticker := time.NewTicker(healthCheckDelay)
+		defer session.background.Done()
+		defer close(stopped)
+		ticker := session.clock.NewTicker(healthCheckDelay)
 		defer ticker.Stop()
 		for {
-			<-ticker.C
-			err := session.ping()
+			select {
+			case <-session.done:
+				return
+			case <-stop:
+				return
+			case <-ticker.C():
+			}
+			err := session.checkPrimary(context.Background())
 			if err != nil {
-				session.notifyConnClose <- true
-				break
+				select {
+				case session.notifyConnClose <- err:
+				case <-session.done:
+				case <-stop:
+				}
+				return
 			}
+			session.checkReplicas(context.Background())
 		}
 	}()
+}
 
-	session.isReady = true
-	session.logger.Println("DB connected!")
-	session.logger.Println("DB setup!")
+// stopHealthCheck stops the health check and waits for it to return, so
+// the pool and configs it reads can change.
+func (session *DB_Session) stopHealthCheck() {
+	if session.healthStop == nil {
+		return
+	}
+	close(session.healthStop)
+	<-session.healthStopped
+	session.healthStop, session.healthStopped = nil, nil
+}
 
-	return nil
+func (session *DB_Session) migrateOn(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return session.migrate(ctx, conn.Conn())
 }
 
-func (session *DB_Session) ping() error {
-	err := session.pool.Ping(context.Background())
+func (session *DB_Session) ping(ctx context.Context) error {
+	err := session.pool.Load().Ping(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetConnection waits for a pooled connection for as long as it takes, or
+// Pool.AcquireTimeoutMs; use GetConnectionCtx to bound the wait.
 func (session *DB_Session) GetConnection() (*pgxpool.Conn, error) {
+	return session.GetConnectionCtx(context.Background())
+}
+
+// GetConnectionCtx acquires a pooled connection, retrying while the
+// session reconnects, until ctx is done or the session shuts down. With
+// the circuit breaker on, it fails fast while the circuit is open; see
+// IsCircuitOpen. Pool.AcquireTimeoutMs bounds the wait further, see
+// IsAcquireTimeout, and Pool.MaxWaiters the callers waiting on a
+// saturated pool, see IsPoolExhausted. Params.OnAcquire is told how
+// long it took.
+func (session *DB_Session) GetConnectionCtx(ctx context.Context) (conn *pgxpool.Conn, err error) {
+	if onAcquire := session.Params().OnAcquire; onAcquire != nil {
+		start := session.clock.Now()
+		defer func() { onAcquire(session.clock.Now().Sub(start), err == nil) }()
+	}
+	if err := session.admitWaiter(); err != nil {
+		return nil, err
+	}
+	defer session.waiters.Add(-1)
+	waitCtx, cancel := session.acquireContext(ctx)
+	defer cancel()
+
 	for {
-		conn, err := session.getConnection()
+		if err := session.breakerAllow(); err != nil {
+			return nil, err
+		}
+		conn, err := session.getConnection(waitCtx)
 		if err != nil {
-			session.logger.Println("Push failed. Retrying...")
+			if waitCtx.Err() != nil || err == errShutdown || errors.Is(err, errConnectFailed) {
+				session.breakerCancel()
+				if waitCtx.Err() != nil {
+					return nil, session.waitError(ctx)
+				}
+				return nil, err
+			}
+			session.breakerFailure(err)
+			session.logger.Log(LevelWarn, "DB acquire failed, retrying", F("error", err))
 			select {
 			case <-session.done:
 				return nil, errShutdown
-			case <-time.After(reconnectDelay):
+			case <-waitCtx.Done():
+				return nil, session.waitError(ctx)
+			case <-session.clock.After(session.reconnectDelay()):
 			}
 			continue
 		}
+		session.breakerSuccess()
 		return conn, nil
 	}
 }
 
-func (session *DB_Session) getConnection() (*pgxpool.Conn, error) {
-	if !session.isReady {
+func (session *DB_Session) getConnection(ctx context.Context) (*pgxpool.Conn, error) {
+	switch session.State() {
+	case StateClosed:
+		return nil, errShutdown
+	case StateFailed:
+		return nil, session.failure
+	case StateReady:
+	default:
 		return nil, errAlreadyClosed
 	}
-	conn, err := session.pool.Acquire(context.Background())
+	conn, err := session.pool.Load().Acquire(ctx)
 	if err != nil {
 		return nil, err
 	}
+	session.injectAcquireFault(conn)
+	session.trackAcquire(conn)
 	return conn, nil
 }
 
-func (session *DB_Session) Close() error {
-	session.logger.Println("Stopping DB")
-	if !session.isReady {
-		return errAlreadyClosed
+// IsReady reports whether the session is connected and accepts
+// acquisitions.
+func (session *DB_Session) IsReady() bool {
+	return session.State() == StateReady
+}
+
+// WaitReady blocks until the session has connected for the first time,
+// ctx is done, the session gave up connecting or it is closed.
+func (session *DB_Session) WaitReady(ctx context.Context) error {
+	select {
+	case <-session.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-session.failed:
+		return session.failure
+	case <-session.done:
+		return errShutdown
 	}
-	session.pool.Close()
-	close(session.done)
-	close(session.notifyConnClose)
-	session.isReady = false
-	return nil
+}
+
+func (session *DB_Session) Logger() Logger {
+	return session.logger
+}
+
+func (session *DB_Session) Clock() Clock {
+	return session.clock
 }
@@ -0,0 +1,87 @@
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// ContainerImage is the Postgres image ContainerDSN runs.
+var ContainerImage = "postgres:15-alpine"
+
+const containerStartTimeout = 2 * time.Minute
+
+var container struct {
+	once sync.Once
+	dsn  string
+	err  error
+}
+
+// ContainerDSN starts a Postgres container on first use and returns its
+// connection string; the tests of one binary share it, each with the
+// schema of its own Open gives them. The container is removed by the
+// testcontainers reaper once the test binary exits. The test is skipped
+// when Docker isn't available.
+func ContainerDSN(t testing.TB) string {
+	t.Helper()
+	ctx := context.Background()
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err == nil {
+		err = provider.Health(ctx)
+	}
+	if err != nil {
+		t.Skipf("dbtest: Docker is not available: %v", err)
+	}
+
+	container.once.Do(func() {
+		container.dsn, container.err = startContainer(ctx)
+	})
+	if container.err != nil {
+		t.Fatalf("dbtest: start %s: %v", ContainerImage, container.err)
+	}
+	return container.dsn
+}
+
+func startContainer(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, containerStartTimeout)
+	defer cancel()
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        ContainerImage,
+			ExposedPorts: []string{"5432/tcp"},
+			Env: map[string]string{
+				"POSTGRES_USER":     "bot",
+				"POSTGRES_PASSWORD": "bot",
+				"POSTGRES_DB":       "books_test",
+			},
+			// The server restarts once after initdb.
+			WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	host, err := c.Host(ctx)
+	if err != nil {
+		return "", err
+	}
+	port, err := c.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("postgres://bot:bot@%s:%s/books_test?sslmode=disable", host, port.Port()), nil
+}
+
+// OpenContainer is Open on the server of ContainerDSN, for machines
+// without a BOOK_BOT_TEST_DSN server.
+func OpenContainer(t testing.TB, configure func(*database.DB_Params)) *database.DB_Session {
+	t.Helper()
+	return openDSN(t, ContainerDSN(t), configure)
+}
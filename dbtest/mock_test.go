@@ -0,0 +1,58 @@
+package dbtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/dbtest"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+type book struct {
+	ID    int64  `db:"id"`
+	Title string `db:"title"`
+}
+
+func TestMockQuery(t *testing.T) {
+	db := dbtest.NewMock(t)
+	db.ExpectQuery("SELECT id, title FROM books").WithArgs(int64(7)).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "title"}).AddRow(int64(7), "Dune"))
+	db.ExpectQuery("SELECT id, title FROM books").WithArgs(int64(8)).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "title"}))
+
+	got, err := database.QueryOne[book](context.Background(), db, "SELECT id, title FROM books WHERE id = $1", int64(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != (book{ID: 7, Title: "Dune"}) {
+		t.Errorf("got %+v", *got)
+	}
+	_, err = database.QueryOne[book](context.Background(), db, "SELECT id, title FROM books WHERE id = $1", int64(8))
+	if !database.IsNotFound(err) || !errors.Is(err, database.ErrNotFound) || !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("missing book: got %v", err)
+	}
+}
+
+func TestMockWithTx(t *testing.T) {
+	db := dbtest.NewMock(t)
+	db.ExpectBegin()
+	db.ExpectExec("UPDATE books").WithArgs("Dune").WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	db.ExpectCommit()
+	db.ExpectBegin()
+	db.ExpectRollback()
+
+	err := db.WithTx(context.Background(), func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "UPDATE books SET title = $1", "Dune")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("failed")
+	if err := db.WithTx(context.Background(), func(pgx.Tx) error { return failure }); err != failure {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+}
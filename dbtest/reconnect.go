@@ -0,0 +1,334 @@
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// recoveryTimeout bounds how long CheckRecovery waits for the session and
+// its callers to get through a disruption.
+const recoveryTimeout = 60 * time.Second
+
+// Proxy forwards TCP connections to the server of BOOK_BOT_TEST_DSN, so a
+// test can cut the network between a session and Postgres. Route a
+// session through it with Route or OpenProxied.
+type Proxy struct {
+	t        testing.TB
+	target   string
+	listener net.Listener
+
+	mu    sync.Mutex
+	cut   bool
+	conns map[net.Conn]struct{}
+}
+
+// NewProxy starts a proxy on a local port, stopped when the test ends.
+// The test is skipped when BOOK_BOT_TEST_DSN is unset or names a Unix
+// socket.
+func NewProxy(t testing.TB) *Proxy {
+	t.Helper()
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skip(DSNEnv + " is not set")
+	}
+	config, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("dbtest: %v", err)
+	}
+	if strings.HasPrefix(config.Host, "/") {
+		t.Skip("dbtest: can't proxy the Unix socket of " + DSNEnv)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("dbtest: %v", err)
+	}
+	proxy := &Proxy{
+		t:        t,
+		target:   net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port))),
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+	}
+	go proxy.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		proxy.Drop()
+	})
+	return proxy
+}
+
+// Route returns dsn with its host replaced by the proxy's. Servers
+// checking the host name of their certificate won't accept it.
+func (p *Proxy) Route(dsn string) string {
+	host, port, _ := net.SplitHostPort(p.listener.Addr().String())
+	return dsnWith(dsn, map[string]string{"host": host, "port": port})
+}
+
+// Cut drops every connection through the proxy and refuses new ones until
+// Restore, like a network partition.
+func (p *Proxy) Cut() {
+	p.mu.Lock()
+	p.cut = true
+	p.mu.Unlock()
+	p.Drop()
+}
+
+func (p *Proxy) Restore() {
+	p.mu.Lock()
+	p.cut = false
+	p.mu.Unlock()
+}
+
+// Drop closes the connections through the proxy but accepts new ones, like
+// a load balancer dropping idle connections.
+func (p *Proxy) Drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func (p *Proxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(client)
+	}
+}
+
+func (p *Proxy) forward(client net.Conn) {
+	p.mu.Lock()
+	cut := p.cut
+	p.mu.Unlock()
+	if cut {
+		client.Close()
+		return
+	}
+	server, err := net.Dial("tcp", p.target)
+	if err != nil {
+		client.Close()
+		return
+	}
+
+	p.mu.Lock()
+	p.conns[client] = struct{}{}
+	p.conns[server] = struct{}{}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, client)
+		delete(p.conns, server)
+		p.mu.Unlock()
+	}()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pipe(server, client)
+	go pipe(client, server)
+	<-done
+	<-done
+}
+
+// dsnWith sets settings in a connection string of either form.
+func dsnWith(dsn string, settings map[string]string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return dsn
+		}
+		query := u.Query()
+		host, port := u.Hostname(), u.Port()
+		for key, value := range settings {
+			switch key {
+			case "host":
+				host = value
+			case "port":
+				port = value
+			default:
+				query.Set(key, value)
+			}
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		u.Host = host
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	// Later keywords override earlier ones.
+	for key, value := range settings {
+		dsn += " " + key + "='" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+	}
+	return dsn
+}
+
+// OpenProxied is Open with the session connecting through a new proxy.
+func OpenProxied(t testing.TB, configure func(*database.DB_Params)) (*database.DB_Session, *Proxy) {
+	t.Helper()
+	proxy := NewProxy(t)
+	session := Open(t, func(params *database.DB_Params) {
+		params.Server = proxy.Route(params.Server)
+		if configure != nil {
+			configure(params)
+		}
+	})
+	return session, proxy
+}
+
+// TerminateBackends ends the server backends of session with
+// pg_terminate_backend, from a connection of its own, and returns how
+// many it ended. With idleOnly it spares those running a query or
+// transaction, as idle_session_timeout does.
+func TerminateBackends(t testing.TB, session *database.DB_Session, idleOnly bool) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, session.Params().Server)
+	if err != nil {
+		t.Fatalf("dbtest: terminate backends: %v", err)
+	}
+	defer conn.Close(context.Background())
+
+	sql := `SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity
+		WHERE application_name = current_setting('application_name') AND pid <> pg_backend_pid()`
+	if idleOnly {
+		sql += " AND state = 'idle'"
+	}
+	var n int
+	if err := conn.QueryRow(ctx, sql).Scan(&n); err != nil {
+		t.Fatalf("dbtest: terminate backends: %v", err)
+	}
+	return n
+}
+
+// CheckRecovery fails the test unless session gets through a disruption
+// without losing callers waiting for a connection. It holds every
+// connection of the pool, which needs Pool.MaxConns set, queues callers
+// behind them and runs disrupt. Then it releases the held connections
+// and, when heal isn't nil, waits for the session to notice and runs
+// heal. Each caller must get a connection that answers within
+// recoveryTimeout; a failed query on a connection of the broken pool is
+// retried, an error from GetConnectionCtx isn't. Set MaxConnectAttempts
+// to 0 so the session doesn't give up while the server is unreachable.
+func CheckRecovery(t testing.TB, session *database.DB_Session, callers int, disrupt, heal func()) {
+	t.Helper()
+	maxConns := int(session.Params().Pool.MaxConns)
+	if maxConns == 0 {
+		t.Fatal("dbtest: CheckRecovery needs Pool.MaxConns")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recoveryTimeout)
+	defer cancel()
+
+	held := make([]*pgxpool.Conn, 0, maxConns)
+	for len(held) < maxConns {
+		conn, err := session.GetConnectionCtx(ctx)
+		if err != nil {
+			t.Fatalf("dbtest: hold connection: %v", err)
+		}
+		held = append(held, conn)
+	}
+
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			for {
+				conn, err := session.GetConnectionCtx(ctx)
+				if err != nil {
+					errs <- fmt.Errorf("caller %d lost: %w", i, err)
+					return
+				}
+				_, err = conn.Exec(ctx, "SELECT 1")
+				conn.Release()
+				if err == nil || ctx.Err() != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	// Let the callers queue up behind the held connections.
+	time.Sleep(100 * time.Millisecond)
+
+	disrupt()
+	for _, conn := range held {
+		conn.Release()
+	}
+	if heal != nil {
+		for session.IsReady() && ctx.Err() == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+		heal()
+	}
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("dbtest: %v", err)
+		}
+	}
+	if _, err := session.Exec(ctx, "SELECT 1"); err != nil {
+		t.Errorf("dbtest: session didn't recover: %v", err)
+	}
+}
+
+// RunReconnectSuite checks that sessions built with configure recover
+// from a network partition, a failover to another server, idle
+// connections dropped by the server, and backends killed by an admin. A
+// service can run it against its own params:
+//
+//	func TestReconnect(t *testing.T) {
+//		dbtest.RunReconnectSuite(t, func(p *database.DB_Params) { p.Pool.MinConns = 1 })
+//	}
+//
+// The failover is simulated with two proxies to the one test server.
+func RunReconnectSuite(t *testing.T, configure func(*database.DB_Params)) {
+	const callers = 8
+	params := func(params *database.DB_Params) {
+		params.MaxConnectAttempts = 0
+		params.Pool.MaxConns = 2
+		if configure != nil {
+			configure(params)
+		}
+	}
+
+	t.Run("partition", func(t *testing.T) {
+		session, proxy := OpenProxied(t, params)
+		CheckRecovery(t, session, callers, proxy.Cut, proxy.Restore)
+	})
+	t.Run("failover", func(t *testing.T) {
+		standby := NewProxy(t)
+		session, primary := OpenProxied(t, func(p *database.DB_Params) {
+			params(p)
+			p.Servers = []string{standby.Route(p.Server)}
+		})
+		CheckRecovery(t, session, callers, primary.Cut, nil)
+	})
+	t.Run("idle_timeout", func(t *testing.T) {
+		session := Open(t, params)
+		CheckRecovery(t, session, callers, func() { TerminateBackends(t, session, true) }, nil)
+	})
+	t.Run("terminate", func(t *testing.T) {
+		session := Open(t, params)
+		CheckRecovery(t, session, callers, func() { TerminateBackends(t, session, false) }, nil)
+	})
+}
@@ -0,0 +1,15 @@
+package dbtest
+
+import (
+	"os"
+	"testing"
+)
+
+// TestReconnect runs the reconnect suite against the server of
+// BOOK_BOT_TEST_DSN.
+func TestReconnect(t *testing.T) {
+	if os.Getenv(DSNEnv) == "" {
+		t.Skip(DSNEnv + " is not set")
+	}
+	RunReconnectSuite(t, nil)
+}
@@ -0,0 +1,115 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	codeLockNotAvailable = "55P03"
+	codeDeadlockDetected = "40P01"
+
+	diagnosticsTimeout = 5 * time.Second
+)
+
+// LockBlocker describes a session blocking another one at the time a lock
+// error was diagnosed.
+type LockBlocker struct {
+	WaitingPID    int32
+	WaitingQuery  string
+	BlockingPID   int32
+	BlockingQuery string
+	BlockingState string
+	XactAge       time.Duration
+	LockType      string
+	LockMode      string
+	Relation      string
+}
+
+// LockError wraps a lock timeout or deadlock error together with the
+// blocking sessions captured from pg_locks right after it happened.
+type LockError struct {
+	Err      error
+	Blockers []LockBlocker
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("%v (%d blocking sessions)", e.Err, len(e.Blockers))
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+func isLockError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == codeLockNotAvailable || pgErr.Code == codeDeadlockDetected
+}
+
+func (session *DB_Session) diagnoseLockError(err error) error {
+	if !isLockError(err) {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+
+	blockers, diagErr := session.lockBlockers(ctx)
+	if diagErr != nil {
+		session.logger.Log(LevelError, "DB diagnostics: capturing blockers failed", F("error", err), F("diagnostics_error", diagErr))
+		return err
+	}
+
+	fields := []Field{F("error", err)}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Detail != "" {
+		fields = append(fields, F("detail", pgErr.Detail))
+	}
+	session.logger.Log(LevelError, "DB diagnostics: lock error", fields...)
+	for _, b := range blockers {
+		session.logger.Log(LevelError, "DB diagnostics: blocked",
+			F("waiting_pid", b.WaitingPID), F("waiting_query", b.WaitingQuery), F("lock_mode", b.LockMode), F("lock_type", b.LockType),
+			F("relation", b.Relation), F("blocking_pid", b.BlockingPID), F("blocking_state", b.BlockingState),
+			F("xact_age", b.XactAge.Round(time.Millisecond)), F("blocking_query", b.BlockingQuery))
+	}
+	return &LockError{Err: err, Blockers: blockers}
+}
+
+func (session *DB_Session) lockBlockers(ctx context.Context) ([]LockBlocker, error) {
+	conn, err := session.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT a.pid, COALESCE(a.query, ''), b.pid, COALESCE(b.query, ''), COALESCE(b.state, ''),
+			COALESCE(now() - b.xact_start, '0'::interval),
+			COALESCE(l.locktype, ''), COALESCE(l.mode, ''), COALESCE(l.relation::regclass::text, '')
+		FROM pg_stat_activity a
+		CROSS JOIN LATERAL unnest(pg_blocking_pids(a.pid)) AS bp(pid)
+		JOIN pg_stat_activity b ON b.pid = bp.pid
+		LEFT JOIN pg_locks l ON l.pid = a.pid AND NOT l.granted
+		ORDER BY a.pid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blockers []LockBlocker
+	for rows.Next() {
+		var b LockBlocker
+		err := rows.Scan(&b.WaitingPID, &b.WaitingQuery, &b.BlockingPID, &b.BlockingQuery, &b.BlockingState,
+			&b.XactAge, &b.LockType, &b.LockMode, &b.Relation)
+		if err != nil {
+			return nil, err
+		}
+		blockers = append(blockers, b)
+	}
+	return blockers, rows.Err()
+}
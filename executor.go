@@ -0,0 +1,248 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	errShardBusy      = errors.New("executor: too many queries queued for the shard")
+	errExecutorClosed = errors.New("executor is closed")
+)
+
+// IsShardBusy reports whether err was returned because a lease's shard
+// already had its limit of queries waiting in the executor.
+func IsShardBusy(err error) bool {
+	return errors.Is(err, errShardBusy)
+}
+
+// Executor runs the queries of many leases on a few connections, for a
+// fleet of long-lived bot shards that would otherwise each hold
+// connections, against a server with a low max_connections. A fixed
+// number of workers acquire a pooled connection per query; queued
+// queries are taken from the shards in turn, so a busy shard doesn't
+// starve the quiet ones.
+type Executor struct {
+	session  *DB_Session
+	perShard int
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	shards  map[string]*shardQueue
+	pending []*shardQueue // shards with queued jobs, in turn order
+	closed  bool
+	running int
+	workers sync.WaitGroup
+}
+
+type shardQueue struct {
+	name   string
+	jobs   []*leaseJob
+	queued bool
+}
+
+type leaseJob struct {
+	ctx  context.Context
+	fn   func(ctx context.Context, conn *pgx.Conn) error
+	done chan error
+	// started is set once a worker took the job, abandoned when its
+	// caller gave up before; both under the executor's mu.
+	started   bool
+	abandoned bool
+}
+
+// NewExecutor starts workers goroutines running the queries of the
+// executor's leases; the pool needs as many connections. Each shard may
+// have perShard queries waiting, 0 for no limit, before Do fails with an
+// error IsShardBusy reports on.
+func (session *DB_Session) NewExecutor(workers, perShard int) *Executor {
+	if workers <= 0 {
+		workers = 1
+	}
+	ex := &Executor{session: session, perShard: perShard, shards: map[string]*shardQueue{}}
+	ex.wake = sync.NewCond(&ex.mu)
+	for i := 0; i < workers; i++ {
+		ex.workers.Add(1)
+		go ex.work()
+	}
+	return ex
+}
+
+// Lease returns the handle a shard submits its queries with. It holds
+// nothing; leases of the same name share a queue.
+func (ex *Executor) Lease(shard string) Lease {
+	return Lease{ex: ex, shard: shard}
+}
+
+// Close stops taking queries and returns once the queued ones ran.
+func (ex *Executor) Close() {
+	ex.mu.Lock()
+	ex.closed = true
+	ex.wake.Broadcast()
+	ex.mu.Unlock()
+	ex.workers.Wait()
+}
+
+// Stats returns the queries waiting in the executor and those running.
+func (ex *Executor) Stats() (queued, running int) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	for _, shard := range ex.pending {
+		queued += len(shard.jobs)
+	}
+	return queued, ex.running
+}
+
+func (ex *Executor) submit(shardName string, job *leaseJob) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.closed {
+		return errExecutorClosed
+	}
+	shard := ex.shards[shardName]
+	if shard == nil {
+		shard = &shardQueue{name: shardName}
+		ex.shards[shardName] = shard
+	}
+	if ex.perShard > 0 && len(shard.jobs) >= ex.perShard {
+		return errShardBusy
+	}
+	shard.jobs = append(shard.jobs, job)
+	if !shard.queued {
+		shard.queued = true
+		ex.pending = append(ex.pending, shard)
+	}
+	ex.wake.Signal()
+	return nil
+}
+
+// next takes the first job of the shard whose turn it is, and sends the
+// shard to the back of the line; it returns nil once closed and drained.
+// Abandoned jobs are dropped.
+func (ex *Executor) next() *leaseJob {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	for {
+		for len(ex.pending) == 0 {
+			if ex.closed {
+				return nil
+			}
+			ex.wake.Wait()
+		}
+		shard := ex.pending[0]
+		ex.pending = ex.pending[1:]
+		job := shard.jobs[0]
+		shard.jobs = shard.jobs[1:]
+		if len(shard.jobs) > 0 {
+			ex.pending = append(ex.pending, shard)
+		} else {
+			shard.queued = false
+			// Forget idle shards, there may be thousands.
+			delete(ex.shards, shard.name)
+		}
+		if job.abandoned {
+			continue
+		}
+		job.started = true
+		ex.running++
+		return job
+	}
+}
+
+// abandon gives up on job unless a worker took it already, and reports
+// whether it did.
+func (ex *Executor) abandon(job *leaseJob) bool {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if job.started {
+		return false
+	}
+	job.abandoned = true
+	return true
+}
+
+func (ex *Executor) work() {
+	defer ex.workers.Done()
+	for {
+		job := ex.next()
+		if job == nil {
+			return
+		}
+		job.done <- ex.run(job)
+		ex.mu.Lock()
+		ex.running--
+		ex.mu.Unlock()
+	}
+}
+
+func (ex *Executor) run(job *leaseJob) error {
+	// The caller's ctx ended while the job was queued.
+	if err := job.ctx.Err(); err != nil {
+		return err
+	}
+	conn, err := ex.session.GetConnectionCtx(job.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return job.fn(job.ctx, conn.Conn())
+}
+
+// Lease submits the queries of one shard to an Executor.
+type Lease struct {
+	ex    *Executor
+	shard string
+}
+
+// Do runs fn on a connection of the executor once it is the shard's turn
+// and returns its error. The connection is only lent for the call: rows
+// must be read before fn returns. If ctx ends while fn is queued, Do
+// returns ctx's error and fn never runs; once fn started, Do waits for
+// it, so fn never outlives the call.
+func (l Lease) Do(ctx context.Context, fn func(ctx context.Context, conn *pgx.Conn) error) error {
+	job := &leaseJob{ctx: ctx, fn: fn, done: make(chan error, 1)}
+	if err := l.ex.submit(l.shard, job); err != nil {
+		return err
+	}
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		if l.ex.abandon(job) {
+			return ctx.Err()
+		}
+		return <-job.done
+	}
+}
+
+func (l Lease) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := l.Do(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		var err error
+		tag, err = conn.Exec(ctx, sql, args...)
+		return err
+	})
+	return tag, err
+}
+
+// QueryRow returns a row whose Scan runs the query through the executor.
+func (l Lease) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return leaseRow{lease: l, ctx: ctx, sql: sql, args: args}
+}
+
+type leaseRow struct {
+	lease Lease
+	ctx   context.Context
+	sql   string
+	args  []any
+}
+
+func (r leaseRow) Scan(dest ...any) error {
+	return r.lease.Do(r.ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		return conn.QueryRow(ctx, r.sql, r.args...).Scan(dest...)
+	})
+}
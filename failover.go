@@ -0,0 +1,129 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A session failed over to a later server checks every failbackInterval
+// whether an earlier one is the primary again, giving each
+// failbackTimeout to answer.
+const (
+	failbackInterval = 30 * time.Second
+	failbackTimeout  = 5 * time.Second
+)
+
+var (
+	errNotPrimary     = errors.New("server is in recovery, not the primary")
+	errPreferredAgain = errors.New("preferred server is the primary again")
+)
+
+// primaryTarget is the servers of the primary's cluster and which one
+// the session is connected to; connect and Reload replace it whole.
+type primaryTarget struct {
+	servers []*pgxpool.Config
+	server  int
+}
+
+func (t *primaryTarget) config() *pgxpool.Config {
+	return t.servers[t.server]
+}
+
+// primaryConfig returns the pool config of the server the session is
+// connected to, or connecting to.
+func (session *DB_Session) primaryConfig() *pgxpool.Config {
+	return session.target.Load().config()
+}
+
+// requirePrimary reports whether a server must accept writes to be used:
+// with Servers set, or target_session_attrs asking for a writable session,
+// a standby is skipped rather than connected to.
+func requirePrimary(servers []*pgxpool.Config) bool {
+	return len(servers) > 1 || servers[0].ConnConfig.ValidateConnect != nil
+}
+
+// openPrimary connects to the first of servers, in the order of Server
+// and Servers, that answers and is the primary, and returns its index.
+// Starting from the first one each time makes the session go back to the
+// preferred server once it is promoted again.
+func (session *DB_Session) openPrimary(ctx context.Context, servers []*pgxpool.Config) (*pgxpool.Pool, int, error) {
+	var hosts []string
+	var last error
+	for i, config := range servers {
+		pool, err := pgxpool.NewWithConfig(ctx, config)
+		if err == nil {
+			if err = pool.Ping(ctx); err == nil && requirePrimary(servers) {
+				err = isPrimary(ctx, pool.QueryRow)
+			}
+			if err != nil {
+				pool.Close()
+			}
+		}
+		if err != nil {
+			if len(servers) > 1 {
+				session.logger.Log(LevelWarn, "DB server unavailable", F("server", i), F("host", config.ConnConfig.Host), F("error", err))
+			}
+			hosts = append(hosts, config.ConnConfig.Host)
+			last = err
+			continue
+		}
+		return pool, i, nil
+	}
+	if len(hosts) == 1 {
+		return nil, 0, last
+	}
+	return nil, 0, fmt.Errorf("no primary among %v: %w", hosts, last)
+}
+
+// checkPrimary is the health check of the primary pool: it must answer,
+// still be the primary, and, after a failover, the preferred servers must
+// still be standbys or down. An error makes the session reconnect.
+func (session *DB_Session) checkPrimary(ctx context.Context) error {
+	if err := session.ping(ctx); err != nil {
+		return err
+	}
+	target := session.target.Load()
+	if !requirePrimary(target.servers) {
+		return nil
+	}
+	if err := isPrimary(ctx, session.pool.Load().QueryRow); err != nil {
+		return err
+	}
+	if target.server == 0 || session.clock.Now().Sub(session.failbackCheckedAt) < failbackInterval {
+		return nil
+	}
+	session.failbackCheckedAt = session.clock.Now()
+	for _, config := range target.servers[:target.server] {
+		if probePrimary(ctx, config) == nil {
+			return fmt.Errorf("%w: %s", errPreferredAgain, config.ConnConfig.Host)
+		}
+	}
+	return nil
+}
+
+func probePrimary(ctx context.Context, config *pgxpool.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, failbackTimeout)
+	defer cancel()
+	conn, err := pgx.ConnectConfig(ctx, config.ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	return isPrimary(ctx, conn.QueryRow)
+}
+
+func isPrimary(ctx context.Context, queryRow func(ctx context.Context, sql string, args ...any) pgx.Row) error {
+	var inRecovery bool
+	if err := queryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return err
+	}
+	if inRecovery {
+		return errNotPrimary
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+//go:build faultinject
+
+package book_bot_database
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Faults configures the faults injected into a session built with the
+// faultinject tag. Rates are probabilities per acquired connection (drops,
+// slow queries) or per committed transaction (serialization failures)
+// drawn from a generator seeded with Seed, so a test sees the same faults
+// on every run. The Next counters force the next N events to fail
+// regardless of the rates.
+type Faults struct {
+	Seed int64
+
+	DropRate          float64
+	SlowRate          float64
+	SlowDelay         time.Duration
+	SerializationRate float64
+
+	DropNext          int
+	SlowNext          int
+	SerializationNext int
+}
+
+type faultState struct {
+	mu     sync.Mutex
+	faults *Faults
+	rand   *rand.Rand
+}
+
+// InjectFaults replaces the faults injected into the session.
+func (session *DB_Session) InjectFaults(faults Faults) {
+	session.faults.mu.Lock()
+	defer session.faults.mu.Unlock()
+	session.faults.faults = &faults
+	session.faults.rand = rand.New(rand.NewSource(faults.Seed))
+}
+
+// ClearFaults stops injecting faults.
+func (session *DB_Session) ClearFaults() {
+	session.faults.mu.Lock()
+	defer session.faults.mu.Unlock()
+	session.faults.faults = nil
+}
+
+// roll decides whether a fault fires, consuming a forced one first.
+func (state *faultState) roll(next *int, rate float64) bool {
+	if *next > 0 {
+		*next--
+		return true
+	}
+	return rate > 0 && state.rand.Float64() < rate
+}
+
+func (session *DB_Session) injectAcquireFault(conn *pgxpool.Conn) {
+	session.faults.mu.Lock()
+	faults := session.faults.faults
+	var drop, slow bool
+	if faults != nil {
+		drop = session.faults.roll(&faults.DropNext, faults.DropRate)
+		slow = session.faults.roll(&faults.SlowNext, faults.SlowRate)
+	}
+	session.faults.mu.Unlock()
+
+	if slow {
+		session.logger.Log(LevelDebug, "DB faultinject: delaying connection", F("delay", faults.SlowDelay))
+		<-session.clock.After(faults.SlowDelay)
+	}
+	if drop {
+		// The pool notices the closed connection on release and replaces it.
+		session.logger.Log(LevelDebug, "DB faultinject: dropping connection")
+		conn.Conn().Close(context.Background())
+	}
+}
+
+func (session *DB_Session) injectCommitFault() error {
+	session.faults.mu.Lock()
+	defer session.faults.mu.Unlock()
+	faults := session.faults.faults
+	if faults == nil || !session.faults.roll(&faults.SerializationNext, faults.SerializationRate) {
+		return nil
+	}
+	session.logger.Log(LevelDebug, "DB faultinject: failing commit with a serialization failure")
+	return &pgconn.PgError{Severity: "ERROR", Code: "40001", Message: "could not serialize access due to concurrent update (injected)"}
+}
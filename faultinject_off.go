@@ -0,0 +1,13 @@
+//go:build !faultinject
+
+package book_bot_database
+
+import "github.com/jackc/pgx/v5/pgxpool"
+
+type faultState struct{}
+
+func (session *DB_Session) injectAcquireFault(conn *pgxpool.Conn) {}
+
+func (session *DB_Session) injectCommitFault() error {
+	return nil
+}
@@ -0,0 +1,164 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SecretProvider looks up credentials by name, e.g. from a vault or a
+// secrets mount, so they need not sit in the configuration.
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// ForeignServer describes a remote PostgreSQL database reachable through
+// postgres_fdw, such as the legacy bot database during a migration. The
+// password is fetched from the SecretProvider under PasswordSecret and
+// stored in the user mapping of the current user.
+type ForeignServer struct {
+	Name           string
+	Host           string
+	Port           int
+	DBName         string
+	User           string
+	PasswordSecret string
+	// Options are further postgres_fdw server options, e.g. fetch_size.
+	Options map[string]string
+}
+
+// SetupForeignServer creates or updates the foreign server and the current
+// user's mapping to it, installing postgres_fdw if needed. It can run on
+// every start, which also picks up a rotated password.
+func (session *DB_Session) SetupForeignServer(ctx context.Context, server ForeignServer, secrets SecretProvider) error {
+	password, err := secrets.Secret(ctx, server.PasswordSecret)
+	if err != nil {
+		return fmt.Errorf("foreign server %s: password: %w", server.Name, err)
+	}
+	options := map[string]string{"host": server.Host, "dbname": server.DBName}
+	if server.Port != 0 {
+		options["port"] = strconv.Itoa(server.Port)
+	}
+	for key, value := range server.Options {
+		options[key] = value
+	}
+	name := QuoteIdentifier(server.Name)
+
+	err = session.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS postgres_fdw SCHEMA public"); err != nil {
+			return err
+		}
+		var current []string
+		err := tx.QueryRow(ctx, "SELECT COALESCE(srvoptions, '{}') FROM pg_foreign_server WHERE srvname = $1", server.Name).Scan(&current)
+		switch err {
+		case nil:
+			existing := map[string]bool{}
+			for _, option := range current {
+				key, _, _ := strings.Cut(option, "=")
+				existing[key] = true
+			}
+			_, err = tx.Exec(ctx, "ALTER SERVER "+name+" OPTIONS ("+fdwOptions(options, existing)+")")
+		case pgx.ErrNoRows:
+			_, err = tx.Exec(ctx, "CREATE SERVER "+name+" FOREIGN DATA WRAPPER postgres_fdw OPTIONS ("+fdwOptions(options, nil)+")")
+		}
+		if err != nil {
+			return err
+		}
+
+		credentials := map[string]string{"user": server.User, "password": password}
+		if _, err := tx.Exec(ctx, "DROP USER MAPPING IF EXISTS FOR CURRENT_USER SERVER "+name); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "CREATE USER MAPPING FOR CURRENT_USER SERVER "+name+" OPTIONS ("+fdwOptions(credentials, nil)+")")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("foreign server %s: %w", server.Name, err)
+	}
+	session.logger.Log(LevelInfo, "DB foreign server configured", F("server", server.Name), F("host", server.Host))
+	return nil
+}
+
+// fdwOptions renders options as an OPTIONS list. With existing, the
+// options of an ALTER: those in existing are SET, the others ADDed.
+func fdwOptions(options map[string]string, existing map[string]bool) string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		verb := ""
+		if existing != nil {
+			verb = "ADD "
+			if existing[key] {
+				verb = "SET "
+			}
+		}
+		parts[i] = verb + QuoteIdentifier(key) + " " + quoteLiteral(options[key])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// quoteLiteral quotes s as an SQL string literal, for the places that
+// don't take parameters, such as OPTIONS lists.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ImportForeignTables makes tables of remoteSchema on server readable as
+// foreign tables in localSchema, replacing earlier imports so column
+// changes on the remote side are picked up.
+func (session *DB_Session) ImportForeignTables(ctx context.Context, server, remoteSchema, localSchema string, tables []string) error {
+	if len(tables) == 0 {
+		return fmt.Errorf("foreign server %s: no tables to import", server)
+	}
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		quoted[i] = QuoteIdentifier(table)
+	}
+	local := QuoteIdentifier(localSchema)
+
+	err := session.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+local); err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if _, err := tx.Exec(ctx, "DROP FOREIGN TABLE IF EXISTS "+QuoteIdentifier(localSchema, table)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, "IMPORT FOREIGN SCHEMA "+QuoteIdentifier(remoteSchema)+" LIMIT TO ("+strings.Join(quoted, ", ")+
+			") FROM SERVER "+QuoteIdentifier(server)+" INTO "+local)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("foreign server %s: import: %w", server, err)
+	}
+	return nil
+}
+
+// CheckForeignServer reads one row of probeTable, a foreign table of the
+// server, and returns how long that took; an error means the remote
+// database is unreachable or the credentials are wrong.
+func (session *DB_Session) CheckForeignServer(ctx context.Context, probeTable string) (time.Duration, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	started := session.clock.Now()
+	var found bool
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM "+QuoteIdentifier(strings.Split(probeTable, ".")...)+")").Scan(&found)
+	if err != nil {
+		return 0, fmt.Errorf("foreign table %s: %w", probeTable, err)
+	}
+	return session.clock.Now().Sub(started), nil
+}
@@ -0,0 +1,38 @@
+package book_bot_database
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const flightTimeout = 30 * time.Second
+
+// Flight coalesces identical concurrent reads: while a call for a key is
+// running, later callers for the same key wait for its result instead of
+// issuing their own query. The shared call runs detached from any single
+// caller's context, so one impatient caller can't fail the others; each
+// caller still stops waiting when its own ctx is done.
+type Flight[T any] struct {
+	group singleflight.Group
+}
+
+func (f *Flight[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	ch := f.group.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), flightTimeout)
+		defer cancel()
+		return fn(ctx)
+	})
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			var zero T
+			return zero, res.Err
+		}
+		return res.Val.(T), nil
+	}
+}
@@ -0,0 +1,79 @@
+package book_bot_database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	errUnknownSort   = errors.New("unknown sort key")
+	errUnknownColumn = errors.New("unknown column")
+)
+
+// QuoteIdentifier quotes a possibly schema-qualified name for use in SQL,
+// e.g. QuoteIdentifier("public", "books") gives "public"."books". Use it
+// for names that can't be bound as parameters.
+func QuoteIdentifier(parts ...string) string {
+	return pgx.Identifier(parts).Sanitize()
+}
+
+// SortColumns maps the sort keys a List API accepts from users to the SQL
+// expression each one sorts by. Only keys in the map ever reach the
+// query, so user input never becomes SQL.
+type SortColumns map[string]string
+
+// OrderBy turns a user supplied sort such as "title", "-date" or
+// "rating:desc" into an ORDER BY clause. An empty sort uses fallback,
+// which must be a key of s. tiebreak, if not empty, is appended so pages
+// stay stable between requests.
+func (s SortColumns) OrderBy(sort, fallback, tiebreak string) (string, error) {
+	sort = strings.TrimSpace(strings.ToLower(sort))
+	if sort == "" {
+		sort = fallback
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		sort, direction = sort[1:], "DESC"
+	} else if key, dir, ok := strings.Cut(sort, ":"); ok {
+		switch dir {
+		case "asc":
+		case "desc":
+			direction = "DESC"
+		default:
+			return "", fmt.Errorf("%w: %s", errUnknownSort, sort)
+		}
+		sort = key
+	}
+	expr, ok := s[sort]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errUnknownSort, sort)
+	}
+	clause := "ORDER BY " + expr + " " + direction
+	if tiebreak != "" {
+		clause += ", " + tiebreak + " " + direction
+	}
+	return clause, nil
+}
+
+// SelectColumns returns the requested columns, quoted, as a select list.
+// Every one must be in allowed; none requested selects all of allowed.
+func SelectColumns(requested, allowed []string) (string, error) {
+	if len(requested) == 0 {
+		requested = allowed
+	}
+	known := make(map[string]bool, len(allowed))
+	for _, column := range allowed {
+		known[column] = true
+	}
+	quoted := make([]string, 0, len(requested))
+	for _, column := range requested {
+		if !known[column] {
+			return "", fmt.Errorf("%w: %s", errUnknownColumn, column)
+		}
+		quoted = append(quoted, QuoteIdentifier(column))
+	}
+	return strings.Join(quoted, ", "), nil
+}
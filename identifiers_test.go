@@ -0,0 +1,75 @@
+package book_bot_database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"books"}, `"books"`},
+		{[]string{"public", "books"}, `"public"."books"`},
+		// A dot inside one part is part of the name, not a qualifier.
+		{[]string{"public.books"}, `"public.books"`},
+		{[]string{`evil"; DROP TABLE books; --`}, `"evil""; DROP TABLE books; --"`},
+		{[]string{`a""b`}, `"a""""b"`},
+		{[]string{"Книги", "Mixed Case"}, `"Книги"."Mixed Case"`},
+		{[]string{"nul\x00byte"}, `"nulbyte"`},
+	}
+	for _, tt := range tests {
+		if got := QuoteIdentifier(tt.parts...); got != tt.want {
+			t.Errorf("QuoteIdentifier(%q) = %s, want %s", tt.parts, got, tt.want)
+		}
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	columns := SortColumns{"title": "b.search_key", "date": "b.created_at"}
+	tests := []struct {
+		sort, tiebreak string
+		want           string
+		err            error
+	}{
+		{"title", "", "ORDER BY b.search_key ASC", nil},
+		{"-date", "b.id", "ORDER BY b.created_at DESC, b.id DESC", nil},
+		{"date:desc", "", "ORDER BY b.created_at DESC", nil},
+		{" Title:ASC ", "", "ORDER BY b.search_key ASC", nil},
+		{"", "b.id", "ORDER BY b.search_key ASC, b.id ASC", nil},
+		{"date:sideways", "", "", errUnknownSort},
+		{"rating", "", "", errUnknownSort},
+		{"b.search_key", "", "", errUnknownSort},
+		{"title; DROP TABLE books", "", "", errUnknownSort},
+		{"-", "", "", errUnknownSort},
+	}
+	for _, tt := range tests {
+		got, err := columns.OrderBy(tt.sort, "title", tt.tiebreak)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("OrderBy(%q) = %q, %v; want %q, %v", tt.sort, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSelectColumns(t *testing.T) {
+	allowed := []string{"id", "title", "author_id"}
+	tests := []struct {
+		requested []string
+		want      string
+		err       error
+	}{
+		{nil, `"id", "title", "author_id"`, nil},
+		{[]string{"title"}, `"title"`, nil},
+		{[]string{"author_id", "id"}, `"author_id", "id"`, nil},
+		{[]string{"title", "password"}, "", errUnknownColumn},
+		{[]string{`title"`}, "", errUnknownColumn},
+		{[]string{"TITLE"}, "", errUnknownColumn},
+	}
+	for _, tt := range tests {
+		got, err := SelectColumns(tt.requested, allowed)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("SelectColumns(%q) = %q, %v; want %q, %v", tt.requested, got, err, tt.want, tt.err)
+		}
+	}
+}
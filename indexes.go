@@ -0,0 +1,149 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// IndexDef declares an index a repository relies on. Columns are SQL
+// expressions (plain column names or things like lower(title)).
+type IndexDef struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+	Method  string
+	Where   string
+}
+
+const indexProgressDelay = 10 * time.Second
+
+var (
+	indexesMu sync.Mutex
+	indexes   = map[string]IndexDef{}
+)
+
+// RegisterIndex adds def to the set of indexes created by EnsureIndexes.
+func RegisterIndex(def IndexDef) {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	if _, ok := indexes[def.Name]; ok {
+		panic(fmt.Sprintf("index %s registered twice", def.Name))
+	}
+	indexes[def.Name] = def
+}
+
+// RegisteredIndexes returns all declared indexes ordered by name.
+func RegisteredIndexes() []IndexDef {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	list := make([]IndexDef, 0, len(indexes))
+	for _, def := range indexes {
+		list = append(list, def)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (def IndexDef) createSQL() string {
+	var b strings.Builder
+	b.WriteString("CREATE ")
+	if def.Unique {
+		b.WriteString("UNIQUE ")
+	}
+	b.WriteString("INDEX CONCURRENTLY IF NOT EXISTS ")
+	b.WriteString(pgx.Identifier{def.Name}.Sanitize())
+	b.WriteString(" ON ")
+	b.WriteString(pgx.Identifier{def.Table}.Sanitize())
+	if def.Method != "" {
+		b.WriteString(" USING ")
+		b.WriteString(def.Method)
+	}
+	b.WriteString(" (")
+	b.WriteString(strings.Join(def.Columns, ", "))
+	b.WriteString(")")
+	if def.Where != "" {
+		b.WriteString(" WHERE ")
+		b.WriteString(def.Where)
+	}
+	return b.String()
+}
+
+// EnsureIndexes creates every registered index that is missing, one at a
+// time and CONCURRENTLY so the tables stay writable. Invalid leftovers of an
+// interrupted build are dropped and rebuilt.
+func (session *DB_Session) EnsureIndexes(ctx context.Context) error {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	for _, def := range RegisteredIndexes() {
+		var exists, valid bool
+		err = conn.QueryRow(ctx, `SELECT true, i.indisvalid
+			FROM pg_index i
+			JOIN pg_class c ON c.oid = i.indexrelid
+			WHERE c.relname = $1 AND c.relnamespace = current_schema()::regnamespace`, def.Name).Scan(&exists, &valid)
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		if exists && valid {
+			continue
+		}
+		if exists {
+			session.logger.Log(LevelWarn, "DB index is invalid, rebuilding", F("index", def.Name))
+			_, err = conn.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+pgx.Identifier{def.Name}.Sanitize())
+			if err != nil {
+				return err
+			}
+		}
+
+		session.logger.Log(LevelInfo, "DB creating index", F("index", def.Name), F("table", def.Table))
+		started := session.clock.Now()
+		stop := session.logIndexProgress(def.Name, conn.Conn().PgConn().PID())
+		_, err = conn.Exec(ctx, def.createSQL())
+		stop()
+		if err != nil {
+			return fmt.Errorf("create index %s: %w", def.Name, err)
+		}
+		session.logger.Log(LevelInfo, "DB index created", F("index", def.Name), F("took", session.clock.Now().Sub(started).Round(time.Millisecond)))
+	}
+	return nil
+}
+
+func (session *DB_Session) logIndexProgress(name string, pid uint32) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := session.clock.NewTicker(indexProgressDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+			}
+			conn, err := session.getConnection(context.Background())
+			if err != nil {
+				continue
+			}
+			var phase string
+			var blocksDone, blocksTotal, tuplesDone, tuplesTotal int64
+			err = conn.QueryRow(context.Background(), `SELECT phase, blocks_done, blocks_total, tuples_done, tuples_total
+				FROM pg_stat_progress_create_index WHERE pid = $1`, pid).Scan(&phase, &blocksDone, &blocksTotal, &tuplesDone, &tuplesTotal)
+			conn.Release()
+			if err != nil {
+				continue
+			}
+			session.logger.Log(LevelInfo, "DB index progress", F("index", name), F("phase", phase),
+				F("blocks_done", blocksDone), F("blocks_total", blocksTotal), F("tuples_done", tuplesDone), F("tuples_total", tuplesTotal))
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,79 @@
+package book_bot_database
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Database is the part of DB_Session bot handlers use. Handlers that take
+// a Database instead of the session can be unit tested with a fake, such
+// as dbtest.Mock.
+type Database interface {
+	GetConnectionCtx(ctx context.Context) (*pgxpool.Conn, error)
+	GetReadConnection(ctx context.Context) (*pgxpool.Conn, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	WithTx(ctx context.Context, fn func(pgx.Tx) error) error
+	Logger() Logger
+	Clock() Clock
+}
+
+var _ Database = (*DB_Session)(nil)
+
+// Exec runs sql on a pooled connection of the primary.
+func (session *DB_Session) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer conn.Release()
+
+	return conn.Exec(ctx, sql, args...)
+}
+
+// Query runs sql on a pooled connection of the primary. The rows hold the
+// connection until they are closed.
+func (session *DB_Session) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return queryReleasing(ctx, conn, sql, args...)
+}
+
+// QueryRow runs sql on a pooled connection of the primary; the connection
+// is released by Scan.
+func (session *DB_Session) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	rows, err := session.Query(ctx, sql, args...)
+	if err != nil {
+		return errRow{err}
+	}
+	return rowOf{rows}
+}
+
+type errRow struct{ err error }
+
+func (r errRow) Scan(...any) error { return r.err }
+
+// rowOf scans the first of rows the way pgx's own QueryRow does.
+type rowOf struct{ rows pgx.Rows }
+
+func (r rowOf) Scan(dest ...any) error {
+	if !r.rows.Next() {
+		r.rows.Close()
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return pgx.ErrNoRows
+	}
+	err := r.rows.Scan(dest...)
+	r.rows.Close()
+	if err != nil {
+		return err
+	}
+	return r.rows.Err()
+}
@@ -0,0 +1,173 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Job is a periodic task, such as purging old rows, RunJobs runs every
+// Every on one bot instance at a time. Run returns how many rows it
+// affected, for the run history.
+type Job struct {
+	Name  string
+	Every time.Duration
+	Run   func(ctx context.Context, session *DB_Session) (int64, error)
+}
+
+// JobRun is one run of a job recorded in job_runs. A run without
+// FinishedAt is in progress, or its instance died during it.
+type JobRun struct {
+	ID         int64      `db:"id"`
+	Job        string     `db:"job"`
+	StartedAt  time.Time  `db:"started_at"`
+	FinishedAt *time.Time `db:"finished_at"`
+	Rows       *int64     `db:"rows"`
+	Error      *string    `db:"error"`
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]Job{}
+)
+
+// jobRunRetention is how long the purge_job_runs job keeps the run
+// history.
+const jobRunRetention = 30 * 24 * time.Hour
+
+func init() {
+	RegisterJob(Job{Name: "purge_job_runs", Every: 24 * time.Hour, Run: func(ctx context.Context, session *DB_Session) (int64, error) {
+		return session.PurgeJobRuns(ctx, jobRunRetention)
+	}})
+}
+
+// RegisterJob adds j to the jobs RunJobs runs. Call it from init;
+// registering a name twice panics.
+func RegisterJob(j Job) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if _, ok := jobs[j.Name]; ok {
+		panic(fmt.Sprintf("job %s registered twice", j.Name))
+	}
+	jobs[j.Name] = j
+}
+
+// RegisteredJobs returns the jobs ordered by name.
+func RegisteredJobs() []Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	list := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SQLJob is a job running one statement, e.g. refreshing a materialized
+// view.
+func SQLJob(name string, every time.Duration, sql string, args ...any) Job {
+	return Job{Name: name, Every: every, Run: func(ctx context.Context, session *DB_Session) (int64, error) {
+		tag, err := session.Exec(ctx, sql, args...)
+		return tag.RowsAffected(), err
+	}}
+}
+
+// RunDueJobs runs the registered jobs whose last run started at least
+// Every ago, one at a time. Each job is guarded by an advisory lock: a
+// job another instance is running is skipped, and the lock being lost
+// cancels the run. A failed job is recorded and retried when it is due
+// again; RunDueJobs returns the first failure.
+func (session *DB_Session) RunDueJobs(ctx context.Context) error {
+	var first error
+	for _, j := range RegisteredJobs() {
+		if err := session.runJob(ctx, j); err != nil && first == nil {
+			first = fmt.Errorf("job %s: %w", j.Name, err)
+		}
+	}
+	return first
+}
+
+func (session *DB_Session) runJob(ctx context.Context, j Job) error {
+	lock, ok, err := session.TryAdvisoryLock(ctx, AdvisoryKey("job:"+j.Name))
+	if err != nil || !ok {
+		return err
+	}
+	defer lock.Release(context.Background())
+
+	// Checked under the lock, so a run that just finished elsewhere
+	// counts.
+	var due bool
+	err = session.QueryRow(ctx, `SELECT coalesce(max(started_at) <= now() - $2::interval, true) FROM job_runs WHERE job = $1`,
+		j.Name, j.Every).Scan(&due)
+	if err != nil || !due {
+		return err
+	}
+
+	var runID int64
+	if err := session.QueryRow(ctx, "INSERT INTO job_runs (job) VALUES ($1) RETURNING id", j.Name).Scan(&runID); err != nil {
+		return err
+	}
+	held, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel()
+		case <-held.Done():
+		}
+	}()
+
+	started := session.clock.Now()
+	rows, runErr := j.Run(held, session)
+	if runErr == nil {
+		runErr = lock.Err()
+	}
+	var message *string
+	if runErr != nil {
+		s := runErr.Error()
+		message = &s
+		session.logger.Log(LevelWarn, "DB job failed", F("job", j.Name), F("error", runErr))
+	} else {
+		session.logger.Log(LevelInfo, "DB job done", F("job", j.Name), F("rows", rows),
+			F("took", session.clock.Now().Sub(started).Round(time.Millisecond)))
+	}
+	// Recorded even if ctx ended meanwhile.
+	_, err = session.Exec(context.Background(), "UPDATE job_runs SET finished_at = now(), rows = $2, error = $3 WHERE id = $1", runID, rows, message)
+	if runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+// RunJobs calls RunDueJobs every interval until ctx is done; interval
+// should be well below the shortest Every. Failures are logged by the job
+// and retried when it is due again.
+func (session *DB_Session) RunJobs(ctx context.Context, interval time.Duration) error {
+	for {
+		session.RunDueJobs(ctx)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.clock.After(interval):
+		}
+	}
+}
+
+// JobHistory returns the last limit runs of job, newest first.
+func (session *DB_Session) JobHistory(ctx context.Context, job string, limit int) ([]JobRun, error) {
+	rows, err := session.Query(ctx, "SELECT id, job, started_at, finished_at, rows, error FROM job_runs WHERE job = $1 ORDER BY id DESC LIMIT $2", job, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[JobRun])
+}
+
+// PurgeJobRuns drops the run history older than keep.
+func (session *DB_Session) PurgeJobRuns(ctx context.Context, keep time.Duration) (int64, error) {
+	return session.DeleteInBatches(ctx, "job_runs", "started_at < now() - $1::interval", 0, 0, nil, keep)
+}
@@ -0,0 +1,79 @@
+package book_bot_database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// JSONMerge is the SQL expression merging the object bound to $param into
+// the JSONB column: top-level keys of the argument replace those of the
+// column, nested objects are not merged.
+func JSONMerge(column, param string) string {
+	return "coalesce(" + column + ", '{}') || " + param + "::jsonb"
+}
+
+// JSONPatch is the SQL expression applying the JSON merge patch (RFC 7396)
+// bound to $param to the JSONB column: objects are merged recursively and
+// keys set to null are removed.
+func JSONPatch(column, param string) string {
+	return "jsonb_merge_patch(" + column + ", " + param + "::jsonb)"
+}
+
+// JSONSet is the SQL expression setting the value bound to $valueParam at
+// the text[] path bound to $pathParam in the JSONB column, creating the
+// objects on the way that are missing. An empty path replaces the whole
+// value.
+func JSONSet(column, pathParam, valueParam string) string {
+	return "jsonb_set_path(" + column + ", " + pathParam + "::text[], " + valueParam + "::jsonb)"
+}
+
+// GetJSON runs sql, which selects one JSONB value, and decodes it into a
+// T. NULL, such as a missing key, gives the zero T; no row gives
+// pgx.ErrNoRows.
+func GetJSON[T any](ctx context.Context, db Database, sql string, args ...any) (T, error) {
+	var value T
+	var raw []byte
+	if err := db.QueryRow(ctx, sql, args...).Scan(&raw); err != nil {
+		return value, err
+	}
+	if raw == nil {
+		return value, nil
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, fmt.Errorf("decode %T: %w", value, err)
+	}
+	return value, nil
+}
+
+// SetJSON sets value, encoded as JSON, at path in the JSONB column of the
+// rows of table matching where, and returns how many rows it updated.
+// where is bound to args from $1 on.
+func SetJSON(ctx context.Context, db Database, table, column string, path []string, value any, where string, args ...any) (int64, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	if path == nil {
+		path = []string{}
+	}
+	pathParam, valueParam := fmt.Sprintf("$%d", len(args)+1), fmt.Sprintf("$%d", len(args)+2)
+	col := QuoteIdentifier(column)
+	tag, err := db.Exec(ctx, "UPDATE "+QuoteIdentifier(table)+" SET "+col+" = "+JSONSet(col, pathParam, valueParam)+" WHERE "+where,
+		append(args[:len(args):len(args)], path, string(encoded))...)
+	return tag.RowsAffected(), err
+}
+
+// PatchJSON applies patch, encoded as JSON, as a merge patch to the JSONB
+// column of the rows of table matching where; see JSONPatch. A struct
+// patch should tag its fields omitempty, so unset fields are kept.
+func PatchJSON(ctx context.Context, db Database, table, column string, patch any, where string, args ...any) (int64, error) {
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return 0, err
+	}
+	col := QuoteIdentifier(column)
+	tag, err := db.Exec(ctx, "UPDATE "+QuoteIdentifier(table)+" SET "+col+" = "+JSONPatch(col, fmt.Sprintf("$%d", len(args)+1))+" WHERE "+where,
+		append(args[:len(args):len(args)], string(encoded))...)
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,139 @@
+package book_bot_database
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const leakStackDepth = 32
+
+// Leak is a connection held longer than Pool.LeakThresholdSec, with the
+// stack of the code that acquired it.
+type Leak struct {
+	PID        uint32
+	AcquiredAt time.Time
+	Held       time.Duration
+	Stack      string
+}
+
+type heldConn struct {
+	acquiredAt time.Time
+	stack      []uintptr
+	reported   bool
+}
+
+// leakTracker records the connections handed out while leak detection
+// is on. Released connections leave it through the pools' AfterRelease;
+// the ones the pool destroys instead are pruned once they are closed.
+type leakTracker struct {
+	mu   sync.Mutex
+	held map[*pgx.Conn]*heldConn
+}
+
+func (session *DB_Session) leakThreshold() time.Duration {
+	return seconds(session.Params().Pool.LeakThresholdSec)
+}
+
+// trackAcquire remembers who acquired conn; a no-op unless leak detection
+// is on.
+func (session *DB_Session) trackAcquire(conn *pgxpool.Conn) {
+	if session.leakThreshold() <= 0 {
+		return
+	}
+	stack := make([]uintptr, leakStackDepth)
+	n := runtime.Callers(3, stack)
+	session.leaks.mu.Lock()
+	defer session.leaks.mu.Unlock()
+	if session.leaks.held == nil {
+		session.leaks.held = map[*pgx.Conn]*heldConn{}
+	}
+	session.leaks.held[conn.Conn()] = &heldConn{acquiredAt: session.clock.Now(), stack: stack[:n]}
+}
+
+func (session *DB_Session) untrack(conn *pgx.Conn) {
+	session.leaks.mu.Lock()
+	defer session.leaks.mu.Unlock()
+	delete(session.leaks.held, conn)
+}
+
+// afterRelease is the pools' AfterRelease hook while leak detection is
+// on.
+func (session *DB_Session) afterRelease(conn *pgx.Conn) bool {
+	session.untrack(conn)
+	return true
+}
+
+// LeakReport returns the connections held longer than the leak threshold,
+// longest held first; empty when leak detection is off.
+func (session *DB_Session) LeakReport() []Leak {
+	threshold := session.leakThreshold()
+	if threshold <= 0 {
+		return nil
+	}
+	now := session.clock.Now()
+	session.leaks.mu.Lock()
+	defer session.leaks.mu.Unlock()
+	var leaks []Leak
+	for conn, held := range session.leaks.held {
+		if conn.IsClosed() {
+			delete(session.leaks.held, conn)
+			continue
+		}
+		if now.Sub(held.acquiredAt) < threshold {
+			continue
+		}
+		leaks = append(leaks, Leak{PID: conn.PgConn().PID(), AcquiredAt: held.acquiredAt, Held: now.Sub(held.acquiredAt), Stack: formatStack(held.stack)})
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].Held > leaks[j].Held })
+	return leaks
+}
+
+// watchLeaks logs every connection once when it has been held longer than
+// the threshold.
+func (session *DB_Session) watchLeaks() {
+	defer session.background.Done()
+	ticker := session.clock.NewTicker(session.leakThreshold() / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.done:
+			return
+		case <-ticker.C():
+		}
+		now := session.clock.Now()
+		session.leaks.mu.Lock()
+		for conn, held := range session.leaks.held {
+			if conn.IsClosed() {
+				delete(session.leaks.held, conn)
+				continue
+			}
+			if held.reported || now.Sub(held.acquiredAt) < session.leakThreshold() {
+				continue
+			}
+			held.reported = true
+			session.logger.Log(LevelWarn, "DB connection held too long, possibly leaked", F("pid", conn.PgConn().PID()),
+				F("held", now.Sub(held.acquiredAt).Round(time.Second)), F("stack", formatStack(held.stack)))
+		}
+		session.leaks.mu.Unlock()
+	}
+}
+
+func formatStack(stack []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		b.WriteString(frame.Function + "\n\t" + frame.File + ":" + strconv.Itoa(frame.Line) + "\n")
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
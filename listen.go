@@ -0,0 +1,189 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// listenBuffer is how many notifications a subscriber may fall behind
+// before new ones are dropped for it.
+const listenBuffer = 64
+
+var errEmptyChannel = errors.New("empty channel name")
+
+// Notification is a payload sent with NOTIFY (or pg_notify) to a channel
+// the session listens on.
+type Notification struct {
+	Channel string
+	Payload string
+	PID     uint32
+}
+
+type listener struct {
+	mu        sync.Mutex
+	subs      map[string][]chan Notification
+	started   bool
+	interrupt context.CancelFunc
+}
+
+// Listen subscribes to channel. Notifications are read on a dedicated
+// connection outside the pool, which reconnects on its own and issues
+// LISTEN again for every subscribed channel; anything sent while it is
+// reconnecting is lost. The returned channel is closed by Unlisten or when
+// the session closes. A subscriber that doesn't keep up misses
+// notifications rather than stalling the others.
+func (session *DB_Session) Listen(channel string) (<-chan Notification, error) {
+	if channel == "" {
+		return nil, errEmptyChannel
+	}
+	l := &session.listener
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-session.done:
+		return nil, errShutdown
+	default:
+	}
+	if l.subs == nil {
+		l.subs = map[string][]chan Notification{}
+	}
+	ch := make(chan Notification, listenBuffer)
+	l.subs[channel] = append(l.subs[channel], ch)
+	if !l.started {
+		l.started = true
+		session.background.Add(1)
+		go session.runListener()
+	} else if l.interrupt != nil {
+		l.interrupt()
+	}
+	return ch, nil
+}
+
+// Unlisten drops the subscription ch returned by Listen and closes it.
+// The connection stops listening on channel once it has no subscribers.
+func (session *DB_Session) Unlisten(channel string, ch <-chan Notification) {
+	l := &session.listener
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	subs := l.subs[channel]
+	for i, sub := range subs {
+		if sub == ch {
+			close(sub)
+			l.subs[channel] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(l.subs[channel]) == 0 {
+		delete(l.subs, channel)
+		if l.interrupt != nil {
+			l.interrupt()
+		}
+	}
+}
+
+func (session *DB_Session) runListener() {
+	defer session.background.Done()
+	stop, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-session.done
+		cancel()
+	}()
+
+	for {
+		config := session.primaryConfig()
+		conn, err := pgx.ConnectConfig(stop, config.ConnConfig.Copy())
+		if err == nil {
+			session.logger.Log(LevelInfo, "DB listener connected", F("host", config.ConnConfig.Host))
+			err = session.listenOn(stop, conn)
+			conn.Close(context.Background())
+		}
+		if stop.Err() != nil {
+			session.listener.closeAll()
+			return
+		}
+		session.logger.Log(LevelWarn, "DB listener connection lost, reconnecting", F("host", config.ConnConfig.Host), F("error", err))
+		select {
+		case <-stop.Done():
+		case <-session.clock.After(session.reconnectDelay()):
+		}
+	}
+}
+
+// listenOn keeps the LISTENs of conn in line with the subscribed channels
+// and dispatches notifications until the connection fails or stop is
+// done. Listen and Unlisten interrupt the wait to let it resync.
+func (session *DB_Session) listenOn(stop context.Context, conn *pgx.Conn) error {
+	l := &session.listener
+	listening := map[string]bool{}
+	for {
+		wait, interrupt := context.WithCancel(stop)
+		l.mu.Lock()
+		l.interrupt = interrupt
+		wanted := make(map[string]bool, len(l.subs))
+		for channel := range l.subs {
+			wanted[channel] = true
+		}
+		l.mu.Unlock()
+
+		for channel := range wanted {
+			if listening[channel] {
+				continue
+			}
+			if _, err := conn.Exec(stop, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+				interrupt()
+				return err
+			}
+			listening[channel] = true
+		}
+		for channel := range listening {
+			if wanted[channel] {
+				continue
+			}
+			if _, err := conn.Exec(stop, "UNLISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+				interrupt()
+				return err
+			}
+			delete(listening, channel)
+		}
+
+		n, err := conn.WaitForNotification(wait)
+		interrupted := wait.Err() != nil
+		interrupt()
+		if err != nil {
+			if interrupted && stop.Err() == nil && !conn.IsClosed() {
+				continue
+			}
+			return err
+		}
+		l.dispatch(Notification{Channel: n.Channel, Payload: n.Payload, PID: n.PID}, session.logger)
+	}
+}
+
+func (l *listener) dispatch(n Notification, logger Logger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sub := range l.subs[n.Channel] {
+		select {
+		case sub <- n:
+		default:
+			logger.Log(LevelWarn, "DB listener dropped a notification for a slow subscriber", F("channel", n.Channel))
+		}
+	}
+}
+
+func (l *listener) closeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for channel, subs := range l.subs {
+		for _, sub := range subs {
+			close(sub)
+		}
+		delete(l.subs, channel)
+	}
+	l.interrupt = nil
+	l.started = false
+}
@@ -0,0 +1,126 @@
+package book_bot_database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+// Field is a structured value attached to a log entry, such as the
+// attempt number or the failing error.
+type Field struct {
+	Key   string
+	Value any
+}
+
+func F(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger receives everything the package logs. Set DB_Params.Logger to
+// plug in the application's logger; the default prints text lines to
+// stdout.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// LoggerFunc adapts a function to Logger.
+type LoggerFunc func(level LogLevel, msg string, fields ...Field)
+
+func (fn LoggerFunc) Log(level LogLevel, msg string, fields ...Field) {
+	fn(level, msg, fields...)
+}
+
+type textLogger struct {
+	logger *log.Logger
+	min    LogLevel
+}
+
+// NewTextLogger prints entries at min and above as
+// "level msg key=value ..." lines through logger.
+func NewTextLogger(logger *log.Logger, min LogLevel) Logger {
+	return &textLogger{logger: logger, min: min}
+}
+
+func (l *textLogger) Log(level LogLevel, msg string, fields ...Field) {
+	if level < l.min {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	l.logger.Println(b.String())
+}
+
+type jsonLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	min LogLevel
+}
+
+// NewJSONLogger writes entries at min and above to w as one JSON object
+// per line, with the fields next to time, level and msg.
+func NewJSONLogger(w io.Writer, min LogLevel) Logger {
+	return &jsonLogger{w: w, min: min}
+}
+
+func (l *jsonLogger) Log(level LogLevel, msg string, fields ...Field) {
+	if level < l.min {
+		return
+	}
+	entry := make(map[string]any, len(fields)+3)
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case error:
+			entry[f.Key] = v.Error()
+		case time.Duration:
+			entry[f.Key] = v.String()
+		case fmt.Stringer:
+			entry[f.Key] = v.String()
+		default:
+			entry[f.Key] = v
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]any{"level": level.String(), "msg": msg, "log_error": err.Error()})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,125 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HotTable is a table with enough churn that autovacuum falls behind at
+// peaks, such as the task queue. AnalyzeHotTables refreshes its
+// statistics every AnalyzeEvery and, if VacuumEvery is set, vacuums it
+// that often, counting the runs of autovacuum too.
+type HotTable struct {
+	Table        string
+	AnalyzeEvery time.Duration
+	VacuumEvery  time.Duration
+}
+
+var (
+	hotTablesMu sync.Mutex
+	hotTables   = map[string]HotTable{}
+)
+
+// RegisterHotTable adds t to the tables AnalyzeHotTables keeps up. Call it
+// from init; registering a table twice panics.
+func RegisterHotTable(t HotTable) {
+	hotTablesMu.Lock()
+	defer hotTablesMu.Unlock()
+	if _, ok := hotTables[t.Table]; ok {
+		panic(fmt.Sprintf("hot table %s registered twice", t.Table))
+	}
+	hotTables[t.Table] = t
+}
+
+// RegisteredHotTables returns the hot tables ordered by name.
+func RegisteredHotTables() []HotTable {
+	hotTablesMu.Lock()
+	defer hotTablesMu.Unlock()
+	list := make([]HotTable, 0, len(hotTables))
+	for _, t := range hotTables {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Table < list[j].Table })
+	return list
+}
+
+// AnalyzeHotTables runs VACUUM (ANALYZE) or ANALYZE on the registered hot
+// tables that are due, one at a time. A table stays due until it is
+// done, so a failed run is tried again on the next call.
+func (session *DB_Session) AnalyzeHotTables(ctx context.Context) error {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	for _, t := range RegisteredHotTables() {
+		var analyzed, vacuumed *time.Time
+		err = conn.QueryRow(ctx, `SELECT greatest(last_analyze, last_autoanalyze), greatest(last_vacuum, last_autovacuum)
+			FROM pg_stat_user_tables WHERE relid = to_regclass($1)`, t.Table).Scan(&analyzed, &vacuumed)
+		if err != nil {
+			return fmt.Errorf("maintenance %s: %w", t.Table, err)
+		}
+
+		now := session.clock.Now()
+		command := ""
+		switch {
+		case t.VacuumEvery > 0 && (vacuumed == nil || now.Sub(*vacuumed) >= t.VacuumEvery):
+			command = "VACUUM (ANALYZE) "
+		case t.AnalyzeEvery > 0 && (analyzed == nil || now.Sub(*analyzed) >= t.AnalyzeEvery):
+			command = "ANALYZE "
+		default:
+			continue
+		}
+
+		session.logger.Log(LevelDebug, "DB maintaining table", F("table", t.Table), F("command", command))
+		if _, err = conn.Exec(ctx, command+QuoteIdentifier(strings.Split(t.Table, ".")...)); err != nil {
+			return fmt.Errorf("maintenance %s: %w", t.Table, err)
+		}
+		session.logger.Log(LevelInfo, "DB table maintained", F("table", t.Table), F("command", command),
+			F("took", session.clock.Now().Sub(now).Round(time.Millisecond)))
+	}
+	return nil
+}
+
+// ReindexConcurrently rebuilds index without blocking writes to its
+// table, e.g. after a queue table's indexes bloated during a backlog.
+// Progress is logged like EnsureIndexes does.
+func (session *DB_Session) ReindexConcurrently(ctx context.Context, index string) error {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	session.logger.Log(LevelInfo, "DB reindexing", F("index", index))
+	started := session.clock.Now()
+	stop := session.logIndexProgress(index, conn.Conn().PgConn().PID())
+	_, err = conn.Exec(ctx, "REINDEX INDEX CONCURRENTLY "+QuoteIdentifier(strings.Split(index, ".")...))
+	stop()
+	if err != nil {
+		return fmt.Errorf("reindex %s: %w", index, err)
+	}
+	session.logger.Log(LevelInfo, "DB index rebuilt", F("index", index), F("took", session.clock.Now().Sub(started).Round(time.Millisecond)))
+	return nil
+}
+
+// RunMaintenance calls AnalyzeHotTables every interval until ctx is done;
+// interval should be well below the shortest schedule. Failures are
+// logged and retried at the next tick.
+func (session *DB_Session) RunMaintenance(ctx context.Context, interval time.Duration) error {
+	for {
+		if err := session.AnalyzeHotTables(ctx); err != nil && ctx.Err() == nil {
+			session.logger.Log(LevelWarn, "DB table maintenance failed", F("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.clock.After(interval):
+		}
+	}
+}
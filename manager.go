@@ -0,0 +1,169 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errUnknownDatabase = errors.New("unknown database")
+
+// DB_ManagerParams configure a DB_Manager: one DB_Params block per
+// database, by name, e.g.
+//
+//	databases:
+//	  main:
+//	    server: postgres://bot@db/books
+//	  analytics:
+//	    server: postgres://bot@olap/analytics
+//	    skip_migrations: true
+//
+// The migrations registered by the package and its repositories are
+// applied to every database that doesn't skip them.
+type DB_ManagerParams struct {
+	Databases map[string]*DB_Params `json:"databases" yaml:"databases"`
+
+	// Logger and Clock are given to the databases that have none; log
+	// lines carry the database name.
+	Logger Logger `json:"-" yaml:"-"`
+	Clock  Clock  `json:"-" yaml:"-"`
+}
+
+// DB_Manager owns several named sessions and runs their lifecycle
+// together.
+type DB_Manager struct {
+	sessions map[string]*DB_Session
+	names    []string
+}
+
+// NewManager creates a session for each configured database. If one is
+// invalid, the sessions already created are closed.
+func NewManager(params *DB_ManagerParams) (*DB_Manager, error) {
+	if len(params.Databases) == 0 {
+		return nil, errors.New("manager: no databases configured")
+	}
+	logger := params.Logger
+	if logger == nil {
+		logger = NewTextLogger(log.New(os.Stdout, "", log.LstdFlags), LevelInfo)
+	}
+
+	manager := &DB_Manager{sessions: map[string]*DB_Session{}}
+	for name := range params.Databases {
+		manager.names = append(manager.names, name)
+	}
+	sort.Strings(manager.names)
+
+	for _, name := range manager.names {
+		db := params.Databases[name]
+		if db == nil {
+			db = &DB_Params{}
+		}
+		if db.Logger == nil {
+			db.Logger = namedLogger(logger, name)
+		}
+		if db.Clock == nil {
+			db.Clock = params.Clock
+		}
+		session, err := NewDB(db)
+		if err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("database %s: %w", name, err)
+		}
+		manager.sessions[name] = session
+	}
+	return manager, nil
+}
+
+func namedLogger(logger Logger, name string) Logger {
+	return LoggerFunc(func(level LogLevel, msg string, fields ...Field) {
+		logger.Log(level, msg, append([]Field{F("database", name)}, fields...)...)
+	})
+}
+
+// Get returns the session of the database name.
+func (manager *DB_Manager) Get(name string) (*DB_Session, error) {
+	session, ok := manager.sessions[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownDatabase, name)
+	}
+	return session, nil
+}
+
+// Names lists the databases in name order.
+func (manager *DB_Manager) Names() []string {
+	return append([]string(nil), manager.names...)
+}
+
+// IsReady reports whether every database is ready.
+func (manager *DB_Manager) IsReady() bool {
+	return len(manager.NotReady()) == 0
+}
+
+// NotReady lists the databases that are not ready, for health checks.
+func (manager *DB_Manager) NotReady() []string {
+	var names []string
+	for _, name := range manager.names {
+		if !manager.sessions[name].IsReady() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// WaitReady blocks until every database has connected once.
+func (manager *DB_Manager) WaitReady(ctx context.Context) error {
+	for _, name := range manager.names {
+		if err := manager.sessions[name].WaitReady(ctx); err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Shutdown shuts every database down gracefully at once, all of them
+// draining until ctx is done. The error names the databases that failed
+// and wraps one of their errors.
+func (manager *DB_Manager) Shutdown(ctx context.Context) error {
+	return manager.each(func(session *DB_Session) error {
+		return session.Shutdown(ctx)
+	})
+}
+
+// Close closes every database without draining.
+func (manager *DB_Manager) Close() error {
+	return manager.each((*DB_Session).Close)
+}
+
+func (manager *DB_Manager) each(fn func(*DB_Session) error) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+		first  error
+	)
+	for name, session := range manager.sessions {
+		wg.Add(1)
+		go func(name string, session *DB_Session) {
+			defer wg.Done()
+			if err := fn(session); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, name)
+				if first == nil {
+					first = err
+				}
+			}
+		}(name, session)
+	}
+	wg.Wait()
+	if first == nil {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("databases %s: %w", strings.Join(failed, ", "), first)
+}
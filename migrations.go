@@ -0,0 +1,318 @@
+package book_bot_database
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Migration is a versioned schema change registered by the package or its
+// repositories. Versions are global, so every module picks unique ones
+// (YYYYMMDDNNNN by convention).
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+const migrationsLockKey = 7210431001
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = map[int64]Migration{}
+)
+
+// RegisterMigration adds m to the global registry. It is meant to be called
+// from init functions and panics on duplicate versions.
+func RegisterMigration(m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if existing, ok := migrations[m.Version]; ok {
+		panic(fmt.Sprintf("migration %d registered twice (%s, %s)", m.Version, existing.Name, m.Name))
+	}
+	migrations[m.Version] = m
+}
+
+// embeddedMigrations are the package's own SQL migrations, shared by the
+// repositories, e.g. the touch_updated_at() trigger function of
+// TouchUpdatedAtSQL.
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+var errNoDownMigration = errors.New("migration has no down script")
+
+func init() {
+	if err := RegisterMigrationsFS(embeddedMigrations, "migrations"); err != nil {
+		panic(err)
+	}
+}
+
+// TouchUpdatedAtSQL is the migration SQL keeping the updated_at column of
+// table at the time of the row's last update, with the touch_updated_at()
+// trigger function. Only for tables whose updated_at means just that:
+// updates that shouldn't count, e.g. claims by workers, would move it too.
+func TouchUpdatedAtSQL(table string) string {
+	return fmt.Sprintf("CREATE TRIGGER %s BEFORE UPDATE ON %s FOR EACH ROW EXECUTE FUNCTION touch_updated_at();",
+		QuoteIdentifier(table+"_touch_updated_at"), QuoteIdentifier(table))
+}
+
+// RegisterMigrationsFS registers the SQL files in dir of fsys, named
+// <version>_<name>.up.sql and optionally <version>_<name>.down.sql.
+func RegisterMigrationsFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	found := map[int64]*Migration{}
+	for _, entry := range entries {
+		file := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(file, ".sql") {
+			continue
+		}
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return fmt.Errorf("migration file %s: expected .up.sql or .down.sql", file)
+		}
+		versionText, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return fmt.Errorf("migration file %s: expected <version>_<name>", file)
+		}
+		version, err := strconv.ParseInt(versionText, 10, 64)
+		if err != nil {
+			return fmt.Errorf("migration file %s: %w", file, err)
+		}
+		sql, err := fs.ReadFile(fsys, path.Join(dir, file))
+		if err != nil {
+			return err
+		}
+
+		m := found[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			found[version] = m
+		} else if m.Name != name {
+			return fmt.Errorf("migration %d has files named %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+	for version, m := range found {
+		if m.Up == "" {
+			return fmt.Errorf("migration %d %s has no up script", version, m.Name)
+		}
+	}
+	for _, m := range found {
+		RegisterMigration(*m)
+	}
+	return nil
+}
+
+// RegisteredMigrations returns all registered migrations ordered by version.
+func RegisteredMigrations() []Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	list := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list
+}
+
+// AppliedMigrations returns the versions recorded in schema_migrations.
+func (session *DB_Session) AppliedMigrations(ctx context.Context) (map[int64]bool, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	return appliedMigrations(ctx, conn)
+}
+
+// Migrate applies every registered migration that hasn't been applied yet,
+// each in its own transaction. Concurrent instances are serialized with an
+// advisory lock. The session runs it on every connect, before it reports
+// ready, unless SkipMigrations is set.
+func (session *DB_Session) Migrate(ctx context.Context) error {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return session.migrate(ctx, conn.Conn())
+}
+
+func (session *DB_Session) migrate(ctx context.Context, conn *pgx.Conn) error {
+	unlock, err := lockMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := session.pendingMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		session.logger.Log(LevelInfo, "DB applying migration", F("version", m.Version), F("name", m.Name))
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, m.Up)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Rollback reverts the last n applied migrations, newest first, each in
+// its own transaction with its Down script. It stops at the first one that
+// isn't registered or has no Down script. A negative n is an error.
+func (session *DB_Session) Rollback(ctx context.Context, n int) error {
+	if n < 0 {
+		return fmt.Errorf("rollback of %d migrations: the count must not be negative", n)
+	}
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	unlock, err := lockMigrations(ctx, conn.Conn())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	versions := make([]int64, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	if n < len(versions) {
+		versions = versions[:n]
+	}
+
+	migrationsMu.Lock()
+	registered := make(map[int64]Migration, len(migrations))
+	for version, m := range migrations {
+		registered[version] = m
+	}
+	migrationsMu.Unlock()
+
+	for _, version := range versions {
+		m, ok := registered[version]
+		if !ok {
+			return fmt.Errorf("migration %d is not registered", version)
+		}
+		if m.Down == "" {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, errNoDownMigration)
+		}
+		session.logger.Log(LevelInfo, "DB rolling back migration", F("version", m.Version), F("name", m.Name))
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, m.Down)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("rollback %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// pendingMigrations creates the schema and schema_migrations if needed
+// and returns the registered migrations not applied yet, in order.
+func (session *DB_Session) pendingMigrations(ctx context.Context, conn *pgx.Conn) ([]Migration, error) {
+	if schema := session.Params().Schema; schema != "" {
+		_, err := conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+QuoteIdentifier(schema))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    BIGINT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range RegisteredMigrations() {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+func lockMigrations(ctx context.Context, conn *pgx.Conn) (func(), error) {
+	_, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationsLockKey)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsLockKey)
+	}, nil
+}
+
+func appliedMigrations(ctx context.Context, q interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}) (map[int64]bool, error) {
+	applied := map[int64]bool{}
+
+	var exists bool
+	err := q.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := q.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
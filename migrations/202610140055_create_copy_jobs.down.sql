@@ -0,0 +1 @@
+DROP TABLE copy_jobs;
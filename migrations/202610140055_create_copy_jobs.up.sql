@@ -0,0 +1,8 @@
+CREATE TABLE copy_jobs (
+	job TEXT PRIMARY KEY,
+	table_name TEXT NOT NULL,
+	rows_copied BIGINT NOT NULL DEFAULT 0,
+	started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	finished_at TIMESTAMPTZ
+);
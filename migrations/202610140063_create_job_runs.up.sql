@@ -0,0 +1,9 @@
+CREATE TABLE job_runs (
+	id BIGSERIAL PRIMARY KEY,
+	job TEXT NOT NULL,
+	started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	finished_at TIMESTAMPTZ,
+	rows BIGINT,
+	error TEXT
+);
+CREATE INDEX job_runs_job_idx ON job_runs (job, started_at);
@@ -0,0 +1,2 @@
+DROP FUNCTION jsonb_set_path(JSONB, TEXT[], JSONB);
+DROP FUNCTION jsonb_merge_patch(JSONB, JSONB);
@@ -0,0 +1,36 @@
+CREATE FUNCTION jsonb_merge_patch(target JSONB, patch JSONB) RETURNS JSONB LANGUAGE plpgsql IMMUTABLE AS $$
+DECLARE
+	k TEXT;
+	v JSONB;
+BEGIN
+	IF patch IS NULL THEN
+		RETURN target;
+	END IF;
+	IF jsonb_typeof(patch) <> 'object' THEN
+		RETURN patch;
+	END IF;
+	IF jsonb_typeof(target) IS DISTINCT FROM 'object' THEN
+		target := '{}';
+	END IF;
+	FOR k, v IN SELECT key, value FROM jsonb_each(patch) LOOP
+		IF v = 'null' THEN
+			target := target - k;
+		ELSE
+			target := jsonb_set(target, ARRAY[k], jsonb_merge_patch(target -> k, v));
+		END IF;
+	END LOOP;
+	RETURN target;
+END
+$$;
+
+CREATE FUNCTION jsonb_set_path(target JSONB, path TEXT[], val JSONB) RETURNS JSONB LANGUAGE plpgsql IMMUTABLE AS $$
+BEGIN
+	IF coalesce(cardinality(path), 0) = 0 THEN
+		RETURN val;
+	END IF;
+	IF jsonb_typeof(target) IS DISTINCT FROM 'object' THEN
+		target := '{}';
+	END IF;
+	RETURN target || jsonb_build_object(path[1], jsonb_set_path(target -> path[1], path[2:], val));
+END
+$$;
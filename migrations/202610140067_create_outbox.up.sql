@@ -0,0 +1,15 @@
+CREATE TABLE outbox (
+	id BIGSERIAL PRIMARY KEY,
+	topic TEXT NOT NULL,
+	key TEXT NOT NULL DEFAULT '',
+	payload JSONB NOT NULL,
+	headers JSONB NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	available_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	published_at TIMESTAMPTZ
+);
+CREATE INDEX outbox_pending_idx ON outbox (available_at, id) WHERE published_at IS NULL;
+CREATE INDEX outbox_key_idx ON outbox (key, id) WHERE published_at IS NULL AND key <> '';
+CREATE INDEX outbox_published_idx ON outbox (published_at) WHERE published_at IS NOT NULL;
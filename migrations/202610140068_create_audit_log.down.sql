@@ -0,0 +1,2 @@
+DROP FUNCTION audit_record();
+DROP TABLE audit_log;
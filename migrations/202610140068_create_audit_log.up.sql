@@ -0,0 +1,54 @@
+CREATE TABLE audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	table_name TEXT NOT NULL,
+	row_id TEXT,
+	op TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	before JSONB,
+	after JSONB,
+	at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX audit_log_row_idx ON audit_log (table_name, row_id, id);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor, id);
+CREATE INDEX audit_log_at_idx ON audit_log (at);
+
+-- audit_record logs the row changes of the table its trigger is on,
+-- ignoring the columns passed as trigger arguments. An update records the
+-- old and new value of each column it changed; one of deleted_at is
+-- recorded as a soft delete or restore.
+CREATE FUNCTION audit_record() RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE
+	old_row JSONB := CASE WHEN TG_OP <> 'INSERT' THEN to_jsonb(OLD) END;
+	new_row JSONB := CASE WHEN TG_OP <> 'DELETE' THEN to_jsonb(NEW) END;
+	before_cols JSONB := '{}';
+	after_cols JSONB := '{}';
+	col TEXT;
+	op TEXT := TG_OP;
+BEGIN
+	IF TG_NARGS > 0 THEN
+		old_row := old_row - TG_ARGV;
+		new_row := new_row - TG_ARGV;
+	END IF;
+	IF TG_OP = 'UPDATE' THEN
+		FOR col IN SELECT jsonb_object_keys(new_row) LOOP
+			IF old_row -> col IS DISTINCT FROM new_row -> col THEN
+				before_cols := before_cols || jsonb_build_object(col, old_row -> col);
+				after_cols := after_cols || jsonb_build_object(col, new_row -> col);
+			END IF;
+		END LOOP;
+		IF after_cols = '{}' THEN
+			RETURN NULL;
+		END IF;
+		IF after_cols ? 'deleted_at' THEN
+			op := CASE WHEN after_cols -> 'deleted_at' = 'null' THEN 'RESTORE' ELSE 'SOFT_DELETE' END;
+		END IF;
+	ELSE
+		before_cols := old_row;
+		after_cols := new_row;
+	END IF;
+	INSERT INTO audit_log (table_name, row_id, op, actor, before, after)
+	VALUES (TG_TABLE_NAME, coalesce(new_row, old_row) ->> 'id', op,
+		coalesce(nullif(current_setting('book_bot.audit_actor', true), ''), session_user::text), before_cols, after_cols);
+	RETURN NULL;
+END
+$$;
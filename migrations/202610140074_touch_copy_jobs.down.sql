@@ -0,0 +1 @@
+DROP TRIGGER copy_jobs_touch_updated_at ON copy_jobs;
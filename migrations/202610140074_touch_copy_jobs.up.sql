@@ -0,0 +1 @@
+CREATE TRIGGER copy_jobs_touch_updated_at BEFORE UPDATE ON copy_jobs FOR EACH ROW EXECUTE FUNCTION touch_updated_at();
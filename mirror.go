@@ -0,0 +1,16 @@
+package book_bot_database
+
+// Mirror receives a copy of high-volume event rows, such as search and
+// task logs, once they are stored in Postgres, so an analytics store can
+// keep the full history while Postgres prunes it. Mirror is called on the
+// writer's goroutine and must not block; delivery is best-effort.
+type Mirror interface {
+	Mirror(table string, row map[string]any)
+}
+
+// MirrorRow passes row to the configured Mirror, if any.
+func (session *DB_Session) MirrorRow(table string, row map[string]any) {
+	if mirror := session.Params().Mirror; mirror != nil {
+		mirror.Mirror(table, row)
+	}
+}
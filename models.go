@@ -0,0 +1,77 @@
+package book_bot_database
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Model declares a table the code expects to exist. Columns are taken from
+// the `db` struct tags of Struct (the same tags pgx uses for scanning);
+// fields tagged `db:"-"` or without a tag are ignored.
+type Model struct {
+	Table   string
+	Struct  any
+	Indexes []string
+}
+
+var (
+	modelsMu sync.Mutex
+	models   = map[string]Model{}
+)
+
+// RegisterModel adds m to the registry used by SchemaDiff.
+func RegisterModel(m Model) {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	if _, ok := models[m.Table]; ok {
+		panic(fmt.Sprintf("model for table %s registered twice", m.Table))
+	}
+	models[m.Table] = m
+}
+
+// RegisteredModels returns all registered models ordered by table name.
+func RegisteredModels() []Model {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	list := make([]Model, 0, len(models))
+	for _, m := range models {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Table < list[j].Table })
+	return list
+}
+
+// Columns returns the column names declared by the model's struct tags.
+func (m Model) Columns() []string {
+	t := reflect.TypeOf(m.Struct)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	return structColumns(t)
+}
+
+func structColumns(t reflect.Type) []string {
+	var columns []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			columns = append(columns, structColumns(field.Type)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("db"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		columns = append(columns, name)
+	}
+	return columns
+}
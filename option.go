@@ -0,0 +1,128 @@
+package book_bot_database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Option is a value of a nullable column: either Some value or None for
+// NULL. It scans from and encodes to the database, so models can spell
+// out nullability instead of overloading zero values. It works for scalar
+// column types (numbers, text, booleans, timestamps, bytea).
+type Option[T any] struct {
+	value T
+	valid bool
+}
+
+func Some[T any](value T) Option[T] {
+	return Option[T]{value: value, valid: true}
+}
+
+func None[T any]() Option[T] {
+	return Option[T]{}
+}
+
+// OptionFromPtr is None for nil and Some of the pointed-to value otherwise.
+func OptionFromPtr[T any](p *T) Option[T] {
+	if p == nil {
+		return None[T]()
+	}
+	return Some(*p)
+}
+
+// Get returns the value and whether there is one.
+func (o Option[T]) Get() (T, bool) {
+	return o.value, o.valid
+}
+
+func (o Option[T]) IsSome() bool {
+	return o.valid
+}
+
+// Or returns the value, or fallback for None.
+func (o Option[T]) Or(fallback T) T {
+	if !o.valid {
+		return fallback
+	}
+	return o.value
+}
+
+// Ptr returns a pointer to a copy of the value, nil for None.
+func (o Option[T]) Ptr() *T {
+	if !o.valid {
+		return nil
+	}
+	v := o.value
+	return &v
+}
+
+func (o Option[T]) String() string {
+	if !o.valid {
+		return "None"
+	}
+	return fmt.Sprintf("Some(%v)", o.value)
+}
+
+// Value encodes the option as a query argument.
+func (o Option[T]) Value() (driver.Value, error) {
+	if !o.valid {
+		return nil, nil
+	}
+	return o.value, nil
+}
+
+// Scan decodes a column value. The driver hands over int64, float64,
+// string, []byte, bool or time.Time, which is converted to T where Go
+// allows it.
+func (o *Option[T]) Scan(src any) error {
+	if src == nil {
+		*o = None[T]()
+		return nil
+	}
+	if v, ok := src.(T); ok {
+		*o = Some(v)
+		return nil
+	}
+	var zero T
+	target := reflect.TypeOf(&zero).Elem()
+	value := reflect.ValueOf(src)
+	if b, ok := src.([]byte); ok && target.Kind() == reflect.String {
+		value = reflect.ValueOf(string(b))
+	}
+	if !value.Type().ConvertibleTo(target) || convertLossy(value.Type(), target) {
+		return fmt.Errorf("can't scan %T into Option[%s]", src, target)
+	}
+	*o = Some(value.Convert(target).Interface().(T))
+	return nil
+}
+
+// convertLossy reports conversions reflect allows but that don't keep the
+// value, such as int64 to string.
+func convertLossy(from, to reflect.Type) bool {
+	if to.Kind() == reflect.String {
+		return from.Kind() != reflect.String
+	}
+	return from.Kind() == reflect.String
+}
+
+func (o Option[T]) MarshalJSON() ([]byte, error) {
+	if !o.valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.value)
+}
+
+func (o *Option[T]) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*o = None[T]()
+		return nil
+	}
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*o = Some(v)
+	return nil
+}
@@ -0,0 +1,92 @@
+package book_bot_database
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOptionAccessors(t *testing.T) {
+	some, none := Some(7), None[int]()
+	if v, ok := some.Get(); v != 7 || !ok {
+		t.Errorf("Some(7).Get() = %d, %v", v, ok)
+	}
+	if _, ok := none.Get(); ok || none.IsSome() {
+		t.Error("None is set")
+	}
+	if some.Or(1) != 7 || none.Or(1) != 1 {
+		t.Errorf("Or: got %d and %d", some.Or(1), none.Or(1))
+	}
+	if p := some.Ptr(); p == nil || *p != 7 {
+		t.Errorf("Some(7).Ptr() = %v", p)
+	}
+	if none.Ptr() != nil {
+		t.Error("None.Ptr() is not nil")
+	}
+	if n := 3; OptionFromPtr(&n) != Some(3) || OptionFromPtr[int](nil) != none {
+		t.Error("OptionFromPtr mismatch")
+	}
+	if some.String() != "Some(7)" || none.String() != "None" {
+		t.Errorf("String: got %s and %s", some, none)
+	}
+}
+
+func TestOptionValue(t *testing.T) {
+	if v, err := Some("x").Value(); v != "x" || err != nil {
+		t.Errorf("Some.Value() = %v, %v", v, err)
+	}
+	if v, err := None[string]().Value(); v != nil || err != nil {
+		t.Errorf("None.Value() = %v, %v", v, err)
+	}
+}
+
+func TestOptionScan(t *testing.T) {
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	check := func(name string, ok bool) {
+		t.Helper()
+		if !ok {
+			t.Error(name)
+		}
+	}
+
+	var i Option[int64]
+	check("int64 from int64", i.Scan(int64(5)) == nil && i == Some(int64(5)))
+	check("int64 from nil", i.Scan(nil) == nil && i == None[int64]())
+
+	var small Option[int32]
+	check("int32 from int64", small.Scan(int64(5)) == nil && small == Some(int32(5)))
+
+	var s Option[string]
+	check("string from []byte", s.Scan([]byte("abc")) == nil && s == Some("abc"))
+	check("string from int64 fails", s.Scan(int64(65)) != nil)
+
+	var n Option[int]
+	check("int from string fails", n.Scan("65") != nil)
+
+	var ts Option[time.Time]
+	check("time from time", ts.Scan(at) == nil && ts == Some(at))
+
+	var b Option[bool]
+	check("bool from float fails", b.Scan(1.5) != nil)
+}
+
+func TestOptionJSON(t *testing.T) {
+	type row struct {
+		A Option[int]    `json:"a"`
+		B Option[string] `json:"b"`
+	}
+	data, err := json.Marshal(row{A: Some(1), B: None[string]()})
+	if err != nil || string(data) != `{"a":1,"b":null}` {
+		t.Fatalf("Marshal = %s, %v", data, err)
+	}
+	var got row
+	if err := json.Unmarshal([]byte(`{"a":null,"b":"x"}`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.A != None[int]() || got.B != Some("x") {
+		t.Errorf("Unmarshal = %+v", got)
+	}
+	if err := json.Unmarshal([]byte(`{"a":"x"}`), &got); err == nil {
+		t.Error("Unmarshal of a string into Option[int] succeeded")
+	}
+}
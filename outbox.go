@@ -0,0 +1,180 @@
+package book_bot_database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	outboxChannel = "outbox"
+	// outboxLease is how long a claimed message is left to its relay
+	// before another one publishes it again.
+	outboxLease          = time.Minute
+	outboxMaxBackoff     = 10 * time.Minute
+	outboxBatchSize      = 100
+	outboxRetention      = 7 * 24 * time.Hour
+	outboxPublishTimeout = 30 * time.Second
+)
+
+// OutboxEvent is an event for a message queue, stored by WriteOutbox.
+// Payload is encoded as JSON. Events with the same non-empty Key are
+// published in the order they were written, each only once the one
+// before it was.
+type OutboxEvent struct {
+	Topic   string
+	Key     string
+	Payload any
+	Headers map[string]string
+}
+
+// OutboxMessage is a stored event handed to a Publisher. Attempts counts
+// this one.
+type OutboxMessage struct {
+	ID        int64             `db:"id"`
+	Topic     string            `db:"topic"`
+	Key       string            `db:"key"`
+	Payload   json.RawMessage   `db:"payload"`
+	Headers   map[string]string `db:"headers"`
+	CreatedAt time.Time         `db:"created_at"`
+	Attempts  int               `db:"attempts"`
+}
+
+// Publisher sends outbox messages to the message queue, e.g. RabbitMQ.
+// Delivery is at least once: a message may be published again if the
+// relay stops before recording it, so consumers should deduplicate on
+// the message ID.
+type Publisher interface {
+	Publish(ctx context.Context, msg OutboxMessage) error
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, msg OutboxMessage) error
+
+func (f PublisherFunc) Publish(ctx context.Context, msg OutboxMessage) error {
+	return f(ctx, msg)
+}
+
+func init() {
+	RegisterJob(Job{Name: "purge_outbox", Every: 24 * time.Hour, Run: func(ctx context.Context, session *DB_Session) (int64, error) {
+		return session.DeleteInBatches(ctx, "outbox", "published_at < now() - $1::interval", 0, 0, nil, outboxRetention)
+	}})
+}
+
+// WriteOutbox stores event in tx, so it is published if and only if tx
+// commits, and returns its ID. A running relay is woken at commit.
+func WriteOutbox(ctx context.Context, tx pgx.Tx, event OutboxEvent) (int64, error) {
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return 0, err
+	}
+	headers := event.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	var id int64
+	err = tx.QueryRow(ctx, `WITH e AS (
+			INSERT INTO outbox (topic, key, payload, headers) VALUES ($1, $2, $3::jsonb, $4) RETURNING id
+		)
+		SELECT e.id FROM e, pg_notify('`+outboxChannel+`', '')`, event.Topic, event.Key, string(payload), headers).Scan(&id)
+	return id, err
+}
+
+// RelayOutbox publishes the messages due, up to a batch of them, and
+// returns how many it published. Relays of several instances share the
+// work. A message failing to publish is retried with a doubling backoff;
+// the others are carried on with, except those after it with the same
+// key.
+func (session *DB_Session) RelayOutbox(ctx context.Context, publisher Publisher) (int, error) {
+	rows, err := session.Query(ctx, `UPDATE outbox SET available_at = now() + $2::interval, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox o
+			WHERE published_at IS NULL AND available_at <= now()
+				AND (key = '' OR NOT EXISTS (SELECT 1 FROM outbox p WHERE p.key = o.key AND p.published_at IS NULL AND p.id < o.id))
+			ORDER BY id LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, topic, key, payload, headers, created_at, attempts`, outboxBatchSize, outboxLease)
+	if err != nil {
+		return 0, err
+	}
+	messages, err := pgx.CollectRows(rows, pgx.RowToStructByName[OutboxMessage])
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, msg := range messages {
+		if err := session.publishOutbox(ctx, publisher, msg); err != nil {
+			if ctx.Err() != nil {
+				return published, ctx.Err()
+			}
+			session.logger.Log(LevelWarn, "DB outbox publish failed", F("id", msg.ID), F("topic", msg.Topic),
+				F("attempts", msg.Attempts), F("error", err))
+			_, err = session.Exec(ctx, "UPDATE outbox SET available_at = now() + $2::interval, last_error = $3 WHERE id = $1",
+				msg.ID, outboxBackoff(msg.Attempts), err.Error())
+			if err != nil {
+				return published, err
+			}
+			continue
+		}
+		// A message published but not recorded here is published again
+		// once its lease ends.
+		if _, err := session.Exec(ctx, "UPDATE outbox SET published_at = now(), last_error = NULL WHERE id = $1", msg.ID); err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+func (session *DB_Session) publishOutbox(ctx context.Context, publisher Publisher, msg OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	defer cancel()
+	return publisher.Publish(ctx, msg)
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	return delay
+}
+
+// RunOutboxRelay relays the outbox to publisher until ctx is done. It
+// runs when WriteOutbox wakes it and every interval, which picks up
+// retries and the messages of relays that stopped midway. Failures are
+// logged and retried.
+func (session *DB_Session) RunOutboxRelay(ctx context.Context, publisher Publisher, interval time.Duration) error {
+	wake, err := session.Listen(outboxChannel)
+	if err != nil {
+		return err
+	}
+	defer session.Unlisten(outboxChannel, wake)
+
+	for {
+		n, err := session.RelayOutbox(ctx, publisher)
+		if err != nil && ctx.Err() == nil {
+			session.logger.Log(LevelWarn, "DB outbox relay failed", F("error", err))
+		}
+		// More may be due right away.
+		if err == nil && n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-wake:
+			if !ok {
+				return errShutdown
+			}
+		case <-session.clock.After(interval):
+		}
+	}
+}
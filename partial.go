@@ -0,0 +1,170 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// maxBindParams is the most parameters one statement can carry; the
+// chunks of InsertManyPartial stay well below it.
+const (
+	maxBindParams      = 65535
+	partialInsertChunk = 1000
+)
+
+// RowOutcome is what happened to one row of InsertManyPartial.
+type RowOutcome int
+
+const (
+	RowInserted RowOutcome = iota
+	// RowSkipped rows violated a constraint, e.g. a duplicate key.
+	RowSkipped
+	// RowFailed rows held data the columns don't accept.
+	RowFailed
+)
+
+func (o RowOutcome) String() string {
+	switch o {
+	case RowInserted:
+		return "inserted"
+	case RowSkipped:
+		return "skipped"
+	case RowFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// RowResult is the outcome of one row; Err is the database error of a
+// skipped or failed row.
+type RowResult struct {
+	Outcome RowOutcome
+	Err     error
+}
+
+// InsertManyPartial inserts rows into table in one transaction, leaving
+// out the rows the database rejects instead of aborting the whole batch,
+// and returns the outcome of every row in order. Rows go in with
+// multi-row INSERTs; a chunk that is rejected is split in halves under
+// savepoints until the offending rows are isolated, so a few bad rows cost
+// a handful of extra statements. Errors not caused by a row's data, such
+// as a lost connection, fail the call and nothing is inserted.
+func (session *DB_Session) InsertManyPartial(ctx context.Context, table string, columns []string, rows [][]any) ([]RowResult, error) {
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("insert into %s: no columns", table)
+	}
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("insert into %s: row %d has %d values for %d columns", table, i, len(row), len(columns))
+		}
+	}
+	chunk := maxBindParams / len(columns)
+	if chunk > partialInsertChunk {
+		chunk = partialInsertChunk
+	}
+
+	var results []RowResult
+	err := session.WithTx(ctx, func(tx pgx.Tx) error {
+		results = make([]RowResult, len(rows))
+		for start := 0; start < len(rows); start += chunk {
+			end := start + chunk
+			if end > len(rows) {
+				end = len(rows)
+			}
+			if err := insertPartial(ctx, tx, table, columns, rows, start, end, results); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func insertPartial(ctx context.Context, tx pgx.Tx, table string, columns []string, rows [][]any, start, end int, results []RowResult) error {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = savepoint.Exec(ctx, insertManySQL(table, columns, end-start), flatten(rows[start:end])...)
+	if err == nil {
+		return savepoint.Commit(ctx)
+	}
+	if rbErr := savepoint.Rollback(ctx); rbErr != nil {
+		return rbErr
+	}
+
+	outcome, rowLevel := rowError(err)
+	if !rowLevel {
+		return err
+	}
+	if end-start == 1 {
+		results[start] = RowResult{Outcome: outcome, Err: err}
+		return nil
+	}
+	mid := start + (end-start)/2
+	if err := insertPartial(ctx, tx, table, columns, rows, start, mid, results); err != nil {
+		return err
+	}
+	return insertPartial(ctx, tx, table, columns, rows, mid, end, results)
+}
+
+// rowError tells errors caused by the data of a row apart from the rest:
+// integrity violations (class 23) skip the row, data exceptions (class 22)
+// fail it.
+func rowError(err error) (RowOutcome, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return 0, false
+	}
+	switch {
+	case strings.HasPrefix(pgErr.Code, "23"):
+		return RowSkipped, true
+	case strings.HasPrefix(pgErr.Code, "22"):
+		return RowFailed, true
+	}
+	return 0, false
+}
+
+func insertManySQL(table string, columns []string, n int) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = QuoteIdentifier(column)
+	}
+	var b strings.Builder
+	b.WriteString("INSERT INTO ")
+	b.WriteString(QuoteIdentifier(strings.Split(table, ".")...))
+	b.WriteString(" (" + strings.Join(quoted, ", ") + ") VALUES ")
+	param := 1
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for j := range columns {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("$" + strconv.Itoa(param))
+			param++
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+func flatten(rows [][]any) []any {
+	var args []any
+	for _, row := range rows {
+		args = append(args, row...)
+	}
+	return args
+}
@@ -0,0 +1,162 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// partitionLockTimeout bounds the wait of partition DDL for the lock on
+// the parent table, so maintenance gives up instead of queueing every
+// query on the table behind a long-running one; it is retried on the next
+// run.
+const partitionLockTimeout = 5 * time.Second
+
+// Partition is one partition of a table partitioned by time range (see
+// MonthlyPartitionsSQL). From is nil for a partition starting at
+// MINVALUE, such as the old rows of a table converted to partitioning; To
+// is nil for one open to MAXVALUE, and both are for a DEFAULT partition.
+type Partition struct {
+	Schema string     `db:"schema"`
+	Name   string     `db:"name"`
+	From   *time.Time `db:"from"`
+	To     *time.Time `db:"to"`
+}
+
+// MonthlyPartitionsSQL is the migration SQL creating the monthly
+// partitions of table, in the session's schema, from first to last months
+// after the current one, 0 being the current month, in UTC. Partitions
+// are named <table>_pYYYYMM. Partition the table by RANGE of a
+// TIMESTAMPTZ column in the same migration; MaintainPartitions creates
+// the later months from then on.
+func MonthlyPartitionsSQL(table string, first, last int) string {
+	return fmt.Sprintf(`DO $$
+		DECLARE
+			m TIMESTAMP := date_trunc('month', now() AT TIME ZONE 'UTC');
+		BEGIN
+			FOR i IN %d..%d LOOP
+				EXECUTE format('CREATE TABLE IF NOT EXISTS %%I PARTITION OF %%I FOR VALUES FROM (%%L) TO (%%L)',
+					%s || '_p' || to_char(m + i * interval '1 month', 'YYYYMM'), %[3]s,
+					(m + i * interval '1 month') AT TIME ZONE 'UTC', (m + (i + 1) * interval '1 month') AT TIME ZONE 'UTC');
+			END LOOP;
+		END $$;`, first, last, quoteLiteral(table))
+}
+
+// Partitions returns the partitions of table, oldest first.
+func (session *DB_Session) Partitions(ctx context.Context, table string) ([]Partition, error) {
+	rows, err := session.Query(ctx, `SELECT n.nspname AS schema, c.relname AS name,
+			substring(pg_get_expr(c.relpartbound, c.oid) FROM 'FROM \(''([^'']+)''\)')::timestamptz AS "from",
+			substring(pg_get_expr(c.relpartbound, c.oid) FROM 'TO \(''([^'']+)''\)')::timestamptz AS "to"
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE i.inhparent = $1::text::regclass
+		ORDER BY 3 NULLS FIRST, 2`, table)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Partition])
+}
+
+// CreateMonthlyPartitions creates the partitions of table for the current
+// month and the months after it, in UTC, that don't exist yet. Months up
+// to the end of the latest partition are skipped, being covered already.
+// It returns how many partitions it created.
+func (session *DB_Session) CreateMonthlyPartitions(ctx context.Context, table string, months int) (int, error) {
+	partitions, err := session.Partitions(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	var covered time.Time
+	for _, p := range partitions {
+		if p.To != nil && p.To.After(covered) {
+			covered = *p.To
+		}
+	}
+
+	now := session.clock.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	created := 0
+	for i := 0; i <= months; i, month = i+1, month.AddDate(0, 1, 0) {
+		if month.Before(covered) {
+			continue
+		}
+		name := fmt.Sprintf("%s_p%s", table, month.Format("200601"))
+		err := session.partitionDDL(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%s) TO (%s)",
+			QuoteIdentifier(name), QuoteIdentifier(table),
+			quoteLiteral(month.Format(time.RFC3339)), quoteLiteral(month.AddDate(0, 1, 0).Format(time.RFC3339))))
+		if err != nil {
+			return created, fmt.Errorf("create partition %s: %w", name, err)
+		}
+		session.logger.Log(LevelInfo, "DB partition created", F("table", table), F("partition", name))
+		created++
+	}
+	return created, nil
+}
+
+// DropPartitionsBefore detaches the partitions of table that end at or
+// before before and drops them, or with keepDetached leaves them as
+// standalone tables, e.g. to be archived. Dropping a partition is
+// instant, unlike deleting its rows. It returns the partitions it
+// detached.
+func (session *DB_Session) DropPartitionsBefore(ctx context.Context, table string, before time.Time, keepDetached bool) ([]Partition, error) {
+	partitions, err := session.Partitions(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	var detached []Partition
+	for _, p := range partitions {
+		if p.To == nil || p.To.After(before) {
+			continue
+		}
+		name := QuoteIdentifier(p.Schema, p.Name)
+		sql := "ALTER TABLE " + QuoteIdentifier(table) + " DETACH PARTITION " + name
+		if !keepDetached {
+			sql += "; DROP TABLE " + name
+		}
+		if err := session.partitionDDL(ctx, sql); err != nil {
+			return detached, fmt.Errorf("detach partition %s: %w", p.Name, err)
+		}
+		session.logger.Log(LevelInfo, "DB partition detached", F("table", table), F("partition", p.Name), F("dropped", !keepDetached))
+		detached = append(detached, p)
+	}
+	return detached, nil
+}
+
+// MaintainPartitions creates the partitions of table for the coming
+// months and, if retention is positive, drops those that ended more than
+// retention ago. It returns how many partitions it created and dropped.
+// Run it daily as a Job:
+//
+//	database.RegisterJob(database.Job{Name: "partition_events", Every: 24 * time.Hour,
+//		Run: func(ctx context.Context, session *database.DB_Session) (int64, error) {
+//			return session.MaintainPartitions(ctx, "events", 3, 365*24*time.Hour)
+//		}})
+func (session *DB_Session) MaintainPartitions(ctx context.Context, table string, months int, retention time.Duration) (int64, error) {
+	created, err := session.CreateMonthlyPartitions(ctx, table, months)
+	if err != nil || retention <= 0 {
+		return int64(created), err
+	}
+	dropped, err := session.DropPartitionsBefore(ctx, table, session.clock.Now().Add(-retention), false)
+	return int64(created + len(dropped)), err
+}
+
+// partitionDDL runs sql in a transaction limited to partitionLockTimeout
+// of waiting for locks.
+func (session *DB_Session) partitionDDL(ctx context.Context, sql string) error {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL lock_timeout = %d", partitionLockTimeout.Milliseconds())); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, sql)
+		return err
+	})
+}
@@ -0,0 +1,68 @@
+package book_bot_database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolStats is a snapshot of one connection pool of the session.
+type PoolStats struct {
+	// Pool is "primary", "pinned" or "replica <n>".
+	Pool              string
+	Host              string
+	MaxConns          int32
+	TotalConns        int32
+	IdleConns         int32
+	AcquiredConns     int32
+	ConstructingConns int32
+	// Acquires counts the connections handed out since the pool opened;
+	// EmptyAcquires those that had to wait for one, CanceledAcquires those
+	// whose caller gave up waiting.
+	Acquires         int64
+	EmptyAcquires    int64
+	CanceledAcquires int64
+	AcquireDuration  time.Duration
+	// Waiters counts the callers of GetConnectionCtx waiting, for the
+	// primary only.
+	Waiters int32
+}
+
+// PoolStats returns a snapshot of each of the session's open pools.
+func (session *DB_Session) PoolStats() []PoolStats {
+	var stats []PoolStats
+	if pool := session.pool.Load(); pool != nil {
+		primary := poolStats("primary", pool)
+		primary.Waiters = session.AcquireWaiters()
+		stats = append(stats, primary)
+	}
+	session.pinnedMu.Lock()
+	if session.pinned != nil {
+		stats = append(stats, poolStats("pinned", session.pinned))
+	}
+	session.pinnedMu.Unlock()
+	for i, r := range session.replicas {
+		if pool := r.getPool(); pool != nil {
+			stats = append(stats, poolStats(fmt.Sprintf("replica %d", i), pool))
+		}
+	}
+	return stats
+}
+
+func poolStats(name string, pool *pgxpool.Pool) PoolStats {
+	s := pool.Stat()
+	return PoolStats{
+		Pool:              name,
+		Host:              pool.Config().ConnConfig.Host,
+		MaxConns:          s.MaxConns(),
+		TotalConns:        s.TotalConns(),
+		IdleConns:         s.IdleConns(),
+		AcquiredConns:     s.AcquiredConns(),
+		ConstructingConns: s.ConstructingConns(),
+		Acquires:          s.AcquireCount(),
+		EmptyAcquires:     s.EmptyAcquireCount(),
+		CanceledAcquires:  s.CanceledAcquireCount(),
+		AcquireDuration:   s.AcquireDuration(),
+	}
+}
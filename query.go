@@ -0,0 +1,71 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNotFound is matched with errors.Is by the errors QueryOne returns
+// for a query returning no row; they also match pgx.ErrNoRows.
+var ErrNotFound = errors.New("no rows found")
+
+// IsNotFound reports whether err was returned by QueryOne for a query
+// returning no row, like errors.Is(err, ErrNotFound).
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+type notFoundError struct{ typeName string }
+
+func (e notFoundError) Error() string {
+	return "no " + e.typeName + " found"
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound || target == pgx.ErrNoRows
+}
+
+// QueryOne runs sql on the primary and scans its first row into a T by
+// column name, as pgx.RowToStructByName does; see IsNotFound for queries
+// returning no row. A repo maps that to its own error:
+//
+//	book, err := database.QueryOne[Book](ctx, repo.session, "SELECT "+Columns+" FROM books WHERE id = $1", id)
+//	if database.IsNotFound(err) {
+//		return nil, ErrNotFound
+//	}
+func QueryOne[T any](ctx context.Context, db Database, sql string, args ...any) (*T, error) {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	value, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[T])
+	if err == pgx.ErrNoRows {
+		return nil, notFoundError{typeName: typeName[T]()}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %w", typeName[T](), err)
+	}
+	return value, nil
+}
+
+// QueryAll runs sql on the primary and scans every row into a T by column
+// name. No rows give an empty slice, not an error.
+func QueryAll[T any](ctx context.Context, db Database, sql string, args ...any) ([]T, error) {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	values, err := pgx.CollectRows(rows, pgx.RowToStructByName[T])
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %w", typeName[T](), err)
+	}
+	return values, nil
+}
+
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().String()
+}
@@ -0,0 +1,86 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var errReloadReplicas = errors.New("reload can't add or remove replicas")
+
+type reloadRequest struct {
+	params   *DB_Params
+	servers  []*pgxpool.Config
+	replicas []*replica
+	pool     *pgxpool.Pool
+	server   int
+	result   chan error
+}
+
+// Reload switches the session to params without a restart, e.g. after a
+// password rotation:
+//
+//	next := *session.Params()
+//	next.Server = dsnWithNewPassword
+//	err := session.Reload(ctx, &next)
+//
+// It parses params and connects a new primary pool first; only once that
+// pool answers, is migrated and prepares the registered statements does
+// it replace the old one, which keeps serving meanwhile and then closes
+// as its connections are released. On any error the session stays as it
+// was. Reload also works while the session is reconnecting, which is
+// what it does when the old credentials stopped working, but not once it
+// has failed. The replica and pinned pools are reconnected with the new
+// settings; connections outside the pools, of Listen and the advisory
+// locks, keep running on the old ones until they reconnect. params
+// replaces the whole configuration, hooks included, except Logger and
+// Clock, and must list as many replicas as before.
+func (session *DB_Session) Reload(ctx context.Context, params *DB_Params) error {
+	params.SetDefaults()
+	if len(params.Replicas) != len(session.replicas) {
+		return errReloadReplicas
+	}
+	servers, replicas, err := session.buildConfigs(params)
+	if err != nil {
+		return err
+	}
+	pool, server, err := session.openPrimary(ctx, servers)
+	if err != nil {
+		return err
+	}
+
+	req := reloadRequest{params: params, servers: servers, replicas: replicas, pool: pool, server: server, result: make(chan error, 1)}
+	select {
+	case session.reloads <- req:
+	case <-ctx.Done():
+		pool.Close()
+		return ctx.Err()
+	case <-session.done:
+		pool.Close()
+		return errShutdown
+	case <-session.failed:
+		pool.Close()
+		return session.failure
+	}
+	return <-req.result
+}
+
+// applyReload swaps the pool and configs of req in; it runs on the
+// connect loop, like connect.
+func (session *DB_Session) applyReload(req reloadRequest) error {
+	err := session.start(req.pool, func() {
+		session.params.Store(req.params)
+		session.target.Store(&primaryTarget{servers: req.servers, server: req.server})
+		session.failbackCheckedAt = session.clock.Now()
+		for i, r := range session.replicas {
+			r.mu.Lock()
+			r.config = req.replicas[i].config
+			r.mu.Unlock()
+		}
+	})
+	if err == nil {
+		session.logger.Log(LevelInfo, "DB configuration reloaded", F("host", session.primaryConfig().ConnConfig.Host))
+	}
+	return err
+}
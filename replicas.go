@@ -0,0 +1,156 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var errNoReplicas = errors.New("no replicas available")
+
+// replicaRetryDelay is how long a replica that failed an acquire is
+// skipped before reads are routed to it again.
+const replicaRetryDelay = 10 * time.Second
+
+// replicaPingTimeout bounds a replica ping, so an unreachable replica
+// can't stall the health check.
+const replicaPingTimeout = 5 * time.Second
+
+func pingReplica(ctx context.Context, pool *pgxpool.Pool) error {
+	ctx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+	defer cancel()
+	return pool.Ping(ctx)
+}
+
+type replica struct {
+	mu        sync.RWMutex
+	config    *pgxpool.Config
+	pool      *pgxpool.Pool
+	downUntil time.Time
+}
+
+func (r *replica) getPool() *pgxpool.Pool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// healthyPool returns the pool unless the replica is disconnected or was
+// marked down.
+func (r *replica) healthyPool(now time.Time) *pgxpool.Pool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if now.Before(r.downUntil) {
+		return nil
+	}
+	return r.pool
+}
+
+func (r *replica) markDown(until time.Time) {
+	r.mu.Lock()
+	r.downUntil = until
+	r.mu.Unlock()
+}
+
+func (r *replica) setPool(pool *pgxpool.Pool) {
+	r.mu.Lock()
+	old := r.pool
+	r.pool = pool
+	r.downUntil = time.Time{}
+	r.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// connectReplicas (re)creates the replica pools. A replica that can't be
+// reached is left without a pool and reads fall back to the primary.
+func (session *DB_Session) connectReplicas() {
+	for i, r := range session.replicas {
+		pool, err := pgxpool.NewWithConfig(context.Background(), r.config)
+		if err == nil {
+			err = pingReplica(context.Background(), pool)
+			if err != nil {
+				pool.Close()
+			}
+		}
+		if err != nil {
+			session.logger.Log(LevelError, "DB replica connect failed", F("replica", i), F("host", r.config.ConnConfig.Host), F("error", err))
+			r.setPool(nil)
+			continue
+		}
+		r.setPool(pool)
+		session.logger.Log(LevelInfo, "DB replica connected", F("replica", i), F("host", r.config.ConnConfig.Host))
+	}
+}
+
+// checkReplicas runs with the primary's health check: it pings connected
+// replicas, marking the unreachable ones down, and retries the ones that
+// have no pool yet.
+func (session *DB_Session) checkReplicas(ctx context.Context) {
+	for i, r := range session.replicas {
+		pool := r.getPool()
+		if pool == nil {
+			pool, err := pgxpool.NewWithConfig(ctx, r.config)
+			if err == nil {
+				err = pingReplica(ctx, pool)
+				if err != nil {
+					pool.Close()
+					continue
+				}
+				r.setPool(pool)
+				session.logger.Log(LevelInfo, "DB replica connected", F("replica", i), F("host", r.config.ConnConfig.Host))
+			}
+			continue
+		}
+		if err := pingReplica(ctx, pool); err != nil {
+			if r.healthyPool(session.clock.Now()) != nil {
+				session.logger.Log(LevelWarn, "DB replica unhealthy", F("replica", i), F("host", r.config.ConnConfig.Host), F("error", err))
+			}
+			r.markDown(session.clock.Now().Add(replicaRetryDelay))
+		}
+	}
+}
+
+// GetReadConnection returns a connection for reads that tolerate
+// replication lag. Replicas take turns; one that fails is skipped for a
+// while, and when none is available the primary serves the read.
+func (session *DB_Session) GetReadConnection(ctx context.Context) (*pgxpool.Conn, error) {
+	replicas := session.replicas
+	if len(replicas) > 0 {
+		now := session.clock.Now()
+		offset := int(session.nextReplica.Add(1))
+		for i := range replicas {
+			r := replicas[(offset+i)%len(replicas)]
+			pool := r.healthyPool(now)
+			if pool == nil {
+				continue
+			}
+			conn, err := pool.Acquire(ctx)
+			if err == nil {
+				session.trackAcquire(conn)
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			session.logger.Log(LevelWarn, "DB replica acquire failed", F("host", r.config.ConnConfig.Host), F("error", err))
+			r.markDown(now.Add(replicaRetryDelay))
+		}
+	}
+	return session.GetConnectionCtx(ctx)
+}
+
+// GetWriteConnection returns a connection to the primary.
+func (session *DB_Session) GetWriteConnection(ctx context.Context) (*pgxpool.Conn, error) {
+	return session.GetConnectionCtx(ctx)
+}
+
+func (session *DB_Session) closeReplicas() {
+	for _, r := range session.replicas {
+		r.setPool(nil)
+	}
+}
@@ -0,0 +1,126 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrorReport describes a failed query for an ErrorReporter. Args holds
+// only the types of the arguments, since their values may be user data.
+type ErrorReport struct {
+	// Label is the one set with WithQueryLabel, or the statement name
+	// for ExecNamed and QueryNamed.
+	Label string
+	SQL   string
+	Args  []string
+	// Class is the SQLSTATE class, e.g. "23" for integrity violations,
+	// and Code the full SQLSTATE; both are empty for errors that didn't
+	// come from the server.
+	Class      string
+	Code       string
+	Table      string
+	Constraint string
+	Err        error
+}
+
+// ErrorReporter receives the unexpected errors of queries, e.g. to send
+// them to an error tracker such as the sentry package. ReportError is
+// called on the goroutine that ran the query and must not block.
+type ErrorReporter interface {
+	ReportError(ctx context.Context, report ErrorReport)
+}
+
+// expectedCodes are the SQLSTATE codes, or classes, the package and its
+// repos handle as part of normal operation: retried serialization
+// failures and deadlocks, lock and statement timeouts, and unique
+// violations of inserts that map them to an "exists" error.
+var expectedCodes = []string{"40", "55P03", "57014", "23505"}
+
+var (
+	expectedErrorsMu sync.RWMutex
+	expectedErrors   []error
+)
+
+// RegisterExpectedError keeps errors matching err, by errors.Is, out of
+// reports, for errors a repo returns as a result rather than a failure,
+// such as a not found error. It panics if err is registered already; call
+// it from init.
+func RegisterExpectedError(err error) {
+	expectedErrorsMu.Lock()
+	defer expectedErrorsMu.Unlock()
+	for _, known := range expectedErrors {
+		if known == err {
+			panic(fmt.Sprintf("expected error %q registered twice", err))
+		}
+	}
+	expectedErrors = append(expectedErrors, err)
+}
+
+// IsExpectedError reports whether err is one ErrorReporter isn't given:
+// a cancelled context, pgx.ErrNoRows, an expected SQLSTATE or a
+// registered error.
+func IsExpectedError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, pgx.ErrNoRows) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		for _, code := range expectedCodes {
+			if strings.HasPrefix(pgErr.Code, code) {
+				return true
+			}
+		}
+	}
+	expectedErrorsMu.RLock()
+	defer expectedErrorsMu.RUnlock()
+	for _, known := range expectedErrors {
+		if errors.Is(err, known) {
+			return true
+		}
+	}
+	return false
+}
+
+type queryLabelKey struct{}
+
+// WithQueryLabel names the queries run with ctx in error reports, so
+// reports group by the operation rather than the SQL text.
+func WithQueryLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, queryLabelKey{}, label)
+}
+
+// ReportError passes err to the configured ErrorReporter unless it is
+// expected, for failures found outside a query, e.g. by a repo checking
+// the rows it got.
+func (session *DB_Session) ReportError(ctx context.Context, err error, sql string, args ...any) {
+	reporter := session.Params().ErrorReporter
+	if reporter == nil || err == nil || IsExpectedError(err) {
+		return
+	}
+	report := ErrorReport{SQL: strings.Join(strings.Fields(sql), " "), Args: argTypes(args), Err: err}
+	report.Label, _ = ctx.Value(queryLabelKey{}).(string)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		report.Code = pgErr.Code
+		if len(pgErr.Code) >= 2 {
+			report.Class = pgErr.Code[:2]
+		}
+		report.Table = pgErr.TableName
+		report.Constraint = pgErr.ConstraintName
+	}
+	reporter.ReportError(ctx, report)
+}
+
+func argTypes(args []any) []string {
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = fmt.Sprintf("%T", arg)
+	}
+	return types
+}
@@ -0,0 +1,294 @@
+package abuse
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	SignalRapidRequests = "rapid_requests"
+	SignalMassLinks     = "mass_links"
+	SignalCaptchaFailed = "captcha_failed"
+	SignalTrapHit       = "trap_hit"
+
+	LevelNone = ""
+)
+
+// Threshold maps a risk score to a restriction level understood by the
+// moderation side (e.g. "throttle", "captcha", "ban").
+type Threshold struct {
+	Level string
+	Score float64
+}
+
+// Config weighs signals and turns scores into levels. Each signal's
+// contribution halves every HalfLife, and signals older than Window are
+// ignored.
+type Config struct {
+	Weights    map[string]float64
+	Thresholds []Threshold
+	HalfLife   time.Duration
+	Window     time.Duration
+}
+
+var DefaultConfig = Config{
+	Weights: map[string]float64{
+		SignalRapidRequests: 1,
+		SignalMassLinks:     3,
+		SignalCaptchaFailed: 2,
+		SignalTrapHit:       10,
+	},
+	Thresholds: []Threshold{
+		{Level: "throttle", Score: 10},
+		{Level: "captcha", Score: 25},
+		{Level: "ban", Score: 60},
+	},
+	HalfLife: 6 * time.Hour,
+	Window:   7 * 24 * time.Hour,
+}
+
+type Risk struct {
+	UserID    int64     `db:"user_id"`
+	Score     float64   `db:"score"`
+	Level     string    `db:"level"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type Signal struct {
+	ID        int64           `db:"id"`
+	UserID    int64           `db:"user_id"`
+	Kind      string          `db:"kind"`
+	Weight    float64         `db:"weight"`
+	Meta      json.RawMessage `db:"meta"`
+	CreatedAt time.Time       `db:"created_at"`
+}
+
+// Action is emitted when a user's risk crosses into a higher level; the
+// moderation worker claims actions and applies the restriction.
+type Action struct {
+	ID         int64      `db:"id"`
+	UserID     int64      `db:"user_id"`
+	Level      string     `db:"level"`
+	Score      float64    `db:"score"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ConsumedAt *time.Time `db:"consumed_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140014,
+		Name:    "create_abuse",
+		Up: `CREATE TABLE abuse_signals (
+			id         BIGSERIAL PRIMARY KEY,
+			user_id    BIGINT NOT NULL,
+			kind       TEXT NOT NULL,
+			weight     DOUBLE PRECISION NOT NULL,
+			meta       JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX abuse_signals_user_idx ON abuse_signals (user_id, created_at);
+		CREATE TABLE user_risk (
+			user_id    BIGINT PRIMARY KEY,
+			score      DOUBLE PRECISION NOT NULL,
+			level      TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE abuse_actions (
+			id          BIGSERIAL PRIMARY KEY,
+			user_id     BIGINT NOT NULL,
+			level       TEXT NOT NULL,
+			score       DOUBLE PRECISION NOT NULL,
+			created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			consumed_at TIMESTAMPTZ
+		);
+		CREATE INDEX abuse_actions_pending_idx ON abuse_actions (id) WHERE consumed_at IS NULL;`,
+		Down: `DROP TABLE abuse_actions; DROP TABLE user_risk; DROP TABLE abuse_signals;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140079,
+		Name:    "touch_user_risk",
+		Up:      database.TouchUpdatedAtSQL("user_risk"),
+		Down:    `DROP TRIGGER user_risk_touch_updated_at ON user_risk;`,
+	})
+	database.RegisterModel(database.Model{Table: "abuse_signals", Struct: Signal{}, Indexes: []string{"abuse_signals_user_idx"}})
+	database.RegisterModel(database.Model{Table: "user_risk", Struct: Risk{}})
+	database.RegisterModel(database.Model{Table: "abuse_actions", Struct: Action{}, Indexes: []string{"abuse_actions_pending_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+	config  Config
+}
+
+func New(session *database.DB_Session, config Config) *Repo {
+	if config.HalfLife <= 0 {
+		config.HalfLife = DefaultConfig.HalfLife
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultConfig.Window
+	}
+	config.Thresholds = append([]Threshold(nil), config.Thresholds...)
+	sort.Slice(config.Thresholds, func(i, j int) bool { return config.Thresholds[i].Score < config.Thresholds[j].Score })
+	return &Repo{session: session, config: config}
+}
+
+func (repo *Repo) level(score float64) string {
+	level := LevelNone
+	for _, t := range repo.config.Thresholds {
+		if score >= t.Score {
+			level = t.Level
+		}
+	}
+	return level
+}
+
+func (repo *Repo) rank(level string) int {
+	for i, t := range repo.config.Thresholds {
+		if t.Level == level {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+const scoreSQL = `SELECT COALESCE(sum(weight * power(0.5, extract(epoch FROM now() - created_at) / $2)), 0)
+	FROM abuse_signals WHERE user_id = $1 AND created_at > now() - $3::interval`
+
+// Record stores a signal for userID and recomputes the user's risk. When
+// the risk enters a higher level an Action is queued for moderation.
+func (repo *Repo) Record(ctx context.Context, userID int64, kind string, meta any) (*Risk, error) {
+	raw := []byte("{}")
+	if meta != nil {
+		var err error
+		if raw, err = json.Marshal(meta); err != nil {
+			return nil, err
+		}
+	}
+	weight, ok := repo.config.Weights[kind]
+	if !ok {
+		weight = 1
+	}
+
+	var risk Risk
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "INSERT INTO abuse_signals (user_id, kind, weight, meta) VALUES ($1, $2, $3, $4)", userID, kind, weight, raw)
+		if err != nil {
+			return err
+		}
+
+		var previous string
+		err = tx.QueryRow(ctx, "SELECT level FROM user_risk WHERE user_id = $1 FOR UPDATE", userID).Scan(&previous)
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+
+		risk.UserID = userID
+		err = tx.QueryRow(ctx, scoreSQL, userID, repo.config.HalfLife.Seconds(), repo.config.Window).Scan(&risk.Score)
+		if err != nil {
+			return err
+		}
+		risk.Level = repo.level(risk.Score)
+
+		err = tx.QueryRow(ctx, `INSERT INTO user_risk (user_id, score, level) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET score = EXCLUDED.score, level = EXCLUDED.level, updated_at = now()
+			RETURNING updated_at`, userID, risk.Score, risk.Level).Scan(&risk.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		if repo.rank(risk.Level) > repo.rank(previous) {
+			_, err = tx.Exec(ctx, "INSERT INTO abuse_actions (user_id, level, score) VALUES ($1, $2, $3)", userID, risk.Level, risk.Score)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &risk, nil
+}
+
+// Score returns the current, decayed risk of userID without storing it.
+func (repo *Repo) Score(ctx context.Context, userID int64) (float64, string, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, LevelNone, err
+	}
+	defer conn.Release()
+
+	var score float64
+	err = conn.QueryRow(ctx, scoreSQL, userID, repo.config.HalfLife.Seconds(), repo.config.Window).Scan(&score)
+	if err != nil {
+		return 0, LevelNone, err
+	}
+	return score, repo.level(score), nil
+}
+
+// ClaimActions hands pending actions to the moderation worker, marking
+// them consumed.
+func (repo *Repo) ClaimActions(ctx context.Context, limit int) ([]Action, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `UPDATE abuse_actions SET consumed_at = now()
+		WHERE id IN (
+			SELECT id FROM abuse_actions WHERE consumed_at IS NULL
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, level, score, created_at, consumed_at`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Action])
+}
+
+// ResetRisk clears a user's level after a moderator reviewed them, so new
+// signals can escalate again from scratch.
+func (repo *Repo) ResetRisk(ctx context.Context, userID int64) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM abuse_signals WHERE user_id = $1", userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM user_risk WHERE user_id = $1", userID)
+		return err
+	})
+}
+
+// TopRisk lists the riskiest users by their last stored score.
+func (repo *Repo) TopRisk(ctx context.Context, limit int) ([]Risk, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT user_id, score, level, updated_at FROM user_risk ORDER BY score DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Risk])
+}
+
+// Signals returns the most recent signals of userID.
+func (repo *Repo) Signals(ctx context.Context, userID int64, limit int) ([]Signal, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id, user_id, kind, weight, meta, created_at FROM abuse_signals
+		WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Signal])
+}
@@ -0,0 +1,146 @@
+package abuse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	IdentityFingerprint = "fingerprint"
+	IdentityPayment     = "payment"
+	IdentityIP          = "ip"
+
+	maxLinkDepth = 3
+)
+
+// Identity is something observed for a Telegram account that another
+// account may share: a web-session fingerprint, a payment identity (card
+// fingerprint, wallet) or an IP. Only a hash of the value is stored.
+type Identity struct {
+	UserID    int64     `db:"user_id"`
+	Kind      string    `db:"kind"`
+	ValueHash string    `db:"value_hash"`
+	FirstSeen time.Time `db:"first_seen"`
+	LastSeen  time.Time `db:"last_seen"`
+}
+
+// LinkedAccount is another account connected to the queried one, through
+// shared identities directly (Depth 1) or via other linked accounts.
+type LinkedAccount struct {
+	UserID   int64     `db:"user_id"`
+	Depth    int       `db:"depth"`
+	Kinds    []string  `db:"kinds"`
+	LastSeen time.Time `db:"last_seen"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140016,
+		Name:    "create_identity_links",
+		Up: `CREATE TABLE identity_links (
+			user_id    BIGINT NOT NULL,
+			kind       TEXT NOT NULL,
+			value_hash TEXT NOT NULL,
+			first_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_seen  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (kind, value_hash, user_id)
+		);
+		CREATE INDEX identity_links_user_idx ON identity_links (user_id);`,
+		Down: `DROP TABLE identity_links;`,
+	})
+	database.RegisterModel(database.Model{Table: "identity_links", Struct: Identity{}, Indexes: []string{"identity_links_user_idx"}})
+}
+
+func hashIdentity(kind, value string) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + value))
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordIdentity notes that userID was seen with value.
+func (repo *Repo) RecordIdentity(ctx context.Context, userID int64, kind, value string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO identity_links (user_id, kind, value_hash) VALUES ($1, $2, $3)
+		ON CONFLICT (kind, value_hash, user_id) DO UPDATE SET last_seen = now()`, userID, kind, hashIdentity(kind, value))
+	return err
+}
+
+// FindLinkedAccounts returns accounts sharing identities with userID,
+// following links up to depth hops (1 = direct only). IP links are
+// ignored unless includeIP is set, since NATs and mobile carriers make them
+// noisy.
+func (repo *Repo) FindLinkedAccounts(ctx context.Context, userID int64, depth int, includeIP bool) ([]LinkedAccount, error) {
+	if depth < 1 {
+		depth = 1
+	}
+	if depth > maxLinkDepth {
+		depth = maxLinkDepth
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `WITH RECURSIVE linked (user_id, depth, kind, last_seen) AS (
+			SELECT $1::bigint, 0, NULL::text, now()
+			UNION
+			SELECT other.user_id, l.depth + 1, other.kind, least(mine.last_seen, other.last_seen)
+			FROM linked l
+			JOIN identity_links mine ON mine.user_id = l.user_id
+			JOIN identity_links other ON other.kind = mine.kind AND other.value_hash = mine.value_hash AND other.user_id <> mine.user_id
+			WHERE l.depth < $2 AND ($3 OR mine.kind <> 'ip')
+		)
+		SELECT user_id, min(depth) AS depth, array_agg(DISTINCT kind) AS kinds, max(last_seen) AS last_seen
+		FROM linked
+		WHERE user_id <> $1
+		GROUP BY user_id
+		ORDER BY depth, last_seen DESC`, userID, depth, includeIP)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[LinkedAccount])
+}
+
+// Identities lists what was recorded for userID.
+func (repo *Repo) Identities(ctx context.Context, userID int64) ([]Identity, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT user_id, kind, value_hash, first_seen, last_seen FROM identity_links
+		WHERE user_id = $1 ORDER BY last_seen DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Identity])
+}
+
+// FindUsersByIdentity returns the accounts seen with value, most recent
+// first.
+func (repo *Repo) FindUsersByIdentity(ctx context.Context, kind, value string) ([]int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT user_id FROM identity_links
+		WHERE kind = $1 AND value_hash = $2 ORDER BY last_seen DESC`, kind, hashIdentity(kind, value))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
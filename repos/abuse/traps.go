@@ -0,0 +1,142 @@
+package abuse
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Trap is a deliberately invalid catalog entry (a fake book link or ID)
+// that no real user can reach; anything requesting it is scraping.
+type Trap struct {
+	ID        int64     `db:"id"`
+	Slug      string    `db:"slug"`
+	Note      string    `db:"note"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type TrapHit struct {
+	ID        int64       `db:"id"`
+	TrapID    int64       `db:"trap_id"`
+	UserID    *int64      `db:"user_id"`
+	IP        *netip.Addr `db:"ip"`
+	UserAgent string      `db:"user_agent"`
+	HitAt     time.Time   `db:"hit_at"`
+}
+
+// Offender aggregates trap hits by user or by IP for the report.
+type Offender struct {
+	UserID   *int64      `db:"user_id"`
+	IP       *netip.Addr `db:"ip"`
+	Hits     int64       `db:"hits"`
+	Traps    int64       `db:"traps"`
+	FirstHit time.Time   `db:"first_hit"`
+	LastHit  time.Time   `db:"last_hit"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140015,
+		Name:    "create_traps",
+		Up: `CREATE TABLE traps (
+			id         BIGSERIAL PRIMARY KEY,
+			slug       TEXT NOT NULL UNIQUE,
+			note       TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE trap_hits (
+			id         BIGSERIAL PRIMARY KEY,
+			trap_id    BIGINT NOT NULL REFERENCES traps (id) ON DELETE CASCADE,
+			user_id    BIGINT,
+			ip         INET,
+			user_agent TEXT NOT NULL DEFAULT '',
+			hit_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX trap_hits_hit_at_idx ON trap_hits (hit_at);`,
+		Down: `DROP TABLE trap_hits; DROP TABLE traps;`,
+	})
+	database.RegisterModel(database.Model{Table: "traps", Struct: Trap{}})
+	database.RegisterModel(database.Model{Table: "trap_hits", Struct: TrapHit{}, Indexes: []string{"trap_hits_hit_at_idx"}})
+}
+
+func (repo *Repo) CreateTrap(ctx context.Context, slug, note string) (*Trap, error) {
+	return database.QueryOne[Trap](ctx, repo.session, `INSERT INTO traps (slug, note) VALUES ($1, $2)
+		ON CONFLICT (slug) DO UPDATE SET note = EXCLUDED.note
+		RETURNING id, slug, note, created_at`, slug, note)
+}
+
+// LookupTrap returns the trap behind slug, or nil if slug is a regular
+// entry. Handlers call it before resolving a catalog link.
+func (repo *Repo) LookupTrap(ctx context.Context, slug string) (*Trap, error) {
+	trap, err := database.QueryOne[Trap](ctx, repo.session, "SELECT id, slug, note, created_at FROM traps WHERE slug = $1", slug)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return trap, err
+}
+
+// RecordTrapHit logs a hit on a trap. Hits by a known user also count as a
+// SignalTrapHit towards their risk score.
+func (repo *Repo) RecordTrapHit(ctx context.Context, trapID int64, userID *int64, ip netip.Addr, userAgent string) error {
+	var addr *netip.Addr
+	if ip.IsValid() {
+		addr = &ip
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, "INSERT INTO trap_hits (trap_id, user_id, ip, user_agent) VALUES ($1, $2, $3, $4)",
+		trapID, userID, addr, userAgent)
+	conn.Release()
+	if err != nil {
+		return err
+	}
+
+	if userID != nil {
+		_, err = repo.Record(ctx, *userID, SignalTrapHit, map[string]any{"trap_id": trapID})
+	}
+	return err
+}
+
+// TrapOffendersByUser reports users with at least minHits trap hits since.
+func (repo *Repo) TrapOffendersByUser(ctx context.Context, since time.Time, minHits int) ([]Offender, error) {
+	return repo.offenders(ctx, "user_id", since, minHits)
+}
+
+// TrapOffendersByIP reports IPs with at least minHits trap hits since,
+// which also catches scrapers going through the web frontends.
+func (repo *Repo) TrapOffendersByIP(ctx context.Context, since time.Time, minHits int) ([]Offender, error) {
+	return repo.offenders(ctx, "ip", since, minHits)
+}
+
+func (repo *Repo) offenders(ctx context.Context, key string, since time.Time, minHits int) ([]Offender, error) {
+	userID, ip := "NULL::bigint", "NULL::inet"
+	if key == "user_id" {
+		userID = "user_id"
+	} else {
+		ip = "ip"
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT `+userID+` AS user_id, `+ip+` AS ip, count(*) AS hits,
+			count(DISTINCT trap_id) AS traps, min(hit_at) AS first_hit, max(hit_at) AS last_hit
+		FROM trap_hits
+		WHERE hit_at >= $1 AND `+key+` IS NOT NULL
+		GROUP BY `+key+`
+		HAVING count(*) >= $2
+		ORDER BY hits DESC`, since, minHits)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Offender])
+}
@@ -0,0 +1,271 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Ledger entry kinds. Every change of a user's premium time is booked as
+// one entry, so the ledger sums up to the premium each user was granted.
+const (
+	KindPurchase   = "purchase"
+	KindGiftDebit  = "gift_debit"
+	KindGiftCredit = "gift_credit"
+	KindPromo      = "promo"
+	KindRefund     = "refund"
+	KindAdjustment = "adjustment"
+)
+
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrSelfGift            = errors.New("can't gift premium to yourself")
+	ErrInvalidDays         = errors.New("days must be positive")
+	ErrInsufficientPremium = errors.New("not enough premium time left to gift")
+	ErrGiftLimit           = errors.New("gift limit reached")
+)
+
+// Entry is one booking in the premium ledger. Days is negative for
+// debits. Both halves of a gift share a TransferID.
+type Entry struct {
+	ID           int64     `db:"id"`
+	UserID       int64     `db:"user_id"`
+	Kind         string    `db:"kind"`
+	Days         int       `db:"days"`
+	TransferID   *int64    `db:"transfer_id"`
+	Counterparty *int64    `db:"counterparty_user_id"`
+	Reference    string    `db:"reference"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// GiftLimits keep gifting from being used to farm or launder premium
+// during promos. Zero disables a limit.
+type GiftLimits struct {
+	MaxDaysPerGift  int
+	MaxGiftsPerDay  int
+	MaxDaysPerMonth int
+	// MinRemaining is premium time the sender must keep after a gift.
+	MinRemaining time.Duration
+	// MinAccountAge is how long the recipient must have used the bot.
+	MinAccountAge time.Duration
+}
+
+// DefaultGiftLimits are the limits New applies.
+var DefaultGiftLimits = GiftLimits{
+	MaxDaysPerGift:  90,
+	MaxGiftsPerDay:  3,
+	MaxDaysPerMonth: 180,
+	MinRemaining:    24 * time.Hour,
+	MinAccountAge:   24 * time.Hour,
+}
+
+const entryColumns = "id, user_id, kind, days, transfer_id, counterparty_user_id, reference, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140048,
+		Name:    "create_premium_ledger",
+		Up: `ALTER TABLE users ADD COLUMN premium_until TIMESTAMPTZ;
+		CREATE SEQUENCE premium_transfers;
+		CREATE TABLE premium_ledger (
+			id                   BIGSERIAL PRIMARY KEY,
+			user_id              BIGINT NOT NULL REFERENCES users (id),
+			kind                 TEXT NOT NULL,
+			days                 INT NOT NULL CHECK (days <> 0),
+			transfer_id          BIGINT,
+			counterparty_user_id BIGINT,
+			reference            TEXT NOT NULL DEFAULT '',
+			created_at           TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX premium_ledger_user_idx ON premium_ledger (user_id, created_at DESC);
+		CREATE INDEX premium_ledger_gifts_idx ON premium_ledger (user_id, created_at) WHERE kind = 'gift_debit';`,
+		Down: `DROP TABLE premium_ledger;
+		DROP SEQUENCE premium_transfers;
+		ALTER TABLE users DROP COLUMN premium_until;`,
+	})
+	database.RegisterModel(database.Model{Table: "premium_ledger", Struct: Entry{}, Indexes: []string{
+		"premium_ledger_user_idx", "premium_ledger_gifts_idx",
+	}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+	Limits  GiftLimits
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session, Limits: DefaultGiftLimits}
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// PremiumUntil returns when the premium of userID ends, nil if the user
+// never had any.
+func (repo *Repo) PremiumUntil(ctx context.Context, userID int64) (*time.Time, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var until *time.Time
+	err = conn.QueryRow(ctx, "SELECT premium_until FROM users WHERE id = $1", userID).Scan(&until)
+	if err == pgx.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return until, err
+}
+
+// Grant adds n days of premium to userID, booked as kind with reference
+// (e.g. a payment or promo code). It extends current premium or starts
+// it now.
+func (repo *Repo) Grant(ctx context.Context, userID int64, n int, kind, reference string) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		return GrantTx(ctx, tx, userID, n, kind, reference)
+	})
+}
+
+// GrantTx is Grant inside the caller's transaction, for modules that book
+// premium together with their own changes.
+func GrantTx(ctx context.Context, tx pgx.Tx, userID int64, n int, kind, reference string) error {
+	if n <= 0 {
+		return ErrInvalidDays
+	}
+	_, err := book(ctx, tx, userID, n, kind, reference)
+	return err
+}
+
+// book moves the premium of userID by n days, forward from now for
+// grants and back for revocations, and returns the ledger entry.
+func book(ctx context.Context, tx pgx.Tx, userID int64, n int, kind, reference string) (entryID int64, err error) {
+	if n == 0 {
+		return 0, ErrInvalidDays
+	}
+	update := `UPDATE users SET premium_until = greatest(COALESCE(premium_until, now()), now()) + $2::interval WHERE id = $1`
+	if n < 0 {
+		update = `UPDATE users SET premium_until = premium_until + $2::interval WHERE id = $1`
+	}
+	tag, err := tx.Exec(ctx, update, userID, days(n))
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, ErrUserNotFound
+	}
+	err = tx.QueryRow(ctx, "INSERT INTO premium_ledger (user_id, kind, days, reference) VALUES ($1, $2, $3, $4) RETURNING id",
+		userID, kind, n, reference).Scan(&entryID)
+	return entryID, err
+}
+
+// GiftPremium moves n days of premium from one user to another in one
+// transaction, booking a debit and a credit under a shared transfer ID.
+// Both accounts are locked in ID order, so opposite gifts running at the
+// same time can't deadlock.
+func (repo *Repo) GiftPremium(ctx context.Context, fromUserID, toUserID int64, n int) (transferID int64, err error) {
+	if fromUserID == toUserID {
+		return 0, ErrSelfGift
+	}
+	if n <= 0 {
+		return 0, ErrInvalidDays
+	}
+	limits := repo.Limits
+	if limits.MaxDaysPerGift > 0 && n > limits.MaxDaysPerGift {
+		return 0, ErrGiftLimit
+	}
+
+	err = repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT id, premium_until, created_at FROM users WHERE id IN ($1, $2)
+			ORDER BY id FOR UPDATE`, fromUserID, toUserID)
+		if err != nil {
+			return err
+		}
+		var senderUntil *time.Time
+		var recipientSince time.Time
+		found := 0
+		for rows.Next() {
+			var id int64
+			var until *time.Time
+			var createdAt time.Time
+			if err := rows.Scan(&id, &until, &createdAt); err != nil {
+				rows.Close()
+				return err
+			}
+			if id == fromUserID {
+				senderUntil = until
+			} else {
+				recipientSince = createdAt
+			}
+			found++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if found < 2 {
+			return ErrUserNotFound
+		}
+
+		now := repo.session.Clock().Now()
+		if senderUntil == nil || senderUntil.Sub(now) < days(n)+limits.MinRemaining {
+			return ErrInsufficientPremium
+		}
+		if limits.MinAccountAge > 0 && now.Sub(recipientSince) < limits.MinAccountAge {
+			return ErrGiftLimit
+		}
+
+		var giftsToday, daysThisMonth int
+		err = tx.QueryRow(ctx, `SELECT count(*) FILTER (WHERE created_at > $2::timestamptz - interval '1 day'),
+				COALESCE(-sum(days), 0)
+			FROM premium_ledger WHERE user_id = $1 AND kind = 'gift_debit' AND created_at > $2::timestamptz - interval '30 days'`,
+			fromUserID, now).Scan(&giftsToday, &daysThisMonth)
+		if err != nil {
+			return err
+		}
+		if limits.MaxGiftsPerDay > 0 && giftsToday >= limits.MaxGiftsPerDay {
+			return ErrGiftLimit
+		}
+		if limits.MaxDaysPerMonth > 0 && daysThisMonth+n > limits.MaxDaysPerMonth {
+			return ErrGiftLimit
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE users SET premium_until = premium_until - $2::interval WHERE id = $1", fromUserID, days(n))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE users SET premium_until = greatest(COALESCE(premium_until, now()), now()) + $2::interval
+			WHERE id = $1`, toUserID, days(n))
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `WITH transfer AS (SELECT nextval('premium_transfers') AS id),
+			debit AS (
+				INSERT INTO premium_ledger (user_id, kind, days, transfer_id, counterparty_user_id)
+				SELECT $1, 'gift_debit', -$3::int, id, $2 FROM transfer
+			), credit AS (
+				INSERT INTO premium_ledger (user_id, kind, days, transfer_id, counterparty_user_id)
+				SELECT $2, 'gift_credit', $3::int, id, $1 FROM transfer
+			)
+			SELECT id FROM transfer`, fromUserID, toUserID, n).Scan(&transferID)
+	})
+	return transferID, err
+}
+
+// Ledger returns the most recent entries of userID.
+func (repo *Repo) Ledger(ctx context.Context, userID int64, limit int) ([]Entry, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+entryColumns+` FROM premium_ledger WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Entry])
+}
@@ -0,0 +1,364 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	InvoicePending           = "pending"
+	InvoicePaid              = "paid"
+	InvoicePartiallyRefunded = "partially_refunded"
+	InvoiceRefunded          = "refunded"
+	InvoiceCancelled         = "cancelled"
+)
+
+// Refund reason codes, as reported in accounting exports.
+const (
+	ReasonCustomerRequest = "customer_request"
+	ReasonDuplicate       = "duplicate"
+	ReasonServiceIssue    = "service_issue"
+	ReasonFraud           = "fraud"
+	ReasonChargeback      = "chargeback"
+)
+
+var (
+	ErrInvoiceNotFound = errors.New("invoice not found")
+	ErrInvoiceState    = errors.New("invoice is not in a state that allows this")
+	ErrRefundTooLarge  = errors.New("refund exceeds the amount left on the invoice")
+	ErrInvalidReason   = errors.New("invalid refund reason")
+)
+
+// Invoice is a payment for premium through a provider (e.g. Telegram
+// Stars or a card processor). Amounts are in minor units of Currency.
+// Paying it books the premium in the ledger; LedgerEntryID points there.
+type Invoice struct {
+	ID               int64      `db:"id"`
+	UserID           int64      `db:"user_id"`
+	Provider         string     `db:"provider"`
+	ProviderChargeID *string    `db:"provider_charge_id"`
+	AmountMinor      int64      `db:"amount_minor"`
+	RefundedMinor    int64      `db:"refunded_minor"`
+	Currency         string     `db:"currency"`
+	PremiumDays      int        `db:"premium_days"`
+	Status           string     `db:"status"`
+	LedgerEntryID    *int64     `db:"ledger_entry_id"`
+	CreatedAt        time.Time  `db:"created_at"`
+	PaidAt           *time.Time `db:"paid_at"`
+}
+
+type Refund struct {
+	ID               int64     `db:"id"`
+	InvoiceID        int64     `db:"invoice_id"`
+	AmountMinor      int64     `db:"amount_minor"`
+	Reason           string    `db:"reason"`
+	Note             string    `db:"note"`
+	ProviderRefundID *string   `db:"provider_refund_id"`
+	RevokedDays      int       `db:"revoked_days"`
+	LedgerEntryID    *int64    `db:"ledger_entry_id"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+// MonthlyTotals are the figures of one currency in a monthly statement.
+type MonthlyTotals struct {
+	Currency      string `db:"currency"`
+	Payments      int64  `db:"payments"`
+	GrossMinor    int64  `db:"gross_minor"`
+	Refunds       int64  `db:"refunds"`
+	RefundedMinor int64  `db:"refunded_minor"`
+	NetMinor      int64  `db:"net_minor"`
+}
+
+const (
+	invoiceColumns = "id, user_id, provider, provider_charge_id, amount_minor, refunded_minor, currency, premium_days, status, " +
+		"ledger_entry_id, created_at, paid_at"
+	refundColumns = "id, invoice_id, amount_minor, reason, note, provider_refund_id, revoked_days, ledger_entry_id, created_at"
+)
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140050,
+		Name:    "create_invoices",
+		Up: `CREATE TABLE invoices (
+			id                 BIGSERIAL PRIMARY KEY,
+			user_id            BIGINT NOT NULL REFERENCES users (id),
+			provider           TEXT NOT NULL,
+			provider_charge_id TEXT,
+			amount_minor       BIGINT NOT NULL CHECK (amount_minor > 0),
+			refunded_minor     BIGINT NOT NULL DEFAULT 0,
+			currency           TEXT NOT NULL,
+			premium_days       INT NOT NULL CHECK (premium_days > 0),
+			status             TEXT NOT NULL DEFAULT 'pending'
+				CHECK (status IN ('pending', 'paid', 'partially_refunded', 'refunded', 'cancelled')),
+			ledger_entry_id    BIGINT REFERENCES premium_ledger (id),
+			created_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+			paid_at            TIMESTAMPTZ,
+			UNIQUE (provider, provider_charge_id),
+			CHECK (refunded_minor BETWEEN 0 AND amount_minor)
+		);
+		CREATE INDEX invoices_user_idx ON invoices (user_id, created_at DESC);
+		CREATE INDEX invoices_paid_idx ON invoices (paid_at) WHERE paid_at IS NOT NULL;
+		CREATE TABLE refunds (
+			id                 BIGSERIAL PRIMARY KEY,
+			invoice_id         BIGINT NOT NULL REFERENCES invoices (id),
+			amount_minor       BIGINT NOT NULL CHECK (amount_minor > 0),
+			reason             TEXT NOT NULL
+				CHECK (reason IN ('customer_request', 'duplicate', 'service_issue', 'fraud', 'chargeback')),
+			note               TEXT NOT NULL DEFAULT '',
+			provider_refund_id TEXT,
+			revoked_days       INT NOT NULL DEFAULT 0 CHECK (revoked_days >= 0),
+			ledger_entry_id    BIGINT REFERENCES premium_ledger (id),
+			created_at         TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX refunds_invoice_idx ON refunds (invoice_id);
+		CREATE INDEX refunds_created_idx ON refunds (created_at);`,
+		Down: `DROP TABLE refunds; DROP TABLE invoices;`,
+	})
+	database.RegisterModel(database.Model{Table: "invoices", Struct: Invoice{}, Indexes: []string{"invoices_user_idx", "invoices_paid_idx"}})
+	database.RegisterModel(database.Model{Table: "refunds", Struct: Refund{}, Indexes: []string{"refunds_invoice_idx", "refunds_created_idx"}})
+}
+
+// CreateInvoice records a pending payment of inv.AmountMinor for
+// inv.PremiumDays of premium.
+func (repo *Repo) CreateInvoice(ctx context.Context, inv Invoice) (*Invoice, error) {
+	if inv.PremiumDays <= 0 {
+		return nil, ErrInvalidDays
+	}
+
+	return database.QueryOne[Invoice](ctx, repo.session, `INSERT INTO invoices (user_id, provider, amount_minor, currency, premium_days)
+		VALUES ($1, $2, $3, $4, $5) RETURNING `+invoiceColumns,
+		inv.UserID, inv.Provider, inv.AmountMinor, inv.Currency, inv.PremiumDays)
+}
+
+func (repo *Repo) GetInvoice(ctx context.Context, id int64) (*Invoice, error) {
+	inv, err := database.QueryOne[Invoice](ctx, repo.session, "SELECT "+invoiceColumns+" FROM invoices WHERE id = $1", id)
+	if database.IsNotFound(err) {
+		return nil, ErrInvoiceNotFound
+	}
+	return inv, err
+}
+
+// MarkPaid settles a pending invoice with the provider's charge ID and
+// grants its premium in the same transaction. Repeating the call with
+// the same charge ID is a no-op, so provider webhooks can be retried.
+func (repo *Repo) MarkPaid(ctx context.Context, invoiceID int64, providerChargeID string) (*Invoice, error) {
+	var inv *Invoice
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT "+invoiceColumns+" FROM invoices WHERE id = $1 FOR UPDATE", invoiceID)
+		if err != nil {
+			return err
+		}
+		inv, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Invoice])
+		if err == pgx.ErrNoRows {
+			return ErrInvoiceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if inv.Status != InvoicePending {
+			if inv.ProviderChargeID != nil && *inv.ProviderChargeID == providerChargeID {
+				return nil
+			}
+			return ErrInvoiceState
+		}
+
+		entryID, err := book(ctx, tx, inv.UserID, inv.PremiumDays, KindPurchase, "invoice:"+strconv.FormatInt(inv.ID, 10))
+		if err != nil {
+			return err
+		}
+		rows, err = tx.Query(ctx, `UPDATE invoices SET status = 'paid', provider_charge_id = $2, ledger_entry_id = $3, paid_at = now()
+			WHERE id = $1 RETURNING `+invoiceColumns, invoiceID, providerChargeID, entryID)
+		if err != nil {
+			return err
+		}
+		inv, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Invoice])
+		return err
+	})
+	return inv, err
+}
+
+// CancelInvoice drops a pending invoice that was never paid.
+func (repo *Repo) CancelInvoice(ctx context.Context, invoiceID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "UPDATE invoices SET status = 'cancelled' WHERE id = $1 AND status = 'pending'", invoiceID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvoiceState
+	}
+	return nil
+}
+
+func validReason(reason string) bool {
+	switch reason {
+	case ReasonCustomerRequest, ReasonDuplicate, ReasonServiceIssue, ReasonFraud, ReasonChargeback:
+		return true
+	}
+	return false
+}
+
+// RefundInvoice records a (partial) refund of a paid invoice and revokes
+// r.RevokedDays of premium, booked in the ledger. Refunds can't exceed
+// what is left of the invoice.
+func (repo *Repo) RefundInvoice(ctx context.Context, invoiceID int64, r Refund) (*Refund, error) {
+	if !validReason(r.Reason) {
+		return nil, ErrInvalidReason
+	}
+	if r.AmountMinor <= 0 || r.RevokedDays < 0 {
+		return nil, ErrRefundTooLarge
+	}
+
+	var refund *Refund
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT "+invoiceColumns+" FROM invoices WHERE id = $1 FOR UPDATE", invoiceID)
+		if err != nil {
+			return err
+		}
+		inv, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Invoice])
+		if err == pgx.ErrNoRows {
+			return ErrInvoiceNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if inv.Status != InvoicePaid && inv.Status != InvoicePartiallyRefunded {
+			return ErrInvoiceState
+		}
+		if inv.RefundedMinor+r.AmountMinor > inv.AmountMinor {
+			return ErrRefundTooLarge
+		}
+
+		var entryID *int64
+		if r.RevokedDays > 0 {
+			id, err := book(ctx, tx, inv.UserID, -r.RevokedDays, KindRefund, "invoice:"+strconv.FormatInt(inv.ID, 10))
+			if err != nil {
+				return err
+			}
+			entryID = &id
+		}
+
+		rows, err = tx.Query(ctx, `INSERT INTO refunds (invoice_id, amount_minor, reason, note, provider_refund_id, revoked_days, ledger_entry_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+refundColumns,
+			invoiceID, r.AmountMinor, r.Reason, r.Note, r.ProviderRefundID, r.RevokedDays, entryID)
+		if err != nil {
+			return err
+		}
+		refund, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Refund])
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE invoices SET refunded_minor = refunded_minor + $2,
+				status = CASE WHEN refunded_minor + $2 = amount_minor THEN 'refunded' ELSE 'partially_refunded' END
+			WHERE id = $1`, invoiceID, r.AmountMinor)
+		return err
+	})
+	return refund, err
+}
+
+// Refunds lists the refunds of invoiceID, oldest first.
+func (repo *Repo) Refunds(ctx context.Context, invoiceID int64) ([]Refund, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+refundColumns+" FROM refunds WHERE invoice_id = $1 ORDER BY id", invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Refund])
+}
+
+// UnbookedPayments returns paid invoices whose premium is missing from the
+// ledger, either never booked or booked for a different user or amount.
+func (repo *Repo) UnbookedPayments(ctx context.Context) ([]Invoice, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+prefixed("i", invoiceColumns)+` FROM invoices i
+		LEFT JOIN premium_ledger l ON l.id = i.ledger_entry_id
+		WHERE i.paid_at IS NOT NULL
+			AND (l.id IS NULL OR l.user_id <> i.user_id OR l.days <> i.premium_days OR l.kind <> 'purchase')
+		ORDER BY i.paid_at`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Invoice])
+}
+
+// UnbookedRefunds returns refunds that revoked premium without a matching
+// ledger entry.
+func (repo *Repo) UnbookedRefunds(ctx context.Context) ([]Refund, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+prefixed("r", refundColumns)+` FROM refunds r
+		LEFT JOIN premium_ledger l ON l.id = r.ledger_entry_id
+		WHERE r.revoked_days > 0 AND (l.id IS NULL OR l.days <> -r.revoked_days OR l.kind <> 'refund')
+		ORDER BY r.created_at`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Refund])
+}
+
+// MonthlyStatement totals payments and refunds per currency for the UTC
+// calendar month containing month. Refunds count in the month they were
+// made, not the month of the payment.
+func (repo *Repo) MonthlyStatement(ctx context.Context, month time.Time) ([]MonthlyTotals, error) {
+	month = month.UTC()
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `WITH paid AS (
+			SELECT currency, count(*) AS payments, sum(amount_minor) AS gross_minor FROM invoices
+			WHERE paid_at >= $1 AND paid_at < $2 GROUP BY currency
+		), refunded AS (
+			SELECT i.currency, count(*) AS refunds, sum(r.amount_minor) AS refunded_minor
+			FROM refunds r JOIN invoices i ON i.id = r.invoice_id
+			WHERE r.created_at >= $1 AND r.created_at < $2 GROUP BY i.currency
+		)
+		SELECT currency, COALESCE(p.payments, 0) AS payments, COALESCE(p.gross_minor, 0)::bigint AS gross_minor,
+			COALESCE(f.refunds, 0) AS refunds, COALESCE(f.refunded_minor, 0)::bigint AS refunded_minor,
+			(COALESCE(p.gross_minor, 0) - COALESCE(f.refunded_minor, 0))::bigint AS net_minor
+		FROM paid p FULL JOIN refunded f USING (currency)
+		ORDER BY currency`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[MonthlyTotals])
+}
+
+// prefixed qualifies a comma separated column list with a table alias.
+func prefixed(alias, columns string) string {
+	parts := strings.Split(columns, ", ")
+	for i, part := range parts {
+		parts[i] = alias + "." + part
+	}
+	return strings.Join(parts, ", ")
+}
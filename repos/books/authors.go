@@ -0,0 +1,254 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/textnorm"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	NamePrimary       = "primary"
+	NameCyrillic      = "cyrillic"
+	NameLatin         = "latin"
+	NamePenName       = "pen_name"
+	NameMerged        = "merged"
+	authorNameColumns = "id, author_id, name, kind, search_key, latin_key, created_at"
+)
+
+var ErrSameAuthor = errors.New("cannot merge an author into itself")
+
+// AuthorName is one spelling of an author's name: the primary one, a
+// transliteration or a pen name.
+type AuthorName struct {
+	ID        int64     `db:"id"`
+	AuthorID  int64     `db:"author_id"`
+	Name      string    `db:"name"`
+	Kind      string    `db:"kind"`
+	SearchKey string    `db:"search_key"`
+	LatinKey  string    `db:"latin_key"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type AuthorMerge struct {
+	MergedID int64     `db:"merged_id"`
+	IntoID   int64     `db:"into_id"`
+	Actor    string    `db:"actor"`
+	MergedAt time.Time `db:"merged_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140006,
+		Name:    "create_author_names",
+		Up: `CREATE TABLE author_names (
+			id         BIGSERIAL PRIMARY KEY,
+			author_id  BIGINT NOT NULL REFERENCES authors (id) ON DELETE CASCADE,
+			name       TEXT NOT NULL,
+			kind       TEXT NOT NULL,
+			search_key TEXT NOT NULL,
+			latin_key  TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			UNIQUE (author_id, name)
+		);
+		CREATE INDEX author_names_search_key_idx ON author_names (search_key text_pattern_ops);
+		CREATE INDEX author_names_latin_key_idx ON author_names (latin_key text_pattern_ops);
+		CREATE TABLE author_merges (
+			merged_id BIGINT PRIMARY KEY,
+			into_id   BIGINT NOT NULL REFERENCES authors (id) ON DELETE CASCADE,
+			actor     TEXT NOT NULL,
+			merged_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`,
+		Down: `DROP TABLE author_merges; DROP TABLE author_names;`,
+	})
+	database.RegisterModel(database.Model{Table: "author_names", Struct: AuthorName{}, Indexes: []string{
+		"author_names_search_key_idx", "author_names_latin_key_idx",
+	}})
+	database.RegisterModel(database.Model{Table: "author_merges", Struct: AuthorMerge{}})
+}
+
+// AddAuthorName stores another spelling for authorID.
+func (repo *Repo) AddAuthorName(ctx context.Context, authorID int64, name, kind string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO author_names (author_id, name, kind, search_key, latin_key)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (author_id, name) DO UPDATE SET kind = EXCLUDED.kind`,
+		authorID, name, kind, SearchKey(name), textnorm.LatinKey(name))
+	return err
+}
+
+func (repo *Repo) AuthorNames(ctx context.Context, authorID int64) ([]AuthorName, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+authorNameColumns+" FROM author_names WHERE author_id = $1 ORDER BY id", authorID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[AuthorName])
+}
+
+// FindAuthors matches query against every stored spelling of every author,
+// in either script, exact matches first.
+func (repo *Repo) FindAuthors(ctx context.Context, query string, limit int) ([]Author, error) {
+	key, latin := SearchKey(query), textnorm.LatinKey(query)
+	if key == "" {
+		return nil, nil
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT a.id, a.name, a.search_key, a.created_at
+		FROM authors a
+		JOIN (
+			SELECT author_id, min(CASE WHEN search_key = $1 OR latin_key = $2 THEN 0 ELSE 1 END) AS rank
+			FROM author_names
+			WHERE search_key LIKE $1 || '%' OR latin_key LIKE $2 || '%'
+			GROUP BY author_id
+		) m ON m.author_id = a.id
+		WHERE NOT book_is_taken_down(NULL, a.id, NULL)
+		ORDER BY m.rank, a.name
+		LIMIT $3`, key, latin, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Author])
+}
+
+// ResolveAuthorID follows merges, so links to a merged author keep working.
+func (repo *Repo) ResolveAuthorID(ctx context.Context, authorID int64) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var into int64
+	err = conn.QueryRow(ctx, "SELECT into_id FROM author_merges WHERE merged_id = $1", authorID).Scan(&into)
+	if err == pgx.ErrNoRows {
+		return authorID, nil
+	}
+	return into, err
+}
+
+// MergeAuthors moves everything of mergeID (books, series, names,
+// takedowns) onto keepID, keeps mergeID's names as spellings of keepID and
+// deletes it. The merge is recorded with the acting admin.
+func (repo *Repo) MergeAuthors(ctx context.Context, keepID, mergeID int64, actor string) error {
+	if keepID == mergeID {
+		return ErrSameAuthor
+	}
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var mergedName string
+		err := tx.QueryRow(ctx, "SELECT name FROM authors WHERE id = $1 FOR UPDATE", mergeID).Scan(&mergedName)
+		if err != nil {
+			return err
+		}
+		if err := TagRevision(ctx, tx, SourceMerge, actor); err != nil {
+			return err
+		}
+
+		statements := []string{
+			"UPDATE books SET author_id = $1, updated_at = now() WHERE author_id = $2",
+			"UPDATE series SET author_id = $1 WHERE author_id = $2",
+			"UPDATE takedowns SET author_id = $1 WHERE author_id = $2",
+			`INSERT INTO author_names (author_id, name, kind, search_key, latin_key)
+				SELECT $1, name, CASE WHEN kind = 'primary' THEN 'merged' ELSE kind END, search_key, latin_key
+				FROM author_names WHERE author_id = $2
+				ON CONFLICT (author_id, name) DO NOTHING`,
+			"UPDATE author_merges SET into_id = $1 WHERE into_id = $2",
+		}
+		for _, sql := range statements {
+			if _, err := tx.Exec(ctx, sql, keepID, mergeID); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO author_names (author_id, name, kind, search_key, latin_key)
+			VALUES ($1, $2, 'merged', $3, $4) ON CONFLICT (author_id, name) DO NOTHING`,
+			keepID, mergedName, SearchKey(mergedName), textnorm.LatinKey(mergedName))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO author_merges (merged_id, into_id, actor) VALUES ($1, $2, $3)", mergeID, keepID, actor)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM authors WHERE id = $1", mergeID)
+		return err
+	})
+}
+
+// refreshAuthorNames makes sure every author has its primary name among
+// the spellings and recomputes the keys of all spellings.
+func (repo *Repo) refreshAuthorNames(ctx context.Context) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO author_names (author_id, name, kind, search_key, latin_key)
+		SELECT id, name, 'primary', '', '' FROM authors
+		ON CONFLICT (author_id, name) DO NOTHING`)
+	conn.Release()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	var cursor int64
+	for {
+		// Counted from the batch of the last attempt only, as WithTx may
+		// retry the transaction.
+		var batch []AuthorName
+		var changed int64
+		err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+			changed = 0
+			rows, err := tx.Query(ctx, "SELECT "+authorNameColumns+" FROM author_names WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE",
+				cursor, searchKeyBatchSize)
+			if err != nil {
+				return err
+			}
+			batch, err = pgx.CollectRows(rows, pgx.RowToStructByName[AuthorName])
+			if err != nil {
+				return err
+			}
+			for _, name := range batch {
+				key, latin := SearchKey(name.Name), textnorm.LatinKey(name.Name)
+				if key == name.SearchKey && latin == name.LatinKey {
+					continue
+				}
+				_, err := tx.Exec(ctx, "UPDATE author_names SET search_key = $2, latin_key = $3 WHERE id = $1", name.ID, key, latin)
+				if err != nil {
+					return err
+				}
+				changed++
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += changed
+		if len(batch) > 0 {
+			cursor = batch[len(batch)-1].ID
+		}
+		if len(batch) < searchKeyBatchSize {
+			return total, nil
+		}
+	}
+}
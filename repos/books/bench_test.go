@@ -0,0 +1,79 @@
+package books
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/RedBuld/book_bot_database/dbtest"
+)
+
+const (
+	benchQuery = "мет"
+	benchLimit = 50
+	// One title string per row plus the fixed cost of acquiring a
+	// connection and running the query.
+	inlineSearchMaxAllocs = benchLimit + 60
+)
+
+// openBenchRepo returns a repo on a dbtest session holding enough books
+// matching benchQuery to fill a page, so per-row costs show.
+func openBenchRepo(tb testing.TB) *Repo {
+	tb.Helper()
+	if os.Getenv(dbtest.DSNEnv) == "" {
+		tb.Skip(dbtest.DSNEnv + " is not set")
+	}
+	session := dbtest.Open(tb, nil)
+	repo := New(session)
+	for i := 0; i < benchLimit; i++ {
+		if _, err := repo.Create(context.Background(), Book{Title: fmt.Sprintf("Метро %d", 2033+i)}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func BenchmarkFindByTitlePrefix(b *testing.B) {
+	repo := openBenchRepo(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := repo.FindByTitlePrefix(ctx, 0, benchQuery, benchLimit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInlineSearch(b *testing.B) {
+	repo := openBenchRepo(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := repo.InlineSearch(ctx, 0, benchQuery, benchLimit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInlineSearchAllocBudget(t *testing.T) {
+	repo := openBenchRepo(t)
+	ctx := context.Background()
+	hits, err := repo.InlineSearch(ctx, 0, benchQuery, benchLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != benchLimit {
+		t.Fatalf("got %d hits, want %d", len(hits), benchLimit)
+	}
+	allocs := testing.AllocsPerRun(20, func() {
+		if _, err := repo.InlineSearch(ctx, 0, benchQuery, benchLimit); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > inlineSearchMaxAllocs {
+		t.Errorf("InlineSearch: %.0f allocs/op, budget %d", allocs, inlineSearchMaxAllocs)
+	}
+}
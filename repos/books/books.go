@@ -0,0 +1,139 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+var ErrNotFound = errors.New("book not found")
+
+type Author struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	SearchKey string    `db:"search_key"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type Series struct {
+	ID        int64     `db:"id"`
+	Title     string    `db:"title"`
+	AuthorID  *int64    `db:"author_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type Book struct {
+	ID             int64                `db:"id"`
+	Title          string               `db:"title"`
+	AuthorID       *int64               `db:"author_id"`
+	SeriesID       *int64               `db:"series_id"`
+	SeriesPosition database.Option[int] `db:"series_position"`
+	Genres         []string             `db:"genres"`
+	Language       string               `db:"language"`
+	Description    string               `db:"description"`
+	CoverURL       string               `db:"cover_url"`
+	SourceSite     string               `db:"source_site"`
+	SourceURL      string               `db:"source_url"`
+	SourceID       *string              `db:"source_id"`
+	SearchKey      string               `db:"search_key"`
+	ContentFlags   []string             `db:"content_flags"`
+	Lifecycle      string               `db:"lifecycle"`
+	LifecycleAt    time.Time            `db:"lifecycle_changed_at"`
+	Ongoing        bool                 `db:"ongoing"`
+	LastCheckedAt  *time.Time           `db:"last_checked_at"`
+	NextCheckAt    *time.Time           `db:"next_check_at"`
+	CheckInterval  time.Duration        `db:"check_interval"`
+	RecheckClaimed *time.Time           `db:"recheck_claimed_until"`
+	Metadata       Metadata             `db:"metadata"`
+	DeletedAt      *time.Time           `db:"deleted_at"`
+	CreatedAt      time.Time            `db:"created_at"`
+	UpdatedAt      time.Time            `db:"updated_at"`
+}
+
+const Columns = "id, title, author_id, series_id, series_position, genres, language, description, cover_url, source_site, source_url, source_id, search_key, content_flags, lifecycle, lifecycle_changed_at, " +
+	"ongoing, last_checked_at, next_check_at, check_interval, recheck_claimed_until, metadata, deleted_at, created_at, updated_at"
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140003,
+		Name:    "create_catalog",
+		Up: `CREATE TABLE authors (
+			id         BIGSERIAL PRIMARY KEY,
+			name       TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE series (
+			id         BIGSERIAL PRIMARY KEY,
+			title      TEXT NOT NULL,
+			author_id  BIGINT REFERENCES authors (id),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE books (
+			id              BIGSERIAL PRIMARY KEY,
+			title           TEXT NOT NULL,
+			author_id       BIGINT REFERENCES authors (id),
+			series_id       BIGINT REFERENCES series (id),
+			series_position INT,
+			genres          TEXT[] NOT NULL DEFAULT '{}',
+			language        TEXT NOT NULL DEFAULT '',
+			description     TEXT NOT NULL DEFAULT '',
+			cover_url       TEXT NOT NULL DEFAULT '',
+			source_site     TEXT NOT NULL,
+			source_url      TEXT NOT NULL UNIQUE,
+			created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX books_author_idx ON books (author_id);
+		CREATE INDEX books_series_idx ON books (series_id, series_position);
+		CREATE INDEX books_genres_idx ON books USING gin (genres);
+		CREATE INDEX books_updated_idx ON books (updated_at);`,
+		Down: `DROP TABLE books; DROP TABLE series; DROP TABLE authors;`,
+	})
+	database.RegisterModel(database.Model{Table: "authors", Struct: Author{}})
+	database.RegisterModel(database.Model{Table: "series", Struct: Series{}})
+	database.RegisterModel(database.Model{Table: "books", Struct: Book{}, Indexes: []string{
+		"books_author_idx", "books_series_idx", "books_genres_idx", "books_updated_idx", "books_source_id_idx",
+		"books_metadata_tags_idx", "books_deleted_idx",
+	}})
+}
+
+// Repo coalesces concurrent reads of the same book page, which arrive in
+// bursts after a channel post links to it.
+type Repo struct {
+	session *database.DB_Session
+	books   database.Flight[Book]
+	stats   database.Flight[Stats]
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// Get returns the book with id. Concurrent calls for the same id share one
+// query; each caller gets its own copy, but the slices in it are shared
+// and must not be modified.
+func (repo *Repo) Get(ctx context.Context, id int64) (*Book, error) {
+	book, err := repo.books.Do(ctx, strconv.FormatInt(id, 10), func(ctx context.Context) (Book, error) {
+		book, err := repo.get(ctx, id)
+		if err != nil {
+			return Book{}, err
+		}
+		return *book, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func (repo *Repo) get(ctx context.Context, id int64) (*Book, error) {
+	book, err := database.QueryOne[Book](ctx, repo.session, "SELECT "+Columns+" FROM books WHERE id = $1", id)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return book, err
+}
@@ -0,0 +1,120 @@
+package books
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+const (
+	FlagAdult    = "adult"
+	FlagViolence = "violence"
+	FlagDrugs    = "drugs"
+	FlagProfane  = "profanity"
+)
+
+// SafeModeFlags are hidden in group chats (negative Telegram IDs) that have
+// not configured a filter of their own.
+var SafeModeFlags = []string{FlagAdult, FlagViolence}
+
+// ContentFilter lists the flags hidden from a viewer. UpdatedAt is nil when
+// the viewer uses the default.
+type ContentFilter struct {
+	ViewerID     int64      `db:"viewer_id"`
+	BlockedFlags []string   `db:"blocked_flags"`
+	UpdatedAt    *time.Time `db:"updated_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140010,
+		Name:    "add_book_content_flags",
+		Up: `ALTER TABLE books ADD COLUMN content_flags TEXT[] NOT NULL DEFAULT '{}';
+		CREATE INDEX books_content_flags_idx ON books USING gin (content_flags);
+		CREATE TABLE content_filters (
+			viewer_id     BIGINT PRIMARY KEY,
+			blocked_flags TEXT[] NOT NULL,
+			updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE FUNCTION content_blocked_flags(p_viewer_id BIGINT) RETURNS TEXT[]
+		LANGUAGE sql STABLE AS $$
+			SELECT COALESCE(
+				(SELECT blocked_flags FROM content_filters WHERE viewer_id = p_viewer_id),
+				CASE WHEN p_viewer_id < 0 THEN '{adult,violence}'::TEXT[] ELSE '{}'::TEXT[] END
+			)
+		$$;`,
+		Down: `DROP FUNCTION content_blocked_flags(BIGINT); DROP TABLE content_filters; ALTER TABLE books DROP COLUMN content_flags;`,
+	})
+	database.RegisterModel(database.Model{Table: "content_filters", Struct: ContentFilter{}})
+}
+
+// AllowedFor returns the SQL condition hiding books whose flags the viewer
+// (a user, or a chat with a negative ID) filters out. $param must be bound
+// to the viewer ID; 0 disables filtering.
+func AllowedFor(alias, param string) string {
+	return "NOT (" + alias + ".content_flags && content_blocked_flags(" + param + "))"
+}
+
+func (repo *Repo) SetContentFlags(ctx context.Context, bookID int64, flags []string) error {
+	if flags == nil {
+		flags = []string{}
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "UPDATE books SET content_flags = $2, updated_at = now() WHERE id = $1", bookID, flags)
+	return err
+}
+
+// GetContentFilter returns the flags hidden for viewerID, including the
+// safe-mode default for chats.
+func (repo *Repo) GetContentFilter(ctx context.Context, viewerID int64) (*ContentFilter, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	filter := &ContentFilter{ViewerID: viewerID}
+	err = conn.QueryRow(ctx, `SELECT content_blocked_flags($1), (SELECT updated_at FROM content_filters WHERE viewer_id = $1)`,
+		viewerID).Scan(&filter.BlockedFlags, &filter.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// SetContentFilter overrides the hidden flags for a user or chat. An empty
+// list shows everything, also in chats.
+func (repo *Repo) SetContentFilter(ctx context.Context, viewerID int64, blocked []string) error {
+	if blocked == nil {
+		blocked = []string{}
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO content_filters (viewer_id, blocked_flags) VALUES ($1, $2)
+		ON CONFLICT (viewer_id) DO UPDATE SET blocked_flags = EXCLUDED.blocked_flags, updated_at = now()`, viewerID, blocked)
+	return err
+}
+
+// ResetContentFilter goes back to the default for viewerID.
+func (repo *Repo) ResetContentFilter(ctx context.Context, viewerID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM content_filters WHERE viewer_id = $1", viewerID)
+	return err
+}
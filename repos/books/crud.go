@@ -0,0 +1,249 @@
+package books
+
+import (
+	"context"
+	"errors"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrEmptyTitle = errors.New("book title is empty")
+
+// Detail is a book with its author and the files it is available in.
+type Detail struct {
+	Book
+	Author *Author
+	Files  []File
+}
+
+// Formats lists the formats the book has a file in.
+func (d *Detail) Formats() []string {
+	formats := make([]string, 0, len(d.Files))
+	for _, file := range d.Files {
+		formats = append(formats, file.Format)
+	}
+	return formats
+}
+
+// TelegramFileIDs maps each format already uploaded to Telegram to its
+// file ID, so the bot can resend it without uploading again.
+func (d *Detail) TelegramFileIDs() map[string]string {
+	ids := map[string]string{}
+	for _, file := range d.Files {
+		if file.TelegramFileID != nil {
+			ids[file.Format] = *file.TelegramFileID
+		}
+	}
+	return ids
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140053,
+		Name:    "add_books_source_id",
+		Up: `ALTER TABLE books ADD COLUMN source_id TEXT;
+		CREATE UNIQUE INDEX books_source_id_idx ON books (source_site, source_id) WHERE source_id IS NOT NULL;`,
+		Down: `DROP INDEX books_source_id_idx; ALTER TABLE books DROP COLUMN source_id;`,
+	})
+}
+
+// insertColumns are the columns callers set; the rest have defaults or
+// are kept by their own methods.
+const insertColumns = "title, author_id, series_id, series_position, genres, language, description, cover_url, source_site, source_url, source_id, search_key, description_key"
+
+func insertArgs(book *Book) []any {
+	return []any{book.Title, book.AuthorID, book.SeriesID, book.SeriesPosition, book.Genres, book.Language,
+		book.Description, book.CoverURL, book.SourceSite, book.SourceURL, book.SourceID, SearchKey(book.Title), SearchKey(book.Description)}
+}
+
+// Create inserts book and returns it as stored.
+func (repo *Repo) Create(ctx context.Context, book Book) (*Book, error) {
+	if err := BookRules.Validate(&book); err != nil {
+		return nil, err
+	}
+
+	return repo.writeBook(ctx, "INSERT INTO books ("+insertColumns+`)
+		VALUES ($1, $2, $3, $4, COALESCE($5::text[], '{}'), $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+Columns, insertArgs(&book)...)
+}
+
+// Upsert inserts book or, when its source URL is already known, updates
+// that book with the scraped fields. Workers use it after parsing a page.
+func (repo *Repo) Upsert(ctx context.Context, book Book) (*Book, error) {
+	if err := BookRules.Validate(&book); err != nil {
+		return nil, err
+	}
+
+	return repo.writeBook(ctx, "INSERT INTO books ("+insertColumns+`)
+		VALUES ($1, $2, $3, $4, COALESCE($5::text[], '{}'), $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (source_url) DO UPDATE SET title = EXCLUDED.title, author_id = EXCLUDED.author_id,
+			series_id = EXCLUDED.series_id, series_position = EXCLUDED.series_position, genres = EXCLUDED.genres,
+			language = EXCLUDED.language, description = EXCLUDED.description, cover_url = EXCLUDED.cover_url,
+			source_site = EXCLUDED.source_site, source_id = EXCLUDED.source_id, search_key = EXCLUDED.search_key,
+			description_key = EXCLUDED.description_key, updated_at = now()
+		RETURNING `+Columns, insertArgs(&book)...)
+}
+
+// Update stores the caller-set fields of book (see Create) under book.ID.
+func (repo *Repo) Update(ctx context.Context, book Book) (*Book, error) {
+	if err := BookRules.Validate(&book); err != nil {
+		return nil, err
+	}
+
+	updated, err := repo.writeBook(ctx, `UPDATE books SET title = $2, author_id = $3, series_id = $4, series_position = $5,
+			genres = COALESCE($6::text[], '{}'), language = $7, description = $8, cover_url = $9,
+			source_site = $10, source_url = $11, source_id = $12, search_key = $13, description_key = $14, updated_at = now()
+		WHERE id = $1
+		RETURNING `+Columns, append([]any{book.ID}, insertArgs(&book)...)...)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return updated, err
+}
+
+// writeBook runs the write sql returning one book in a transaction, with
+// the revision it records attributed from ctx (see WithRevisionAuthor).
+func (repo *Repo) writeBook(ctx context.Context, sql string, args ...any) (*Book, error) {
+	var book *Book
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		if err := tagRevisionFrom(ctx, tx); err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		book, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Book])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// Delete soft-deletes the book: it is hidden from users until Restore
+// brings it back, and removed with its files and external IDs by Purge or
+// once DeletedRetention passed. Attribute it with database.WithActor.
+func (repo *Repo) Delete(ctx context.Context, id int64) error {
+	err := repo.session.SoftDelete(ctx, "books", id)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// GetDetail returns the book with id together with its author and files.
+func (repo *Repo) GetDetail(ctx context.Context, id int64) (*Detail, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+" FROM books WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	book, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Book])
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	detail := &Detail{Book: book}
+
+	if book.AuthorID != nil {
+		rows, err = conn.Query(ctx, "SELECT id, name, search_key, created_at FROM authors WHERE id = $1", *book.AuthorID)
+		if err != nil {
+			return nil, err
+		}
+		detail.Author, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Author])
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	rows, err = conn.Query(ctx, "SELECT "+FileColumns+" FROM book_files WHERE book_id = $1 ORDER BY format", id)
+	if err != nil {
+		return nil, err
+	}
+	detail.Files, err = pgx.CollectRows(rows, pgx.RowToStructByName[File])
+	if err != nil {
+		return nil, err
+	}
+	return detail, nil
+}
+
+// FindBySourceURL returns the book scraped from url, or ErrNotFound.
+func (repo *Repo) FindBySourceURL(ctx context.Context, url string) (*Book, error) {
+	return repo.findOne(ctx, "source_url = $1", url)
+}
+
+// FindBySourceID returns the book with the given ID on its source site,
+// or ErrNotFound.
+func (repo *Repo) FindBySourceID(ctx context.Context, site, sourceID string) (*Book, error) {
+	return repo.findOne(ctx, "source_site = $1 AND source_id = $2", site, sourceID)
+}
+
+func (repo *Repo) findOne(ctx context.Context, where string, args ...any) (*Book, error) {
+	book, err := database.QueryOne[Book](ctx, repo.session, "SELECT "+Columns+" FROM books WHERE "+where, args...)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return book, err
+}
+
+// Sorts are the sort keys book lists accept from users: by title, by
+// when the book was added, or by downloads.
+var Sorts = database.SortColumns{
+	"title":  "books.search_key",
+	"date":   "books.created_at",
+	"rating": "COALESCE((SELECT sum(s.total) FROM book_download_stats s WHERE s.book_id = books.id), 0)",
+}
+
+// ByAuthor lists the visible books of an author ordered by sort (see
+// Sorts), newest first if it is empty.
+func (repo *Repo) ByAuthor(ctx context.Context, authorID int64, sort string, limit, offset int) ([]Book, error) {
+	orderBy, err := Sorts.OrderBy(sort, "-date", "books.id")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+" FROM books WHERE author_id = $1 AND "+Visible("books")+`
+		`+orderBy+` LIMIT $2 OFFSET $3`, authorID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Book])
+}
+
+// BySeries lists the visible books of a series in reading order.
+func (repo *Repo) BySeries(ctx context.Context, seriesID int64) ([]Book, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+" FROM books WHERE series_id = $1 AND "+Visible("books")+`
+		ORDER BY series_position NULLS LAST, id`, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Book])
+}
+
+// Each calls fn for every book, visible or not, in id order, streaming
+// them from a cursor instead of loading the table; for exports.
+func (repo *Repo) Each(ctx context.Context, fn func(book *Book) error) error {
+	return database.ForEachRow(ctx, repo.session, "SELECT "+Columns+" FROM books ORDER BY id", 0, fn)
+}
@@ -0,0 +1,67 @@
+package books
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// DeletedRetention is how long deleted books can be restored before the
+// purge_deleted_books job removes them; set it before starting RunJobs.
+var DeletedRetention = 90 * 24 * time.Hour
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140069,
+		Name:    "add_books_soft_delete",
+		Up: database.SoftDeleteSQL("books") + database.AuditTriggerSQL("books",
+			"search_key", "updated_at", "lifecycle_changed_at", "last_checked_at", "next_check_at", "check_interval", "recheck_claimed_until"),
+		Down: `DROP TRIGGER books_audit ON books; DROP INDEX books_deleted_idx; ALTER TABLE books DROP COLUMN deleted_at;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140083,
+		Name:    "ignore_books_search_vector_in_audit",
+		Up: `DROP TRIGGER books_audit ON books;` + database.AuditTriggerSQL("books",
+			"search_key", "search_vector", "updated_at", "lifecycle_changed_at", "last_checked_at", "next_check_at", "check_interval", "recheck_claimed_until"),
+		Down: `DROP TRIGGER books_audit ON books;` + database.AuditTriggerSQL("books",
+			"search_key", "updated_at", "lifecycle_changed_at", "last_checked_at", "next_check_at", "check_interval", "recheck_claimed_until"),
+	})
+	database.RegisterJob(database.Job{Name: "purge_deleted_books", Every: 24 * time.Hour, Run: func(ctx context.Context, session *database.DB_Session) (int64, error) {
+		return session.PurgeDeleted(ctx, "books", DeletedRetention)
+	}})
+}
+
+// Restore brings back a deleted book.
+func (repo *Repo) Restore(ctx context.Context, id int64) error {
+	err := repo.session.Restore(ctx, "books", id)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Purge removes a deleted book for good, with its files and external
+// IDs; books not deleted first give ErrNotFound. Its takedowns stay, with
+// their audit, for the record.
+func (repo *Repo) Purge(ctx context.Context, id int64) error {
+	err := repo.session.Purge(ctx, "books", id)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// ListDeleted returns the deleted books, most recently deleted first,
+// for moderators to restore.
+func (repo *Repo) ListDeleted(ctx context.Context, limit int) ([]Book, error) {
+	return database.QueryAll[Book](ctx, repo.session, "SELECT "+Columns+" FROM books WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id LIMIT $1", limit)
+}
+
+// AuditLog returns the last limit changes of the book, with who made
+// them, newest first; the entry deleting a book holds everything needed
+// to recreate it.
+func (repo *Repo) AuditLog(ctx context.Context, id int64, limit int) ([]database.AuditEntry, error) {
+	return repo.session.AuditLog(ctx, "books", id, limit)
+}
@@ -0,0 +1,163 @@
+package books
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// StatsWindow is the rolling window reported as Stats.Recent.
+	StatsWindow = 30
+	// StatShards is the number of rows each book's counters are split over.
+	StatShards = 8
+)
+
+// Stats are the download counters shown in a book card. They are kept
+// up to date by RecordDownload rather than aggregated on demand.
+type Stats struct {
+	BookID         int64            `db:"book_id"`
+	Total          int64            `db:"total"`
+	Recent         int64            `db:"recent"`
+	ByFormat       map[string]int64 `db:"by_format"`
+	LastDownloadAt *time.Time       `db:"last_download_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140027,
+		Name:    "create_book_download_stats",
+		Up: `CREATE TABLE book_download_stats (
+			book_id          BIGINT PRIMARY KEY REFERENCES books (id) ON DELETE CASCADE,
+			total            BIGINT NOT NULL DEFAULT 0,
+			by_format        JSONB NOT NULL DEFAULT '{}',
+			last_download_at TIMESTAMPTZ
+		);
+		CREATE TABLE book_download_daily (
+			book_id   BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			day       DATE NOT NULL,
+			downloads BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (book_id, day)
+		);`,
+		Down: `DROP TABLE book_download_daily;
+		DROP TABLE book_download_stats;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140042,
+		Name:    "shard_book_download_stats",
+		Up: `ALTER TABLE book_download_stats ADD COLUMN shard SMALLINT NOT NULL DEFAULT 0;
+		ALTER TABLE book_download_stats DROP CONSTRAINT book_download_stats_pkey;
+		ALTER TABLE book_download_stats ADD PRIMARY KEY (book_id, shard);
+		ALTER TABLE book_download_daily ADD COLUMN shard SMALLINT NOT NULL DEFAULT 0;
+		ALTER TABLE book_download_daily DROP CONSTRAINT book_download_daily_pkey;
+		ALTER TABLE book_download_daily ADD PRIMARY KEY (book_id, day, shard);`,
+		Down: `INSERT INTO book_download_daily (book_id, day, shard, downloads)
+			SELECT book_id, day, 0, sum(downloads) FROM book_download_daily GROUP BY book_id, day
+			ON CONFLICT (book_id, day, shard) DO UPDATE SET downloads = EXCLUDED.downloads;
+		DELETE FROM book_download_daily WHERE shard <> 0;
+		ALTER TABLE book_download_daily DROP CONSTRAINT book_download_daily_pkey;
+		ALTER TABLE book_download_daily ADD PRIMARY KEY (book_id, day);
+		ALTER TABLE book_download_daily DROP COLUMN shard;
+		INSERT INTO book_download_stats (book_id, shard, total, by_format, last_download_at)
+			SELECT s.book_id, 0, sum(s.total), COALESCE((
+					SELECT jsonb_object_agg(f.key, f.n) FROM (
+						SELECT e.key, sum(e.value::bigint) AS n FROM book_download_stats s2, jsonb_each_text(s2.by_format) e
+						WHERE s2.book_id = s.book_id GROUP BY e.key
+					) f
+				), '{}'), max(s.last_download_at)
+			FROM book_download_stats s GROUP BY s.book_id
+			ON CONFLICT (book_id, shard) DO UPDATE SET total = EXCLUDED.total, by_format = EXCLUDED.by_format,
+				last_download_at = EXCLUDED.last_download_at;
+		DELETE FROM book_download_stats WHERE shard <> 0;
+		ALTER TABLE book_download_stats DROP CONSTRAINT book_download_stats_pkey;
+		ALTER TABLE book_download_stats ADD PRIMARY KEY (book_id);
+		ALTER TABLE book_download_stats DROP COLUMN shard;`,
+	})
+}
+
+// RecordDownload counts one completed download of bookID in format. It is
+// called when a download task finishes.
+//
+// Counters are split over StatShards rows per book, summed on read. Each
+// connection writes to the shard picked by its backend PID, so downloads
+// of a popular book running on different connections don't queue up on
+// a single row lock.
+func (repo *Repo) RecordDownload(ctx context.Context, bookID int64, format string) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO book_download_stats AS s (book_id, shard, total, by_format, last_download_at)
+			VALUES ($1, pg_backend_pid() % $3, 1, jsonb_build_object($2::text, 1), now())
+			ON CONFLICT (book_id, shard) DO UPDATE SET total = s.total + 1,
+				by_format = s.by_format || jsonb_build_object($2::text, COALESCE((s.by_format->>$2::text)::bigint, 0) + 1),
+				last_download_at = now()`, bookID, format, StatShards)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO book_download_daily AS d (book_id, day, shard, downloads)
+			VALUES ($1, current_date, pg_backend_pid() % $2, 1)
+			ON CONFLICT (book_id, day, shard) DO UPDATE SET downloads = d.downloads + 1`, bookID, StatShards)
+		return err
+	})
+}
+
+// GetBookStats returns the download counters of bookID; a book that was
+// never downloaded gets zero counters. Like Get, concurrent calls for the
+// same book share one query.
+func (repo *Repo) GetBookStats(ctx context.Context, bookID int64) (*Stats, error) {
+	stats, err := repo.stats.Do(ctx, strconv.FormatInt(bookID, 10), func(ctx context.Context) (Stats, error) {
+		stats, err := repo.getBookStats(ctx, bookID)
+		if err != nil {
+			return Stats{}, err
+		}
+		return *stats, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	byFormat := make(map[string]int64, len(stats.ByFormat))
+	for format, n := range stats.ByFormat {
+		byFormat[format] = n
+	}
+	stats.ByFormat = byFormat
+	return &stats, nil
+}
+
+func (repo *Repo) getBookStats(ctx context.Context, bookID int64) (*Stats, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	stats := &Stats{BookID: bookID}
+	err = conn.QueryRow(ctx, `SELECT
+			COALESCE((SELECT sum(total) FROM book_download_stats WHERE book_id = $1), 0)::bigint,
+			(SELECT COALESCE(jsonb_object_agg(f.key, f.n), '{}') FROM (
+				SELECT e.key, sum(e.value::bigint) AS n FROM book_download_stats s, jsonb_each_text(s.by_format) e
+				WHERE s.book_id = $1 GROUP BY e.key
+			) f),
+			(SELECT max(last_download_at) FROM book_download_stats WHERE book_id = $1),
+			COALESCE((SELECT sum(downloads) FROM book_download_daily WHERE book_id = $1 AND day > current_date - $2::int), 0)::bigint`,
+		bookID, StatsWindow).Scan(&stats.Total, &stats.ByFormat, &stats.LastDownloadAt, &stats.Recent)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// PruneDownloadDaily drops daily counters that fell out of the window.
+func (repo *Repo) PruneDownloadDaily(ctx context.Context) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "DELETE FROM book_download_daily WHERE day <= current_date - $1::int", StatsWindow)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,214 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	SchemeISBN      = "isbn"
+	SchemeGoodreads = "goodreads"
+	SchemeLiveLib   = "livelib"
+	SchemeFantlab   = "fantlab"
+)
+
+var ErrInvalidISBN = errors.New("invalid ISBN")
+
+// ExternalIDTakenError is returned when an identifier already belongs to
+// another book, which usually means the two records are duplicates.
+type ExternalIDTakenError struct {
+	Scheme string
+	Value  string
+	BookID int64
+}
+
+func (e *ExternalIDTakenError) Error() string {
+	return fmt.Sprintf("%s %s already belongs to book %d", e.Scheme, e.Value, e.BookID)
+}
+
+type ExternalID struct {
+	BookID    int64     `db:"book_id"`
+	Scheme    string    `db:"scheme"`
+	Value     string    `db:"value"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140007,
+		Name:    "create_book_external_ids",
+		Up: `CREATE TABLE book_external_ids (
+			book_id    BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			scheme     TEXT NOT NULL,
+			value      TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (scheme, value)
+		);
+		CREATE INDEX book_external_ids_book_idx ON book_external_ids (book_id);`,
+		Down: `DROP TABLE book_external_ids;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_external_ids", Struct: ExternalID{}, Indexes: []string{"book_external_ids_book_idx"}})
+}
+
+// NormalizeExternalID brings an identifier to its canonical stored form.
+// ISBNs are validated and stored as ISBN-13 without separators, so the
+// 10- and 13-digit spellings of one book collide as they should.
+func NormalizeExternalID(scheme, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if scheme != SchemeISBN {
+		return value, nil
+	}
+
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == 'x' || r == 'X':
+			return 'X'
+		case r == '-' || r == ' ':
+			return -1
+		}
+		return '?'
+	}, value)
+
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, r := range digits {
+			var d int
+			switch {
+			case r == 'X' && i == 9:
+				d = 10
+			case r >= '0' && r <= '9':
+				d = int(r - '0')
+			default:
+				return "", ErrInvalidISBN
+			}
+			sum += d * (10 - i)
+		}
+		if sum%11 != 0 {
+			return "", ErrInvalidISBN
+		}
+		isbn := "978" + digits[:9]
+		return isbn + string(rune('0'+isbn13Check(isbn))), nil
+	case 13:
+		for _, r := range digits {
+			if r < '0' || r > '9' {
+				return "", ErrInvalidISBN
+			}
+		}
+		if int(digits[12]-'0') != isbn13Check(digits[:12]) {
+			return "", ErrInvalidISBN
+		}
+		return digits, nil
+	}
+	return "", ErrInvalidISBN
+}
+
+func isbn13Check(first12 string) int {
+	sum := 0
+	for i, r := range first12 {
+		d := int(r - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return (10 - sum%10) % 10
+}
+
+// AddExternalID attaches an identifier to bookID. Adding an identifier the
+// book already has is a no-op; one owned by another book returns an
+// *ExternalIDTakenError.
+func (repo *Repo) AddExternalID(ctx context.Context, bookID int64, scheme, value string) error {
+	value, err := NormalizeExternalID(scheme, value)
+	if err != nil {
+		return err
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var owner int64
+	err = conn.QueryRow(ctx, `WITH inserted AS (
+			INSERT INTO book_external_ids (book_id, scheme, value) VALUES ($1, $2, $3)
+			ON CONFLICT (scheme, value) DO NOTHING
+			RETURNING book_id
+		)
+		SELECT book_id FROM inserted
+		UNION ALL
+		SELECT book_id FROM book_external_ids WHERE scheme = $2 AND value = $3
+		LIMIT 1`, bookID, scheme, value).Scan(&owner)
+	if err != nil {
+		return err
+	}
+	if owner != bookID {
+		return &ExternalIDTakenError{Scheme: scheme, Value: value, BookID: owner}
+	}
+	return nil
+}
+
+func (repo *Repo) RemoveExternalID(ctx context.Context, bookID int64, scheme, value string) error {
+	value, err := NormalizeExternalID(scheme, value)
+	if err != nil {
+		return err
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM book_external_ids WHERE book_id = $1 AND scheme = $2 AND value = $3", bookID, scheme, value)
+	return err
+}
+
+func (repo *Repo) ExternalIDs(ctx context.Context, bookID int64) ([]ExternalID, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT book_id, scheme, value, created_at FROM book_external_ids
+		WHERE book_id = $1 ORDER BY scheme, value`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[ExternalID])
+}
+
+// FindByExternalID returns the book carrying the identifier, or ErrNotFound.
+func (repo *Repo) FindByExternalID(ctx context.Context, scheme, value string) (*Book, error) {
+	value, err := NormalizeExternalID(scheme, value)
+	if err != nil {
+		return nil, err
+	}
+
+	book, err := database.QueryOne[Book](ctx, repo.session, "SELECT "+prefixed("b", Columns)+` FROM books b
+		JOIN book_external_ids e ON e.book_id = b.id
+		WHERE e.scheme = $1 AND e.value = $2`, scheme, value)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return book, err
+}
+
+// prefixed qualifies a comma separated column list with a table alias.
+func prefixed(alias, columns string) string {
+	parts := strings.Split(columns, ", ")
+	for i, part := range parts {
+		parts[i] = alias + "." + part
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,94 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrFileNotFound = errors.New("book file not found")
+
+// File is a downloaded and converted book in one format, stored by the
+// file server under StorageKey and optionally already uploaded to Telegram.
+type File struct {
+	ID             int64     `db:"id"`
+	BookID         int64     `db:"book_id"`
+	Format         string    `db:"format"`
+	StorageKey     string    `db:"storage_key"`
+	SizeBytes      int64     `db:"size_bytes"`
+	TelegramFileID *string   `db:"telegram_file_id"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+const FileColumns = "id, book_id, format, storage_key, size_bytes, telegram_file_id, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140011,
+		Name:    "create_book_files",
+		Up: `CREATE TABLE book_files (
+			id               BIGSERIAL PRIMARY KEY,
+			book_id          BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			format           TEXT NOT NULL,
+			storage_key      TEXT NOT NULL,
+			size_bytes       BIGINT NOT NULL DEFAULT 0,
+			telegram_file_id TEXT,
+			created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+			UNIQUE (book_id, format)
+		);`,
+		Down: `DROP TABLE book_files;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_files", Struct: File{}})
+}
+
+// PutFile stores the file of a book in a format, replacing the previous one.
+func (repo *Repo) PutFile(ctx context.Context, file File) (*File, error) {
+	if err := FileRules.Validate(&file); err != nil {
+		return nil, err
+	}
+
+	return database.QueryOne[File](ctx, repo.session, `INSERT INTO book_files (book_id, format, storage_key, size_bytes, telegram_file_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (book_id, format) DO UPDATE SET storage_key = EXCLUDED.storage_key, size_bytes = EXCLUDED.size_bytes,
+			telegram_file_id = EXCLUDED.telegram_file_id, created_at = now()
+		RETURNING `+FileColumns, file.BookID, file.Format, file.StorageKey, file.SizeBytes, file.TelegramFileID)
+}
+
+func (repo *Repo) GetFile(ctx context.Context, id int64) (*File, error) {
+	file, err := database.QueryOne[File](ctx, repo.session, "SELECT "+FileColumns+" FROM book_files WHERE id = $1", id)
+	if database.IsNotFound(err) {
+		return nil, ErrFileNotFound
+	}
+	return file, err
+}
+
+// Files returns every stored format of bookID.
+func (repo *Repo) Files(ctx context.Context, bookID int64) ([]File, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+FileColumns+" FROM book_files WHERE book_id = $1 ORDER BY format", bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[File])
+}
+
+// SetTelegramFileID caches the Telegram file ID after the first upload so
+// the bot can resend the file without uploading it again.
+func (repo *Repo) SetTelegramFileID(ctx context.Context, id int64, telegramFileID string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "UPDATE book_files SET telegram_file_id = $2 WHERE id = $1", id, telegramFileID)
+	return err
+}
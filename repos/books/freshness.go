@@ -0,0 +1,118 @@
+package books
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Recheck intervals of ongoing books adapt to how often they are found
+// changed: halved on a change, grown by half otherwise, within these bounds.
+const (
+	MinCheckInterval = time.Hour
+	MaxCheckInterval = 14 * 24 * time.Hour
+)
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140024,
+		Name:    "add_books_freshness",
+		Up: `ALTER TABLE books ADD COLUMN ongoing BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE books ADD COLUMN last_checked_at TIMESTAMPTZ;
+		ALTER TABLE books ADD COLUMN next_check_at TIMESTAMPTZ;
+		ALTER TABLE books ADD COLUMN check_interval INTERVAL NOT NULL DEFAULT '1 day';
+		ALTER TABLE books ADD COLUMN recheck_claimed_until TIMESTAMPTZ;
+		CREATE INDEX books_next_check_idx ON books (next_check_at) WHERE ongoing;`,
+		Down: `ALTER TABLE books DROP COLUMN recheck_claimed_until, DROP COLUMN check_interval,
+			DROP COLUMN next_check_at, DROP COLUMN last_checked_at, DROP COLUMN ongoing;`,
+	})
+}
+
+// SetOngoing marks a web serial as still being published (scheduling
+// rechecks) or finished (no more rechecks).
+func (repo *Repo) SetOngoing(ctx context.Context, bookID int64, ongoing bool) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `UPDATE books SET ongoing = $2,
+		next_check_at = CASE WHEN $2 THEN COALESCE(next_check_at, now()) END
+		WHERE id = $1`, bookID, ongoing)
+	return err
+}
+
+// DueForRecheck claims up to limit ongoing books whose next check is due,
+// hiding them from other crawlers for lease; deleted and taken down books
+// aren't rechecked. The crawler reports back with RecordCheck; an
+// unreported claim simply expires.
+func (repo *Repo) DueForRecheck(ctx context.Context, limit int, lease time.Duration) ([]Book, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `UPDATE books SET recheck_claimed_until = now() + $2::interval
+		WHERE id IN (
+			SELECT id FROM books
+			WHERE ongoing AND next_check_at <= now() AND lifecycle <> 'removed'
+				AND `+database.NotDeleted("books")+` AND NOT book_is_taken_down(books.id, books.author_id, books.source_site)
+				AND (recheck_claimed_until IS NULL OR recheck_claimed_until < now())
+			ORDER BY next_check_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+Columns, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Book])
+}
+
+// RecordCheck stores the outcome of a recheck and schedules the next one,
+// sooner when the book changed and later when it didn't.
+func (repo *Repo) RecordCheck(ctx context.Context, bookID int64, changed bool) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `UPDATE books SET
+			last_checked_at = now(),
+			check_interval = interval_next,
+			next_check_at = CASE WHEN ongoing THEN now() + interval_next END,
+			recheck_claimed_until = NULL
+		FROM (
+			SELECT greatest($3::interval, least($4::interval, CASE WHEN $2 THEN check_interval / 2 ELSE check_interval * 1.5 END)) AS interval_next
+			FROM books WHERE id = $1
+		) next
+		WHERE id = $1`, bookID, changed, MinCheckInterval, MaxCheckInterval)
+	return err
+}
+
+// SetCheckInterval overrides the recheck interval, e.g. with a cadence
+// inferred from publication history.
+func (repo *Repo) SetCheckInterval(ctx context.Context, bookID int64, interval time.Duration) error {
+	if interval < MinCheckInterval {
+		interval = MinCheckInterval
+	}
+	if interval > MaxCheckInterval {
+		interval = MaxCheckInterval
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `UPDATE books SET check_interval = $2,
+		next_check_at = CASE WHEN ongoing THEN COALESCE(last_checked_at, now()) + $2::interval END
+		WHERE id = $1`, bookID, interval)
+	return err
+}
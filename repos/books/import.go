@@ -0,0 +1,22 @@
+package books
+
+import (
+	"context"
+	"strings"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+// ImportCatalog copies a scraped catalog into books with the COPY
+// protocol, filling in the search keys; see database.CopyStructs for
+// batching and progress. Source URLs must be new: a duplicate fails its
+// batch, so re-imports of known books should go through Upsert.
+func (repo *Repo) ImportCatalog(ctx context.Context, catalog []Book, opts database.CopyOptions) (int64, error) {
+	for i := range catalog {
+		catalog[i].SearchKey = SearchKey(catalog[i].Title)
+		if catalog[i].Genres == nil {
+			catalog[i].Genres = []string{}
+		}
+	}
+	return database.CopyStructs(ctx, repo.session, "books", strings.Split(insertColumns, ", "), catalog, opts)
+}
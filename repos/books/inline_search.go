@@ -0,0 +1,54 @@
+package books
+
+import (
+	"context"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// InlineHit is the slim result of an inline query: just enough to render
+// one line of the Telegram inline results list.
+type InlineHit struct {
+	ID       int64
+	Title    string
+	AuthorID int64
+}
+
+var inlineFormats = pgx.QueryResultFormats{pgx.BinaryFormatCode, pgx.TextFormatCode, pgx.BinaryFormatCode}
+
+// InlineSearch is FindByTitlePrefix for inline queries, which arrive in
+// storms on every keystroke. It scans raw values into a slice allocated
+// once, targeting one allocation per row (the title) plus a constant
+// overhead per call, compared to about a dozen per row when decoding full
+// Books.
+func (repo *Repo) InlineSearch(ctx context.Context, viewerID int64, query string, limit int) ([]InlineHit, error) {
+	key := SearchKey(query)
+	if key == "" {
+		return nil, nil
+	}
+
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id, title, author_id FROM books
+		WHERE search_key LIKE replace(replace($1, '\', '\\'), '%', '\%') || '%' AND `+Visible("books")+`
+			AND `+AllowedFor("books", "$3")+`
+		ORDER BY search_key, id LIMIT $2`, inlineFormats, key, limit, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	return database.CollectRaw(rows, limit, scanInlineHit)
+}
+
+func scanInlineHit(values [][]byte, hit *InlineHit) (err error) {
+	if hit.ID, err = database.RawInt8(values[0]); err != nil {
+		return err
+	}
+	hit.Title = string(values[1])
+	hit.AuthorID, err = database.RawInt8(values[2])
+	return err
+}
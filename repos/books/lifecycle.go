@@ -0,0 +1,160 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Lifecycle states of a catalog entry. Only available and stale entries
+// are shown to users; stale ones are still served but due for a refresh.
+const (
+	StateDiscovered = "discovered"
+	StateParsed     = "parsed"
+	StateAvailable  = "available"
+	StateStale      = "stale"
+	StateRemoved    = "removed"
+)
+
+var ErrInvalidTransition = errors.New("invalid book lifecycle transition")
+
+// transitions lists the states each state can be reached from. The same
+// rules are enforced by a trigger, so raw SQL can't bypass them either.
+var transitions = map[string][]string{
+	StateDiscovered: {StateRemoved},
+	StateParsed:     {StateDiscovered, StateStale},
+	StateAvailable:  {StateParsed, StateStale},
+	StateStale:      {StateAvailable},
+	StateRemoved:    {StateDiscovered, StateParsed, StateAvailable, StateStale},
+}
+
+type LifecycleEvent struct {
+	ID     int64     `db:"id"`
+	BookID int64     `db:"book_id"`
+	From   string    `db:"from_state"`
+	To     string    `db:"to_state"`
+	Reason string    `db:"reason"`
+	At     time.Time `db:"at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140023,
+		Name:    "add_book_lifecycle",
+		Up: `ALTER TABLE books ADD COLUMN lifecycle TEXT NOT NULL DEFAULT 'available'
+			CHECK (lifecycle IN ('discovered', 'parsed', 'available', 'stale', 'removed'));
+		ALTER TABLE books ADD COLUMN lifecycle_changed_at TIMESTAMPTZ NOT NULL DEFAULT now();
+		ALTER TABLE books ALTER COLUMN lifecycle SET DEFAULT 'discovered';
+		CREATE INDEX books_lifecycle_idx ON books (lifecycle, lifecycle_changed_at);
+		CREATE TABLE book_lifecycle_events (
+			id         BIGSERIAL PRIMARY KEY,
+			book_id    BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			from_state TEXT NOT NULL,
+			to_state   TEXT NOT NULL,
+			reason     TEXT NOT NULL DEFAULT '',
+			at         TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX book_lifecycle_events_book_idx ON book_lifecycle_events (book_id, id);
+		CREATE FUNCTION books_check_lifecycle() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF NEW.lifecycle IS DISTINCT FROM OLD.lifecycle AND NOT (
+				(NEW.lifecycle = 'parsed' AND OLD.lifecycle IN ('discovered', 'stale')) OR
+				(NEW.lifecycle = 'available' AND OLD.lifecycle IN ('parsed', 'stale')) OR
+				(NEW.lifecycle = 'stale' AND OLD.lifecycle = 'available') OR
+				(NEW.lifecycle = 'discovered' AND OLD.lifecycle = 'removed') OR
+				(NEW.lifecycle = 'removed')
+			) THEN
+				RAISE EXCEPTION 'invalid lifecycle transition % -> %', OLD.lifecycle, NEW.lifecycle
+					USING ERRCODE = 'check_violation';
+			END IF;
+			IF NEW.lifecycle IS DISTINCT FROM OLD.lifecycle THEN
+				NEW.lifecycle_changed_at := now();
+			END IF;
+			RETURN NEW;
+		END
+		$$;
+		CREATE TRIGGER books_check_lifecycle BEFORE UPDATE OF lifecycle ON books
+			FOR EACH ROW EXECUTE FUNCTION books_check_lifecycle();`,
+		Down: `DROP TRIGGER books_check_lifecycle ON books; DROP FUNCTION books_check_lifecycle();
+		DROP TABLE book_lifecycle_events; ALTER TABLE books DROP COLUMN lifecycle_changed_at; ALTER TABLE books DROP COLUMN lifecycle;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_lifecycle_events", Struct: LifecycleEvent{}, Indexes: []string{"book_lifecycle_events_book_idx"}})
+}
+
+// CanTransition reports whether a book may move from one state to another.
+func CanTransition(from, to string) bool {
+	for _, allowed := range transitions[to] {
+		if allowed == from {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves bookID to state to and records why. It returns
+// ErrInvalidTransition if the book's current state doesn't allow it.
+func (repo *Repo) Transition(ctx context.Context, bookID int64, to, reason string) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var from string
+		err := tx.QueryRow(ctx, "SELECT lifecycle FROM books WHERE id = $1 FOR UPDATE", bookID).Scan(&from)
+		if err == pgx.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if from == to {
+			return nil
+		}
+		if !CanTransition(from, to) {
+			return ErrInvalidTransition
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE books SET lifecycle = $2, updated_at = now() WHERE id = $1", bookID, to)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO book_lifecycle_events (book_id, from_state, to_state, reason) VALUES ($1, $2, $3, $4)",
+			bookID, from, to, reason)
+		return err
+	})
+}
+
+// MarkStaleOlderThan moves available books not updated for age to stale
+// and returns how many were moved.
+func (repo *Repo) MarkStaleOlderThan(ctx context.Context, age time.Duration, reason string) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `WITH moved AS (
+			UPDATE books SET lifecycle = 'stale' WHERE lifecycle = 'available' AND updated_at < now() - $1::interval
+			RETURNING id
+		)
+		INSERT INTO book_lifecycle_events (book_id, from_state, to_state, reason)
+		SELECT id, 'available', 'stale', $2 FROM moved`, age, reason)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (repo *Repo) LifecycleHistory(ctx context.Context, bookID int64) ([]LifecycleEvent, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id, book_id, from_state, to_state, reason, at FROM book_lifecycle_events
+		WHERE book_id = $1 ORDER BY id`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[LifecycleEvent])
+}
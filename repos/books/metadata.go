@@ -0,0 +1,121 @@
+package books
+
+import (
+	"context"
+	"encoding/json"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Metadata is what the site adapters know about a book beyond its
+// columns, stored in the metadata JSONB column. Unset fields are left out
+// of the JSON, so a Metadata can be applied as a patch (PatchMetadata).
+type Metadata struct {
+	Cover *Cover   `json:"cover,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// Sites holds the attributes each source site adapter keeps about the
+	// book, keyed by site, in a shape of the adapter's own; see
+	// SiteAttributes.
+	Sites map[string]json.RawMessage `json:"sites,omitempty"`
+}
+
+// Cover describes the cover image at Book.CoverURL.
+type Cover struct {
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SizeBytes   int64  `json:"size_bytes,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140065,
+		Name:    "add_books_metadata",
+		Up: `ALTER TABLE books ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+		CREATE INDEX books_metadata_tags_idx ON books USING gin ((metadata -> 'tags'));`,
+		Down: `DROP INDEX books_metadata_tags_idx; ALTER TABLE books DROP COLUMN metadata;`,
+	})
+}
+
+// Tagged returns the SQL condition for books having the tag bound to
+// $param in their metadata.
+func Tagged(alias, param string) string {
+	return alias + ".metadata -> 'tags' ? " + param
+}
+
+// GetMetadata returns the metadata of the book with id.
+func (repo *Repo) GetMetadata(ctx context.Context, id int64) (*Metadata, error) {
+	metadata, err := database.GetJSON[Metadata](ctx, repo.session, "SELECT metadata FROM books WHERE id = $1", id)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// PatchMetadata merges the set fields of patch into the metadata of the
+// book with id. Tags replace the stored list; Sites replace the
+// attributes of the sites listed, a null removing them.
+func (repo *Repo) PatchMetadata(ctx context.Context, id int64, patch Metadata) error {
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	return repo.updateMetadata(ctx, database.JSONPatch("metadata", "$2"), id, string(encoded))
+}
+
+func (repo *Repo) SetCover(ctx context.Context, id int64, cover Cover) error {
+	return repo.setMetadata(ctx, id, []string{"cover"}, cover)
+}
+
+func (repo *Repo) SetTags(ctx context.Context, id int64, tags []string) error {
+	if tags == nil {
+		tags = []string{}
+	}
+	return repo.setMetadata(ctx, id, []string{"tags"}, tags)
+}
+
+// SetSiteAttributes replaces the attributes the adapter of site keeps
+// about the book with id by attrs, encoded as JSON.
+func (repo *Repo) SetSiteAttributes(ctx context.Context, id int64, site string, attrs any) error {
+	return repo.setMetadata(ctx, id, []string{"sites", site}, attrs)
+}
+
+// SiteAttributes decodes the attributes the adapter of site keeps about
+// the book with id into a T, the zero T if there are none.
+func SiteAttributes[T any](ctx context.Context, repo *Repo, id int64, site string) (T, error) {
+	attrs, err := database.GetJSON[T](ctx, repo.session, "SELECT metadata -> 'sites' -> $2 FROM books WHERE id = $1", id, site)
+	if err == pgx.ErrNoRows {
+		return attrs, ErrNotFound
+	}
+	return attrs, err
+}
+
+func (repo *Repo) setMetadata(ctx context.Context, id int64, path []string, value any) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return repo.updateMetadata(ctx, database.JSONSet("metadata", "$2", "$3"), id, path, string(encoded))
+}
+
+func (repo *Repo) updateMetadata(ctx context.Context, expr string, id int64, args ...any) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "UPDATE books SET metadata = "+expr+", updated_at = now() WHERE id = $1", append([]any{id}, args...)...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package books
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultReindexBatchSize = 500
+
+// ReindexProgress is the persisted state of a ReindexSearch run.
+type ReindexProgress struct {
+	Name       string     `db:"name"`
+	LastBookID int64      `db:"last_book_id"`
+	Processed  int64      `db:"processed"`
+	Total      int64      `db:"total"`
+	StartedAt  time.Time  `db:"started_at"`
+	UpdatedAt  time.Time  `db:"updated_at"`
+	FinishedAt *time.Time `db:"finished_at"`
+}
+
+const reindexColumns = "name, last_book_id, processed, total, started_at, updated_at, finished_at"
+
+type ReindexOptions struct {
+	// Name identifies the run; calling again with the same name resumes it.
+	Name      string
+	BatchSize int
+	Pause     time.Duration
+	// Restart discards the cursor of a previous run with the same name.
+	Restart bool
+	OnBatch func(ReindexProgress)
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140031,
+		Name:    "create_search_reindex_runs",
+		Up: `CREATE TABLE search_reindex_runs (
+			name         TEXT PRIMARY KEY,
+			last_book_id BIGINT NOT NULL DEFAULT 0,
+			processed    BIGINT NOT NULL DEFAULT 0,
+			total        BIGINT NOT NULL DEFAULT 0,
+			started_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finished_at  TIMESTAMPTZ
+		);`,
+		Down: `DROP TABLE search_reindex_runs;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140078,
+		Name:    "touch_search_reindex_runs",
+		Up: database.TouchUpdatedAtSQL("search_reindex_runs") +
+			database.TouchUpdatedAtSQL("content_filters"),
+		Down: `DROP TRIGGER search_reindex_runs_touch_updated_at ON search_reindex_runs; DROP TRIGGER content_filters_touch_updated_at ON content_filters;`,
+	})
+	database.RegisterModel(database.Model{Table: "search_reindex_runs", Struct: ReindexProgress{}})
+}
+
+// ReindexSearch rebuilds the search vector of every book in batches
+// ordered by ID, e.g. after RebuildSearchConfiguration. Each batch is
+// committed together with its cursor, so an interrupted run resumes where
+// it stopped; Pause between batches keeps the load on the primary low.
+func (repo *Repo) ReindexSearch(ctx context.Context, opts ReindexOptions) (*ReindexProgress, error) {
+	if opts.Name == "" {
+		opts.Name = "default"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultReindexBatchSize
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Restart {
+		_, err = conn.Exec(ctx, "DELETE FROM search_reindex_runs WHERE name = $1", opts.Name)
+	}
+	if err == nil {
+		_, err = conn.Exec(ctx, `INSERT INTO search_reindex_runs (name, total) VALUES ($1, (SELECT count(*) FROM books))
+			ON CONFLICT (name) DO NOTHING`, opts.Name)
+	}
+	conn.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var progress ReindexProgress
+		var batch int64
+		err = repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, "SELECT "+reindexColumns+" FROM search_reindex_runs WHERE name = $1 FOR UPDATE", opts.Name)
+			if err != nil {
+				return err
+			}
+			progress, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[ReindexProgress])
+			if err != nil || progress.FinishedAt != nil {
+				return err
+			}
+
+			// Touching search_key fires the vector trigger, so the vector is
+			// computed exactly as on a regular write.
+			var last *int64
+			err = tx.QueryRow(ctx, `WITH batch AS (
+					UPDATE books SET search_key = search_key
+					WHERE id IN (SELECT id FROM books WHERE id > $1 ORDER BY id LIMIT $2)
+					RETURNING id
+				)
+				SELECT count(*), max(id) FROM batch`, progress.LastBookID, opts.BatchSize).Scan(&batch, &last)
+			if err != nil {
+				return err
+			}
+			if batch == 0 {
+				return tx.QueryRow(ctx, `UPDATE search_reindex_runs SET finished_at = now(), updated_at = now() WHERE name = $1
+					RETURNING finished_at`, opts.Name).Scan(&progress.FinishedAt)
+			}
+
+			progress.LastBookID = *last
+			progress.Processed += batch
+			_, err = tx.Exec(ctx, "UPDATE search_reindex_runs SET last_book_id = $2, processed = $3, updated_at = now() WHERE name = $1",
+				opts.Name, progress.LastBookID, progress.Processed)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if progress.FinishedAt != nil {
+			return &progress, nil
+		}
+		if opts.OnBatch != nil {
+			opts.OnBatch(progress)
+		}
+
+		if opts.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return &progress, ctx.Err()
+			case <-repo.session.Clock().After(opts.Pause):
+			}
+		}
+	}
+}
+
+// ReindexStatus returns the state of a ReindexSearch run.
+func (repo *Repo) ReindexStatus(ctx context.Context, name string) (*ReindexProgress, error) {
+	progress, err := database.QueryOne[ReindexProgress](ctx, repo.session, "SELECT "+reindexColumns+" FROM search_reindex_runs WHERE name = $1", name)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return progress, err
+}
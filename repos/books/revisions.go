@@ -0,0 +1,235 @@
+package books
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// SourceRevert attributes the revisions written by RevertToRevision.
+	SourceRevert = "revert"
+	// SourceMerge attributes author changes made by MergeAuthors.
+	SourceMerge = "merge"
+)
+
+var ErrUnknownRevision = errors.New("unknown book revision")
+
+// revisionColumns are the metadata columns book_revisions tracks. The
+// scheduling and lifecycle columns change on their own and aren't
+// history.
+var revisionColumns = []string{
+	"title", "author_id", "series_id", "series_position", "genres", "language",
+	"description", "cover_url", "source_site", "source_url", "source_id",
+}
+
+// Revision is one change of a book's metadata: the old and new value of
+// every column it changed, as JSON, and who made it. The first revision
+// of a book created after revisions were introduced holds its initial
+// values with null old values.
+type Revision struct {
+	ID        int64                  `db:"id"`
+	BookID    int64                  `db:"book_id"`
+	Changes   map[string]FieldChange `db:"changes"`
+	Source    string                 `db:"source"`
+	Actor     string                 `db:"actor"`
+	CreatedAt time.Time              `db:"created_at"`
+}
+
+type FieldChange struct {
+	Old json.RawMessage `json:"old"`
+	New json.RawMessage `json:"new"`
+}
+
+const revisionSelect = "SELECT id, book_id, changes, source, actor, created_at FROM book_revisions"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140057,
+		Name:    "create_book_revisions",
+		Up: `CREATE TABLE book_revisions (
+			id         BIGSERIAL PRIMARY KEY,
+			book_id    BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			changes    JSONB NOT NULL,
+			source     TEXT NOT NULL,
+			actor      TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX book_revisions_book_idx ON book_revisions (book_id, id);
+		CREATE FUNCTION book_revisions_record() RETURNS trigger LANGUAGE plpgsql AS $$
+		DECLARE
+			old_row JSONB := CASE WHEN TG_OP = 'UPDATE' THEN to_jsonb(OLD) END;
+			new_row JSONB := to_jsonb(NEW);
+			changes JSONB := '{}';
+			col     TEXT;
+		BEGIN
+			FOREACH col IN ARRAY TG_ARGV LOOP
+				IF old_row -> col IS DISTINCT FROM new_row -> col THEN
+					changes := changes || jsonb_build_object(col, jsonb_build_object('old', old_row -> col, 'new', new_row -> col));
+				END IF;
+			END LOOP;
+			IF changes <> '{}' THEN
+				INSERT INTO book_revisions (book_id, changes, source, actor) VALUES (NEW.id, changes,
+					COALESCE(NULLIF(current_setting('book_bot.revision_source', true), ''), 'unknown'),
+					COALESCE(current_setting('book_bot.revision_actor', true), ''));
+			END IF;
+			RETURN NULL;
+		END $$;
+		CREATE TRIGGER book_revisions AFTER INSERT OR UPDATE OF ` + strings.Join(revisionColumns, ", ") + ` ON books
+			FOR EACH ROW EXECUTE FUNCTION book_revisions_record('` + strings.Join(revisionColumns, "', '") + `');`,
+		Down: `DROP TRIGGER book_revisions ON books;
+		DROP FUNCTION book_revisions_record();
+		DROP TABLE book_revisions;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_revisions", Struct: Revision{}, Indexes: []string{"book_revisions_book_idx"}})
+}
+
+type revisionAuthorKey struct{}
+
+type revisionAuthor struct{ source, actor string }
+
+// WithRevisionAuthor attributes the revisions written by Create, Upsert
+// and Update under ctx to source (e.g. the scraper or enrichment provider)
+// and actor (e.g. the worker or admin). Unattributed changes are recorded
+// with source "unknown".
+func WithRevisionAuthor(ctx context.Context, source, actor string) context.Context {
+	return context.WithValue(ctx, revisionAuthorKey{}, revisionAuthor{source: source, actor: actor})
+}
+
+// TagRevision attributes the book changes made later in tx to source and
+// actor, for writers that update books in their own transactions. The
+// audit_log entries of the changes name actor too.
+func TagRevision(ctx context.Context, tx pgx.Tx, source, actor string) error {
+	_, err := tx.Exec(ctx, `SELECT set_config('book_bot.revision_source', $1, true), set_config('book_bot.revision_actor', $2, true),
+		set_config('book_bot.audit_actor', $2, true)`, source, actor)
+	return err
+}
+
+func tagRevisionFrom(ctx context.Context, tx pgx.Tx) error {
+	author, ok := ctx.Value(revisionAuthorKey{}).(revisionAuthor)
+	if !ok {
+		return nil
+	}
+	return TagRevision(ctx, tx, author.source, author.actor)
+}
+
+// GetRevisionHistory returns the revisions of bookID, newest first.
+func (repo *Repo) GetRevisionHistory(ctx context.Context, bookID int64) ([]Revision, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, revisionSelect+" WHERE book_id = $1 ORDER BY id DESC", bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Revision])
+}
+
+// RevertToRevision puts the metadata of bookID back to how it was right
+// after revisionID, undoing every later change, e.g. a run of bad
+// enrichment. The revert is itself a revision, attributed to actor, so it
+// can be undone the same way.
+func (repo *Repo) RevertToRevision(ctx context.Context, bookID, revisionID int64, actor string) (*Book, error) {
+	var book *Book
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var owner int64
+		err := tx.QueryRow(ctx, "SELECT book_id FROM book_revisions WHERE id = $1", revisionID).Scan(&owner)
+		if err == pgx.ErrNoRows || (err == nil && owner != bookID) {
+			return ErrUnknownRevision
+		}
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx, "SELECT "+Columns+" FROM books WHERE id = $1 FOR UPDATE", bookID)
+		if err != nil {
+			return err
+		}
+		book, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Book])
+		if err != nil {
+			return err
+		}
+
+		rows, err = tx.Query(ctx, revisionSelect+" WHERE book_id = $1 AND id > $2 ORDER BY id", bookID, revisionID)
+		if err != nil {
+			return err
+		}
+		later, err := pgx.CollectRows(rows, pgx.RowToStructByName[Revision])
+		if err != nil || len(later) == 0 {
+			return err
+		}
+
+		// The value a column had after revisionID is the old value of
+		// the first later revision that changed it.
+		state := map[string]json.RawMessage{}
+		for _, revision := range later {
+			for column, change := range revision.Changes {
+				if _, seen := state[column]; !seen {
+					state[column] = change.Old
+				}
+			}
+		}
+		set, args := revertAssignments(state)
+		if len(set) == 0 {
+			return nil
+		}
+
+		if err := TagRevision(ctx, tx, SourceRevert, actor); err != nil {
+			return err
+		}
+		values, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		args = append([]any{bookID, values}, args...)
+		rows, err = tx.Query(ctx, "UPDATE books SET "+strings.Join(set, ", ")+`, updated_at = now()
+			FROM jsonb_populate_record(NULL::books, $2) r WHERE books.id = $1
+			RETURNING `+qualifiedColumns, args...)
+		if err != nil {
+			return err
+		}
+		book, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Book])
+		return err
+	})
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// revertAssignments builds the SET list restoring the tracked columns of
+// state from the jsonb_populate_record row r. A restored title or
+// description also restores its search key, which is computed in Go; the
+// key arguments follow the book ID and the record, $1 and $2.
+func revertAssignments(state map[string]json.RawMessage) ([]string, []any) {
+	var set []string
+	var args []any
+	for _, column := range revisionColumns {
+		value, ok := state[column]
+		if !ok {
+			continue
+		}
+		set = append(set, column+" = r."+column)
+		key := map[string]string{"title": "search_key", "description": "description_key"}[column]
+		if key == "" {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(value, &text); err == nil {
+			args = append(args, SearchKey(text))
+			set = append(set, key+" = $"+strconv.Itoa(len(args)+2))
+		}
+	}
+	return set, args
+}
@@ -0,0 +1,177 @@
+package books
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/RedBuld/book_bot_database/textnorm"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+var ErrBadCursor = errors.New("malformed search cursor")
+
+// SearchFilters narrow SearchBooks; zero fields don't filter. ViewerID
+// applies the viewer's content filters (see AllowedFor).
+type SearchFilters struct {
+	Language string
+	Genres   []string
+	AuthorID int64
+	Site     string
+	ViewerID int64
+}
+
+// SearchHit is a matching book with its rank; higher ranks match better.
+type SearchHit struct {
+	Book
+	Rank float32 `db:"rank"`
+}
+
+// SearchPage is one page of results. Total counts every match for offset
+// pages and is -1 for cursor pages, which skip the count. NextCursor, if
+// not empty, continues after the last hit and is cheaper than deep
+// offsets.
+type SearchPage struct {
+	Hits       []SearchHit
+	Total      int
+	Page       int
+	PageSize   int
+	NextCursor string
+}
+
+// SearchBooks runs a full-text search over titles and descriptions,
+// using the search_vector column kept by the books_search_vector trigger
+// and its GIN index, so unlike a LIKE scan it stays fast on the whole
+// catalog. query accepts web search syntax ("quoted phrases", -excluded
+// words, or) and is rewritten with the search synonyms first. Titles rank
+// above descriptions, and books users downloaded from searches with the
+// same words above the others. page starts at 1.
+func (repo *Repo) SearchBooks(ctx context.Context, query string, filters SearchFilters, page, pageSize int) (*SearchPage, error) {
+	if page < 1 {
+		page = 1
+	}
+	pageSize = searchPageSize(pageSize)
+	return repo.search(ctx, query, filters, "", (page-1)*pageSize, page, pageSize)
+}
+
+// SearchBooksAfter returns the page following cursor, a NextCursor of an
+// earlier page for the same query and filters.
+func (repo *Repo) SearchBooksAfter(ctx context.Context, query string, filters SearchFilters, cursor string, pageSize int) (*SearchPage, error) {
+	return repo.search(ctx, query, filters, cursor, 0, 0, searchPageSize(pageSize))
+}
+
+func searchPageSize(size int) int {
+	if size <= 0 {
+		return defaultSearchPageSize
+	}
+	if size > maxSearchPageSize {
+		return maxSearchPageSize
+	}
+	return size
+}
+
+func (repo *Repo) search(ctx context.Context, query string, filters SearchFilters, cursor string, offset, page, pageSize int) (*SearchPage, error) {
+	key := SearchKey(query)
+	if key == "" {
+		return nil, ErrEmptyTerm
+	}
+
+	// websearch_to_tsquery needs the quotes, dashes and "or" that SearchKey
+	// folds away, so it gets the query only lowercased and yo-folded.
+	args := []any{textnorm.FoldYo(textnorm.Lowercase(query)), filters.ViewerID, strings.Fields(key)}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := []string{"books.search_vector @@ q.query", Visible("books"), AllowedFor("books", "$2")}
+	if filters.Language != "" {
+		where = append(where, "books.language = "+arg(filters.Language))
+	}
+	if len(filters.Genres) > 0 {
+		where = append(where, "books.genres && "+arg(filters.Genres)+"::text[]")
+	}
+	if filters.AuthorID != 0 {
+		where = append(where, "books.author_id = "+arg(filters.AuthorID))
+	}
+	if filters.Site != "" {
+		where = append(where, "books.source_site = "+arg(filters.Site))
+	}
+	// Books downloaded from earlier searches with the same words rank higher
+	// by their search_boosts; the boost is part of the rank, so the cursor
+	// stays consistent.
+	const rank = `(ts_rank_cd(books.search_vector, q.query) * COALESCE((SELECT exp(sum(ln(sb.boost))) FROM search_boosts sb
+		WHERE sb.book_id = books.id AND sb.term = ANY($3::text[])), 1))::real`
+	from := `FROM books, websearch_to_tsquery('` + SearchConfig + `', search_rewrite($1)) AS q(query)
+		WHERE ` + strings.Join(where, " AND ")
+
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	result := &SearchPage{Page: page, PageSize: pageSize, Total: -1}
+	filter := from
+	if cursor != "" {
+		afterRank, afterID, err := decodeSearchCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter += " AND (" + rank + ", books.id) < (" + arg(afterRank) + "::real, " + arg(afterID) + "::bigint)"
+	} else if err := conn.QueryRow(ctx, "SELECT count(*) "+from, args...).Scan(&result.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, "SELECT "+qualifiedColumns+", "+rank+" AS rank "+filter+`
+		ORDER BY rank DESC, books.id DESC LIMIT `+arg(pageSize+1)+" OFFSET "+arg(offset), args...)
+	if err != nil {
+		return nil, err
+	}
+	result.Hits, err = pgx.CollectRows(rows, pgx.RowToStructByName[SearchHit])
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Hits) > pageSize {
+		result.Hits = result.Hits[:pageSize]
+		last := result.Hits[pageSize-1]
+		result.NextCursor = encodeSearchCursor(last.Rank, last.ID)
+	}
+	return result, nil
+}
+
+// qualifiedColumns is Columns prefixed with the books table, as the
+// search joins the query.
+var qualifiedColumns = "books." + strings.ReplaceAll(Columns, ", ", ", books.")
+
+func encodeSearchCursor(rank float32, id int64) string {
+	raw := strconv.FormatFloat(float64(rank), 'g', -1, 32) + ":" + strconv.FormatInt(id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSearchCursor(cursor string) (float32, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, ErrBadCursor
+	}
+	rankText, idText, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, 0, ErrBadCursor
+	}
+	rank, err := strconv.ParseFloat(rankText, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", ErrBadCursor, err)
+	}
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", ErrBadCursor, err)
+	}
+	return float32(rank), id, nil
+}
@@ -0,0 +1,249 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// SearchConfig is the text search configuration book vectors and queries
+// are built with. Synonyms and stopwords are applied by search_rewrite
+// before the text reaches it.
+const SearchConfig = "book_search"
+
+var ErrEmptyTerm = errors.New("search term is empty after normalization")
+
+type Synonym struct {
+	Phrase    string `db:"phrase"`
+	Canonical string `db:"canonical"`
+}
+
+func init() {
+	// search_boosts is written by repos/searchlog from the downloads of
+	// search results; it lives here as SearchBooks ranks with it.
+	database.RegisterMigration(database.Migration{
+		Version: 202610140029,
+		Name:    "create_search_boosts",
+		Up: `CREATE TABLE search_boosts (
+			term       TEXT NOT NULL,
+			book_id    BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			downloads  BIGINT NOT NULL DEFAULT 0,
+			boost      DOUBLE PRECISION NOT NULL DEFAULT 1,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (term, book_id)
+		);`,
+		Down: `DROP TABLE search_boosts;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140030,
+		Name:    "create_search_configuration",
+		Up: `CREATE TABLE search_synonyms (
+			phrase    TEXT PRIMARY KEY,
+			canonical TEXT NOT NULL
+		);
+		CREATE TABLE search_stopwords (
+			word TEXT PRIMARY KEY
+		);
+		CREATE TEXT SEARCH CONFIGURATION book_search (COPY = simple);
+		CREATE FUNCTION search_rewrite(s TEXT) RETURNS TEXT LANGUAGE sql IMMUTABLE AS $$ SELECT s $$;
+		ALTER TABLE books ADD COLUMN search_vector TSVECTOR;
+		CREATE FUNCTION books_search_vector() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			NEW.search_vector := setweight(to_tsvector('book_search', search_rewrite(NEW.search_key)), 'A') ||
+				setweight(to_tsvector('book_search', search_rewrite(lower(NEW.description))), 'B');
+			RETURN NEW;
+		END $$;
+		CREATE TRIGGER books_search_vector BEFORE INSERT OR UPDATE OF search_key, description ON books
+			FOR EACH ROW EXECUTE FUNCTION books_search_vector();
+		CREATE INDEX books_search_vector_idx ON books USING gin (search_vector);`,
+		Down: `DROP INDEX books_search_vector_idx;
+		DROP TRIGGER books_search_vector ON books;
+		DROP FUNCTION books_search_vector();
+		ALTER TABLE books DROP COLUMN search_vector;
+		DROP FUNCTION search_rewrite(TEXT);
+		DROP TEXT SEARCH CONFIGURATION book_search;
+		DROP TABLE search_stopwords;
+		DROP TABLE search_synonyms;`,
+	})
+	// The description is indexed from description_key, normalized in Go
+	// like search_key so both sides of a match go through the same
+	// pipeline. It starts as the lowercased description; RefreshSearchKeys
+	// normalizes it.
+	database.RegisterMigration(database.Migration{
+		Version: 202610140085,
+		Name:    "add_books_description_key",
+		Up: `DROP TRIGGER books_audit ON books;` + database.AuditTriggerSQL("books",
+			"search_key", "description_key", "search_vector", "updated_at", "lifecycle_changed_at", "last_checked_at", "next_check_at", "check_interval", "recheck_claimed_until") + `
+		ALTER TABLE books ADD COLUMN description_key TEXT NOT NULL DEFAULT '';
+		CREATE OR REPLACE FUNCTION books_search_vector() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			NEW.search_vector := setweight(to_tsvector('book_search', search_rewrite(NEW.search_key)), 'A') ||
+				setweight(to_tsvector('book_search', search_rewrite(NEW.description_key)), 'B');
+			RETURN NEW;
+		END $$;
+		DROP TRIGGER books_search_vector ON books;
+		CREATE TRIGGER books_search_vector BEFORE INSERT OR UPDATE OF search_key, description_key ON books
+			FOR EACH ROW EXECUTE FUNCTION books_search_vector();
+		UPDATE books SET description_key = lower(description);`,
+		Down: `DROP TRIGGER books_search_vector ON books;
+		CREATE OR REPLACE FUNCTION books_search_vector() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			NEW.search_vector := setweight(to_tsvector('book_search', search_rewrite(NEW.search_key)), 'A') ||
+				setweight(to_tsvector('book_search', search_rewrite(lower(NEW.description))), 'B');
+			RETURN NEW;
+		END $$;
+		CREATE TRIGGER books_search_vector BEFORE INSERT OR UPDATE OF search_key, description ON books
+			FOR EACH ROW EXECUTE FUNCTION books_search_vector();
+		ALTER TABLE books DROP COLUMN description_key;
+		DROP TRIGGER books_audit ON books;` + database.AuditTriggerSQL("books",
+			"search_key", "search_vector", "updated_at", "lifecycle_changed_at", "last_checked_at", "next_check_at", "check_interval", "recheck_claimed_until"),
+	})
+	database.RegisterModel(database.Model{Table: "search_synonyms", Struct: Synonym{}})
+}
+
+// AddSynonym makes phrase match like canonical, e.g. "книга 1" and
+// "part one" as "том 1". It takes effect after RebuildSearchConfiguration.
+func (repo *Repo) AddSynonym(ctx context.Context, phrase, canonical string) error {
+	phrase, canonical = SearchKey(phrase), SearchKey(canonical)
+	if phrase == "" || canonical == "" {
+		return ErrEmptyTerm
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO search_synonyms (phrase, canonical) VALUES ($1, $2)
+		ON CONFLICT (phrase) DO UPDATE SET canonical = EXCLUDED.canonical`, phrase, canonical)
+	return err
+}
+
+func (repo *Repo) RemoveSynonym(ctx context.Context, phrase string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM search_synonyms WHERE phrase = $1", SearchKey(phrase))
+	return err
+}
+
+func (repo *Repo) Synonyms(ctx context.Context) ([]Synonym, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT phrase, canonical FROM search_synonyms ORDER BY phrase")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Synonym])
+}
+
+// AddStopword drops word from indexed text and queries. It takes effect
+// after RebuildSearchConfiguration.
+func (repo *Repo) AddStopword(ctx context.Context, word string) error {
+	word = SearchKey(word)
+	if word == "" {
+		return ErrEmptyTerm
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "INSERT INTO search_stopwords (word) VALUES ($1) ON CONFLICT DO NOTHING", word)
+	return err
+}
+
+func (repo *Repo) RemoveStopword(ctx context.Context, word string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM search_stopwords WHERE word = $1", SearchKey(word))
+	return err
+}
+
+func (repo *Repo) Stopwords(ctx context.Context) ([]string, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT word FROM search_stopwords ORDER BY word")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// RebuildSearchConfiguration regenerates search_rewrite from the synonym
+// and stopword tables. The function has to stay IMMUTABLE to be usable in
+// the vector trigger, so the dictionaries are compiled into its body
+// instead of being looked up. Stored vectors keep the old rules until
+// ReindexSearch runs.
+func (repo *Repo) RebuildSearchConfiguration(ctx context.Context) error {
+	synonyms, err := repo.Synonyms(ctx)
+	if err != nil {
+		return err
+	}
+	stopwords, err := repo.Stopwords(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Longer phrases first, so "книга первая" wins over "книга".
+	sort.SliceStable(synonyms, func(i, j int) bool { return len(synonyms[i].Phrase) > len(synonyms[j].Phrase) })
+
+	expr := "s"
+	for _, synonym := range synonyms {
+		expr = "regexp_replace(" + expr + ", " + sqlLiteral(`\m`+regexpQuote(synonym.Phrase)+`\M`) + ", " +
+			sqlLiteral(strings.ReplaceAll(synonym.Canonical, `\`, `\\`)) + ", 'g')"
+	}
+	if len(stopwords) > 0 {
+		quoted := make([]string, len(stopwords))
+		for i, word := range stopwords {
+			quoted[i] = regexpQuote(word)
+		}
+		expr = "regexp_replace(" + expr + ", " + sqlLiteral(`\m(`+strings.Join(quoted, "|")+`)\M`) + ", ' ', 'g')"
+	}
+
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "CREATE OR REPLACE FUNCTION search_rewrite(s TEXT) RETURNS TEXT LANGUAGE sql IMMUTABLE AS "+
+			sqlLiteral("SELECT "+expr))
+		if err == nil {
+			repo.session.Logger().Log(database.LevelInfo, "DB search configuration rebuilt", database.F("synonyms", len(synonyms)), database.F("stopwords", len(stopwords)))
+		}
+		return err
+	})
+}
+
+func sqlLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func regexpQuote(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\.^$|?*+()[]{}`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
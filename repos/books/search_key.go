@@ -0,0 +1,124 @@
+package books
+
+import (
+	"context"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/textnorm"
+	"github.com/jackc/pgx/v5"
+)
+
+const searchKeyBatchSize = 1000
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140005,
+		Name:    "add_books_search_key",
+		Up: `ALTER TABLE books ADD COLUMN search_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE authors ADD COLUMN search_key TEXT NOT NULL DEFAULT '';
+		CREATE INDEX books_search_key_idx ON books (search_key text_pattern_ops);
+		CREATE INDEX authors_search_key_idx ON authors (search_key text_pattern_ops);`,
+		Down: `ALTER TABLE books DROP COLUMN search_key; ALTER TABLE authors DROP COLUMN search_key;`,
+	})
+}
+
+// SearchKey returns the normalized key stored for a title or name. Queries
+// must go through the same function before matching against it.
+func SearchKey(s string) string {
+	return textnorm.Normalize(s)
+}
+
+// FindByTitlePrefix returns books whose normalized title starts with the
+// normalized query, hiding content filtered out for viewerID.
+func (repo *Repo) FindByTitlePrefix(ctx context.Context, viewerID int64, query string, limit int) ([]Book, error) {
+	key := SearchKey(query)
+	if key == "" {
+		return nil, nil
+	}
+
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+` FROM books
+		WHERE search_key LIKE replace(replace($1, '\', '\\'), '%', '\%') || '%' AND `+Visible("books")+`
+			AND `+AllowedFor("books", "$3")+`
+		ORDER BY search_key, id LIMIT $2`, key, limit, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Book])
+}
+
+// RefreshSearchKeys recomputes the stored keys of every book title and
+// description, author and author spelling in batches; run it after
+// changing the normalization pipeline.
+func (repo *Repo) RefreshSearchKeys(ctx context.Context) (int64, error) {
+	var total int64
+	for _, table := range []struct{ name, source, key string }{
+		{"books", "title", "search_key"}, {"books", "description", "description_key"}, {"authors", "name", "search_key"},
+	} {
+		var cursor int64
+		for {
+			// Set from the batch of the last attempt only, as WithTx may
+			// retry the transaction.
+			var updated int
+			var last, changed int64
+			err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+				last, changed = cursor, 0
+				rows, err := tx.Query(ctx, "SELECT id, "+table.source+", "+table.key+" FROM "+table.name+
+					" WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE", cursor, searchKeyBatchSize)
+				if err != nil {
+					return err
+				}
+				type keyRow struct {
+					id       int64
+					source   string
+					key      string
+					computed string
+				}
+				var batch []keyRow
+				for rows.Next() {
+					var row keyRow
+					if err := rows.Scan(&row.id, &row.source, &row.key); err != nil {
+						rows.Close()
+						return err
+					}
+					row.computed = SearchKey(row.source)
+					batch = append(batch, row)
+				}
+				rows.Close()
+				if err := rows.Err(); err != nil {
+					return err
+				}
+
+				for _, row := range batch {
+					last = row.id
+					if row.key == row.computed {
+						continue
+					}
+					_, err := tx.Exec(ctx, "UPDATE "+table.name+" SET "+table.key+" = $2 WHERE id = $1", row.id, row.computed)
+					if err != nil {
+						return err
+					}
+					changed++
+				}
+				updated = len(batch)
+				return nil
+			})
+			if err != nil {
+				return total, err
+			}
+			total += changed
+			cursor = last
+			if updated < searchKeyBatchSize {
+				break
+			}
+		}
+	}
+
+	names, err := repo.refreshAuthorNames(ctx)
+	return total + names, err
+}
@@ -0,0 +1,236 @@
+package books
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	TakedownBook   = "book"
+	TakedownAuthor = "author"
+	TakedownSite   = "site"
+
+	takedownColumns = "id, kind, book_id, author_id, site, reason, reference, effective_from, lifted_at, added_by, created_at"
+)
+
+var (
+	ErrTakenDown       = errors.New("content is unavailable due to a takedown")
+	ErrInvalidTakedown = errors.New("takedown needs exactly the target matching its kind")
+)
+
+// Takedown excludes a book, every book of an author or every book from a
+// site from search and downloads, starting at EffectiveFrom. The record
+// outlives its target: once the book or author is deleted, BookID or
+// AuthorID is nil while the takedown and its audit stay.
+type Takedown struct {
+	ID            int64      `db:"id"`
+	Kind          string     `db:"kind"`
+	BookID        *int64     `db:"book_id"`
+	AuthorID      *int64     `db:"author_id"`
+	Site          *string    `db:"site"`
+	Reason        string     `db:"reason"`
+	Reference     string     `db:"reference"`
+	EffectiveFrom time.Time  `db:"effective_from"`
+	LiftedAt      *time.Time `db:"lifted_at"`
+	AddedBy       string     `db:"added_by"`
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+type TakedownAudit struct {
+	ID         int64     `db:"id"`
+	TakedownID int64     `db:"takedown_id"`
+	Action     string    `db:"action"`
+	Actor      string    `db:"actor"`
+	Note       string    `db:"note"`
+	At         time.Time `db:"at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140009,
+		Name:    "create_takedowns",
+		Up: `CREATE TABLE takedowns (
+			id             BIGSERIAL PRIMARY KEY,
+			kind           TEXT NOT NULL CHECK (kind IN ('book', 'author', 'site')),
+			book_id        BIGINT REFERENCES books (id) ON DELETE CASCADE,
+			author_id      BIGINT REFERENCES authors (id) ON DELETE CASCADE,
+			site           TEXT,
+			reason         TEXT NOT NULL,
+			reference      TEXT NOT NULL DEFAULT '',
+			effective_from TIMESTAMPTZ NOT NULL DEFAULT now(),
+			lifted_at      TIMESTAMPTZ,
+			added_by       TEXT NOT NULL,
+			created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX takedowns_book_idx ON takedowns (book_id) WHERE lifted_at IS NULL;
+		CREATE INDEX takedowns_author_idx ON takedowns (author_id) WHERE lifted_at IS NULL;
+		CREATE INDEX takedowns_site_idx ON takedowns (site) WHERE lifted_at IS NULL;
+		CREATE TABLE takedown_audit (
+			id          BIGSERIAL PRIMARY KEY,
+			takedown_id BIGINT NOT NULL REFERENCES takedowns (id),
+			action      TEXT NOT NULL,
+			actor       TEXT NOT NULL,
+			note        TEXT NOT NULL DEFAULT '',
+			at          TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE FUNCTION book_is_taken_down(p_book_id BIGINT, p_author_id BIGINT, p_site TEXT) RETURNS BOOLEAN
+		LANGUAGE sql STABLE AS $$
+			SELECT EXISTS (
+				SELECT 1 FROM takedowns t
+				WHERE t.lifted_at IS NULL AND t.effective_from <= now()
+					AND ((t.kind = 'book' AND t.book_id = p_book_id)
+						OR (t.kind = 'author' AND t.author_id = p_author_id)
+						OR (t.kind = 'site' AND t.site = p_site))
+			)
+		$$;`,
+		Down: `DROP FUNCTION book_is_taken_down(BIGINT, BIGINT, TEXT); DROP TABLE takedown_audit; DROP TABLE takedowns;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140082,
+		Name:    "keep_takedowns_of_deleted_targets",
+		Up: `ALTER TABLE takedowns
+			DROP CONSTRAINT takedowns_book_id_fkey,
+			ADD CONSTRAINT takedowns_book_id_fkey FOREIGN KEY (book_id) REFERENCES books (id) ON DELETE SET NULL,
+			DROP CONSTRAINT takedowns_author_id_fkey,
+			ADD CONSTRAINT takedowns_author_id_fkey FOREIGN KEY (author_id) REFERENCES authors (id) ON DELETE SET NULL;`,
+		Down: `ALTER TABLE takedowns
+			DROP CONSTRAINT takedowns_book_id_fkey,
+			ADD CONSTRAINT takedowns_book_id_fkey FOREIGN KEY (book_id) REFERENCES books (id) ON DELETE CASCADE,
+			DROP CONSTRAINT takedowns_author_id_fkey,
+			ADD CONSTRAINT takedowns_author_id_fkey FOREIGN KEY (author_id) REFERENCES authors (id) ON DELETE CASCADE;`,
+	})
+	database.RegisterModel(database.Model{Table: "takedowns", Struct: Takedown{}, Indexes: []string{
+		"takedowns_book_idx", "takedowns_author_idx", "takedowns_site_idx",
+	}})
+	database.RegisterModel(database.Model{Table: "takedown_audit", Struct: TakedownAudit{}})
+}
+
+// Visible returns the SQL condition that hides taken down, deleted and
+// not yet (or no longer) available books, for the books table aliased as
+// alias.
+// Every query listing books to users must include it.
+func Visible(alias string) string {
+	return alias + ".lifecycle IN ('available', 'stale') AND " + database.NotDeleted(alias) + " AND NOT book_is_taken_down(" + alias + ".id, " + alias + ".author_id, " + alias + ".source_site)"
+}
+
+// AddTakedown stores t and its audit record. Exactly the field matching
+// t.Kind must be set, though it is cleared later if the target is
+// deleted; a zero EffectiveFrom means immediately.
+func (repo *Repo) AddTakedown(ctx context.Context, t Takedown) (*Takedown, error) {
+	valid := (t.Kind == TakedownBook && t.BookID != nil && t.AuthorID == nil && t.Site == nil) ||
+		(t.Kind == TakedownAuthor && t.AuthorID != nil && t.BookID == nil && t.Site == nil) ||
+		(t.Kind == TakedownSite && t.Site != nil && t.BookID == nil && t.AuthorID == nil)
+	if !valid {
+		return nil, ErrInvalidTakedown
+	}
+	if t.EffectiveFrom.IsZero() {
+		t.EffectiveFrom = repo.session.Clock().Now()
+	}
+
+	var created *Takedown
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `INSERT INTO takedowns (kind, book_id, author_id, site, reason, reference, effective_from, added_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING `+takedownColumns,
+			t.Kind, t.BookID, t.AuthorID, t.Site, t.Reason, t.Reference, t.EffectiveFrom, t.AddedBy)
+		if err != nil {
+			return err
+		}
+		created, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Takedown])
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO takedown_audit (takedown_id, action, actor, note) VALUES ($1, 'added', $2, $3)",
+			created.ID, t.AddedBy, t.Reason)
+		return err
+	})
+	return created, err
+}
+
+// LiftTakedown ends a takedown, keeping the record and auditing who did it.
+func (repo *Repo) LiftTakedown(ctx context.Context, id int64, actor, note string) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE takedowns SET lifted_at = now() WHERE id = $1 AND lifted_at IS NULL", id)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO takedown_audit (takedown_id, action, actor, note) VALUES ($1, 'lifted', $2, $3)", id, actor, note)
+		return err
+	})
+}
+
+// ListTakedowns returns active (or, with all set, every) takedown, newest
+// first.
+func (repo *Repo) ListTakedowns(ctx context.Context, all bool, limit, offset int) ([]Takedown, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+takedownColumns+` FROM takedowns
+		WHERE $1 OR lifted_at IS NULL ORDER BY id DESC LIMIT $2 OFFSET $3`, all, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Takedown])
+}
+
+func (repo *Repo) TakedownAudit(ctx context.Context, takedownID int64) ([]TakedownAudit, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id, takedown_id, action, actor, note, at FROM takedown_audit
+		WHERE takedown_id = $1 ORDER BY id`, takedownID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[TakedownAudit])
+}
+
+// CheckAvailable returns ErrTakenDown if bookID may not be downloaded.
+// Enqueueing a download and serving a file through a token or share call
+// it.
+func (repo *Repo) CheckAvailable(ctx context.Context, bookID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var takenDown bool
+	err = conn.QueryRow(ctx, "SELECT book_is_taken_down(b.id, b.author_id, b.source_site) FROM books b WHERE b.id = $1", bookID).Scan(&takenDown)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if takenDown {
+		return ErrTakenDown
+	}
+	return nil
+}
+
+// SiteTakenDown reports whether a whole source site is blocked, for
+// download requests by URL that don't map to a catalog entry yet.
+func (repo *Repo) SiteTakenDown(ctx context.Context, site string) (bool, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var takenDown bool
+	err = conn.QueryRow(ctx, "SELECT book_is_taken_down(NULL, NULL, $1)", site).Scan(&takenDown)
+	return takenDown, err
+}
@@ -0,0 +1,61 @@
+package books
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown file format")
+	ErrForeignURL    = errors.New("source url is not on the book's site")
+)
+
+// Formats are the file formats a book can be stored in.
+var Formats = []string{"fb2", "epub", "mobi", "azw3", "pdf", "txt", "docx", "html"}
+
+// SiteHosts maps a source site to the hosts its pages live on, including
+// mirrors; the bot fills it from its site configuration at startup. A
+// book's source URL must be on one of them. Sites missing from the map
+// aren't checked.
+var SiteHosts = map[string][]string{}
+
+// BookRules are checked by Create, Upsert and Update.
+var BookRules = database.NewValidator("books", Columns, func(b *Book) int64 { return b.ID }).
+	Rule("title", func(b *Book) error {
+		if strings.TrimSpace(b.Title) == "" {
+			return ErrEmptyTitle
+		}
+		return nil
+	}).
+	Rule("source url", func(b *Book) error {
+		hosts, ok := SiteHosts[b.SourceSite]
+		if !ok {
+			return nil
+		}
+		u, err := url.Parse(b.SourceURL)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrForeignURL, err)
+		}
+		host := strings.ToLower(u.Hostname())
+		for _, h := range hosts {
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not on %s", ErrForeignURL, host, b.SourceSite)
+	})
+
+// FileRules are checked by PutFile.
+var FileRules = database.NewValidator("book_files", FileColumns, func(f *File) int64 { return f.ID }).
+	Rule("format", func(f *File) error {
+		for _, format := range Formats {
+			if f.Format == format {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %q", ErrUnknownFormat, f.Format)
+	})
@@ -0,0 +1,201 @@
+package calibre
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+)
+
+const maxPathPart = 100
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+type opfPackage struct {
+	XMLName          xml.Name    `xml:"package"`
+	Xmlns            string      `xml:"xmlns,attr"`
+	Version          string      `xml:"version,attr"`
+	UniqueIdentifier string      `xml:"unique-identifier,attr"`
+	Metadata         opfMetadata `xml:"metadata"`
+}
+
+type opfMetadata struct {
+	XmlnsDC     string          `xml:"xmlns:dc,attr"`
+	XmlnsOPF    string          `xml:"xmlns:opf,attr"`
+	Identifiers []opfIdentifier `xml:"dc:identifier"`
+	Title       string          `xml:"dc:title"`
+	Creator     *opfCreator     `xml:"dc:creator,omitempty"`
+	Description string          `xml:"dc:description,omitempty"`
+	Language    string          `xml:"dc:language,omitempty"`
+	Subjects    []string        `xml:"dc:subject"`
+	Source      string          `xml:"dc:source,omitempty"`
+	Date        string          `xml:"dc:date,omitempty"`
+	Meta        []opfMeta       `xml:"meta"`
+}
+
+type opfIdentifier struct {
+	ID     string `xml:"id,attr,omitempty"`
+	Scheme string `xml:"opf:scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type opfCreator struct {
+	Role  string `xml:"opf:role,attr"`
+	Value string `xml:",chardata"`
+}
+
+type opfMeta struct {
+	Name    string `xml:"name,attr"`
+	Content string `xml:"content,attr"`
+}
+
+type exportRow struct {
+	id             int64
+	title          string
+	author         *string
+	series         *string
+	seriesPosition *int
+	genres         []string
+	language       string
+	description    string
+	sourceURL      string
+	createdAt      time.Time
+	updatedAt      time.Time
+}
+
+// ExportCalibreCompatible writes the catalog to w as a zip archive laid out
+// like a Calibre library: one "Author/Title (id)/metadata.opf" per book.
+// Calibre can import it with "Add books from directories" or rebuild a
+// library database from it. Rows are streamed, so memory use is bounded.
+func (repo *Repo) ExportCalibreCompatible(ctx context.Context, w io.Writer) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT b.id, b.title, a.name, s.title, b.series_position, b.genres,
+			b.language, b.description, b.source_url, b.created_at, b.updated_at
+		FROM books b
+		LEFT JOIN authors a ON a.id = b.author_id
+		LEFT JOIN series s ON s.id = b.series_id
+		WHERE `+books.Visible("b")+`
+		ORDER BY b.id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	archive := zip.NewWriter(w)
+	for rows.Next() {
+		var row exportRow
+		err := rows.Scan(&row.id, &row.title, &row.author, &row.series, &row.seriesPosition, &row.genres,
+			&row.language, &row.description, &row.sourceURL, &row.createdAt, &row.updatedAt)
+		if err != nil {
+			return err
+		}
+
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     row.path(),
+			Method:   zip.Deflate,
+			Modified: row.updatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(file, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(file)
+		enc.Indent("", "  ")
+		if err := enc.Encode(row.opf()); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func (row exportRow) path() string {
+	author := "Unknown"
+	if row.author != nil && *row.author != "" {
+		author = *row.author
+	}
+	return fmt.Sprintf("%s/%s (%d)/metadata.opf", cleanPathPart(author), cleanPathPart(row.title), row.id)
+}
+
+func (row exportRow) opf() opfPackage {
+	meta := opfMetadata{
+		XmlnsDC:  "http://purl.org/dc/elements/1.1/",
+		XmlnsOPF: "http://www.idpf.org/2007/opf",
+		Identifiers: []opfIdentifier{
+			{ID: "book_bot_id", Scheme: "book_bot", Value: strconv.FormatInt(row.id, 10)},
+			{Scheme: "URI", Value: row.sourceURL},
+		},
+		Title:       row.title,
+		Description: row.description,
+		Language:    row.language,
+		Subjects:    row.genres,
+		Source:      row.sourceURL,
+		Date:        row.createdAt.UTC().Format(time.RFC3339),
+		Meta: []opfMeta{
+			{Name: "calibre:timestamp", Content: row.createdAt.UTC().Format(time.RFC3339)},
+			{Name: "calibre:title_sort", Content: row.title},
+		},
+	}
+	if row.author != nil {
+		meta.Creator = &opfCreator{Role: "aut", Value: *row.author}
+	}
+	if row.series != nil {
+		meta.Meta = append(meta.Meta, opfMeta{Name: "calibre:series", Content: *row.series})
+		if row.seriesPosition != nil {
+			meta.Meta = append(meta.Meta, opfMeta{Name: "calibre:series_index", Content: strconv.Itoa(*row.seriesPosition)})
+		}
+	}
+	return opfPackage{
+		Xmlns:            "http://www.idpf.org/2007/opf",
+		Version:          "2.0",
+		UniqueIdentifier: "book_bot_id",
+		Metadata:         meta,
+	}
+}
+
+// cleanPathPart mirrors Calibre's own filename sanitizing closely enough for
+// the paths to be valid on every platform.
+func cleanPathPart(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 32 {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.Trim(s, " .")
+	for len(s) > maxPathPart {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	if s == "" {
+		return "_"
+	}
+	return s
+}
@@ -0,0 +1,280 @@
+package challenges
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Sources of a finished book. Downloads are recorded by a trigger on
+// download_tasks; reads come from the user marking a book as read.
+const (
+	SourceDownload = "download"
+	SourceRead     = "read"
+)
+
+var (
+	ErrNotFound       = errors.New("challenge not found")
+	ErrInvalidTarget  = errors.New("challenge target must be positive")
+	ErrInvalidPeriod  = errors.New("challenge must end after it starts")
+	ErrInvalidSources = errors.New("invalid challenge sources")
+)
+
+// Goal is a user's target of books for a calendar year.
+type Goal struct {
+	UserID   int64 `db:"user_id"`
+	Year     int   `db:"year"`
+	Target   int   `db:"target"`
+	Progress int   `db:"progress"`
+}
+
+// Challenge is a chat-wide race over a time window. Only books finished
+// through one of Sources within the window count.
+type Challenge struct {
+	ID        int64     `db:"id"`
+	ChatID    int64     `db:"chat_id"`
+	Title     string    `db:"title"`
+	Target    int       `db:"target"`
+	Sources   []string  `db:"sources"`
+	StartsAt  time.Time `db:"starts_at"`
+	EndsAt    time.Time `db:"ends_at"`
+	CreatedBy int64     `db:"created_by"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type Standing struct {
+	UserID   int64      `db:"user_id"`
+	Books    int        `db:"books"`
+	Rank     int        `db:"rank"`
+	LastAt   *time.Time `db:"last_at"`
+	Finished bool       `db:"finished"`
+}
+
+const challengeColumns = "id, chat_id, title, target, sources, starts_at, ends_at, created_by, created_at"
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140047,
+		Name:    "create_challenges",
+		Up: `CREATE TABLE finished_books (
+			user_id     BIGINT NOT NULL,
+			book_id     BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			source      TEXT NOT NULL CHECK (source IN ('download', 'read')),
+			finished_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, book_id, source)
+		);
+		CREATE INDEX finished_books_user_idx ON finished_books (user_id, finished_at);
+		CREATE TABLE reading_goals (
+			user_id BIGINT NOT NULL,
+			year    INT NOT NULL,
+			target  INT NOT NULL CHECK (target > 0),
+			PRIMARY KEY (user_id, year)
+		);
+		CREATE TABLE chat_challenges (
+			id         BIGSERIAL PRIMARY KEY,
+			chat_id    BIGINT NOT NULL,
+			title      TEXT NOT NULL,
+			target     INT NOT NULL CHECK (target > 0),
+			sources    TEXT[] NOT NULL,
+			starts_at  TIMESTAMPTZ NOT NULL,
+			ends_at    TIMESTAMPTZ NOT NULL CHECK (ends_at > starts_at),
+			created_by BIGINT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX chat_challenges_chat_idx ON chat_challenges (chat_id, ends_at DESC);
+		CREATE TABLE chat_challenge_members (
+			challenge_id BIGINT NOT NULL REFERENCES chat_challenges (id) ON DELETE CASCADE,
+			user_id      BIGINT NOT NULL,
+			joined_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (challenge_id, user_id)
+		);
+		CREATE FUNCTION download_tasks_finished_book() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			INSERT INTO finished_books (user_id, book_id, source, finished_at)
+			VALUES (NEW.user_id, NEW.book_id, 'download', COALESCE(NEW.finished_at, now()))
+			ON CONFLICT DO NOTHING;
+			RETURN NULL;
+		END
+		$$;
+		CREATE TRIGGER download_tasks_finished_book AFTER UPDATE OF status ON download_tasks
+			FOR EACH ROW WHEN (NEW.status = 'done' AND OLD.status <> 'done' AND NEW.kind = 'download' AND NEW.book_id IS NOT NULL)
+			EXECUTE FUNCTION download_tasks_finished_book();`,
+		Down: `DROP TRIGGER download_tasks_finished_book ON download_tasks;
+		DROP FUNCTION download_tasks_finished_book();
+		DROP TABLE chat_challenge_members;
+		DROP TABLE chat_challenges;
+		DROP TABLE reading_goals;
+		DROP TABLE finished_books;`,
+	})
+	database.RegisterModel(database.Model{Table: "chat_challenges", Struct: Challenge{}, Indexes: []string{"chat_challenges_chat_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// MarkRead records that userID read bookID. A book counts once per
+// source, however often it is marked.
+func (repo *Repo) MarkRead(ctx context.Context, userID, bookID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO finished_books (user_id, book_id, source) VALUES ($1, $2, 'read')
+		ON CONFLICT DO NOTHING`, userID, bookID)
+	return err
+}
+
+// SetGoal sets the number of books userID wants to finish in year.
+func (repo *Repo) SetGoal(ctx context.Context, userID int64, year, target int) error {
+	if target <= 0 {
+		return ErrInvalidTarget
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO reading_goals (user_id, year, target) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, year) DO UPDATE SET target = EXCLUDED.target`, userID, year, target)
+	return err
+}
+
+// GetGoal returns the goal of userID for year with the distinct books
+// finished in that year (UTC), or nil if no goal was set.
+func (repo *Repo) GetGoal(ctx context.Context, userID int64, year int) (*Goal, error) {
+	goal, err := database.QueryOne[Goal](ctx, repo.session, `SELECT g.user_id, g.year, g.target, (
+			SELECT count(DISTINCT f.book_id) FROM finished_books f
+			WHERE f.user_id = g.user_id AND f.finished_at >= make_timestamptz(g.year, 1, 1, 0, 0, 0, 'UTC')
+				AND f.finished_at < make_timestamptz(g.year + 1, 1, 1, 0, 0, 0, 'UTC')
+		)::int AS progress
+		FROM reading_goals g WHERE g.user_id = $1 AND g.year = $2`, userID, year)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return goal, err
+}
+
+// CreateChallenge starts a challenge in chatID; the creator joins it.
+func (repo *Repo) CreateChallenge(ctx context.Context, c Challenge) (*Challenge, error) {
+	if c.Target <= 0 {
+		return nil, ErrInvalidTarget
+	}
+	if !c.EndsAt.After(c.StartsAt) {
+		return nil, ErrInvalidPeriod
+	}
+	if len(c.Sources) == 0 {
+		c.Sources = []string{SourceDownload, SourceRead}
+	}
+	for _, source := range c.Sources {
+		if source != SourceDownload && source != SourceRead {
+			return nil, ErrInvalidSources
+		}
+	}
+
+	var created *Challenge
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `INSERT INTO chat_challenges (chat_id, title, target, sources, starts_at, ends_at, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+challengeColumns,
+			c.ChatID, c.Title, c.Target, c.Sources, c.StartsAt, c.EndsAt, c.CreatedBy)
+		if err != nil {
+			return err
+		}
+		created, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Challenge])
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO chat_challenge_members (challenge_id, user_id) VALUES ($1, $2)", created.ID, c.CreatedBy)
+		return err
+	})
+	return created, err
+}
+
+func (repo *Repo) Join(ctx context.Context, challengeID, userID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `INSERT INTO chat_challenge_members (challenge_id, user_id)
+		SELECT id, $2 FROM chat_challenges WHERE id = $1 ON CONFLICT DO NOTHING`, challengeID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		var exists bool
+		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM chat_challenges WHERE id = $1)", challengeID).Scan(&exists)
+		if err == nil && !exists {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (repo *Repo) Leave(ctx context.Context, challengeID, userID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM chat_challenge_members WHERE challenge_id = $1 AND user_id = $2", challengeID, userID)
+	return err
+}
+
+// Active returns the challenges of chatID that are running at now.
+func (repo *Repo) Active(ctx context.Context, chatID int64, now time.Time) ([]Challenge, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+challengeColumns+` FROM chat_challenges
+		WHERE chat_id = $1 AND starts_at <= $2 AND ends_at > $2 ORDER BY ends_at`, chatID, now)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Challenge])
+}
+
+// Leaderboard ranks the members of challengeID by the distinct books they
+// finished within its window; members tied on books share a rank and the
+// one who got there first is listed first.
+func (repo *Repo) Leaderboard(ctx context.Context, challengeID int64, limit int) ([]Standing, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT m.user_id, s.books, (rank() OVER (ORDER BY s.books DESC))::int AS rank,
+			s.last_at, s.books >= c.target AS finished
+		FROM chat_challenges c
+		JOIN chat_challenge_members m ON m.challenge_id = c.id
+		CROSS JOIN LATERAL (
+			SELECT count(DISTINCT f.book_id)::int AS books, max(f.finished_at) AS last_at FROM finished_books f
+			WHERE f.user_id = m.user_id AND f.source = ANY (c.sources)
+				AND f.finished_at >= c.starts_at AND f.finished_at < c.ends_at
+		) s
+		WHERE c.id = $1
+		ORDER BY s.books DESC, s.last_at NULLS LAST, m.user_id LIMIT $2`, challengeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Standing])
+}
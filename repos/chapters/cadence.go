@@ -0,0 +1,173 @@
+package chapters
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	cadenceSamples     = 30
+	minCadenceSamples  = 3
+	dominantDayShare   = 0.5
+	staleCadenceFactor = 4
+)
+
+var ErrNotEnoughData = errors.New("not enough publications to infer a cadence")
+
+// Cadence is the inferred publishing rhythm of a serialized book.
+// DominantWeekday is set when most chapters come out on the same day
+// ("usually updates on Fridays").
+type Cadence struct {
+	BookID          int64         `db:"book_id"`
+	MedianInterval  time.Duration `db:"median_interval"`
+	DominantWeekday *int          `db:"dominant_weekday"`
+	WeekdayShare    float64       `db:"weekday_share"`
+	Samples         int           `db:"samples"`
+	LastPublishedAt time.Time     `db:"last_published_at"`
+	ComputedAt      time.Time     `db:"computed_at"`
+}
+
+// Weekday returns the dominant weekday, if any.
+func (c *Cadence) Weekday() (time.Weekday, bool) {
+	if c.DominantWeekday == nil {
+		return 0, false
+	}
+	return time.Weekday(*c.DominantWeekday), true
+}
+
+// ExpectedNext estimates when the next chapter comes out.
+func (c *Cadence) ExpectedNext() time.Time {
+	return c.LastPublishedAt.Add(c.MedianInterval)
+}
+
+// Stalled reports whether the book went quiet for much longer than usual.
+func (c *Cadence) Stalled(now time.Time) bool {
+	return now.Sub(c.LastPublishedAt) > staleCadenceFactor*c.MedianInterval
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140026,
+		Name:    "create_book_cadence",
+		Up: `CREATE TABLE book_cadence (
+			book_id           BIGINT PRIMARY KEY REFERENCES books (id) ON DELETE CASCADE,
+			median_interval   INTERVAL NOT NULL,
+			dominant_weekday  SMALLINT,
+			weekday_share     DOUBLE PRECISION NOT NULL,
+			samples           INT NOT NULL,
+			last_published_at TIMESTAMPTZ NOT NULL,
+			computed_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`,
+		Down: `DROP TABLE book_cadence;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_cadence", Struct: Cadence{}})
+}
+
+// inferCadence computes a cadence from publication times; weekdays are
+// taken in loc.
+func inferCadence(published []time.Time, loc *time.Location) (*Cadence, error) {
+	if len(published) < minCadenceSamples {
+		return nil, ErrNotEnoughData
+	}
+	sort.Slice(published, func(i, j int) bool { return published[i].Before(published[j]) })
+
+	intervals := make([]time.Duration, 0, len(published)-1)
+	for i := 1; i < len(published); i++ {
+		if d := published[i].Sub(published[i-1]); d > 0 {
+			intervals = append(intervals, d)
+		}
+	}
+	if len(intervals) < minCadenceSamples-1 {
+		return nil, ErrNotEnoughData
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+
+	cadence := &Cadence{
+		MedianInterval:  intervals[len(intervals)/2],
+		Samples:         len(published),
+		LastPublishedAt: published[len(published)-1],
+	}
+
+	var days [7]int
+	for _, t := range published {
+		days[t.In(loc).Weekday()]++
+	}
+	best := 0
+	for day := range days {
+		if days[day] > days[best] {
+			best = day
+		}
+	}
+	cadence.WeekdayShare = float64(days[best]) / float64(len(published))
+	if cadence.WeekdayShare >= dominantDayShare {
+		cadence.DominantWeekday = &best
+	}
+	return cadence, nil
+}
+
+// InferCadence recomputes the cadence of bookID from its latest chapter
+// publications, stores it, and aligns the book's recheck interval with it
+// so the crawler looks again around when the next chapter is expected.
+func (repo *Repo) InferCadence(ctx context.Context, bookID int64, loc *time.Location) (*Cadence, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `SELECT published_at FROM book_chapters
+		WHERE book_id = $1 AND published_at IS NOT NULL
+		ORDER BY published_at DESC LIMIT $2`, bookID, cadenceSamples)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	published, err := pgx.CollectRows(rows, pgx.RowTo[time.Time])
+	conn.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	cadence, err := inferCadence(published, loc)
+	if err != nil {
+		return nil, err
+	}
+	cadence.BookID = bookID
+
+	conn, err = repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.QueryRow(ctx, `INSERT INTO book_cadence (book_id, median_interval, dominant_weekday, weekday_share, samples, last_published_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (book_id) DO UPDATE SET median_interval = EXCLUDED.median_interval, dominant_weekday = EXCLUDED.dominant_weekday,
+			weekday_share = EXCLUDED.weekday_share, samples = EXCLUDED.samples, last_published_at = EXCLUDED.last_published_at,
+			computed_at = now()
+		RETURNING computed_at`,
+		bookID, cadence.MedianInterval, cadence.DominantWeekday, cadence.WeekdayShare, cadence.Samples, cadence.LastPublishedAt,
+	).Scan(&cadence.ComputedAt)
+	conn.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	return cadence, repo.books.SetCheckInterval(ctx, bookID, cadence.MedianInterval)
+}
+
+// GetCadence returns the stored cadence of bookID, or nil if none was
+// inferred yet.
+func (repo *Repo) GetCadence(ctx context.Context, bookID int64) (*Cadence, error) {
+	cadence, err := database.QueryOne[Cadence](ctx, repo.session, `SELECT book_id, median_interval, dominant_weekday, weekday_share, samples, last_published_at, computed_at
+		FROM book_cadence WHERE book_id = $1`, bookID)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return cadence, err
+}
@@ -0,0 +1,83 @@
+package chapters
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+// Chapter is one published chapter of a serialized book. Position is the
+// chapter's index in the book's table of contents. Hash identifies the
+// chapter's content, see Hash; it's empty when the content wasn't fetched.
+type Chapter struct {
+	BookID      int64      `db:"book_id"`
+	Position    int        `db:"position"`
+	Title       string     `db:"title"`
+	Hash        string     `db:"hash"`
+	PublishedAt *time.Time `db:"published_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+const columns = "book_id, position, title, hash, published_at, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140025,
+		Name:    "create_book_chapters",
+		Up: `CREATE TABLE book_chapters (
+			book_id      BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			position     INT NOT NULL,
+			title        TEXT NOT NULL DEFAULT '',
+			published_at TIMESTAMPTZ,
+			created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (book_id, position)
+		);
+		CREATE INDEX book_chapters_published_idx ON book_chapters (book_id, published_at DESC);`,
+		Down: `DROP TABLE book_chapters;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_chapters", Struct: Chapter{}, Indexes: []string{"book_chapters_published_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+	books   *books.Repo
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session, books: books.New(session)}
+}
+
+// RecordChapters upserts the scraped chapters of bookID. A known
+// publication date or hash is never erased by a scrape that lacks it.
+func (repo *Repo) RecordChapters(ctx context.Context, bookID int64, list []Chapter) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		for _, c := range list {
+			_, err := tx.Exec(ctx, `INSERT INTO book_chapters (book_id, position, title, hash, published_at) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (book_id, position) DO UPDATE SET title = EXCLUDED.title,
+					hash = COALESCE(NULLIF(EXCLUDED.hash, ''), book_chapters.hash),
+					published_at = COALESCE(EXCLUDED.published_at, book_chapters.published_at)`,
+				bookID, c.Position, c.Title, c.Hash, c.PublishedAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *Repo) List(ctx context.Context, bookID int64) ([]Chapter, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+" FROM book_chapters WHERE book_id = $1 ORDER BY position", bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Chapter])
+}
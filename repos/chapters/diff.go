@@ -0,0 +1,74 @@
+package chapters
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140070,
+		Name:    "add_book_chapters_hash",
+		Up:      `ALTER TABLE book_chapters ADD COLUMN hash TEXT NOT NULL DEFAULT '';`,
+		Down:    `ALTER TABLE book_chapters DROP COLUMN hash;`,
+	})
+}
+
+// Hash returns the hash identifying chapter content, for Chapter.Hash.
+func Hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Diff is what a scrape of a book's chapter list changed since the last
+// one recorded. Removed holds the positions recorded but not scraped.
+type Diff struct {
+	New     []Chapter
+	Changed []Chapter
+	Removed []int
+}
+
+// Empty reports whether the scrape changed nothing to download.
+func (d *Diff) Empty() bool {
+	return len(d.New) == 0 && len(d.Changed) == 0
+}
+
+// DiffChapters compares the scraped chapter list of bookID with the
+// recorded one, so only the new and changed chapters are downloaded. A
+// chapter changed if its title did, or its hash did when both the scrape
+// and the record have one. Call RecordChapters once the download is done.
+func (repo *Repo) DiffChapters(ctx context.Context, bookID int64, scraped []Chapter) (*Diff, error) {
+	recorded, err := repo.List(ctx, bookID)
+	if err != nil {
+		return nil, err
+	}
+	return diffChapters(recorded, scraped), nil
+}
+
+func diffChapters(recorded, scraped []Chapter) *Diff {
+	known := make(map[int]Chapter, len(recorded))
+	for _, c := range recorded {
+		known[c.Position] = c
+	}
+
+	diff := &Diff{}
+	for _, c := range scraped {
+		old, ok := known[c.Position]
+		switch {
+		case !ok:
+			diff.New = append(diff.New, c)
+		case c.Title != old.Title || (c.Hash != "" && old.Hash != "" && c.Hash != old.Hash):
+			diff.Changed = append(diff.Changed, c)
+		}
+		delete(known, c.Position)
+	}
+	for _, c := range recorded {
+		if _, ok := known[c.Position]; ok {
+			diff.Removed = append(diff.Removed, c.Position)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,93 @@
+package chapters
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Progress is how far a user read a serialized book: every chapter up to
+// Position included.
+type Progress struct {
+	UserID    int64     `db:"user_id"`
+	BookID    int64     `db:"book_id"`
+	Position  int       `db:"position"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140071,
+		Name:    "create_chapter_progress",
+		Up: `CREATE TABLE chapter_progress (
+			user_id    BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			book_id    BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			position   INT NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, book_id)
+		);
+		CREATE INDEX chapter_progress_book_idx ON chapter_progress (book_id);`,
+		Down: `DROP TABLE chapter_progress;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140081,
+		Name:    "touch_chapter_progress",
+		Up:      database.TouchUpdatedAtSQL("chapter_progress"),
+		Down:    `DROP TRIGGER chapter_progress_touch_updated_at ON chapter_progress;`,
+	})
+	database.RegisterModel(database.Model{Table: "chapter_progress", Struct: Progress{}, Indexes: []string{"chapter_progress_book_idx"}})
+}
+
+// MarkRead records that userID read bookID up to position. Progress only
+// moves forward; use SetProgress to go back.
+func (repo *Repo) MarkRead(ctx context.Context, userID, bookID int64, position int) error {
+	_, err := repo.session.Exec(ctx, `INSERT INTO chapter_progress (user_id, book_id, position) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, book_id) DO UPDATE SET position = EXCLUDED.position, updated_at = now()
+		WHERE chapter_progress.position < EXCLUDED.position`, userID, bookID, position)
+	return err
+}
+
+// SetProgress records that userID read bookID up to position, even if
+// that's before the recorded progress.
+func (repo *Repo) SetProgress(ctx context.Context, userID, bookID int64, position int) error {
+	_, err := repo.session.Exec(ctx, `INSERT INTO chapter_progress (user_id, book_id, position) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, book_id) DO UPDATE SET position = EXCLUDED.position, updated_at = now()`, userID, bookID, position)
+	return err
+}
+
+// GetProgress returns the progress of userID in bookID, or nil if they
+// read none of it.
+func (repo *Repo) GetProgress(ctx context.Context, userID, bookID int64) (*Progress, error) {
+	progress, err := database.QueryOne[Progress](ctx, repo.session,
+		"SELECT user_id, book_id, position, updated_at FROM chapter_progress WHERE user_id = $1 AND book_id = $2", userID, bookID)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return progress, err
+}
+
+// Unread returns the chapters of bookID after the progress of userID, all
+// of them if they read none.
+func (repo *Repo) Unread(ctx context.Context, userID, bookID int64) ([]Chapter, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT `+columns+` FROM book_chapters c
+		WHERE c.book_id = $2 AND c.position > COALESCE((SELECT position FROM chapter_progress WHERE user_id = $1 AND book_id = $2), -1)
+		ORDER BY c.position`, userID, bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Chapter])
+}
+
+// ClearProgress forgets the progress of userID in bookID.
+func (repo *Repo) ClearProgress(ctx context.Context, userID, bookID int64) error {
+	_, err := repo.session.Exec(ctx, "DELETE FROM chapter_progress WHERE user_id = $1 AND book_id = $2", userID, bookID)
+	return err
+}
@@ -0,0 +1,183 @@
+package chatlibrary
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var ErrNotInLibrary = errors.New("book is not in the chat library")
+
+// Entry is a book on a group chat's shared shelf. AddedBy is the member
+// who added it; pinned entries are listed first.
+type Entry struct {
+	ID       int64     `db:"id"`
+	ChatID   int64     `db:"chat_id"`
+	BookID   int64     `db:"book_id"`
+	Title    string    `db:"title"`
+	AddedBy  int64     `db:"added_by"`
+	Note     string    `db:"note"`
+	Pinned   bool      `db:"pinned"`
+	PinnedBy *int64    `db:"pinned_by"`
+	AddedAt  time.Time `db:"added_at"`
+}
+
+// Contributor counts what one member added to a chat library.
+type Contributor struct {
+	UserID      int64     `db:"user_id"`
+	Books       int64     `db:"books"`
+	LastAddedAt time.Time `db:"last_added_at"`
+}
+
+// Page is one page of a chat library; Number starts at 1.
+type Page struct {
+	Entries []Entry
+	Total   int64
+	Number  int
+	Size    int
+}
+
+func (p Page) HasNext() bool {
+	return int64(p.Number*p.Size) < p.Total
+}
+
+const entryColumns = "l.id, l.chat_id, l.book_id, b.title, l.added_by, l.note, l.pinned, l.pinned_by, l.added_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140046,
+		Name:    "create_chat_library",
+		Up: `CREATE TABLE chat_library (
+			id        BIGSERIAL PRIMARY KEY,
+			chat_id   BIGINT NOT NULL,
+			book_id   BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			added_by  BIGINT NOT NULL,
+			note      TEXT NOT NULL DEFAULT '',
+			pinned    BOOLEAN NOT NULL DEFAULT false,
+			pinned_by BIGINT,
+			added_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			UNIQUE (chat_id, book_id)
+		);
+		CREATE INDEX chat_library_list_idx ON chat_library (chat_id, pinned DESC, id DESC);
+		CREATE INDEX chat_library_added_by_idx ON chat_library (chat_id, added_by);`,
+		Down: `DROP TABLE chat_library;`,
+	})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// AddToChatLibrary puts bookID on the shelf of chatID, credited to
+// userID. Adding a book that is already there keeps the original
+// contributor and returns the existing entry.
+func (repo *Repo) AddToChatLibrary(ctx context.Context, chatID, bookID, userID int64, note string) (*Entry, error) {
+	return database.QueryOne[Entry](ctx, repo.session, `WITH added AS (
+			INSERT INTO chat_library (chat_id, book_id, added_by, note) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (chat_id, book_id) DO UPDATE SET chat_id = EXCLUDED.chat_id
+			RETURNING *
+		)
+		SELECT `+entryColumns+` FROM added l JOIN books b ON b.id = l.book_id`, chatID, bookID, userID, note)
+}
+
+func (repo *Repo) RemoveFromChatLibrary(ctx context.Context, chatID, bookID int64) error {
+	return repo.exec(ctx, "DELETE FROM chat_library WHERE chat_id = $1 AND book_id = $2", chatID, bookID)
+}
+
+// Pin moves bookID to the top of the chat library; userID is recorded as
+// the member who pinned it.
+func (repo *Repo) Pin(ctx context.Context, chatID, bookID, userID int64) error {
+	return repo.exec(ctx, "UPDATE chat_library SET pinned = true, pinned_by = $3 WHERE chat_id = $1 AND book_id = $2",
+		chatID, bookID, userID)
+}
+
+func (repo *Repo) Unpin(ctx context.Context, chatID, bookID int64) error {
+	return repo.exec(ctx, "UPDATE chat_library SET pinned = false, pinned_by = NULL WHERE chat_id = $1 AND book_id = $2",
+		chatID, bookID)
+}
+
+func (repo *Repo) exec(ctx context.Context, sql string, args ...any) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotInLibrary
+	}
+	return nil
+}
+
+// ListChatLibrary returns a page of the chat library, pinned books first,
+// then the most recently added. Books that aren't books.Visible, e.g.
+// deleted or taken down, are left out, also from Total.
+func (repo *Repo) ListChatLibrary(ctx context.Context, chatID int64, number, size int) (*Page, error) {
+	if number < 1 {
+		number = 1
+	}
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	page := &Page{Number: number, Size: size}
+	err = conn.QueryRow(ctx, `SELECT count(*) FROM chat_library l JOIN books b ON b.id = l.book_id
+		WHERE l.chat_id = $1 AND `+books.Visible("b"), chatID).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, "SELECT "+entryColumns+` FROM chat_library l JOIN books b ON b.id = l.book_id
+		WHERE l.chat_id = $1 AND `+books.Visible("b")+` ORDER BY l.pinned DESC, l.id DESC LIMIT $2 OFFSET $3`, chatID, size, (number-1)*size)
+	if err != nil {
+		return nil, err
+	}
+	page.Entries, err = pgx.CollectRows(rows, pgx.RowToStructByName[Entry])
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Contributors ranks the members of chatID by the books they added.
+func (repo *Repo) Contributors(ctx context.Context, chatID int64, limit int) ([]Contributor, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT added_by AS user_id, count(*) AS books, max(added_at) AS last_added_at
+		FROM chat_library WHERE chat_id = $1 GROUP BY added_by ORDER BY books DESC, last_added_at DESC LIMIT $2`,
+		chatID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Contributor])
+}
@@ -0,0 +1,252 @@
+package costs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Cost categories workers report.
+const (
+	CategoryProxy     = "proxy"
+	CategoryBandwidth = "bandwidth"
+	CategoryStorage   = "storage"
+)
+
+// User tiers costs are attributed to. Costs not caused by a user's task,
+// such as catalog crawling, go to the system tier.
+const (
+	TierFree    = "free"
+	TierPremium = "premium"
+	TierSystem  = "system"
+)
+
+var ErrInvalidCost = errors.New("invalid cost event")
+
+// Event is one cost posted by a worker. Amounts are in millionths of a
+// US dollar. With a TaskID the site and tier are taken from the task and
+// its user at the time of posting.
+type Event struct {
+	ID           int64     `db:"id"`
+	WorkerID     string    `db:"worker_id"`
+	TaskID       *int64    `db:"task_id"`
+	Site         string    `db:"site"`
+	Tier         string    `db:"tier"`
+	Category     string    `db:"category"`
+	AmountMicros int64     `db:"amount_micros"`
+	OccurredAt   time.Time `db:"occurred_at"`
+}
+
+// Rollup is the monthly total of one site, tier and category.
+type Rollup struct {
+	Month        time.Time `db:"month"`
+	Site         string    `db:"site"`
+	Tier         string    `db:"tier"`
+	Category     string    `db:"category"`
+	AmountMicros int64     `db:"amount_micros"`
+	Events       int64     `db:"events"`
+}
+
+// SiteEconomics is what a site cost in a month per tier against what it
+// delivered.
+type SiteEconomics struct {
+	Site                  string `db:"site"`
+	Tier                  string `db:"tier"`
+	AmountMicros          int64  `db:"amount_micros"`
+	Downloads             int64  `db:"downloads"`
+	CostPerDownloadMicros *int64 `db:"cost_per_download_micros"`
+}
+
+const eventColumns = "id, worker_id, task_id, site, tier, category, amount_micros, occurred_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140051,
+		Name:    "create_cost_accounting",
+		Up: `CREATE TABLE cost_events (
+			id            BIGSERIAL PRIMARY KEY,
+			worker_id     TEXT NOT NULL,
+			task_id       BIGINT REFERENCES download_tasks (id) ON DELETE SET NULL,
+			site          TEXT NOT NULL,
+			tier          TEXT NOT NULL CHECK (tier IN ('free', 'premium', 'system')),
+			category      TEXT NOT NULL CHECK (category IN ('proxy', 'bandwidth', 'storage')),
+			amount_micros BIGINT NOT NULL CHECK (amount_micros >= 0),
+			occurred_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX cost_events_occurred_idx ON cost_events (occurred_at);
+		CREATE TABLE cost_monthly (
+			month         DATE NOT NULL,
+			site          TEXT NOT NULL,
+			tier          TEXT NOT NULL,
+			category      TEXT NOT NULL,
+			amount_micros BIGINT NOT NULL,
+			events        BIGINT NOT NULL,
+			PRIMARY KEY (month, site, tier, category)
+		);`,
+		Down: `DROP TABLE cost_monthly; DROP TABLE cost_events;`,
+	})
+	database.RegisterModel(database.Model{Table: "cost_events", Struct: Event{}, Indexes: []string{"cost_events_occurred_idx"}})
+	database.RegisterModel(database.Model{Table: "cost_monthly", Struct: Rollup{}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+func validCategory(category string) bool {
+	switch category {
+	case CategoryProxy, CategoryBandwidth, CategoryStorage:
+		return true
+	}
+	return false
+}
+
+// PostTaskCost records a cost a worker spent on a task. The site comes
+// from the task and the tier from whether its user had premium.
+func (repo *Repo) PostTaskCost(ctx context.Context, workerID string, taskID int64, category string, amountMicros int64) error {
+	if !validCategory(category) || amountMicros < 0 {
+		return ErrInvalidCost
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `INSERT INTO cost_events (worker_id, task_id, site, tier, category, amount_micros)
+		SELECT $1, t.id, t.site, CASE WHEN u.premium_until > now() THEN 'premium' ELSE 'free' END, $3, $4
+		FROM download_tasks t LEFT JOIN users u ON u.id = t.user_id
+		WHERE t.id = $2`, workerID, taskID, category, amountMicros)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidCost
+	}
+	return nil
+}
+
+// PostSiteCost records a cost of site not tied to a task, attributed to
+// the system tier; storage bills usually land here.
+func (repo *Repo) PostSiteCost(ctx context.Context, workerID, site, category string, amountMicros int64) error {
+	if !validCategory(category) || amountMicros < 0 || site == "" {
+		return ErrInvalidCost
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO cost_events (worker_id, site, tier, category, amount_micros)
+		VALUES ($1, $2, 'system', $3, $4)`, workerID, site, category, amountMicros)
+	return err
+}
+
+func monthBounds(month time.Time) (time.Time, time.Time) {
+	month = month.UTC()
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 1, 0)
+}
+
+// RollupMonth recomputes the monthly totals of the UTC month containing
+// month. It can run again as late costs arrive.
+func (repo *Repo) RollupMonth(ctx context.Context, month time.Time) error {
+	from, to := monthBounds(month)
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM cost_monthly WHERE month = $1::date", from)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO cost_monthly (month, site, tier, category, amount_micros, events)
+			SELECT $1::date, site, tier, category, sum(amount_micros), count(*) FROM cost_events
+			WHERE occurred_at >= $1 AND occurred_at < $2
+			GROUP BY site, tier, category`, from, to)
+		return err
+	})
+}
+
+// Monthly returns the rolled up totals of a month.
+func (repo *Repo) Monthly(ctx context.Context, month time.Time) ([]Rollup, error) {
+	from, _ := monthBounds(month)
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT month, site, tier, category, amount_micros, events FROM cost_monthly
+		WHERE month = $1::date ORDER BY amount_micros DESC`, from)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Rollup])
+}
+
+// Economics puts the rolled up costs of a month next to the downloads
+// each site completed per tier, most expensive per download first. The
+// system tier has no downloads of its own, so its cost per download is
+// against all downloads of the site.
+func (repo *Repo) Economics(ctx context.Context, month time.Time) ([]SiteEconomics, error) {
+	from, to := monthBounds(month)
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `WITH cost AS (
+			SELECT site, tier, sum(amount_micros) AS amount_micros FROM cost_monthly
+			WHERE month = $1::date GROUP BY site, tier
+		), delivered AS (
+			SELECT t.site, CASE WHEN u.premium_until > t.finished_at THEN 'premium' ELSE 'free' END AS tier, count(*) AS downloads
+			FROM download_tasks t LEFT JOIN users u ON u.id = t.user_id
+			WHERE t.status = 'done' AND t.kind = 'download' AND t.finished_at >= $1 AND t.finished_at < $2
+			GROUP BY 1, 2
+		)
+		SELECT c.site, c.tier, c.amount_micros::bigint AS amount_micros, d.downloads,
+			(c.amount_micros / NULLIF(d.downloads, 0))::bigint AS cost_per_download_micros
+		FROM cost c
+		CROSS JOIN LATERAL (
+			SELECT COALESCE(sum(downloads), 0)::bigint AS downloads FROM delivered
+			WHERE site = c.site AND (c.tier = 'system' OR tier = c.tier)
+		) d
+		ORDER BY cost_per_download_micros DESC NULLS FIRST, c.site, c.tier`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[SiteEconomics])
+}
+
+// PurgeEvents drops raw cost events older than before, in batches; roll
+// the months up first.
+func (repo *Repo) PurgeEvents(ctx context.Context, before time.Time) (int64, error) {
+	return repo.session.DeleteInBatches(ctx, "cost_events", "occurred_at < $1", 0, 0, nil, before)
+}
+
+// Events lists the recent costs posted by workerID, for auditing a
+// worker's reports.
+func (repo *Repo) Events(ctx context.Context, workerID string, limit int) ([]Event, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+eventColumns+" FROM cost_events WHERE worker_id = $1 ORDER BY id DESC LIMIT $2", workerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Event])
+}
@@ -0,0 +1,321 @@
+package enrichment
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	FieldCover       = "cover"
+	FieldDescription = "description"
+	FieldGenres      = "genres"
+
+	StatusPending  = "pending"
+	StatusClaimed  = "claimed"
+	StatusDone     = "done"
+	StatusRejected = "rejected"
+	StatusFailed   = "failed"
+
+	SourceManual = "manual"
+
+	defaultMaxAttempts = 5
+)
+
+var (
+	ErrUnknownField = errors.New("unknown enrichment field")
+	ErrNotClaimed   = errors.New("enrichment item is not claimed by this worker")
+)
+
+// fieldColumns maps enrichable fields to the books column they fill and the
+// condition under which the field counts as missing.
+var fieldColumns = map[string]struct{ column, missing string }{
+	FieldCover:       {"cover_url", "b.cover_url = ''"},
+	FieldDescription: {"description", "b.description = ''"},
+	FieldGenres:      {"genres", "cardinality(b.genres) = 0"},
+}
+
+type Item struct {
+	ID           int64      `db:"id"`
+	BookID       int64      `db:"book_id"`
+	Field        string     `db:"field"`
+	Status       string     `db:"status"`
+	WorkerID     *string    `db:"worker_id"`
+	ClaimedUntil *time.Time `db:"claimed_until"`
+	Attempts     int        `db:"attempts"`
+	LastError    *string    `db:"last_error"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+}
+
+// Provenance records where the current value of a book field came from.
+type Provenance struct {
+	BookID     int64     `db:"book_id"`
+	Field      string    `db:"field"`
+	Source     string    `db:"source"`
+	Confidence float64   `db:"confidence"`
+	AppliedAt  time.Time `db:"applied_at"`
+}
+
+// Result is what an enrichment worker found for an item. Text is used for
+// cover and description, Genres for genres.
+type Result struct {
+	Source     string
+	Confidence float64
+	Text       string
+	Genres     []string
+}
+
+// Rules decide whether a result may replace a value that's already set.
+// A value is replaced only by a source of higher priority, or of the same
+// priority with higher confidence. Manual edits are never replaced.
+type Rules struct {
+	SourcePriority map[string]int
+}
+
+func (rules Rules) priority(source string) int {
+	if source == SourceManual {
+		return int(^uint(0) >> 1)
+	}
+	return rules.SourcePriority[source]
+}
+
+func (rules Rules) allows(current *Provenance, result Result) bool {
+	if current == nil {
+		return true
+	}
+	if current.Source == SourceManual {
+		return false
+	}
+	cur, next := rules.priority(current.Source), rules.priority(result.Source)
+	if next != cur {
+		return next > cur
+	}
+	return result.Confidence > current.Confidence
+}
+
+const itemColumns = "id, book_id, field, status, worker_id, claimed_until, attempts, last_error, created_at, updated_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140008,
+		Name:    "create_enrichment",
+		Up: `CREATE TABLE enrichment_items (
+			id            BIGSERIAL PRIMARY KEY,
+			book_id       BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			field         TEXT NOT NULL,
+			status        TEXT NOT NULL DEFAULT 'pending',
+			worker_id     TEXT,
+			claimed_until TIMESTAMPTZ,
+			attempts      INT NOT NULL DEFAULT 0,
+			last_error    TEXT,
+			created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE UNIQUE INDEX enrichment_items_open_idx ON enrichment_items (book_id, field) WHERE status IN ('pending', 'claimed');
+		CREATE INDEX enrichment_items_queue_idx ON enrichment_items (field, id) WHERE status IN ('pending', 'claimed');
+		CREATE TABLE book_field_provenance (
+			book_id    BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			field      TEXT NOT NULL,
+			source     TEXT NOT NULL,
+			confidence DOUBLE PRECISION NOT NULL DEFAULT 0,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (book_id, field)
+		);`,
+		Down: `DROP TABLE book_field_provenance; DROP TABLE enrichment_items;`,
+	})
+	database.RegisterModel(database.Model{Table: "enrichment_items", Struct: Item{}, Indexes: []string{
+		"enrichment_items_open_idx", "enrichment_items_queue_idx",
+	}})
+	database.RegisterModel(database.Model{Table: "book_field_provenance", Struct: Provenance{}})
+}
+
+type Repo struct {
+	session     *database.DB_Session
+	Rules       Rules
+	MaxAttempts int
+}
+
+func New(session *database.DB_Session, rules Rules) *Repo {
+	return &Repo{session: session, Rules: rules, MaxAttempts: defaultMaxAttempts}
+}
+
+// EmitMissing queues up to limit work items for books missing field.
+// Books that already have an open item for it are skipped.
+func (repo *Repo) EmitMissing(ctx context.Context, field string, limit int) (int64, error) {
+	def, ok := fieldColumns[field]
+	if !ok {
+		return 0, ErrUnknownField
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `INSERT INTO enrichment_items (book_id, field)
+		SELECT b.id, $1 FROM books b
+		WHERE `+def.missing+`
+			AND NOT EXISTS (SELECT 1 FROM enrichment_items i WHERE i.book_id = b.id AND i.field = $1 AND i.status IN ('pending', 'claimed', 'rejected'))
+		ORDER BY b.id
+		LIMIT $2
+		ON CONFLICT DO NOTHING`, field, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Claim hands up to limit items of the given fields to workerID for lease.
+// Items whose lease expired are handed out again.
+func (repo *Repo) Claim(ctx context.Context, workerID string, fields []string, limit int, lease time.Duration) ([]Item, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `UPDATE enrichment_items SET status = 'claimed', worker_id = $1,
+			claimed_until = now() + $4::interval, attempts = attempts + 1, updated_at = now()
+		WHERE id IN (
+			SELECT id FROM enrichment_items
+			WHERE field = ANY($2) AND (status = 'pending' OR (status = 'claimed' AND claimed_until < now()))
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+itemColumns, workerID, fields, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Item])
+}
+
+// Apply stores a worker's result. The book is only updated when Rules allow
+// the source to override the current value; otherwise the item is marked
+// rejected. It reports whether the value was applied.
+func (repo *Repo) Apply(ctx context.Context, workerID string, itemID int64, result Result) (bool, error) {
+	var applied bool
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var item Item
+		rows, err := tx.Query(ctx, "SELECT "+itemColumns+" FROM enrichment_items WHERE id = $1 FOR UPDATE", itemID)
+		if err != nil {
+			return err
+		}
+		item, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Item])
+		if err != nil {
+			return err
+		}
+		if item.Status != StatusClaimed || item.WorkerID == nil || *item.WorkerID != workerID {
+			return ErrNotClaimed
+		}
+		def, ok := fieldColumns[item.Field]
+		if !ok {
+			return ErrUnknownField
+		}
+
+		var current *Provenance
+		rows, err = tx.Query(ctx, `SELECT book_id, field, source, confidence, applied_at FROM book_field_provenance
+			WHERE book_id = $1 AND field = $2 FOR UPDATE`, item.BookID, item.Field)
+		if err != nil {
+			return err
+		}
+		current, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Provenance])
+		if err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+
+		status := StatusRejected
+		if repo.Rules.allows(current, result) {
+			var value any = result.Text
+			if item.Field == FieldGenres {
+				value = result.Genres
+			}
+			if err := books.TagRevision(ctx, tx, result.Source, workerID); err != nil {
+				return err
+			}
+			set, args := def.column+" = $2", []any{item.BookID, value}
+			if item.Field == FieldDescription {
+				// Keeps the description searchable like one stored by books.Repo.
+				set, args = set+", description_key = $3", append(args, books.SearchKey(result.Text))
+			}
+			_, err = tx.Exec(ctx, "UPDATE books SET "+set+", updated_at = now() WHERE id = $1", args...)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `INSERT INTO book_field_provenance (book_id, field, source, confidence) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (book_id, field) DO UPDATE SET source = EXCLUDED.source, confidence = EXCLUDED.confidence, applied_at = now()`,
+				item.BookID, item.Field, result.Source, result.Confidence)
+			if err != nil {
+				return err
+			}
+			status = StatusDone
+			applied = true
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE enrichment_items SET status = $2, claimed_until = NULL, updated_at = now() WHERE id = $1", itemID, status)
+		return err
+	})
+	return applied, err
+}
+
+// Fail releases a claimed item after an error. It becomes pending again
+// until MaxAttempts is reached.
+func (repo *Repo) Fail(ctx context.Context, workerID string, itemID int64, cause error) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `UPDATE enrichment_items SET
+			status = CASE WHEN attempts >= $4 THEN 'failed' ELSE 'pending' END,
+			last_error = $3, worker_id = NULL, claimed_until = NULL, updated_at = now()
+		WHERE id = $1 AND status = 'claimed' AND worker_id = $2`, itemID, workerID, cause.Error(), repo.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotClaimed
+	}
+	return nil
+}
+
+// SetManual records that an admin edited field by hand, protecting the
+// value from being overwritten by enrichment.
+func (repo *Repo) SetManual(ctx context.Context, bookID int64, field string) error {
+	if _, ok := fieldColumns[field]; !ok {
+		return ErrUnknownField
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO book_field_provenance (book_id, field, source, confidence) VALUES ($1, $2, $3, 1)
+		ON CONFLICT (book_id, field) DO UPDATE SET source = EXCLUDED.source, confidence = 1, applied_at = now()`,
+		bookID, field, SourceManual)
+	return err
+}
+
+func (repo *Repo) Provenance(ctx context.Context, bookID int64) ([]Provenance, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT book_id, field, source, confidence, applied_at FROM book_field_provenance
+		WHERE book_id = $1 ORDER BY field`, bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Provenance])
+}
@@ -0,0 +1,201 @@
+package errjournal
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	ClassSiteDown          = "site_down"
+	ClassAuthExpired       = "auth_expired"
+	ClassNotFound          = "not_found"
+	ClassFormatUnsupported = "format_unsupported"
+	ClassUnknown           = "unknown"
+)
+
+// Class is a stable failure category. Raw worker errors change with every
+// site layout update; classes don't, so stats and user messages key on them.
+type Class struct {
+	Class       string `db:"class"`
+	Description string `db:"description"`
+	Retryable   bool   `db:"retryable"`
+}
+
+// Rule maps raw errors matching Pattern (a case-insensitive regexp) to
+// Class. Rules with a Site only apply to that site and win over generic
+// ones; lower Priority values are tried first.
+type Rule struct {
+	ID       int64  `db:"id"`
+	Class    string `db:"class"`
+	Site     string `db:"site"`
+	Pattern  string `db:"pattern"`
+	Priority int    `db:"priority"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140019,
+		Name:    "create_error_classes",
+		Up: `CREATE TABLE error_classes (
+			class       TEXT PRIMARY KEY,
+			description TEXT NOT NULL,
+			retryable   BOOLEAN NOT NULL DEFAULT false
+		);
+		INSERT INTO error_classes (class, description, retryable) VALUES
+			('site_down', 'Source site is unreachable or overloaded', true),
+			('auth_expired', 'Site credentials or session are no longer valid', true),
+			('not_found', 'The book does not exist on the site', false),
+			('format_unsupported', 'The requested format cannot be produced', false),
+			('unknown', 'Unclassified failure', true);
+		CREATE TABLE error_class_rules (
+			id       BIGSERIAL PRIMARY KEY,
+			class    TEXT NOT NULL REFERENCES error_classes (class),
+			site     TEXT NOT NULL DEFAULT '',
+			pattern  TEXT NOT NULL,
+			priority INT NOT NULL DEFAULT 100
+		);
+		INSERT INTO error_class_rules (class, pattern, priority) VALUES
+			('format_unsupported', 'unsupported format|format not supported|cannot convert|conversion failed', 10),
+			('not_found', '\m404\M|not found|no such book|has been deleted', 20),
+			('auth_expired', '\m40[13]\M|unauthori[sz]ed|forbidden|login required|session expired', 30),
+			('site_down', 'connection refused|no such host|timed? ?out|\m50[234]\M|bad gateway|service unavailable', 40);
+		UPDATE user_errors SET error_class = 'unknown' WHERE error_class NOT IN (SELECT class FROM error_classes);
+		ALTER TABLE user_errors ALTER COLUMN error_class SET DEFAULT 'unknown';
+		ALTER TABLE user_errors ADD CONSTRAINT user_errors_class_fk FOREIGN KEY (error_class) REFERENCES error_classes (class);`,
+		Down: `ALTER TABLE user_errors DROP CONSTRAINT user_errors_class_fk; ALTER TABLE user_errors ALTER COLUMN error_class SET DEFAULT ''; DROP TABLE error_class_rules; DROP TABLE error_classes;`,
+	})
+	database.RegisterModel(database.Model{Table: "error_classes", Struct: Class{}})
+	database.RegisterModel(database.Model{Table: "error_class_rules", Struct: Rule{}})
+}
+
+type compiledRule struct {
+	Rule
+	re *regexp.Regexp
+}
+
+// Classifier matches raw errors against the rules loaded from the
+// database. Call Reload after editing rules; it's safe for concurrent use.
+type Classifier struct {
+	session *database.DB_Session
+
+	mu       sync.RWMutex
+	rules    []compiledRule
+	loadedAt time.Time
+}
+
+func NewClassifier(session *database.DB_Session) *Classifier {
+	return &Classifier{session: session}
+}
+
+// postgresWordBoundaries translates the \m and \M word anchors used in the
+// seeded patterns (so they also work with ~* in SQL) to Go's \b.
+var postgresWordBoundaries = regexp.MustCompile(`\\[mM]`)
+
+func (c *Classifier) Reload(ctx context.Context) error {
+	conn, err := c.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id, class, site, pattern, priority FROM error_class_rules
+		ORDER BY site = '', priority, id`)
+	if err != nil {
+		return err
+	}
+	rules, err := pgx.CollectRows(rows, pgx.RowToStructByName[Rule])
+	if err != nil {
+		return err
+	}
+
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile("(?i)" + postgresWordBoundaries.ReplaceAllString(rule.Pattern, `\b`))
+		if err != nil {
+			c.session.Logger().Log(database.LevelWarn, "DB error class rule has invalid pattern", database.F("rule_id", rule.ID), database.F("error", err))
+			continue
+		}
+		compiled = append(compiled, compiledRule{Rule: rule, re: re})
+	}
+
+	c.mu.Lock()
+	c.rules = compiled
+	c.loadedAt = c.session.Clock().Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// Classify returns the class of a raw error message from site, or
+// ClassUnknown.
+func (c *Classifier) Classify(site, message string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, rule := range c.rules {
+		if rule.Site != "" && rule.Site != site {
+			continue
+		}
+		if rule.re.MatchString(message) {
+			return rule.Class
+		}
+	}
+	return ClassUnknown
+}
+
+func (c *Classifier) AddRule(ctx context.Context, rule Rule) error {
+	if _, err := regexp.Compile(rule.Pattern); err != nil {
+		return err
+	}
+
+	conn, err := c.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, "INSERT INTO error_class_rules (class, site, pattern, priority) VALUES ($1, $2, $3, $4)",
+		rule.Class, rule.Site, rule.Pattern, rule.Priority)
+	conn.Release()
+	if err != nil {
+		return err
+	}
+	return c.Reload(ctx)
+}
+
+func (c *Classifier) Classes(ctx context.Context) ([]Class, error) {
+	conn, err := c.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT class, description, retryable FROM error_classes ORDER BY class")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Class])
+}
+
+type ClassCount struct {
+	Class string `db:"error_class"`
+	Site  string `db:"site"`
+	Count int64  `db:"count"`
+}
+
+// ClassCounts aggregates journaled failures by class and site since.
+func (repo *Repo) ClassCounts(ctx context.Context, since time.Time) ([]ClassCount, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT error_class, site, count(*) AS count FROM user_errors
+		WHERE created_at >= $1 GROUP BY error_class, site ORDER BY count DESC`, since)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[ClassCount])
+}
@@ -0,0 +1,107 @@
+package errjournal
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultKeep = 20
+
+// Entry is one failed download as support needs to see it.
+type Entry struct {
+	ID         int64     `db:"id"`
+	UserID     int64     `db:"user_id"`
+	TaskID     *int64    `db:"task_id"`
+	BookID     *int64    `db:"book_id"`
+	Site       string    `db:"site"`
+	URL        string    `db:"url"`
+	ErrorClass string    `db:"error_class"`
+	Message    string    `db:"message"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+const columns = "id, user_id, task_id, book_id, site, url, error_class, message, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140018,
+		Name:    "create_user_errors",
+		Up: `CREATE TABLE user_errors (
+			id          BIGSERIAL PRIMARY KEY,
+			user_id     BIGINT NOT NULL,
+			task_id     BIGINT,
+			book_id     BIGINT,
+			site        TEXT NOT NULL DEFAULT '',
+			url         TEXT NOT NULL DEFAULT '',
+			error_class TEXT NOT NULL DEFAULT '',
+			message     TEXT NOT NULL DEFAULT '',
+			created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX user_errors_user_idx ON user_errors (user_id, id DESC);`,
+		Down: `DROP TABLE user_errors;`,
+	})
+	database.RegisterModel(database.Model{Table: "user_errors", Struct: Entry{}, Indexes: []string{"user_errors_user_idx"}})
+}
+
+// Repo keeps only the last Keep entries per user. Entries recorded without
+// an ErrorClass are classified with Classifier.
+type Repo struct {
+	session    *database.DB_Session
+	Keep       int
+	Classifier *Classifier
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session, Keep: defaultKeep}
+}
+
+// Record journals a failed download and trims the user's journal.
+func (repo *Repo) Record(ctx context.Context, e Entry) error {
+	if e.ErrorClass == "" {
+		e.ErrorClass = ClassUnknown
+		if repo.Classifier != nil {
+			e.ErrorClass = repo.Classifier.Classify(e.Site, e.Message)
+		}
+	}
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO user_errors (user_id, task_id, book_id, site, url, error_class, message)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`, e.UserID, e.TaskID, e.BookID, e.Site, e.URL, e.ErrorClass, e.Message)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM user_errors WHERE user_id = $1 AND id < (
+				SELECT min(id) FROM (SELECT id FROM user_errors WHERE user_id = $1 ORDER BY id DESC LIMIT $2) kept
+			)`, e.UserID, repo.Keep)
+		return err
+	})
+}
+
+// GetRecentErrors returns the user's journal, newest first.
+func (repo *Repo) GetRecentErrors(ctx context.Context, userID int64) ([]Entry, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+" FROM user_errors WHERE user_id = $1 ORDER BY id DESC LIMIT $2", userID, repo.Keep)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Entry])
+}
+
+// Clear empties the journal of userID, e.g. after support resolved it.
+func (repo *Repo) Clear(ctx context.Context, userID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM user_errors WHERE user_id = $1", userID)
+	return err
+}
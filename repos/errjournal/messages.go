@@ -0,0 +1,55 @@
+package errjournal
+
+import (
+	"context"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/i18n"
+)
+
+const messageKeyPrefix = "error_class."
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140021,
+		Name:    "seed_error_class_messages",
+		Up: `INSERT INTO translations (key, lang, text) VALUES
+			('error_class.site_down', 'en', 'The site is not responding right now. The download will be retried automatically.'),
+			('error_class.site_down', 'ru', 'Сайт сейчас не отвечает. Мы повторим загрузку автоматически.'),
+			('error_class.auth_expired', 'en', 'The bot lost access to this site. We are fixing it, please try again later.'),
+			('error_class.auth_expired', 'ru', 'Бот потерял доступ к этому сайту. Мы уже чиним, попробуйте позже.'),
+			('error_class.not_found', 'en', 'This book was not found on the site. It may have been removed.'),
+			('error_class.not_found', 'ru', 'Книга не найдена на сайте. Возможно, её удалили.'),
+			('error_class.format_unsupported', 'en', 'This book cannot be converted to the requested format. Try another one.'),
+			('error_class.format_unsupported', 'ru', 'Эту книгу нельзя сконвертировать в выбранный формат. Попробуйте другой.'),
+			('error_class.unknown', 'en', 'Something went wrong while downloading. Please try again later.'),
+			('error_class.unknown', 'ru', 'Что-то пошло не так при загрузке. Попробуйте позже.')
+		ON CONFLICT (key, lang) DO NOTHING;`,
+		Down: `DELETE FROM translations WHERE key LIKE 'error\_class.%';`,
+	})
+}
+
+// Messages maps error classes to the explanation shown to users, so the
+// bot and the data layer phrase failures the same way.
+type Messages struct {
+	i18n *i18n.Repo
+}
+
+func NewMessages(translations *i18n.Repo) *Messages {
+	return &Messages{i18n: translations}
+}
+
+// GetUserMessage returns the localized message for errClass, falling back
+// to the unknown class when a class has no text yet.
+func (m *Messages) GetUserMessage(ctx context.Context, errClass, lang string) (string, error) {
+	text, err := m.i18n.Get(ctx, messageKeyPrefix+errClass, lang)
+	if err == i18n.ErrMissing && errClass != ClassUnknown {
+		return m.i18n.Get(ctx, messageKeyPrefix+ClassUnknown, lang)
+	}
+	return text, err
+}
+
+// SetUserMessage changes the text shown for errClass in lang.
+func (m *Messages) SetUserMessage(ctx context.Context, errClass, lang, text string) error {
+	return m.i18n.Set(ctx, messageKeyPrefix+errClass, lang, text)
+}
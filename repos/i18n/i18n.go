@@ -0,0 +1,155 @@
+package i18n
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	DefaultLang     = "en"
+	defaultCacheTTL = 5 * time.Minute
+)
+
+var ErrMissing = errors.New("translation missing")
+
+type Translation struct {
+	Key       string    `db:"key"`
+	Lang      string    `db:"lang"`
+	Text      string    `db:"text"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140020,
+		Name:    "create_translations",
+		Up: `CREATE TABLE translations (
+			key        TEXT NOT NULL,
+			lang       TEXT NOT NULL,
+			text       TEXT NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (key, lang)
+		);`,
+		Down: `DROP TABLE translations;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140077,
+		Name:    "touch_translations",
+		Up:      database.TouchUpdatedAtSQL("translations"),
+		Down:    `DROP TRIGGER translations_touch_updated_at ON translations;`,
+	})
+	database.RegisterModel(database.Model{Table: "translations", Struct: Translation{}})
+}
+
+// Repo serves translations from an in-memory copy of the table that is
+// refreshed every few minutes, so lookups on the message path don't hit
+// the database.
+type Repo struct {
+	session *database.DB_Session
+	ttl     time.Duration
+
+	mu       sync.RWMutex
+	texts    map[string]string
+	loadedAt time.Time
+}
+
+// New caches translations for the session's Cache.TranslationsTTLSec.
+func New(session *database.DB_Session) *Repo {
+	ttl := time.Duration(session.Params().Cache.TranslationsTTLSec) * time.Second
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	return &Repo{session: session, ttl: ttl}
+}
+
+func cacheKey(key, lang string) string {
+	return lang + "\x00" + key
+}
+
+// Reload refreshes the in-memory copy.
+func (repo *Repo) Reload(ctx context.Context) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT key, lang, text, updated_at FROM translations")
+	if err != nil {
+		return err
+	}
+	list, err := pgx.CollectRows(rows, pgx.RowToStructByName[Translation])
+	if err != nil {
+		return err
+	}
+
+	texts := make(map[string]string, len(list))
+	for _, t := range list {
+		texts[cacheKey(t.Key, t.Lang)] = t.Text
+	}
+
+	repo.mu.Lock()
+	repo.texts = texts
+	repo.loadedAt = repo.session.Clock().Now()
+	repo.mu.Unlock()
+	return nil
+}
+
+func (repo *Repo) lookup(key, lang string) (string, bool, bool) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	text, ok := repo.texts[cacheKey(key, lang)]
+	return text, ok, repo.session.Clock().Now().Sub(repo.loadedAt) < repo.ttl
+}
+
+// Get returns the text of key in lang, falling back from a regional
+// variant ("pt-br") to the base language and then to DefaultLang.
+func (repo *Repo) Get(ctx context.Context, key, lang string) (string, error) {
+	if _, _, fresh := repo.lookup(key, lang); !fresh {
+		if err := repo.Reload(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	lang = strings.ToLower(lang)
+	candidates := []string{lang}
+	if base, _, ok := strings.Cut(lang, "-"); ok {
+		candidates = append(candidates, base)
+	}
+	candidates = append(candidates, DefaultLang)
+
+	for _, l := range candidates {
+		if text, ok, _ := repo.lookup(key, l); ok {
+			return text, nil
+		}
+	}
+	return "", ErrMissing
+}
+
+// Set stores a translation and updates the in-memory copy.
+func (repo *Repo) Set(ctx context.Context, key, lang, text string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO translations (key, lang, text) VALUES ($1, $2, $3)
+		ON CONFLICT (key, lang) DO UPDATE SET text = EXCLUDED.text, updated_at = now()`, key, strings.ToLower(lang), text)
+	if err != nil {
+		return err
+	}
+
+	repo.mu.Lock()
+	if repo.texts != nil {
+		repo.texts[cacheKey(key, strings.ToLower(lang))] = text
+	}
+	repo.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,233 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	_ "github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/RedBuld/book_bot_database/repos/preferences"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrDigestLost = errors.New("digest claim expired or unknown")
+
+// Notification is a message waiting in the outbox for its user, such as a
+// new chapter of a subscribed series. DigestID and ClaimedUntil are set
+// while a digest holding it is being sent.
+type Notification struct {
+	ID           int64           `db:"id"`
+	UserID       int64           `db:"user_id"`
+	Kind         string          `db:"kind"`
+	BookID       *int64          `db:"book_id"`
+	SeriesID     *int64          `db:"series_id"`
+	Payload      json.RawMessage `db:"payload"`
+	CreatedAt    time.Time       `db:"created_at"`
+	DigestID     *int64          `db:"digest_id"`
+	ClaimedUntil *time.Time      `db:"claimed_until"`
+	SentAt       *time.Time      `db:"sent_at"`
+}
+
+// Digest is the pending notifications of one user claimed to be sent as
+// one message. Groups hold them by series, in the order their oldest
+// notification was queued; notifications without a series form a group
+// of their own.
+type Digest struct {
+	ID     int64
+	UserID int64
+	Groups []Group
+}
+
+type Group struct {
+	SeriesID *int64
+	Items    []Notification
+}
+
+const columns = "id, user_id, kind, book_id, series_id, payload, created_at, digest_id, claimed_until, sent_at"
+
+var qualifiedColumns = "n." + strings.ReplaceAll(columns, ", ", ", n.")
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140058,
+		Name:    "create_notification_outbox",
+		Up: `CREATE TABLE notification_outbox (
+			id            BIGSERIAL PRIMARY KEY,
+			user_id       BIGINT NOT NULL,
+			kind          TEXT NOT NULL,
+			book_id       BIGINT REFERENCES books (id) ON DELETE CASCADE,
+			series_id     BIGINT REFERENCES series (id) ON DELETE SET NULL,
+			payload       JSONB NOT NULL DEFAULT '{}',
+			created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+			digest_id     BIGINT,
+			claimed_until TIMESTAMPTZ,
+			sent_at       TIMESTAMPTZ
+		);
+		CREATE INDEX notification_outbox_pending_idx ON notification_outbox (user_id, created_at) WHERE sent_at IS NULL;
+		CREATE INDEX notification_outbox_digest_idx ON notification_outbox (digest_id) WHERE digest_id IS NOT NULL;
+		CREATE SEQUENCE notification_digest_seq;`,
+		Down: `DROP SEQUENCE notification_digest_seq; DROP TABLE notification_outbox;`,
+	})
+	database.RegisterModel(database.Model{Table: "notification_outbox", Struct: Notification{}, Indexes: []string{
+		"notification_outbox_pending_idx", "notification_outbox_digest_idx",
+	}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// Enqueue queues n for its user; only UserID, Kind, BookID, SeriesID and
+// Payload are used.
+func (repo *Repo) Enqueue(ctx context.Context, n Notification) (*Notification, error) {
+	if n.Payload == nil {
+		n.Payload = json.RawMessage("{}")
+	}
+
+	return database.QueryOne[Notification](ctx, repo.session, `INSERT INTO notification_outbox (user_id, kind, book_id, series_id, payload)
+		VALUES ($1, $2, $3, $4, $5) RETURNING `+columns, n.UserID, n.Kind, n.BookID, n.SeriesID, n.Payload)
+}
+
+// ClaimDigests claims the digests of up to maxDigests users, those waiting
+// the longest first, each with the user's maxItems oldest pending
+// notifications; the rest wait for the next digest. A digest is claimed
+// with one statement, so it is never split between workers, and users
+// with a digest still being sent are skipped. A digest that is neither
+// sent nor released within lease can be claimed again. Notifications
+// about a series or book the user muted are dropped instead.
+func (repo *Repo) ClaimDigests(ctx context.Context, maxItems, maxDigests int, lease time.Duration) ([]Digest, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `DELETE FROM notification_outbox o
+		WHERE o.sent_at IS NULL AND (o.claimed_until IS NULL OR o.claimed_until < now())
+			AND `+preferences.MutedSQL("o.user_id", "o.series_id", "o.book_id", "NULL", "now()"))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `WITH users AS (
+			SELECT user_id FROM notification_outbox
+			WHERE sent_at IS NULL
+			GROUP BY user_id
+			HAVING bool_and(claimed_until IS NULL OR claimed_until < now())
+			ORDER BY min(created_at)
+			LIMIT $2
+		), digests AS (
+			SELECT user_id, nextval('notification_digest_seq') AS digest_id FROM users
+		), picked AS (
+			SELECT o.id, d.digest_id FROM digests d, LATERAL (
+				SELECT id FROM notification_outbox
+				WHERE user_id = d.user_id AND sent_at IS NULL
+				ORDER BY created_at, id LIMIT $1
+				FOR UPDATE
+			) o
+		)
+		UPDATE notification_outbox n SET digest_id = p.digest_id, claimed_until = now() + $3::interval
+		FROM picked p
+		WHERE n.id = p.id AND n.sent_at IS NULL AND (n.claimed_until IS NULL OR n.claimed_until < now())
+		RETURNING `+qualifiedColumns, maxItems, maxDigests, lease)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := pgx.CollectRows(rows, pgx.RowToStructByName[Notification])
+	if err != nil {
+		return nil, err
+	}
+	return buildDigests(claimed), nil
+}
+
+// buildDigests groups claimed notifications by digest and, within one,
+// by series, keeping the queue order.
+func buildDigests(claimed []Notification) []Digest {
+	sort.Slice(claimed, func(i, j int) bool {
+		if !claimed[i].CreatedAt.Equal(claimed[j].CreatedAt) {
+			return claimed[i].CreatedAt.Before(claimed[j].CreatedAt)
+		}
+		return claimed[i].ID < claimed[j].ID
+	})
+	var digests []Digest
+	index := map[int64]int{}
+	for _, n := range claimed {
+		i, ok := index[*n.DigestID]
+		if !ok {
+			i = len(digests)
+			index[*n.DigestID] = i
+			digests = append(digests, Digest{ID: *n.DigestID, UserID: n.UserID})
+		}
+		digests[i].add(n)
+	}
+	return digests
+}
+
+func (d *Digest) add(n Notification) {
+	for i := range d.Groups {
+		if sameSeries(d.Groups[i].SeriesID, n.SeriesID) {
+			d.Groups[i].Items = append(d.Groups[i].Items, n)
+			return
+		}
+	}
+	d.Groups = append(d.Groups, Group{SeriesID: n.SeriesID, Items: []Notification{n}})
+}
+
+func sameSeries(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// Count returns the number of notifications in the digest.
+func (d *Digest) Count() int {
+	n := 0
+	for _, g := range d.Groups {
+		n += len(g.Items)
+	}
+	return n
+}
+
+// MarkSent records that digestID was delivered. It fails with
+// ErrDigestLost when the claim expired and the notifications may be
+// claimed by another digest.
+func (repo *Repo) MarkSent(ctx context.Context, digestID int64) error {
+	return repo.finish(ctx, "sent_at = now(), claimed_until = NULL", digestID)
+}
+
+// Release returns the notifications of digestID to the queue unsent, e.g.
+// after a failed delivery.
+func (repo *Repo) Release(ctx context.Context, digestID int64) error {
+	return repo.finish(ctx, "digest_id = NULL, claimed_until = NULL", digestID)
+}
+
+func (repo *Repo) finish(ctx context.Context, set string, digestID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "UPDATE notification_outbox SET "+set+`
+		WHERE digest_id = $1 AND sent_at IS NULL AND claimed_until >= now()`, digestID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDigestLost
+	}
+	return nil
+}
+
+// PurgeSent drops notifications sent more than keep ago.
+func (repo *Repo) PurgeSent(ctx context.Context, keep time.Duration) (int64, error) {
+	return repo.session.DeleteInBatches(ctx, "notification_outbox", "sent_at < now() - $1::interval", 0, 0, nil, keep)
+}
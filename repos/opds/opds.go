@@ -0,0 +1,213 @@
+package opds
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Page selects a slice of a feed. Number starts at 1.
+type Page struct {
+	Number int
+	Size   int
+}
+
+func (p Page) normalize() Page {
+	if p.Number < 1 {
+		p.Number = 1
+	}
+	if p.Size <= 0 {
+		p.Size = defaultPageSize
+	}
+	if p.Size > maxPageSize {
+		p.Size = maxPageSize
+	}
+	return p
+}
+
+func (p Page) offset() int {
+	return (p.Number - 1) * p.Size
+}
+
+// Feed is one page of a feed plus the total needed for next/last links.
+type Feed[T any] struct {
+	Items   []T
+	Total   int64
+	Page    int
+	Size    int
+	Updated time.Time
+}
+
+func (f Feed[T]) HasNext() bool {
+	return int64(f.Page*f.Size) < f.Total
+}
+
+// NavEntry is a navigation feed entry (an author, a series or a genre).
+type NavEntry struct {
+	ID      string    `db:"id"`
+	Title   string    `db:"title"`
+	Count   int64     `db:"count"`
+	Updated time.Time `db:"updated"`
+}
+
+// Entry is the projection of a book needed for an acquisition feed entry.
+type Entry struct {
+	ID             int64     `db:"id"`
+	Title          string    `db:"title"`
+	Author         *string   `db:"author"`
+	AuthorID       *int64    `db:"author_id"`
+	Series         *string   `db:"series"`
+	SeriesPosition *int      `db:"series_position"`
+	Summary        string    `db:"summary"`
+	CoverURL       string    `db:"cover_url"`
+	Language       string    `db:"language"`
+	Genres         []string  `db:"genres"`
+	Updated        time.Time `db:"updated"`
+}
+
+// Filter narrows acquisition feeds. Zero values mean "any". ViewerID
+// applies that user's or chat's content filter.
+type Filter struct {
+	ViewerID     int64
+	AuthorID     int64
+	SeriesID     int64
+	Genre        string
+	UpdatedSince time.Time
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+var entrySelect = `SELECT b.id, b.title, a.name AS author, b.author_id, s.title AS series, b.series_position,
+		b.description AS summary, b.cover_url, b.language, b.genres, b.updated_at AS updated,
+		count(*) OVER () AS total
+	FROM books b
+	LEFT JOIN authors a ON a.id = b.author_id
+	LEFT JOIN series s ON s.id = b.series_id
+	WHERE ` + books.Visible("b") + `
+		AND ($1::bigint = 0 OR b.author_id = $1)
+		AND ($2::bigint = 0 OR b.series_id = $2)
+		AND ($3::text = '' OR $3 = ANY(b.genres))
+		AND ($4::timestamptz IS NULL OR b.updated_at > $4)
+		AND ` + books.AllowedFor("b", "$7")
+
+type entryRow struct {
+	Entry
+	Total int64 `db:"total"`
+}
+
+// Entries returns an acquisition feed page. Series feeds are ordered by
+// position, everything else newest first.
+func (repo *Repo) Entries(ctx context.Context, filter Filter, page Page) (*Feed[Entry], error) {
+	page = page.normalize()
+	order := " ORDER BY b.updated_at DESC, b.id DESC"
+	if filter.SeriesID != 0 {
+		order = " ORDER BY b.series_position NULLS LAST, b.id"
+	}
+
+	var since *time.Time
+	if !filter.UpdatedSince.IsZero() {
+		since = &filter.UpdatedSince
+	}
+
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, entrySelect+order+" LIMIT $5 OFFSET $6",
+		filter.AuthorID, filter.SeriesID, filter.Genre, since, page.Size, page.offset(), filter.ViewerID)
+	if err != nil {
+		return nil, err
+	}
+	list, err := pgx.CollectRows(rows, pgx.RowToStructByName[entryRow])
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &Feed[Entry]{Items: make([]Entry, 0, len(list)), Page: page.Number, Size: page.Size}
+	for _, row := range list {
+		feed.Total = row.Total
+		feed.Items = append(feed.Items, row.Entry)
+		if row.Updated.After(feed.Updated) {
+			feed.Updated = row.Updated
+		}
+	}
+	return feed, nil
+}
+
+func (repo *Repo) navigation(ctx context.Context, query string, page Page, args ...any) (*Feed[NavEntry], error) {
+	page = page.normalize()
+
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var total int64
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM ("+query+") nav", args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append(args, page.Size, page.offset())
+	rows, err := conn.Query(ctx, query+" ORDER BY title LIMIT $"+strconv.Itoa(len(args)-1)+" OFFSET $"+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, pgx.RowToStructByName[NavEntry])
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &Feed[NavEntry]{Items: items, Total: total, Page: page.Number, Size: page.Size}
+	for _, item := range items {
+		if item.Updated.After(feed.Updated) {
+			feed.Updated = item.Updated
+		}
+	}
+	return feed, nil
+}
+
+// Authors is the author navigation feed, optionally limited to names
+// starting with prefix.
+func (repo *Repo) Authors(ctx context.Context, prefix string, page Page) (*Feed[NavEntry], error) {
+	return repo.navigation(ctx, `SELECT a.id::text AS id, a.name AS title, count(b.id) AS count,
+			COALESCE(max(b.updated_at), a.created_at) AS updated
+		FROM authors a JOIN books b ON b.author_id = a.id
+		WHERE `+books.Visible("b")+` AND a.name ILIKE $1 || '%'
+		GROUP BY a.id`, page, prefix)
+}
+
+// Series is the series navigation feed, optionally limited to one author.
+func (repo *Repo) Series(ctx context.Context, authorID int64, page Page) (*Feed[NavEntry], error) {
+	return repo.navigation(ctx, `SELECT s.id::text AS id, s.title AS title, count(b.id) AS count,
+			COALESCE(max(b.updated_at), s.created_at) AS updated
+		FROM series s JOIN books b ON b.series_id = s.id
+		WHERE `+books.Visible("b")+` AND ($1::bigint = 0 OR s.author_id = $1)
+		GROUP BY s.id`, page, authorID)
+}
+
+// Genres is the genre navigation feed.
+func (repo *Repo) Genres(ctx context.Context, page Page) (*Feed[NavEntry], error) {
+	return repo.navigation(ctx, `SELECT g AS id, g AS title, count(*) AS count, max(b.updated_at) AS updated
+		FROM books b, unnest(b.genres) AS g
+		WHERE `+books.Visible("b")+`
+		GROUP BY g`, page)
+}
@@ -0,0 +1,206 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+
+	KindCatalogImport = "catalog_import"
+	KindReindex       = "reindex"
+	KindBroadcast     = "broadcast"
+)
+
+var (
+	ErrNotFound  = errors.New("operation not found")
+	ErrCancelled = errors.New("operation cancelled")
+)
+
+// Operation tracks a multi-minute admin job so the bot can poll and show
+// its progress. ResultRef points at whatever the job produced (a file key,
+// a report ID).
+type Operation struct {
+	ID              int64      `db:"id"`
+	Kind            string     `db:"kind"`
+	Status          string     `db:"status"`
+	Done            int64      `db:"done"`
+	Total           int64      `db:"total"`
+	Message         string     `db:"message"`
+	ResultRef       *string    `db:"result_ref"`
+	Error           *string    `db:"error"`
+	CreatedBy       string     `db:"created_by"`
+	CancelRequested bool       `db:"cancel_requested"`
+	CreatedAt       time.Time  `db:"created_at"`
+	UpdatedAt       time.Time  `db:"updated_at"`
+	FinishedAt      *time.Time `db:"finished_at"`
+}
+
+// Progress returns the completed fraction, or -1 when the total is unknown.
+func (op *Operation) Progress() float64 {
+	if op.Total <= 0 {
+		return -1
+	}
+	return float64(op.Done) / float64(op.Total)
+}
+
+func (op *Operation) Finished() bool {
+	return op.FinishedAt != nil
+}
+
+const columns = "id, kind, status, done, total, message, result_ref, error, created_by, cancel_requested, created_at, updated_at, finished_at"
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140022,
+		Name:    "create_operations",
+		Up: `CREATE TABLE operations (
+			id               BIGSERIAL PRIMARY KEY,
+			kind             TEXT NOT NULL,
+			status           TEXT NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed', 'cancelled')),
+			done             BIGINT NOT NULL DEFAULT 0,
+			total            BIGINT NOT NULL DEFAULT 0,
+			message          TEXT NOT NULL DEFAULT '',
+			result_ref       TEXT,
+			error            TEXT,
+			created_by       TEXT NOT NULL,
+			cancel_requested BOOLEAN NOT NULL DEFAULT false,
+			created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finished_at      TIMESTAMPTZ
+		);
+		CREATE INDEX operations_kind_idx ON operations (kind, created_at DESC);`,
+		Down: `DROP TABLE operations;`,
+	})
+	database.RegisterModel(database.Model{Table: "operations", Struct: Operation{}, Indexes: []string{"operations_kind_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+func (repo *Repo) one(ctx context.Context, sql string, args ...any) (*Operation, error) {
+	op, err := database.QueryOne[Operation](ctx, repo.session, sql, args...)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return op, err
+}
+
+func (repo *Repo) Start(ctx context.Context, kind, createdBy string, total int64) (*Operation, error) {
+	return repo.one(ctx, "INSERT INTO operations (kind, created_by, total) VALUES ($1, $2, $3) RETURNING "+columns, kind, createdBy, total)
+}
+
+// Get is the polling API: it returns the current state of the operation.
+func (repo *Repo) Get(ctx context.Context, id int64) (*Operation, error) {
+	return repo.one(ctx, "SELECT "+columns+" FROM operations WHERE id = $1", id)
+}
+
+// Report stores progress. A negative total leaves the total unchanged. It
+// returns ErrCancelled once someone requested cancellation, so the job can
+// stop at its next checkpoint.
+func (repo *Repo) Report(ctx context.Context, id, done, total int64, message string) error {
+	op, err := repo.one(ctx, `UPDATE operations SET done = $2, total = CASE WHEN $3::bigint < 0 THEN total ELSE $3 END,
+			message = $4, updated_at = now()
+		WHERE id = $1 AND finished_at IS NULL RETURNING `+columns, id, done, total, message)
+	if err != nil {
+		return err
+	}
+	if op.CancelRequested {
+		return ErrCancelled
+	}
+	return nil
+}
+
+func (repo *Repo) finish(ctx context.Context, id int64, status string, resultRef, cause *string) error {
+	_, err := repo.one(ctx, `UPDATE operations SET status = $2, result_ref = $3, error = $4,
+			done = CASE WHEN $2 = 'succeeded' AND total > 0 THEN total ELSE done END,
+			updated_at = now(), finished_at = now()
+		WHERE id = $1 AND finished_at IS NULL RETURNING `+columns, id, status, resultRef, cause)
+	return err
+}
+
+func (repo *Repo) Succeed(ctx context.Context, id int64, resultRef string) error {
+	return repo.finish(ctx, id, StatusSucceeded, &resultRef, nil)
+}
+
+func (repo *Repo) Fail(ctx context.Context, id int64, cause error) error {
+	if cause == ErrCancelled {
+		return repo.finish(ctx, id, StatusCancelled, nil, nil)
+	}
+	msg := cause.Error()
+	return repo.finish(ctx, id, StatusFailed, nil, &msg)
+}
+
+// RequestCancel asks a running operation to stop; the job notices on its
+// next Report.
+func (repo *Repo) RequestCancel(ctx context.Context, id int64) error {
+	_, err := repo.one(ctx, "UPDATE operations SET cancel_requested = true WHERE id = $1 AND finished_at IS NULL RETURNING "+columns, id)
+	return err
+}
+
+// List returns recent operations of kind (all kinds if empty), optionally
+// only the unfinished ones.
+func (repo *Repo) List(ctx context.Context, kind string, activeOnly bool, limit int) ([]Operation, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+` FROM operations
+		WHERE ($1 = '' OR kind = $1) AND (NOT $2 OR finished_at IS NULL)
+		ORDER BY created_at DESC LIMIT $3`, kind, activeOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Operation])
+}
+
+// Tracker is handed to jobs run through Run.
+type Tracker struct {
+	repo *Repo
+	ctx  context.Context
+	ID   int64
+}
+
+// Report stores progress; see Repo.Report.
+func (t *Tracker) Report(done, total int64, message string) error {
+	return t.repo.Report(t.ctx, t.ID, done, total, message)
+}
+
+// Run records an operation around fn: it starts it, and marks it succeeded
+// with fn's result reference, or failed/cancelled with fn's error. The
+// operation ID is returned as soon as it's created via started, so callers
+// can run fn in the background and reply with something to poll.
+func (repo *Repo) Run(ctx context.Context, kind, createdBy string, started func(id int64), fn func(t *Tracker) (string, error)) error {
+	op, err := repo.Start(ctx, kind, createdBy, 0)
+	if err != nil {
+		return err
+	}
+	if started != nil {
+		started(op.ID)
+	}
+
+	ref, err := fn(&Tracker{repo: repo, ctx: ctx, ID: op.ID})
+	if err != nil {
+		if finishErr := repo.Fail(context.Background(), op.ID, err); finishErr != nil {
+			repo.session.Logger().Log(database.LevelError, "DB operation failed to record failure", database.F("operation_id", op.ID), database.F("error", finishErr))
+		}
+		return err
+	}
+	return repo.Succeed(context.Background(), op.ID, ref)
+}
@@ -0,0 +1,109 @@
+package preferences
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type MigrateOptions struct {
+	BatchSize int
+	Pause     time.Duration
+	OnBatch   func(Progress)
+}
+
+const defaultBatchSize = 500
+
+// MigratePreferences rewrites every stored preferences document through
+// transform in batches ordered by user ID. Each batch and its cursor are
+// committed together, so an interrupted run resumes where it stopped when
+// called again with the same name; a finished migration is a no-op.
+func MigratePreferences[Old, New any](ctx context.Context, repo *Repo, name string, transform func(Old) (New, error), opts MigrateOptions) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, "INSERT INTO preference_migrations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING", name)
+	conn.Release()
+	if err != nil {
+		return err
+	}
+
+	for {
+		var progress Progress
+		var batch int
+		err = repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, "SELECT "+progressColumns+" FROM preference_migrations WHERE name = $1 FOR UPDATE", name)
+			if err != nil {
+				return err
+			}
+			progress, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Progress])
+			if err != nil || progress.FinishedAt != nil {
+				return err
+			}
+
+			rows, err = tx.Query(ctx, `SELECT user_id, preferences, updated_at FROM user_preferences WHERE user_id > $1
+				ORDER BY user_id LIMIT $2 FOR UPDATE`, progress.LastUserID, opts.BatchSize)
+			if err != nil {
+				return err
+			}
+			docs, err := pgx.CollectRows(rows, pgx.RowToStructByName[Preferences])
+			if err != nil {
+				return err
+			}
+			batch = len(docs)
+			if batch == 0 {
+				_, err = tx.Exec(ctx, "UPDATE preference_migrations SET finished_at = now(), updated_at = now() WHERE name = $1", name)
+				return err
+			}
+
+			for _, doc := range docs {
+				var old Old
+				if err := json.Unmarshal(doc.Preferences, &old); err != nil {
+					return err
+				}
+				updated, err := transform(old)
+				if err != nil {
+					return err
+				}
+				raw, err := json.Marshal(updated)
+				if err != nil {
+					return err
+				}
+				_, err = tx.Exec(ctx, "UPDATE user_preferences SET preferences = $2, updated_at = now() WHERE user_id = $1", doc.UserID, raw)
+				if err != nil {
+					return err
+				}
+			}
+
+			progress.LastUserID = docs[batch-1].UserID
+			progress.Processed += int64(batch)
+			_, err = tx.Exec(ctx, "UPDATE preference_migrations SET last_user_id = $2, processed = $3, updated_at = now() WHERE name = $1",
+				name, progress.LastUserID, progress.Processed)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if progress.FinishedAt != nil || batch == 0 {
+			return nil
+		}
+		if opts.OnBatch != nil {
+			opts.OnBatch(progress)
+		}
+
+		if opts.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-repo.session.Clock().After(opts.Pause):
+			}
+		}
+	}
+}
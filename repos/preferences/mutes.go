@@ -0,0 +1,198 @@
+package preferences
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Kinds of entities a user can mute.
+const (
+	EntitySeries = "series"
+	EntityBook   = "book"
+	EntityAuthor = "author"
+)
+
+const (
+	// suggestMuteAfter dismissals of one entity within suggestMuteWindow
+	// suggest muting it for suggestedMute.
+	suggestMuteAfter  = 3
+	suggestMuteWindow = 7 * 24 * time.Hour
+	suggestedMute     = 30 * 24 * time.Hour
+)
+
+var ErrInvalidEntity = errors.New("invalid mute entity")
+
+// Entity is what a notification is about, e.g. the series of a new
+// chapter.
+type Entity struct {
+	Kind string
+	ID   int64
+}
+
+// Mute silences every notification about an entity for a user until
+// Until.
+type Mute struct {
+	UserID     int64     `db:"user_id"`
+	EntityKind string    `db:"entity_kind"`
+	EntityID   int64     `db:"entity_id"`
+	Until      time.Time `db:"until"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// MuteSuggestion proposes muting an entity the user keeps dismissing.
+type MuteSuggestion struct {
+	Entity     Entity
+	Dismissals int
+	Until      time.Time
+}
+
+const muteColumns = "user_id, entity_kind, entity_id, until, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140059,
+		Name:    "create_notification_mutes",
+		Up: `CREATE TABLE notification_mutes (
+			user_id     BIGINT NOT NULL,
+			entity_kind TEXT NOT NULL CHECK (entity_kind IN ('series', 'book', 'author')),
+			entity_id   BIGINT NOT NULL,
+			until       TIMESTAMPTZ NOT NULL,
+			created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, entity_kind, entity_id)
+		);
+		CREATE TABLE notification_dismissals (
+			user_id      BIGINT NOT NULL,
+			entity_kind  TEXT NOT NULL,
+			entity_id    BIGINT NOT NULL,
+			dismissed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX notification_dismissals_entity_idx ON notification_dismissals (user_id, entity_kind, entity_id, dismissed_at);`,
+		Down: `DROP TABLE notification_dismissals; DROP TABLE notification_mutes;`,
+	})
+	database.RegisterModel(database.Model{Table: "notification_mutes", Struct: Mute{}})
+}
+
+func validEntity(e Entity) bool {
+	switch e.Kind {
+	case EntitySeries, EntityBook, EntityAuthor:
+		return true
+	}
+	return false
+}
+
+// MutedSQL is a condition true when the user in userExpr muted one of the
+// entities of the notification at at, for queries filtering notifications
+// in bulk. Pass NULL for the entities the notification isn't about.
+func MutedSQL(userExpr, seriesExpr, bookExpr, authorExpr, at string) string {
+	return `EXISTS (SELECT 1 FROM notification_mutes m WHERE m.user_id = ` + userExpr + ` AND m.until > ` + at + ` AND (
+		(m.entity_kind = 'series' AND m.entity_id = ` + seriesExpr + `) OR
+		(m.entity_kind = 'book' AND m.entity_id = ` + bookExpr + `) OR
+		(m.entity_kind = 'author' AND m.entity_id = ` + authorExpr + `)))`
+}
+
+// Mute silences notifications about entity for userID until until,
+// replacing an earlier mute of it.
+func (repo *Repo) Mute(ctx context.Context, userID int64, entity Entity, until time.Time) error {
+	if !validEntity(entity) {
+		return ErrInvalidEntity
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO notification_mutes (user_id, entity_kind, entity_id, until) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, entity_kind, entity_id) DO UPDATE SET until = EXCLUDED.until, created_at = now()`,
+		userID, entity.Kind, entity.ID, until)
+	return err
+}
+
+func (repo *Repo) Unmute(ctx context.Context, userID int64, entity Entity) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM notification_mutes WHERE user_id = $1 AND entity_kind = $2 AND entity_id = $3",
+		userID, entity.Kind, entity.ID)
+	return err
+}
+
+// Mutes returns the mutes of userID still active at now, ending soonest
+// first.
+func (repo *Repo) Mutes(ctx context.Context, userID int64, now time.Time) ([]Mute, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+muteColumns+" FROM notification_mutes WHERE user_id = $1 AND until > $2 ORDER BY until",
+		userID, now)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Mute])
+}
+
+// RecordDismissal notes that userID dismissed a notification about
+// entity. On the dismissal that makes several within a week it returns a
+// suggestion to mute the entity, which the bot can offer; otherwise, or
+// when the entity is muted already, it returns nil.
+func (repo *Repo) RecordDismissal(ctx context.Context, userID int64, entity Entity) (*MuteSuggestion, error) {
+	if !validEntity(entity) {
+		return nil, ErrInvalidEntity
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var dismissals int
+	var muted bool
+	var now time.Time
+	err = conn.QueryRow(ctx, `WITH added AS (
+			INSERT INTO notification_dismissals (user_id, entity_kind, entity_id) VALUES ($1, $2, $3)
+		)
+		SELECT 1 + (SELECT count(*) FROM notification_dismissals
+				WHERE user_id = $1 AND entity_kind = $2 AND entity_id = $3 AND dismissed_at > now() - $4::interval),
+			EXISTS (SELECT 1 FROM notification_mutes WHERE user_id = $1 AND entity_kind = $2 AND entity_id = $3 AND until > now()),
+			now()`,
+		userID, entity.Kind, entity.ID, suggestMuteWindow).Scan(&dismissals, &muted, &now)
+	if err != nil {
+		return nil, err
+	}
+	if muted || dismissals != suggestMuteAfter {
+		return nil, nil
+	}
+	return &MuteSuggestion{Entity: entity, Dismissals: dismissals, Until: now.Add(suggestedMute)}, nil
+}
+
+// PurgeDismissals drops dismissals too old to count towards a suggestion,
+// along with expired mutes.
+func (repo *Repo) PurgeDismissals(ctx context.Context) (int64, error) {
+	n, err := repo.session.DeleteInBatches(ctx, "notification_dismissals", "dismissed_at < now() - $1::interval", 0, 0, nil, suggestMuteWindow)
+	if err != nil {
+		return n, err
+	}
+	mutes, err := repo.session.DeleteInBatches(ctx, "notification_mutes", "until < now()", 0, 0, nil)
+	return n + mutes, err
+}
+
+func entityArgs(about []Entity) ([]string, []int64) {
+	kinds := make([]string, len(about))
+	ids := make([]int64, len(about))
+	for i, e := range about {
+		kinds[i], ids[i] = e.Kind, e.ID
+	}
+	return kinds, ids
+}
@@ -0,0 +1,256 @@
+package preferences
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Delivery modes of a notification. Silent messages are sent without a
+// sound; digest-only ones are left for the next digest.
+const (
+	ModeMessage = "message"
+	ModeSilent  = "silent"
+	ModeDigest  = "digest"
+	ModeOff     = "off"
+)
+
+// Any matches every kind or channel in a NotificationRule.
+const Any = "*"
+
+var (
+	ErrInvalidMode       = errors.New("invalid notification mode")
+	ErrInvalidQuietHours = errors.New("invalid quiet hours")
+)
+
+// NotificationRule sets the delivery mode of one kind of notification
+// (a subscription type such as "new_chapter") on one channel, e.g. the
+// private chat or a linked channel. Either can be Any; the most specific
+// rule wins, with the kind weighing more than the channel. Without any
+// rule a notification is sent as a message.
+type NotificationRule struct {
+	UserID    int64     `db:"user_id"`
+	Kind      string    `db:"kind"`
+	Channel   string    `db:"channel"`
+	Mode      string    `db:"mode"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// QuietHours turn messages into silent ones between StartMinute and
+// EndMinute, counted from local midnight in Timezone. The range may wrap
+// past midnight.
+type QuietHours struct {
+	UserID      int64  `db:"user_id"`
+	StartMinute int    `db:"start_minute"`
+	EndMinute   int    `db:"end_minute"`
+	Timezone    string `db:"timezone"`
+}
+
+const (
+	ruleColumns       = "user_id, kind, channel, mode, updated_at"
+	quietHoursColumns = "user_id, start_minute, end_minute, timezone"
+)
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140044,
+		Name:    "create_notification_preferences",
+		Up: `CREATE TABLE notification_rules (
+			user_id    BIGINT NOT NULL,
+			kind       TEXT NOT NULL,
+			channel    TEXT NOT NULL,
+			mode       TEXT NOT NULL CHECK (mode IN ('message', 'silent', 'digest', 'off')),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (user_id, kind, channel)
+		);
+		CREATE TABLE notification_quiet_hours (
+			user_id      BIGINT PRIMARY KEY,
+			start_minute SMALLINT NOT NULL CHECK (start_minute BETWEEN 0 AND 1439),
+			end_minute   SMALLINT NOT NULL CHECK (end_minute BETWEEN 0 AND 1439),
+			timezone     TEXT NOT NULL
+		);
+		CREATE FUNCTION notification_mode(p_user_id BIGINT, p_kind TEXT, p_channel TEXT, p_at TIMESTAMPTZ)
+		RETURNS TEXT LANGUAGE sql STABLE AS $$
+			WITH rule AS (
+				SELECT COALESCE((
+					SELECT mode FROM notification_rules
+					WHERE user_id = p_user_id AND kind IN (p_kind, '*') AND channel IN (p_channel, '*')
+					ORDER BY kind = '*', channel = '*' LIMIT 1
+				), 'message') AS mode
+			), quiet AS (
+				SELECT EXISTS (
+					SELECT 1 FROM notification_quiet_hours q,
+						LATERAL (SELECT extract(hour FROM p_at AT TIME ZONE q.timezone) * 60 +
+							extract(minute FROM p_at AT TIME ZONE q.timezone) AS minute) l
+					WHERE q.user_id = p_user_id AND CASE
+						WHEN q.start_minute <= q.end_minute THEN l.minute >= q.start_minute AND l.minute < q.end_minute
+						ELSE l.minute >= q.start_minute OR l.minute < q.end_minute
+					END
+				) AS active
+			)
+			SELECT CASE WHEN rule.mode = 'message' AND quiet.active THEN 'silent' ELSE rule.mode END
+			FROM rule, quiet
+		$$;`,
+		Down: `DROP FUNCTION notification_mode(BIGINT, TEXT, TEXT, TIMESTAMPTZ);
+		DROP TABLE notification_quiet_hours;
+		DROP TABLE notification_rules;`,
+	})
+	database.RegisterModel(database.Model{Table: "notification_rules", Struct: NotificationRule{}})
+	database.RegisterModel(database.Model{Table: "notification_quiet_hours", Struct: QuietHours{}})
+}
+
+func validMode(mode string) bool {
+	switch mode {
+	case ModeMessage, ModeSilent, ModeDigest, ModeOff:
+		return true
+	}
+	return false
+}
+
+// SetNotificationMode stores the mode for kind on channel, either of which
+// can be Any.
+func (repo *Repo) SetNotificationMode(ctx context.Context, userID int64, kind, channel, mode string) error {
+	if !validMode(mode) {
+		return ErrInvalidMode
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO notification_rules (user_id, kind, channel, mode) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, kind, channel) DO UPDATE SET mode = EXCLUDED.mode, updated_at = now()`,
+		userID, kind, channel, mode)
+	return err
+}
+
+// ClearNotificationMode drops the rule for kind on channel, falling back
+// to the less specific ones.
+func (repo *Repo) ClearNotificationMode(ctx context.Context, userID int64, kind, channel string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM notification_rules WHERE user_id = $1 AND kind = $2 AND channel = $3",
+		userID, kind, channel)
+	return err
+}
+
+func (repo *Repo) NotificationRules(ctx context.Context, userID int64) ([]NotificationRule, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+ruleColumns+" FROM notification_rules WHERE user_id = $1 ORDER BY kind, channel", userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[NotificationRule])
+}
+
+// SetQuietHours replaces the quiet hours of q.UserID.
+func (repo *Repo) SetQuietHours(ctx context.Context, q QuietHours) error {
+	if q.StartMinute < 0 || q.StartMinute >= 24*60 || q.EndMinute < 0 || q.EndMinute >= 24*60 || q.StartMinute == q.EndMinute {
+		return ErrInvalidQuietHours
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return ErrInvalidQuietHours
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO notification_quiet_hours (user_id, start_minute, end_minute, timezone)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO UPDATE SET start_minute = EXCLUDED.start_minute,
+			end_minute = EXCLUDED.end_minute, timezone = EXCLUDED.timezone`,
+		q.UserID, q.StartMinute, q.EndMinute, q.Timezone)
+	return err
+}
+
+// GetQuietHours returns nil if userID has no quiet hours.
+func (repo *Repo) GetQuietHours(ctx context.Context, userID int64) (*QuietHours, error) {
+	q, err := database.QueryOne[QuietHours](ctx, repo.session, "SELECT "+quietHoursColumns+" FROM notification_quiet_hours WHERE user_id = $1", userID)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return q, err
+}
+
+func (repo *Repo) ClearQuietHours(ctx context.Context, userID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM notification_quiet_hours WHERE user_id = $1", userID)
+	return err
+}
+
+// mutedAbout is true when the user in userExpr muted one of the entities
+// in the arrays $5 (kinds) and $6 (IDs) at $4.
+func mutedAbout(userExpr string) string {
+	return `EXISTS (SELECT 1 FROM notification_mutes m, unnest($5::text[], $6::bigint[]) AS a (kind, id)
+		WHERE m.user_id = ` + userExpr + ` AND m.entity_kind = a.kind AND m.entity_id = a.id AND m.until > $4::timestamptz)`
+}
+
+// ShouldNotify returns how a notification of kind on channel is delivered
+// to userID at now: one of the modes, with quiet hours applied. It is
+// ModeOff when the user muted any of the entities the notification is
+// about.
+func (repo *Repo) ShouldNotify(ctx context.Context, userID int64, kind, channel string, now time.Time, about ...Entity) (string, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Release()
+
+	kinds, ids := entityArgs(about)
+	var mode string
+	err = conn.QueryRow(ctx, "SELECT CASE WHEN "+mutedAbout("$1")+` THEN 'off'
+		ELSE notification_mode($1::bigint, $2::text, $3::text, $4::timestamptz) END`,
+		userID, kind, channel, now, kinds, ids).Scan(&mode)
+	return mode, err
+}
+
+// NotifyModes is ShouldNotify for a fan-out to many users in one query.
+// Users whose mode is ModeOff are left out.
+func (repo *Repo) NotifyModes(ctx context.Context, userIDs []int64, kind, channel string, now time.Time, about ...Entity) (map[int64]string, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	kinds, ids := entityArgs(about)
+	rows, err := conn.Query(ctx, `SELECT u.id, m.mode FROM unnest($1::bigint[]) AS u (id),
+			LATERAL (SELECT notification_mode(u.id, $2::text, $3::text, $4::timestamptz) AS mode) m
+		WHERE m.mode <> 'off' AND NOT `+mutedAbout("u.id"), userIDs, kind, channel, now, kinds, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	modes := make(map[int64]string, len(userIDs))
+	for rows.Next() {
+		var userID int64
+		var mode string
+		if err := rows.Scan(&userID, &mode); err != nil {
+			return nil, err
+		}
+		modes[userID] = mode
+	}
+	return modes, rows.Err()
+}
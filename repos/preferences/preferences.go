@@ -0,0 +1,105 @@
+package preferences
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+type Preferences struct {
+	UserID      int64           `db:"user_id"`
+	Preferences json.RawMessage `db:"preferences"`
+	UpdatedAt   time.Time       `db:"updated_at"`
+}
+
+type Progress struct {
+	Name       string     `db:"name"`
+	LastUserID int64      `db:"last_user_id"`
+	Processed  int64      `db:"processed"`
+	StartedAt  time.Time  `db:"started_at"`
+	UpdatedAt  time.Time  `db:"updated_at"`
+	FinishedAt *time.Time `db:"finished_at"`
+}
+
+const progressColumns = "name, last_user_id, processed, started_at, updated_at, finished_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140001,
+		Name:    "create_user_preferences",
+		Up: `CREATE TABLE user_preferences (
+			user_id     BIGINT PRIMARY KEY,
+			preferences JSONB NOT NULL DEFAULT '{}',
+			updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE preference_migrations (
+			name         TEXT PRIMARY KEY,
+			last_user_id BIGINT NOT NULL DEFAULT 0,
+			processed    BIGINT NOT NULL DEFAULT 0,
+			started_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finished_at  TIMESTAMPTZ
+		);`,
+		Down: `DROP TABLE preference_migrations; DROP TABLE user_preferences;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140075,
+		Name:    "touch_user_preferences",
+		Up: database.TouchUpdatedAtSQL("user_preferences") +
+			database.TouchUpdatedAtSQL("preference_migrations") +
+			database.TouchUpdatedAtSQL("notification_rules"),
+		Down: `DROP TRIGGER user_preferences_touch_updated_at ON user_preferences; DROP TRIGGER preference_migrations_touch_updated_at ON preference_migrations; DROP TRIGGER notification_rules_touch_updated_at ON notification_rules;`,
+	})
+	database.RegisterModel(database.Model{Table: "user_preferences", Struct: Preferences{}})
+	database.RegisterModel(database.Model{Table: "preference_migrations", Struct: Progress{}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// Get returns the raw preferences document of userID, or "{}" if the user
+// has none stored.
+func (repo *Repo) Get(ctx context.Context, userID int64) (json.RawMessage, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var prefs json.RawMessage
+	err = conn.QueryRow(ctx, "SELECT preferences FROM user_preferences WHERE user_id = $1", userID).Scan(&prefs)
+	if err == pgx.ErrNoRows {
+		return json.RawMessage("{}"), nil
+	}
+	return prefs, err
+}
+
+func (repo *Repo) Set(ctx context.Context, userID int64, prefs json.RawMessage) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO user_preferences (user_id, preferences) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET preferences = EXCLUDED.preferences, updated_at = now()`, userID, prefs)
+	return err
+}
+
+// GetProgress returns the state of the named preference migration, or nil
+// if it never ran.
+func (repo *Repo) GetProgress(ctx context.Context, name string) (*Progress, error) {
+	progress, err := database.QueryOne[Progress](ctx, repo.session, "SELECT "+progressColumns+" FROM preference_migrations WHERE name = $1", name)
+	if database.IsNotFound(err) {
+		return nil, nil
+	}
+	return progress, err
+}
@@ -0,0 +1,311 @@
+package promos
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/billing"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrNotFound        = errors.New("promo code not found")
+	ErrExpired         = errors.New("promo code expired")
+	ErrExhausted       = errors.New("promo code has no redemptions left")
+	ErrAlreadyRedeemed = errors.New("promo code already redeemed")
+	ErrNoReward        = errors.New("promo code grants nothing")
+	ErrInvalidCount    = errors.New("promo code count must not be negative")
+)
+
+// Reward is what redeeming a code grants: premium days through the
+// billing ledger and bonus downloads on top of the quota of that day.
+type Reward struct {
+	PremiumDays    int `db:"premium_days"`
+	BonusDownloads int `db:"bonus_downloads"`
+}
+
+// Code is a promo code of a campaign. MaxRedemptions nil means any number
+// of users may redeem it; each user can redeem a code once.
+type Code struct {
+	ID             int64      `db:"id"`
+	Code           string     `db:"code"`
+	Campaign       string     `db:"campaign"`
+	PremiumDays    int        `db:"premium_days"`
+	BonusDownloads int        `db:"bonus_downloads"`
+	MaxRedemptions *int       `db:"max_redemptions"`
+	Redemptions    int        `db:"redemptions"`
+	ExpiresAt      *time.Time `db:"expires_at"`
+	DisabledAt     *time.Time `db:"disabled_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+// Spec describes the codes GenerateCodes creates.
+type Spec struct {
+	Campaign       string
+	Prefix         string
+	Reward         Reward
+	MaxRedemptions *int
+	ExpiresAt      *time.Time
+}
+
+// CampaignStats summarize the redemptions of a campaign.
+type CampaignStats struct {
+	Campaign         string     `db:"campaign"`
+	Codes            int64      `db:"codes"`
+	RedeemedCodes    int64      `db:"redeemed_codes"`
+	Redemptions      int64      `db:"redemptions"`
+	Users            int64      `db:"users"`
+	PremiumDays      int64      `db:"premium_days"`
+	BonusDownloads   int64      `db:"bonus_downloads"`
+	FirstRedemption  *time.Time `db:"first_redemption"`
+	LatestRedemption *time.Time `db:"latest_redemption"`
+}
+
+type DailyRedemptions struct {
+	Day         time.Time `db:"day"`
+	Redemptions int64     `db:"redemptions"`
+}
+
+const codeColumns = "id, code, campaign, premium_days, bonus_downloads, max_redemptions, redemptions, expires_at, disabled_at, created_at"
+
+var codeEncoding = base32.NewEncoding("ABCDEFGHJKLMNPQRSTUVWXYZ23456789").WithPadding(base32.NoPadding)
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140049,
+		Name:    "create_promos",
+		Up: `CREATE TABLE promo_codes (
+			id              BIGSERIAL PRIMARY KEY,
+			code            TEXT NOT NULL UNIQUE,
+			campaign        TEXT NOT NULL,
+			premium_days    INT NOT NULL DEFAULT 0 CHECK (premium_days >= 0),
+			bonus_downloads INT NOT NULL DEFAULT 0 CHECK (bonus_downloads >= 0),
+			max_redemptions INT CHECK (max_redemptions > 0),
+			redemptions     INT NOT NULL DEFAULT 0,
+			expires_at      TIMESTAMPTZ,
+			disabled_at     TIMESTAMPTZ,
+			created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+			CHECK (max_redemptions IS NULL OR redemptions <= max_redemptions)
+		);
+		CREATE INDEX promo_codes_campaign_idx ON promo_codes (campaign);
+		CREATE TABLE promo_redemptions (
+			code_id     BIGINT NOT NULL REFERENCES promo_codes (id) ON DELETE CASCADE,
+			user_id     BIGINT NOT NULL,
+			redeemed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (code_id, user_id)
+		);
+		CREATE INDEX promo_redemptions_redeemed_idx ON promo_redemptions (redeemed_at);`,
+		Down: `DROP TABLE promo_redemptions; DROP TABLE promo_codes;`,
+	})
+	database.RegisterModel(database.Model{Table: "promo_codes", Struct: Code{}, Indexes: []string{"promo_codes_campaign_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func newCode(prefix string) (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return normalizeCode(prefix) + codeEncoding.EncodeToString(buf), nil
+}
+
+// GenerateCodes creates count random codes for spec in bulk and returns
+// them. Codes that collide with existing ones are regenerated; the codes
+// are created in one transaction, so a failure creates none.
+func (repo *Repo) GenerateCodes(ctx context.Context, spec Spec, count int) ([]string, error) {
+	if count < 0 {
+		return nil, ErrInvalidCount
+	}
+	if spec.Reward.PremiumDays <= 0 && spec.Reward.BonusDownloads <= 0 {
+		return nil, ErrNoReward
+	}
+
+	var created []string
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		created = make([]string, 0, count)
+		for len(created) < count {
+			batch := make([]string, count-len(created))
+			for i := range batch {
+				var err error
+				if batch[i], err = newCode(spec.Prefix); err != nil {
+					return err
+				}
+			}
+			rows, err := tx.Query(ctx, `INSERT INTO promo_codes (code, campaign, premium_days, bonus_downloads, max_redemptions, expires_at)
+				SELECT code, $2, $3, $4, $5, $6 FROM unnest($1::text[]) AS code
+				ON CONFLICT (code) DO NOTHING RETURNING code`,
+				batch, spec.Campaign, spec.Reward.PremiumDays, spec.Reward.BonusDownloads, spec.MaxRedemptions, spec.ExpiresAt)
+			if err != nil {
+				return err
+			}
+			codes, err := pgx.CollectRows(rows, pgx.RowTo[string])
+			if err != nil {
+				return err
+			}
+			created = append(created, codes...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// CreateCode adds a code with a chosen text, e.g. a campaign word.
+func (repo *Repo) CreateCode(ctx context.Context, code string, spec Spec) (*Code, error) {
+	if spec.Reward.PremiumDays <= 0 && spec.Reward.BonusDownloads <= 0 {
+		return nil, ErrNoReward
+	}
+
+	return database.QueryOne[Code](ctx, repo.session, `INSERT INTO promo_codes (code, campaign, premium_days, bonus_downloads, max_redemptions, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING `+codeColumns,
+		normalizeCode(spec.Prefix+code), spec.Campaign, spec.Reward.PremiumDays, spec.Reward.BonusDownloads, spec.MaxRedemptions, spec.ExpiresAt)
+}
+
+// Disable stops code from being redeemed any further.
+func (repo *Repo) Disable(ctx context.Context, code string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "UPDATE promo_codes SET disabled_at = now() WHERE code = $1 AND disabled_at IS NULL", normalizeCode(code))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Redeem applies code for userID and returns the reward granted. Taking a
+// redemption, recording the user and granting the reward happen in one
+// transaction, so concurrent redemptions never exceed the code's limit.
+func (repo *Repo) Redeem(ctx context.Context, userID int64, code string) (*Reward, error) {
+	code = normalizeCode(code)
+	var reward *Reward
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `UPDATE promo_codes SET redemptions = redemptions + 1
+			WHERE code = $1 AND disabled_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+				AND (max_redemptions IS NULL OR redemptions < max_redemptions)
+			RETURNING `+codeColumns, code)
+		if err != nil {
+			return err
+		}
+		promo, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Code])
+		if err == pgx.ErrNoRows {
+			return repo.unavailable(ctx, tx, code)
+		}
+		if err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, `INSERT INTO promo_redemptions (code_id, user_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, promo.ID, userID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrAlreadyRedeemed
+		}
+
+		if promo.PremiumDays > 0 {
+			if err := billing.GrantTx(ctx, tx, userID, promo.PremiumDays, billing.KindPromo, promo.Code); err != nil {
+				return err
+			}
+		}
+		if promo.BonusDownloads > 0 {
+			_, err = tx.Exec(ctx, `UPDATE users SET
+					downloads_today = CASE WHEN quota_day = current_date THEN downloads_today ELSE 0 END - $2,
+					quota_day = current_date
+				WHERE id = $1`, userID, promo.BonusDownloads)
+			if err != nil {
+				return err
+			}
+		}
+		reward = &Reward{PremiumDays: promo.PremiumDays, BonusDownloads: promo.BonusDownloads}
+		return nil
+	})
+	return reward, err
+}
+
+// unavailable tells why code couldn't be taken.
+func (repo *Repo) unavailable(ctx context.Context, tx pgx.Tx, code string) error {
+	rows, err := tx.Query(ctx, "SELECT "+codeColumns+" FROM promo_codes WHERE code = $1", code)
+	if err != nil {
+		return err
+	}
+	promo, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Code])
+	if err == pgx.ErrNoRows || (err == nil && promo.DisabledAt != nil) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if promo.ExpiresAt != nil && !promo.ExpiresAt.After(repo.session.Clock().Now()) {
+		return ErrExpired
+	}
+	return ErrExhausted
+}
+
+func (repo *Repo) Get(ctx context.Context, code string) (*Code, error) {
+	promo, err := database.QueryOne[Code](ctx, repo.session, "SELECT "+codeColumns+" FROM promo_codes WHERE code = $1", normalizeCode(code))
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return promo, err
+}
+
+// Stats returns the redemption figures of campaign.
+func (repo *Repo) Stats(ctx context.Context, campaign string) (*CampaignStats, error) {
+	return database.QueryOne[CampaignStats](ctx, repo.session, `SELECT $1::text AS campaign,
+			(SELECT count(*) FROM promo_codes WHERE campaign = $1) AS codes,
+			count(DISTINCT r.code_id) AS redeemed_codes,
+			count(r.user_id) AS redemptions,
+			count(DISTINCT r.user_id) AS users,
+			COALESCE(sum(c.premium_days), 0)::bigint AS premium_days,
+			COALESCE(sum(c.bonus_downloads), 0)::bigint AS bonus_downloads,
+			min(r.redeemed_at) AS first_redemption,
+			max(r.redeemed_at) AS latest_redemption
+		FROM promo_redemptions r JOIN promo_codes c ON c.id = r.code_id
+		WHERE c.campaign = $1`, campaign)
+}
+
+// RedemptionsByDay counts the redemptions of campaign per UTC day within
+// [from, to).
+func (repo *Repo) RedemptionsByDay(ctx context.Context, campaign string, from, to time.Time) ([]DailyRedemptions, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT date_trunc('day', r.redeemed_at AT TIME ZONE 'UTC') AS day, count(*) AS redemptions
+		FROM promo_redemptions r JOIN promo_codes c ON c.id = r.code_id
+		WHERE c.campaign = $1 AND r.redeemed_at >= $2 AND r.redeemed_at < $3
+		GROUP BY 1 ORDER BY 1`, campaign, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DailyRedemptions])
+}
@@ -0,0 +1,156 @@
+// Package ratelimit enforces request limits shared by every bot instance:
+// the counters live in Postgres and each check updates them with one
+// atomic statement, so limits hold across deploys and horizontal scaling.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+var ErrInvalidLimit = errors.New("invalid rate limit")
+
+// Decision is the outcome of a check. Remaining is what is left of the
+// limit after it; RetryAfter, when the check was denied, is how long until
+// it would be allowed.
+type Decision struct {
+	Allowed    bool
+	Remaining  float64
+	RetryAfter time.Duration
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140062,
+		Name:    "create_rate_limits",
+		Up: `CREATE TABLE rate_limit_windows (
+			key          TEXT PRIMARY KEY,
+			window_start TIMESTAMPTZ NOT NULL,
+			count        BIGINT NOT NULL
+		);
+		CREATE TABLE rate_limit_buckets (
+			key        TEXT PRIMARY KEY,
+			tokens     DOUBLE PRECISION NOT NULL,
+			allowed    BOOLEAN NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL
+		);`,
+		Down: `DROP TABLE rate_limit_buckets; DROP TABLE rate_limit_windows;`,
+	})
+}
+
+// UserKey is the key of a per-user limit of action, e.g. "search".
+func UserKey(userID int64, action string) string {
+	return "user:" + strconv.FormatInt(userID, 10) + ":" + action
+}
+
+// SourceKey is the key of the limit of requests to a source site.
+func SourceKey(site string) string {
+	return "source:" + site
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// FixedWindow counts a hit of key in the current window, windows being
+// aligned to multiples of window since the epoch, and allows it while the
+// window has at most limit hits. Denied hits count too, so a client
+// hammering a limit stays limited until the window ends.
+func (repo *Repo) FixedWindow(ctx context.Context, key string, limit int, window time.Duration) (Decision, error) {
+	if limit <= 0 || window < time.Second {
+		return Decision{}, ErrInvalidLimit
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer conn.Release()
+
+	var count int64
+	var resetIn float64
+	err = conn.QueryRow(ctx, `WITH w AS (
+			SELECT to_timestamp(floor(extract(epoch FROM now())::float8 / $2::float8) * $2::float8) AS start
+		)
+		INSERT INTO rate_limit_windows AS r (key, window_start, count) SELECT $1, start, 1 FROM w
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN r.window_start = EXCLUDED.window_start THEN r.count + 1 ELSE 1 END,
+			window_start = EXCLUDED.window_start
+		RETURNING count, extract(epoch FROM r.window_start + $2::float8 * interval '1 second' - now())::float8`,
+		key, window.Seconds()).Scan(&count, &resetIn)
+	if err != nil {
+		return Decision{}, err
+	}
+	d := Decision{Allowed: count <= int64(limit), Remaining: math.Max(0, float64(int64(limit)-count))}
+	if !d.Allowed {
+		d.RetryAfter = seconds(resetIn)
+	}
+	return d, nil
+}
+
+// TokenBucket takes cost tokens from the bucket of key, which holds up to
+// burst tokens and refills at rate tokens per second, starting full. A
+// denied check takes nothing.
+func (repo *Repo) TokenBucket(ctx context.Context, key string, rate, burst, cost float64) (Decision, error) {
+	if rate <= 0 || burst <= 0 || cost <= 0 || cost > burst {
+		return Decision{}, ErrInvalidLimit
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer conn.Release()
+
+	// The tokens of the bucket after refilling since its last check; the
+	// update of an upsert can't join it in.
+	const refill = "least($3::float8, b.tokens + extract(epoch FROM now() - b.updated_at)::float8 * $2::float8)"
+	var d Decision
+	err = conn.QueryRow(ctx, `INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at) VALUES ($1, $3::float8 - $4::float8, true, now())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = `+refill+` - CASE WHEN `+refill+` >= $4::float8 THEN $4::float8 ELSE 0 END,
+			allowed = `+refill+` >= $4::float8,
+			updated_at = now()
+		RETURNING allowed, tokens`,
+		key, rate, burst, cost).Scan(&d.Allowed, &d.Remaining)
+	if err != nil {
+		return Decision{}, err
+	}
+	if !d.Allowed {
+		d.RetryAfter = seconds((cost - d.Remaining) / rate)
+	}
+	return d, nil
+}
+
+// Reset drops the counters of key, e.g. after an admin lifted a limit.
+func (repo *Repo) Reset(ctx context.Context, key string) error {
+	batch := &database.Batch{}
+	batch.Queue("DELETE FROM rate_limit_windows WHERE key = $1", key)
+	batch.Queue("DELETE FROM rate_limit_buckets WHERE key = $1", key)
+	_, err := repo.session.SendBatch(ctx, batch)
+	return err
+}
+
+// PurgeIdle drops counters untouched for idle, which must exceed the
+// longest window and the time any bucket takes to refill.
+func (repo *Repo) PurgeIdle(ctx context.Context, idle time.Duration) (int64, error) {
+	n, err := repo.session.DeleteInBatches(ctx, "rate_limit_windows", "window_start < now() - $1::interval", 0, 0, nil, idle)
+	if err != nil {
+		return n, err
+	}
+	buckets, err := repo.session.DeleteInBatches(ctx, "rate_limit_buckets", "updated_at < now() - $1::interval", 0, 0, nil, idle)
+	return n + buckets, err
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
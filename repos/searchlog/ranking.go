@@ -0,0 +1,79 @@
+package searchlog
+
+import (
+	"context"
+	"strings"
+
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+// terms splits a normalized query into the words boosts are keyed by.
+func terms(normalized string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, term := range strings.Fields(normalized) {
+		if !seen[term] {
+			seen[term] = true
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+// RecordDownload marks bookID as the result actually downloaded from a
+// search and raises its boost for every term of the query, which
+// SearchBooks of repos/books multiplies into its rank. The boost
+// grows logarithmically, so a popular book can't bury everything else.
+func (repo *Repo) RecordDownload(ctx context.Context, searchID, bookID int64) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var normalized string
+		err := tx.QueryRow(ctx, "UPDATE search_log SET clicked_book_id = $2 WHERE id = $1 RETURNING normalized", searchID, bookID).Scan(&normalized)
+		if err != nil {
+			return err
+		}
+		for _, term := range terms(normalized) {
+			_, err = tx.Exec(ctx, `INSERT INTO search_boosts (term, book_id, downloads, boost) VALUES ($1, $2, 1, 1 + ln(2))
+				ON CONFLICT (term, book_id) DO UPDATE SET downloads = search_boosts.downloads + 1,
+					boost = 1 + ln(search_boosts.downloads + 2), updated_at = now()`, term, bookID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Boosts returns the combined boost of each of bookIDs for query. Books
+// without feedback are left out and should be treated as 1.
+func (repo *Repo) Boosts(ctx context.Context, query string, bookIDs []int64) (map[int64]float64, error) {
+	boosts := map[int64]float64{}
+	words := terms(books.SearchKey(query))
+	if len(words) == 0 || len(bookIDs) == 0 {
+		return boosts, nil
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT book_id, exp(sum(ln(boost))) FROM search_boosts
+		WHERE term = ANY($1) AND book_id = ANY($2)
+		GROUP BY book_id`, words, bookIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookID int64
+		var boost float64
+		if err := rows.Scan(&bookID, &boost); err != nil {
+			return nil, err
+		}
+		boosts[bookID] = boost
+	}
+	return boosts, rows.Err()
+}
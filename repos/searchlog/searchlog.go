@@ -0,0 +1,135 @@
+package searchlog
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+// Entry is one search made by a user and, if any, the result they picked.
+type Entry struct {
+	ID            int64     `db:"id"`
+	UserID        int64     `db:"user_id"`
+	Query         string    `db:"query"`
+	Normalized    string    `db:"normalized"`
+	Results       int       `db:"results"`
+	ClickedBookID *int64    `db:"clicked_book_id"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+// ZeroResultQuery groups searches that found nothing by normalized query.
+type ZeroResultQuery struct {
+	Query          string    `db:"query"`
+	Searches       int64     `db:"searches"`
+	Users          int64     `db:"users"`
+	LastSearchedAt time.Time `db:"last_searched_at"`
+}
+
+const columns = "id, user_id, query, normalized, results, clicked_book_id, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140028,
+		Name:    "create_search_log",
+		Up: `CREATE TABLE search_log (
+			id              BIGSERIAL PRIMARY KEY,
+			user_id         BIGINT NOT NULL,
+			query           TEXT NOT NULL,
+			normalized      TEXT NOT NULL,
+			results         INT NOT NULL,
+			clicked_book_id BIGINT REFERENCES books (id) ON DELETE SET NULL,
+			created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX search_log_created_idx ON search_log (created_at);
+		CREATE INDEX search_log_zero_idx ON search_log (created_at, normalized) WHERE results = 0;`,
+		Down: `DROP TABLE search_log;`,
+	})
+	database.RegisterModel(database.Model{Table: "search_log", Struct: Entry{}, Indexes: []string{"search_log_created_idx", "search_log_zero_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// Log records a search and returns its id, to be passed to RecordClick.
+func (repo *Repo) Log(ctx context.Context, userID int64, query string, results int) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var id int64
+	err = conn.QueryRow(ctx, `INSERT INTO search_log (user_id, query, normalized, results) VALUES ($1, $2, $3, $4) RETURNING id`,
+		userID, query, books.SearchKey(query), results).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	repo.session.MirrorRow("search_log", map[string]any{
+		"id": id, "user_id": userID, "query": query, "normalized": books.SearchKey(query), "results": results,
+		"created_at": repo.session.Clock().Now(),
+	})
+	return id, nil
+}
+
+// RecordClick stores which result of a search the user opened.
+func (repo *Repo) RecordClick(ctx context.Context, searchID, bookID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "UPDATE search_log SET clicked_book_id = $2 WHERE id = $1", searchID, bookID)
+	return err
+}
+
+// GetZeroResultQueries returns the most frequent searches of the last
+// period that found nothing, i.e. content users want but the catalog lacks.
+func (repo *Repo) GetZeroResultQueries(ctx context.Context, period time.Duration, limit int) ([]ZeroResultQuery, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT normalized AS query, count(*) AS searches, count(DISTINCT user_id) AS users,
+			max(created_at) AS last_searched_at
+		FROM search_log
+		WHERE results = 0 AND created_at > now() - $1::interval AND normalized <> ''
+		GROUP BY normalized
+		ORDER BY users DESC, searches DESC
+		LIMIT $2`, period, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[ZeroResultQuery])
+}
+
+// Recent returns the latest searches of a user.
+func (repo *Repo) Recent(ctx context.Context, userID int64, limit int) ([]Entry, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+" FROM search_log WHERE user_id = $1 ORDER BY id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Entry])
+}
+
+// Purge drops log entries older than keep, in batches (see
+// database.DeleteInBatches).
+func (repo *Repo) Purge(ctx context.Context, keep time.Duration) (int64, error) {
+	return repo.session.DeleteInBatches(ctx, "search_log", "created_at < now() - $1::interval", 0, 0, nil, keep)
+}
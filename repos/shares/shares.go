@@ -0,0 +1,217 @@
+package shares
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrShareNotFound  = errors.New("share not found")
+	ErrShareExpired   = errors.New("share expired")
+	ErrShareRevoked   = errors.New("share revoked")
+	ErrNotShareTarget = errors.New("share is meant for someone else")
+)
+
+// Share lets its owner give a cached book file to another user or chat for
+// a limited time. Resolving a share doesn't count against quotas. With
+// neither target set, anyone holding the code may resolve it.
+type Share struct {
+	ID           int64      `db:"id"`
+	Code         string     `db:"code"`
+	FileID       int64      `db:"file_id"`
+	OwnerUserID  int64      `db:"owner_user_id"`
+	TargetUserID *int64     `db:"target_user_id"`
+	TargetChatID *int64     `db:"target_chat_id"`
+	ExpiresAt    time.Time  `db:"expires_at"`
+	RevokedAt    *time.Time `db:"revoked_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+type Access struct {
+	ID         int64     `db:"id"`
+	ShareID    int64     `db:"share_id"`
+	UserID     int64     `db:"user_id"`
+	ChatID     *int64    `db:"chat_id"`
+	Granted    bool      `db:"granted"`
+	Reason     string    `db:"reason"`
+	AccessedAt time.Time `db:"accessed_at"`
+}
+
+const columns = "id, code, file_id, owner_user_id, target_user_id, target_chat_id, expires_at, revoked_at, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140013,
+		Name:    "create_shares",
+		Up: `CREATE TABLE shares (
+			id             BIGSERIAL PRIMARY KEY,
+			code           TEXT NOT NULL UNIQUE,
+			file_id        BIGINT NOT NULL REFERENCES book_files (id) ON DELETE CASCADE,
+			owner_user_id  BIGINT NOT NULL,
+			target_user_id BIGINT,
+			target_chat_id BIGINT,
+			expires_at     TIMESTAMPTZ NOT NULL,
+			revoked_at     TIMESTAMPTZ,
+			created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX shares_owner_idx ON shares (owner_user_id, created_at DESC);
+		CREATE TABLE share_access_log (
+			id          BIGSERIAL PRIMARY KEY,
+			share_id    BIGINT NOT NULL REFERENCES shares (id) ON DELETE CASCADE,
+			user_id     BIGINT NOT NULL,
+			chat_id     BIGINT,
+			granted     BOOLEAN NOT NULL,
+			reason      TEXT NOT NULL DEFAULT '',
+			accessed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX share_access_log_share_idx ON share_access_log (share_id, accessed_at DESC);`,
+		Down: `DROP TABLE share_access_log; DROP TABLE shares;`,
+	})
+	database.RegisterModel(database.Model{Table: "shares", Struct: Share{}, Indexes: []string{"shares_owner_idx"}})
+	database.RegisterModel(database.Model{Table: "share_access_log", Struct: Access{}, Indexes: []string{"share_access_log_share_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// CreateShare shares fileID for ttl. Set targetUserID or targetChatID to
+// restrict who can resolve it.
+func (repo *Repo) CreateShare(ctx context.Context, ownerUserID, fileID int64, targetUserID, targetChatID *int64, ttl time.Duration) (*Share, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	code := base64.RawURLEncoding.EncodeToString(buf)
+
+	return database.QueryOne[Share](ctx, repo.session, `INSERT INTO shares (code, file_id, owner_user_id, target_user_id, target_chat_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now() + $6::interval) RETURNING `+columns,
+		code, fileID, ownerUserID, targetUserID, targetChatID, ttl)
+}
+
+// ResolveShare returns the shared file if userID (optionally writing in
+// chatID) may access it; a share of a taken down book gives
+// books.ErrTakenDown. Every attempt, granted or not, is logged.
+func (repo *Repo) ResolveShare(ctx context.Context, code string, userID int64, chatID *int64) (*books.File, error) {
+	var file *books.File
+	var denied error
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT "+columns+" FROM shares WHERE code = $1", code)
+		if err != nil {
+			return err
+		}
+		share, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Share])
+		if err == pgx.ErrNoRows {
+			denied = ErrShareNotFound
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case share.RevokedAt != nil:
+			denied = ErrShareRevoked
+		case !share.ExpiresAt.After(repo.session.Clock().Now()):
+			denied = ErrShareExpired
+		case share.TargetUserID != nil && *share.TargetUserID != userID && share.OwnerUserID != userID:
+			denied = ErrNotShareTarget
+		case share.TargetChatID != nil && (chatID == nil || *share.TargetChatID != *chatID) && share.OwnerUserID != userID:
+			denied = ErrNotShareTarget
+		}
+		if denied == nil {
+			var takenDown bool
+			err = tx.QueryRow(ctx, `SELECT book_is_taken_down(b.id, b.author_id, b.source_site)
+				FROM book_files f JOIN books b ON b.id = f.book_id WHERE f.id = $1`, share.FileID).Scan(&takenDown)
+			if err != nil && err != pgx.ErrNoRows {
+				return err
+			}
+			if takenDown {
+				denied = books.ErrTakenDown
+			}
+		}
+
+		reason := ""
+		if denied != nil {
+			reason = denied.Error()
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO share_access_log (share_id, user_id, chat_id, granted, reason) VALUES ($1, $2, $3, $4, $5)",
+			share.ID, userID, chatID, denied == nil, reason)
+		if err != nil || denied != nil {
+			return err
+		}
+
+		rows, err = tx.Query(ctx, "SELECT "+books.FileColumns+" FROM book_files WHERE id = $1", share.FileID)
+		if err != nil {
+			return err
+		}
+		file, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[books.File])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, denied
+}
+
+// Revoke ends a share early. Only its owner can revoke it.
+func (repo *Repo) Revoke(ctx context.Context, ownerUserID, shareID int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "UPDATE shares SET revoked_at = now() WHERE id = $1 AND owner_user_id = $2 AND revoked_at IS NULL",
+		shareID, ownerUserID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// ListActive returns the owner's shares that can still be resolved.
+func (repo *Repo) ListActive(ctx context.Context, ownerUserID int64) ([]Share, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+` FROM shares
+		WHERE owner_user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		ORDER BY created_at DESC`, ownerUserID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Share])
+}
+
+func (repo *Repo) AccessLog(ctx context.Context, shareID int64, limit int) ([]Access, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id, share_id, user_id, chat_id, granted, reason, accessed_at FROM share_access_log
+		WHERE share_id = $1 ORDER BY accessed_at DESC LIMIT $2`, shareID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Access])
+}
@@ -0,0 +1,264 @@
+package sites
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrNotFound = errors.New("site not found")
+
+// Site is a source site the workers download books from, with the mirrors
+// its pages are served on and the parsers that read them.
+type Site struct {
+	Name      string          `db:"name"`
+	BaseURL   string          `db:"base_url"`
+	Enabled   bool            `db:"enabled"`
+	Settings  json.RawMessage `db:"settings"`
+	UpdatedAt time.Time       `db:"updated_at"`
+
+	Mirrors []Mirror `db:"-"`
+	Parsers []Parser `db:"-"`
+}
+
+// Mirror is another host of a site, tried in priority order, lowest
+// first.
+type Mirror struct {
+	ID       int64  `db:"id"`
+	Site     string `db:"site"`
+	Host     string `db:"host"`
+	Priority int    `db:"priority"`
+	Enabled  bool   `db:"enabled"`
+}
+
+// Parser is the configuration of the parser of one kind of page of a
+// site, e.g. "book" or "chapter".
+type Parser struct {
+	ID      int64           `db:"id"`
+	Site    string          `db:"site"`
+	Kind    string          `db:"kind"`
+	Version string          `db:"version"`
+	Config  json.RawMessage `db:"config"`
+}
+
+const (
+	siteColumns   = "name, base_url, enabled, settings, updated_at"
+	mirrorColumns = "id, site, host, priority, enabled"
+	parserColumns = "id, site, kind, version, config"
+)
+
+// configChannel is notified with the new version whenever the site
+// configuration changes.
+const configChannel = "site_config"
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140061,
+		Name:    "create_sites",
+		Up: `CREATE TABLE sites (
+			name       TEXT PRIMARY KEY,
+			base_url   TEXT NOT NULL,
+			enabled    BOOLEAN NOT NULL DEFAULT true,
+			settings   JSONB NOT NULL DEFAULT '{}',
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE TABLE site_mirrors (
+			id       BIGSERIAL PRIMARY KEY,
+			site     TEXT NOT NULL REFERENCES sites (name) ON DELETE CASCADE,
+			host     TEXT NOT NULL,
+			priority INT NOT NULL DEFAULT 0,
+			enabled  BOOLEAN NOT NULL DEFAULT true,
+			UNIQUE (site, host)
+		);
+		CREATE TABLE site_parsers (
+			id      BIGSERIAL PRIMARY KEY,
+			site    TEXT NOT NULL REFERENCES sites (name) ON DELETE CASCADE,
+			kind    TEXT NOT NULL,
+			version TEXT NOT NULL,
+			config  JSONB NOT NULL DEFAULT '{}',
+			UNIQUE (site, kind)
+		);
+		CREATE TABLE site_config_version (
+			id      BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+			version BIGINT NOT NULL
+		);
+		INSERT INTO site_config_version (version) VALUES (1);
+		CREATE FUNCTION site_config_bump() RETURNS trigger LANGUAGE plpgsql AS $$
+		DECLARE
+			new_version BIGINT;
+		BEGIN
+			UPDATE site_config_version SET version = version + 1 RETURNING version INTO new_version;
+			PERFORM pg_notify('` + configChannel + `', new_version::text);
+			RETURN NULL;
+		END $$;
+		CREATE TRIGGER site_config_bump AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON sites
+			FOR EACH STATEMENT EXECUTE FUNCTION site_config_bump();
+		CREATE TRIGGER site_config_bump AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON site_mirrors
+			FOR EACH STATEMENT EXECUTE FUNCTION site_config_bump();
+		CREATE TRIGGER site_config_bump AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON site_parsers
+			FOR EACH STATEMENT EXECUTE FUNCTION site_config_bump();`,
+		Down: `DROP TABLE site_parsers; DROP TABLE site_mirrors; DROP TABLE sites;
+		DROP FUNCTION site_config_bump();
+		DROP TABLE site_config_version;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140076,
+		Name:    "touch_sites",
+		Up:      database.TouchUpdatedAtSQL("sites"),
+		Down:    `DROP TRIGGER sites_touch_updated_at ON sites;`,
+	})
+	database.RegisterModel(database.Model{Table: "sites", Struct: Site{}})
+	database.RegisterModel(database.Model{Table: "site_mirrors", Struct: Mirror{}})
+	database.RegisterModel(database.Model{Table: "site_parsers", Struct: Parser{}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// PutSite creates or replaces the settings of site; Mirrors and Parsers
+// are ignored.
+func (repo *Repo) PutSite(ctx context.Context, site Site) error {
+	if site.Settings == nil {
+		site.Settings = json.RawMessage("{}")
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO sites (name, base_url, enabled, settings) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name) DO UPDATE SET base_url = EXCLUDED.base_url, enabled = EXCLUDED.enabled,
+			settings = EXCLUDED.settings, updated_at = now()`,
+		site.Name, site.BaseURL, site.Enabled, site.Settings)
+	return err
+}
+
+// DeleteSite drops a site along with its mirrors and parsers.
+func (repo *Repo) DeleteSite(ctx context.Context, name string) error {
+	return repo.exec(ctx, "DELETE FROM sites WHERE name = $1", name)
+}
+
+// PutMirror adds a mirror of its site or updates the one on the same host.
+func (repo *Repo) PutMirror(ctx context.Context, mirror Mirror) error {
+	return repo.exec(ctx, `INSERT INTO site_mirrors (site, host, priority, enabled) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (site, host) DO UPDATE SET priority = EXCLUDED.priority, enabled = EXCLUDED.enabled`,
+		mirror.Site, mirror.Host, mirror.Priority, mirror.Enabled)
+}
+
+func (repo *Repo) DeleteMirror(ctx context.Context, site, host string) error {
+	return repo.exec(ctx, "DELETE FROM site_mirrors WHERE site = $1 AND host = $2", site, host)
+}
+
+// PutParser sets the parser of one page kind of its site.
+func (repo *Repo) PutParser(ctx context.Context, parser Parser) error {
+	if parser.Config == nil {
+		parser.Config = json.RawMessage("{}")
+	}
+	return repo.exec(ctx, `INSERT INTO site_parsers (site, kind, version, config) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (site, kind) DO UPDATE SET version = EXCLUDED.version, config = EXCLUDED.config`,
+		parser.Site, parser.Kind, parser.Version, parser.Config)
+}
+
+func (repo *Repo) exec(ctx context.Context, sql string, args ...any) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Get reads a site with its mirrors and parsers straight from the
+// database; workers should use a Cache instead.
+func (repo *Repo) Get(ctx context.Context, name string) (*Site, error) {
+	snapshot, err := repo.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	site, ok := snapshot.Sites[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return site, nil
+}
+
+// load reads the whole configuration in one repeatable read transaction,
+// so the version matches the rows.
+func (repo *Repo) load(ctx context.Context) (*Snapshot, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	snapshot := &Snapshot{Sites: map[string]*Site{}}
+	if err := tx.QueryRow(ctx, "SELECT version FROM site_config_version").Scan(&snapshot.Version); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, "SELECT "+siteColumns+" FROM sites")
+	if err != nil {
+		return nil, err
+	}
+	sites, err := pgx.CollectRows(rows, pgx.RowToStructByName[Site])
+	if err != nil {
+		return nil, err
+	}
+	for i := range sites {
+		snapshot.Sites[sites[i].Name] = &sites[i]
+	}
+
+	rows, err = tx.Query(ctx, "SELECT "+mirrorColumns+" FROM site_mirrors ORDER BY site, priority, id")
+	if err != nil {
+		return nil, err
+	}
+	mirrors, err := pgx.CollectRows(rows, pgx.RowToStructByName[Mirror])
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mirrors {
+		if site := snapshot.Sites[m.Site]; site != nil {
+			site.Mirrors = append(site.Mirrors, m)
+		}
+	}
+
+	rows, err = tx.Query(ctx, "SELECT "+parserColumns+" FROM site_parsers ORDER BY site, kind")
+	if err != nil {
+		return nil, err
+	}
+	parsers, err := pgx.CollectRows(rows, pgx.RowToStructByName[Parser])
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parsers {
+		if site := snapshot.Sites[p.Site]; site != nil {
+			site.Parsers = append(site.Parsers, p)
+		}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,138 @@
+package sites
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+// DefaultRefresh is how often a Cache checks the configuration version
+// when it hears no notification.
+const DefaultRefresh = time.Minute
+
+// Snapshot is the whole site configuration at one version. It is shared
+// by the callers of a Cache and must not be modified.
+type Snapshot struct {
+	Version int64
+	Sites   map[string]*Site
+}
+
+// Hosts maps each enabled site to its base URL's host and the hosts of its
+// enabled mirrors, in the form books.SiteHosts takes.
+func (s *Snapshot) Hosts() map[string][]string {
+	hosts := make(map[string][]string, len(s.Sites))
+	for name, site := range s.Sites {
+		if !site.Enabled {
+			continue
+		}
+		list := []string{hostOf(site.BaseURL)}
+		for _, m := range site.Mirrors {
+			if m.Enabled {
+				list = append(list, m.Host)
+			}
+		}
+		hosts[name] = list
+	}
+	return hosts
+}
+
+// Cache keeps a Snapshot of the site configuration in memory for the
+// workers, so they don't each read the same rows every few seconds. Run
+// reloads it when a change is notified, and checks the version every
+// refresh interval for changes notified while the listener reconnected.
+type Cache struct {
+	repo      *Repo
+	refresh   time.Duration
+	snapshot  atomic.Pointer[Snapshot]
+	loading   sync.Mutex
+	onChanged func(*Snapshot)
+}
+
+// NewCache returns a cache checking the version every refresh (0 picks
+// DefaultRefresh). onChanged, if not nil, is called with every snapshot
+// loaded after the first, e.g. to refresh books.SiteHosts.
+func NewCache(session *database.DB_Session, refresh time.Duration, onChanged func(*Snapshot)) *Cache {
+	if refresh <= 0 {
+		refresh = DefaultRefresh
+	}
+	return &Cache{repo: New(session), refresh: refresh, onChanged: onChanged}
+}
+
+// GetSiteSnapshot returns the current snapshot, loading it on the first
+// call if Run hasn't yet.
+func (c *Cache) GetSiteSnapshot(ctx context.Context) (*Snapshot, error) {
+	if snapshot := c.snapshot.Load(); snapshot != nil {
+		return snapshot, nil
+	}
+	return c.reload(ctx, 0)
+}
+
+// reload loads the configuration unless the snapshot is at version
+// already.
+func (c *Cache) reload(ctx context.Context, version int64) (*Snapshot, error) {
+	c.loading.Lock()
+	defer c.loading.Unlock()
+	current := c.snapshot.Load()
+	if current != nil && current.Version >= version {
+		return current, nil
+	}
+	snapshot, err := c.repo.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.snapshot.Store(snapshot)
+	if current != nil && c.onChanged != nil {
+		c.onChanged(snapshot)
+	}
+	return snapshot, nil
+}
+
+// Run keeps the cache fresh until ctx is done. A failed reload is logged
+// and tried again at the next notification or check.
+func (c *Cache) Run(ctx context.Context) error {
+	session := c.repo.session
+	notifications, err := session.Listen(configChannel)
+	if err != nil {
+		return err
+	}
+	defer session.Unlisten(configChannel, notifications)
+
+	for {
+		version, err := c.version(ctx)
+		if err == nil {
+			_, err = c.reload(ctx, version)
+		}
+		if err != nil && ctx.Err() == nil {
+			session.Logger().Log(database.LevelWarn, "DB site config reload failed", database.F("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-notifications:
+			if !ok {
+				return nil
+			}
+		case <-session.Clock().After(c.refresh):
+		}
+	}
+}
+
+// version reads the current version, one tiny row, to tell whether the
+// snapshot is stale.
+func (c *Cache) version(ctx context.Context) (int64, error) {
+	var version int64
+	err := c.repo.session.QueryRow(ctx, "SELECT version FROM site_config_version").Scan(&version)
+	return version, err
+}
+
+func hostOf(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return baseURL
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,136 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	_ "github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	KindMagnet = "magnet"
+	KindURL    = "url"
+)
+
+var ErrNoSource = errors.New("no source for book")
+
+// Source is an alternative place a book can be acquired from.
+type Source struct {
+	ID               int64      `db:"id"`
+	BookID           int64      `db:"book_id"`
+	Kind             string     `db:"kind"`
+	URI              string     `db:"uri"`
+	Seeders          *int       `db:"seeders"`
+	SeedersCheckedAt *time.Time `db:"seeders_checked_at"`
+	Verified         bool       `db:"verified"`
+	VerifiedAt       *time.Time `db:"verified_at"`
+	AddedAt          time.Time  `db:"added_at"`
+}
+
+const columns = "id, book_id, kind, uri, seeders, seeders_checked_at, verified, verified_at, added_at"
+
+// preference orders verified sources first, then by the last seeders
+// snapshot, then the most recently added.
+const preference = " ORDER BY verified DESC, seeders DESC NULLS LAST, added_at DESC"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140004,
+		Name:    "create_book_sources",
+		Up: `CREATE TABLE book_sources (
+			id                 BIGSERIAL PRIMARY KEY,
+			book_id            BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			kind               TEXT NOT NULL CHECK (kind IN ('magnet', 'url')),
+			uri                TEXT NOT NULL,
+			seeders            INT,
+			seeders_checked_at TIMESTAMPTZ,
+			verified           BOOLEAN NOT NULL DEFAULT false,
+			verified_at        TIMESTAMPTZ,
+			added_at           TIMESTAMPTZ NOT NULL DEFAULT now(),
+			UNIQUE (book_id, uri)
+		);`,
+		Down: `DROP TABLE book_sources;`,
+	})
+	database.RegisterModel(database.Model{Table: "book_sources", Struct: Source{}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// Register adds a source for bookID, or returns the existing one for the
+// same URI.
+func (repo *Repo) Register(ctx context.Context, bookID int64, kind, uri string) (*Source, error) {
+	return database.QueryOne[Source](ctx, repo.session, `INSERT INTO book_sources (book_id, kind, uri) VALUES ($1, $2, $3)
+		ON CONFLICT (book_id, uri) DO UPDATE SET kind = EXCLUDED.kind
+		RETURNING `+columns, bookID, kind, uri)
+}
+
+// UpdateSeeders stores a fresh seeders snapshot.
+func (repo *Repo) UpdateSeeders(ctx context.Context, id int64, seeders int) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "UPDATE book_sources SET seeders = $2, seeders_checked_at = now() WHERE id = $1", id, seeders)
+	return err
+}
+
+// SetVerified marks a source as checked to deliver the right book (or not).
+func (repo *Repo) SetVerified(ctx context.Context, id int64, verified bool) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `UPDATE book_sources SET verified = $2,
+		verified_at = CASE WHEN $2 THEN now() END WHERE id = $1`, id, verified)
+	return err
+}
+
+func (repo *Repo) Delete(ctx context.Context, id int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM book_sources WHERE id = $1", id)
+	return err
+}
+
+// List returns all sources of bookID, preferred first.
+func (repo *Repo) List(ctx context.Context, bookID int64) ([]Source, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+" FROM book_sources WHERE book_id = $1"+preference, bookID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Source])
+}
+
+// Preferred returns the best source of bookID. With verifiedOnly set,
+// unverified sources are never returned.
+func (repo *Repo) Preferred(ctx context.Context, bookID int64, verifiedOnly bool) (*Source, error) {
+	source, err := database.QueryOne[Source](ctx, repo.session, "SELECT "+columns+" FROM book_sources WHERE book_id = $1 AND (verified OR NOT $2)"+preference+" LIMIT 1",
+		bookID, verifiedOnly)
+	if database.IsNotFound(err) {
+		return nil, ErrNoSource
+	}
+	return source, err
+}
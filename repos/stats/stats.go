@@ -0,0 +1,337 @@
+package stats
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+// Event is one completed download. BookID is cleared when the book is
+// deleted, so the event still counts for its user and site.
+type Event struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	BookID    *int64    `db:"book_id"`
+	Site      string    `db:"site"`
+	Format    string    `db:"format"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Daily is the rolled up downloads of one site on one UTC day.
+type Daily struct {
+	Day       time.Time `db:"day"`
+	Site      string    `db:"site"`
+	Downloads int64     `db:"downloads"`
+}
+
+// Period is the downloads of the day or week starting at Start.
+type Period struct {
+	Start     time.Time `db:"start"`
+	Downloads int64     `db:"downloads"`
+}
+
+type SiteCount struct {
+	Site      string `db:"site"`
+	Downloads int64  `db:"downloads"`
+}
+
+type UserCount struct {
+	UserID    int64 `db:"user_id"`
+	Downloads int64 `db:"downloads"`
+}
+
+type BookCount struct {
+	BookID    int64  `db:"book_id"`
+	Title     string `db:"title"`
+	Downloads int64  `db:"downloads"`
+}
+
+const eventColumns = "id, user_id, book_id, site, format, created_at"
+
+// eventPartitionsAhead is how many months of download_events partitions
+// are kept created ahead of the current one.
+const eventPartitionsAhead = 3
+
+// EventRetention is how long the partition_download_events job keeps raw
+// download events, dropping them a month at a time; set it before
+// starting RunJobs, 0 keeps them all. Day, week and site reports keep
+// working from the rollups of the days dropped, as long as RunRollups
+// ran meanwhile.
+var EventRetention = 400 * 24 * time.Hour
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140056,
+		Name:    "create_download_events",
+		Up: `CREATE TABLE download_events (
+			id         BIGSERIAL PRIMARY KEY,
+			user_id    BIGINT NOT NULL,
+			book_id    BIGINT REFERENCES books (id) ON DELETE SET NULL,
+			site       TEXT NOT NULL,
+			format     TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX download_events_created_idx ON download_events (created_at);
+		CREATE INDEX download_events_user_idx ON download_events (user_id, created_at);
+		CREATE TABLE download_daily (
+			day       DATE NOT NULL,
+			site      TEXT NOT NULL,
+			downloads BIGINT NOT NULL,
+			PRIMARY KEY (day, site)
+		);`,
+		Down: `DROP TABLE download_daily; DROP TABLE download_events;`,
+	})
+	// Converts download_events to monthly partitions without copying: the
+	// existing table becomes the partition of everything before next
+	// month. Attaching it checks its rows and builds the new primary key
+	// on it, which takes a while on a big table; run it off-peak.
+	database.RegisterMigration(database.Migration{
+		Version: 202610140066,
+		Name:    "partition_download_events",
+		Up: `ALTER TABLE download_events RENAME TO download_events_legacy;
+		ALTER INDEX download_events_pkey RENAME TO download_events_legacy_pkey;
+		ALTER INDEX download_events_created_idx RENAME TO download_events_legacy_created_idx;
+		ALTER INDEX download_events_user_idx RENAME TO download_events_legacy_user_idx;
+		CREATE TABLE download_events (
+			id         BIGINT NOT NULL DEFAULT nextval('download_events_id_seq'),
+			user_id    BIGINT NOT NULL,
+			book_id    BIGINT REFERENCES books (id) ON DELETE SET NULL,
+			site       TEXT NOT NULL,
+			format     TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (id, created_at)
+		) PARTITION BY RANGE (created_at);
+		ALTER SEQUENCE download_events_id_seq OWNED BY download_events.id;
+		CREATE INDEX download_events_created_idx ON download_events (created_at);
+		CREATE INDEX download_events_user_idx ON download_events (user_id, created_at);
+		DO $$
+		BEGIN
+			EXECUTE format('ALTER TABLE download_events ATTACH PARTITION download_events_legacy FOR VALUES FROM (MINVALUE) TO (%L)',
+				(date_trunc('month', now() AT TIME ZONE 'UTC') + interval '1 month') AT TIME ZONE 'UTC');
+		END $$;
+		` + database.MonthlyPartitionsSQL("download_events", 1, eventPartitionsAhead),
+		Down: `CREATE TABLE download_events_flat (LIKE download_events INCLUDING DEFAULTS);
+		INSERT INTO download_events_flat SELECT * FROM download_events;
+		ALTER SEQUENCE download_events_id_seq OWNED BY download_events_flat.id;
+		DROP TABLE download_events;
+		ALTER TABLE download_events_flat RENAME TO download_events;
+		ALTER TABLE download_events ADD PRIMARY KEY (id), ADD FOREIGN KEY (book_id) REFERENCES books (id) ON DELETE SET NULL;
+		CREATE INDEX download_events_created_idx ON download_events (created_at);
+		CREATE INDEX download_events_user_idx ON download_events (user_id, created_at);`,
+	})
+	database.RegisterJob(database.Job{Name: "partition_download_events", Every: 24 * time.Hour, Run: func(ctx context.Context, session *database.DB_Session) (int64, error) {
+		return session.MaintainPartitions(ctx, "download_events", eventPartitionsAhead, EventRetention)
+	}})
+	database.RegisterModel(database.Model{Table: "download_events", Struct: Event{}, Indexes: []string{"download_events_created_idx", "download_events_user_idx"}})
+	database.RegisterModel(database.Model{Table: "download_daily", Struct: Daily{}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// Record stores a completed download of bookID by userID. It is called
+// along with books.RecordDownload, which keeps the per-book counters.
+func (repo *Repo) Record(ctx context.Context, userID, bookID int64, site, format string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `INSERT INTO download_events (user_id, book_id, site, format) VALUES ($1, $2, $3, $4)
+		RETURNING `+eventColumns, userID, bookID, site, format)
+	if err != nil {
+		return err
+	}
+	event, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Event])
+	if err != nil {
+		return err
+	}
+	repo.session.MirrorRow("download_events", map[string]any{
+		"id": event.ID, "user_id": userID, "book_id": bookID, "site": site, "format": format, "created_at": event.CreatedAt,
+	})
+	return nil
+}
+
+// dailySQL yields daily downloads per site since the UTC day of $1: days
+// already rolled up come from download_daily, later ones are counted from
+// the raw events, so reports are current whether or not rollups run.
+const dailySQL = `WITH rolled AS (
+		SELECT COALESCE(max(day) + 1, '-infinity'::date) AS boundary FROM download_daily
+	), daily AS (
+		SELECT d.day, d.site, d.downloads FROM download_daily d WHERE d.day >= ($1::timestamptz AT TIME ZONE 'UTC')::date
+		UNION ALL
+		SELECT (e.created_at AT TIME ZONE 'UTC')::date, e.site, count(*)
+		FROM download_events e, rolled r
+		WHERE e.created_at >= greatest(date_trunc('day', $1::timestamptz AT TIME ZONE 'UTC'), r.boundary::timestamp) AT TIME ZONE 'UTC'
+		GROUP BY 1, 2
+	) `
+
+// PerDay returns the downloads of each UTC day since since, oldest
+// first. Days without downloads are left out.
+func (repo *Repo) PerDay(ctx context.Context, since time.Time) ([]Period, error) {
+	return repo.periods(ctx, "day", since)
+}
+
+// PerWeek is PerDay by ISO week, each starting on Monday.
+func (repo *Repo) PerWeek(ctx context.Context, since time.Time) ([]Period, error) {
+	return repo.periods(ctx, "week", since)
+}
+
+func (repo *Repo) periods(ctx context.Context, unit string, since time.Time) ([]Period, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, dailySQL+`SELECT date_trunc($2::text, day)::date AS start, sum(downloads)::bigint AS downloads
+		FROM daily GROUP BY 1 ORDER BY 1`, since, unit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Period])
+}
+
+// BySite returns the downloads per source site since the UTC day of
+// since, busiest first.
+func (repo *Repo) BySite(ctx context.Context, since time.Time) ([]SiteCount, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, dailySQL+`SELECT site, sum(downloads)::bigint AS downloads
+		FROM daily GROUP BY site ORDER BY downloads DESC, site`, since)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[SiteCount])
+}
+
+// UserDownloads counts the downloads of userID since since.
+func (repo *Repo) UserDownloads(ctx context.Context, userID int64, since time.Time) (int64, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	var n int64
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM download_events WHERE user_id = $1 AND created_at >= $2", userID, since).Scan(&n)
+	return n, err
+}
+
+// TopUsers returns the users with the most downloads since since.
+func (repo *Repo) TopUsers(ctx context.Context, since time.Time, limit int) ([]UserCount, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT user_id, count(*) AS downloads FROM download_events
+		WHERE created_at >= $1 GROUP BY user_id ORDER BY downloads DESC, user_id LIMIT $2`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[UserCount])
+}
+
+// TopBooks returns the most downloaded visible books since since.
+func (repo *Repo) TopBooks(ctx context.Context, since time.Time, limit int) ([]BookCount, error) {
+	conn, err := repo.session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT books.id AS book_id, books.title, e.downloads
+		FROM (
+			SELECT book_id, count(*) AS downloads FROM download_events
+			WHERE created_at >= $1 AND book_id IS NOT NULL GROUP BY book_id
+		) e
+		JOIN books ON books.id = e.book_id
+		WHERE `+books.Visible("books")+`
+		ORDER BY e.downloads DESC, books.id LIMIT $2`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[BookCount])
+}
+
+// RollupPending rolls the complete UTC days after the last rolled up one
+// into download_daily and returns how many site days it wrote. Today is
+// left to the raw events until it is over.
+func (repo *Repo) RollupPending(ctx context.Context) (int64, error) {
+	now := repo.session.Clock().Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `INSERT INTO download_daily (day, site, downloads)
+		SELECT (created_at AT TIME ZONE 'UTC')::date, site, count(*) FROM download_events
+		WHERE created_at >= (SELECT COALESCE(max(day) + 1, '-infinity'::date) FROM download_daily)::timestamp AT TIME ZONE 'UTC'
+			AND created_at < $1
+		GROUP BY 1, 2
+		ON CONFLICT (day, site) DO UPDATE SET downloads = EXCLUDED.downloads`, today)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// RunRollups calls RollupPending every interval until ctx is done. A
+// failed rollup is logged and tried again at the next tick.
+func (repo *Repo) RunRollups(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := repo.RollupPending(ctx); err != nil && ctx.Err() == nil {
+			repo.session.Logger().Log(database.LevelWarn, "DB download stats rollup failed", database.F("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-repo.session.Clock().After(interval):
+		}
+	}
+}
+
+// PurgeEvents drops raw download events older than before. Day, week and
+// site reports keep working from the rollups; per user and per book
+// reports only cover the events kept. Roll the days up first. Monthly
+// partitions entirely before before are dropped whole; the count returned
+// is of the events deleted from those before falls in.
+func (repo *Repo) PurgeEvents(ctx context.Context, before time.Time) (int64, error) {
+	if _, err := repo.session.DropPartitionsBefore(ctx, "download_events", before, false); err != nil {
+		return 0, err
+	}
+	partitions, err := repo.session.Partitions(ctx, "download_events")
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, p := range partitions {
+		if p.From != nil && !p.From.Before(before) {
+			break
+		}
+		n, err := repo.session.DeleteInBatches(ctx, p.Schema+"."+p.Name, "created_at < $1", 0, 0, nil, before)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,184 @@
+package subscriptions
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	_ "github.com/RedBuld/book_bot_database/repos/chapters"
+	"github.com/RedBuld/book_bot_database/repos/preferences"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// notificationLease is how long a fetched notification is left to be
+	// delivered before it is fetched again.
+	notificationLease     = 5 * time.Minute
+	notificationRetention = 30 * 24 * time.Hour
+)
+
+// Rate limits of FetchPendingNotifications; set them before fetching.
+var (
+	// Settle is how long a notification waits after its latest chapter, so
+	// the chapters of one crawl are announced in one message.
+	Settle = 2 * time.Minute
+	// UserLimit is how many notifications a user gets per UserWindow at
+	// most; the others wait.
+	UserLimit  = 10
+	UserWindow = time.Hour
+)
+
+// Notification tells a user about the new chapters of a book, from
+// FirstPosition to LastPosition; Chapters counts them. New chapters
+// recorded before it is delivered are added to it, so a user has one
+// pending notification per book at most.
+type Notification struct {
+	ID            int64      `db:"id"`
+	UserID        int64      `db:"user_id"`
+	BookID        int64      `db:"book_id"`
+	FirstPosition int        `db:"first_position"`
+	LastPosition  int        `db:"last_position"`
+	Chapters      int        `db:"chapters"`
+	CreatedAt     time.Time  `db:"created_at"`
+	UpdatedAt     time.Time  `db:"updated_at"`
+	ClaimedUntil  *time.Time `db:"claimed_until"`
+	NotifiedAt    *time.Time `db:"notified_at"`
+}
+
+const notificationColumns = "id, user_id, book_id, first_position, last_position, chapters, created_at, updated_at, claimed_until, notified_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140073,
+		Name:    "create_subscription_notifications",
+		Up: `CREATE TABLE subscription_notifications (
+			id             BIGSERIAL PRIMARY KEY,
+			user_id        BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			book_id        BIGINT NOT NULL REFERENCES books (id) ON DELETE CASCADE,
+			first_position INT NOT NULL,
+			last_position  INT NOT NULL,
+			chapters       INT NOT NULL,
+			created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+			claimed_until  TIMESTAMPTZ,
+			notified_at    TIMESTAMPTZ
+		);
+		CREATE UNIQUE INDEX subscription_notifications_pending_idx ON subscription_notifications (user_id, book_id) WHERE notified_at IS NULL;
+		CREATE INDEX subscription_notifications_due_idx ON subscription_notifications (created_at) WHERE notified_at IS NULL;
+		CREATE INDEX subscription_notifications_sent_idx ON subscription_notifications (user_id, notified_at) WHERE notified_at IS NOT NULL;
+
+		CREATE FUNCTION subscription_notify_chapter() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			INSERT INTO subscription_notifications (user_id, book_id, first_position, last_position, chapters)
+			SELECT DISTINCT s.user_id, b.id, NEW.position, NEW.position, 1
+			FROM books b JOIN subscriptions s ON s.book_id = b.id OR s.author_id = b.author_id
+			WHERE b.id = NEW.book_id AND b.deleted_at IS NULL
+			ON CONFLICT (user_id, book_id) WHERE notified_at IS NULL DO UPDATE SET
+				first_position = LEAST(subscription_notifications.first_position, EXCLUDED.first_position),
+				last_position = GREATEST(subscription_notifications.last_position, EXCLUDED.last_position),
+				chapters = subscription_notifications.chapters + 1,
+				updated_at = now();
+			RETURN NULL;
+		END $$;
+		CREATE TRIGGER book_chapters_notify AFTER INSERT ON book_chapters FOR EACH ROW EXECUTE FUNCTION subscription_notify_chapter();`,
+		Down: `DROP TRIGGER book_chapters_notify ON book_chapters; DROP FUNCTION subscription_notify_chapter(); DROP TABLE subscription_notifications;`,
+	})
+	database.RegisterModel(database.Model{Table: "subscription_notifications", Struct: Notification{}, Indexes: []string{
+		"subscription_notifications_pending_idx", "subscription_notifications_due_idx", "subscription_notifications_sent_idx",
+	}})
+	database.RegisterJob(database.Job{Name: "purge_subscription_notifications", Every: 24 * time.Hour, Run: func(ctx context.Context, session *database.DB_Session) (int64, error) {
+		return session.DeleteInBatches(ctx, "subscription_notifications", "notified_at < now() - $1::interval", 0, 0, nil, notificationRetention)
+	}})
+}
+
+// FetchPendingNotifications claims up to batch notifications due for
+// delivery, oldest first, for MarkNotified. Chapters recorded in
+// book_chapters produce them for the subscribers of the book and its
+// author. A notification is due once it settled (Settle) and its user is
+// under UserLimit; notifications about a book or author the user muted
+// are dropped. One not marked notified within a few minutes, e.g. because
+// the bot stopped, is fetched again, so delivery is at least once.
+func (repo *Repo) FetchPendingNotifications(ctx context.Context, batch int) ([]Notification, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `DELETE FROM subscription_notifications n USING books b
+		WHERE b.id = n.book_id AND n.notified_at IS NULL AND (n.claimed_until IS NULL OR n.claimed_until < now())
+			AND `+preferences.MutedSQL("n.user_id", "b.series_id", "n.book_id", "b.author_id", "now()"))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, `WITH used AS (
+			SELECT user_id, count(*) AS n FROM subscription_notifications
+			WHERE notified_at > now() - $3::interval OR (notified_at IS NULL AND claimed_until >= now())
+			GROUP BY user_id
+		), due AS (
+			SELECT n.id, n.created_at, COALESCE(u.n, 0) + row_number() OVER (PARTITION BY n.user_id ORDER BY n.created_at, n.id) AS rank
+			FROM subscription_notifications n LEFT JOIN used u ON u.user_id = n.user_id
+			WHERE n.notified_at IS NULL AND (n.claimed_until IS NULL OR n.claimed_until < now())
+				AND n.updated_at <= now() - $2::interval
+		), picked AS (
+			SELECT id FROM subscription_notifications
+			WHERE id IN (SELECT id FROM due WHERE rank <= $4 ORDER BY created_at, id LIMIT $1)
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE subscription_notifications n SET claimed_until = now() + $5::interval
+		FROM picked p
+		WHERE n.id = p.id AND n.notified_at IS NULL AND (n.claimed_until IS NULL OR n.claimed_until < now())
+		RETURNING `+qualified(notificationColumns), batch, Settle, UserWindow, UserLimit, notificationLease)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Notification])
+}
+
+// MarkNotified records that the fetched notifications were delivered.
+// Chapters added to one after it was fetched are left pending in a new
+// notification.
+func (repo *Repo) MarkNotified(ctx context.Context, notifications ...Notification) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		for _, n := range notifications {
+			var first, last, chapters int
+			err := tx.QueryRow(ctx, `SELECT first_position, last_position, chapters FROM subscription_notifications
+				WHERE id = $1 AND notified_at IS NULL FOR UPDATE`, n.ID).Scan(&first, &last, &chapters)
+			if err == nil {
+				_, err = tx.Exec(ctx, `UPDATE subscription_notifications
+					SET notified_at = now(), claimed_until = NULL, first_position = $2, last_position = $3, chapters = $4
+					WHERE id = $1`, n.ID, n.FirstPosition, n.LastPosition, n.Chapters)
+			}
+			if err == pgx.ErrNoRows {
+				// Marked by an earlier call.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if chapters <= n.Chapters {
+				continue
+			}
+			if last > n.LastPosition {
+				first = n.LastPosition + 1
+			}
+			_, err = tx.Exec(ctx, `INSERT INTO subscription_notifications (user_id, book_id, first_position, last_position, chapters)
+				VALUES ($1, $2, $3, $4, $5)`, n.UserID, n.BookID, first, last, chapters-n.Chapters)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Pending returns the notifications of userID not delivered yet.
+func (repo *Repo) Pending(ctx context.Context, userID int64) ([]Notification, error) {
+	return database.QueryAll[Notification](ctx, repo.session,
+		"SELECT "+notificationColumns+" FROM subscription_notifications WHERE user_id = $1 AND notified_at IS NULL ORDER BY created_at, id", userID)
+}
+
+func qualified(columns string) string {
+	return "n." + strings.ReplaceAll(columns, ", ", ", n.")
+}
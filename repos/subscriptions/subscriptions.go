@@ -0,0 +1,124 @@
+package subscriptions
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	_ "github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+// Subscription asks for a notification when new chapters of a book come
+// out; exactly one of BookID and AuthorID is set, an author subscription
+// covering all the author's books.
+type Subscription struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	BookID    *int64    `db:"book_id"`
+	AuthorID  *int64    `db:"author_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+const columns = "id, user_id, book_id, author_id, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140072,
+		Name:    "create_subscriptions",
+		Up: `CREATE TABLE subscriptions (
+			id         BIGSERIAL PRIMARY KEY,
+			user_id    BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			book_id    BIGINT REFERENCES books (id) ON DELETE CASCADE,
+			author_id  BIGINT REFERENCES authors (id) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			CHECK ((book_id IS NULL) <> (author_id IS NULL))
+		);
+		CREATE UNIQUE INDEX subscriptions_book_idx ON subscriptions (book_id, user_id) WHERE book_id IS NOT NULL;
+		CREATE UNIQUE INDEX subscriptions_author_idx ON subscriptions (author_id, user_id) WHERE author_id IS NOT NULL;
+		CREATE INDEX subscriptions_user_idx ON subscriptions (user_id);`,
+		Down: `DROP TABLE subscriptions;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140084,
+		Name:    "move_subscriptions_on_author_merge",
+		Up: `CREATE FUNCTION subscriptions_merge_author() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			UPDATE subscriptions s SET author_id = NEW.into_id
+			WHERE s.author_id = NEW.merged_id
+				AND NOT EXISTS (SELECT 1 FROM subscriptions o WHERE o.author_id = NEW.into_id AND o.user_id = s.user_id);
+			DELETE FROM subscriptions WHERE author_id = NEW.merged_id;
+			RETURN NULL;
+		END $$;
+		CREATE TRIGGER author_merges_subscriptions AFTER INSERT ON author_merges FOR EACH ROW EXECUTE FUNCTION subscriptions_merge_author();`,
+		Down: `DROP TRIGGER author_merges_subscriptions ON author_merges; DROP FUNCTION subscriptions_merge_author();`,
+	})
+	database.RegisterModel(database.Model{Table: "subscriptions", Struct: Subscription{}, Indexes: []string{
+		"subscriptions_book_idx", "subscriptions_author_idx", "subscriptions_user_idx",
+	}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+// SubscribeBook subscribes userID to the new chapters of bookID; being
+// subscribed already is not an error.
+func (repo *Repo) SubscribeBook(ctx context.Context, userID, bookID int64) error {
+	_, err := repo.session.Exec(ctx, `INSERT INTO subscriptions (user_id, book_id) VALUES ($1, $2)
+		ON CONFLICT (book_id, user_id) WHERE book_id IS NOT NULL DO NOTHING`, userID, bookID)
+	return err
+}
+
+// SubscribeAuthor subscribes userID to the new chapters of every book of
+// authorID. Merging the author into another, with MergeAuthors of
+// repos/books, moves the subscription onto that one.
+func (repo *Repo) SubscribeAuthor(ctx context.Context, userID, authorID int64) error {
+	_, err := repo.session.Exec(ctx, `INSERT INTO subscriptions (user_id, author_id) VALUES ($1, $2)
+		ON CONFLICT (author_id, user_id) WHERE author_id IS NOT NULL DO NOTHING`, userID, authorID)
+	return err
+}
+
+// UnsubscribeBook ends the subscription of userID to bookID. Their
+// notifications not sent yet are dropped unless they still follow the
+// book's author.
+func (repo *Repo) UnsubscribeBook(ctx context.Context, userID, bookID int64) error {
+	return repo.unsubscribe(ctx, "book_id", userID, bookID)
+}
+
+// UnsubscribeAuthor ends the subscription of userID to authorID, like
+// UnsubscribeBook.
+func (repo *Repo) UnsubscribeAuthor(ctx context.Context, userID, authorID int64) error {
+	return repo.unsubscribe(ctx, "author_id", userID, authorID)
+}
+
+func (repo *Repo) unsubscribe(ctx context.Context, column string, userID, id int64) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM subscriptions WHERE user_id = $1 AND "+column+" = $2", userID, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM subscription_notifications n USING books b
+			WHERE n.user_id = $1 AND n.notified_at IS NULL AND b.id = n.book_id
+				AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = n.user_id AND (s.book_id = b.id OR s.author_id = b.author_id))`, userID)
+		return err
+	})
+}
+
+// List returns the subscriptions of userID, newest first.
+func (repo *Repo) List(ctx context.Context, userID int64) ([]Subscription, error) {
+	return database.QueryAll[Subscription](ctx, repo.session,
+		"SELECT "+columns+" FROM subscriptions WHERE user_id = $1 ORDER BY created_at DESC, id DESC", userID)
+}
+
+// Subscribed reports whether userID gets notified about bookID, through
+// the book or its author.
+func (repo *Repo) Subscribed(ctx context.Context, userID, bookID int64) (bool, error) {
+	var subscribed bool
+	err := repo.session.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM subscriptions s, books b
+		WHERE b.id = $2 AND s.user_id = $1 AND (s.book_id = b.id OR s.author_id = b.author_id))`, userID, bookID).Scan(&subscribed)
+	return subscribed, err
+}
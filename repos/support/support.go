@@ -0,0 +1,130 @@
+package support
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/abuse"
+	"github.com/RedBuld/book_bot_database/repos/errjournal"
+	"github.com/RedBuld/book_bot_database/repos/preferences"
+	"github.com/RedBuld/book_bot_database/repos/users"
+)
+
+const (
+	recentLimit      = 10
+	shortIDLength    = 8
+	linkedLookupHops = 1
+)
+
+var ErrEmptyQuery = errors.New("empty support lookup")
+
+// Query identifies a user by any one of its fields; the first set field
+// wins, in declaration order.
+type Query struct {
+	TelegramID int64
+	Username   string
+	ShortID    string
+	PaymentID  string
+}
+
+// ParseQuery interprets the argument of /whois: "@name" is a username,
+// digits a Telegram ID, an 8 character handle a short ID, and anything else
+// a payment identity.
+func ParseQuery(arg string) Query {
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "@") {
+		return Query{Username: arg}
+	}
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return Query{TelegramID: id}
+	}
+	if len(arg) == shortIDLength {
+		return Query{ShortID: arg}
+	}
+	return Query{PaymentID: arg}
+}
+
+// Profile is everything support needs about a user, gathered in one call.
+type Profile struct {
+	User           *users.User
+	Preferences    json.RawMessage
+	Risk           float64
+	RiskLevel      string
+	RecentSignals  []abuse.Signal
+	RecentErrors   []errjournal.Entry
+	LinkedAccounts []abuse.LinkedAccount
+}
+
+type Repo struct {
+	session     *database.DB_Session
+	users       *users.Repo
+	preferences *preferences.Repo
+	abuse       *abuse.Repo
+	errors      *errjournal.Repo
+}
+
+func New(session *database.DB_Session, abuseRepo *abuse.Repo) *Repo {
+	return &Repo{
+		session:     session,
+		users:       users.New(session),
+		preferences: preferences.New(session),
+		abuse:       abuseRepo,
+		errors:      errjournal.New(session),
+	}
+}
+
+func (repo *Repo) resolve(ctx context.Context, q Query) (*users.User, error) {
+	switch {
+	case q.TelegramID != 0:
+		return repo.users.Get(ctx, q.TelegramID)
+	case q.Username != "":
+		return repo.users.GetByUsername(ctx, q.Username)
+	case q.ShortID != "":
+		return repo.users.GetByShortID(ctx, q.ShortID)
+	case q.PaymentID != "":
+		linked, err := repo.abuse.FindUsersByIdentity(ctx, abuse.IdentityPayment, q.PaymentID)
+		if err != nil {
+			return nil, err
+		}
+		if len(linked) == 0 {
+			return nil, users.ErrNotFound
+		}
+		return repo.users.Get(ctx, linked[0])
+	}
+	return nil, ErrEmptyQuery
+}
+
+// LookupUser finds the user matching q and assembles their profile.
+func (repo *Repo) LookupUser(ctx context.Context, q Query) (*Profile, error) {
+	user, err := repo.resolve(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{User: user}
+	profile.Preferences, err = repo.preferences.Get(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	profile.Risk, profile.RiskLevel, err = repo.abuse.Score(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	profile.RecentSignals, err = repo.abuse.Signals(ctx, user.ID, recentLimit)
+	if err != nil {
+		return nil, err
+	}
+	profile.RecentErrors, err = repo.errors.GetRecentErrors(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	profile.LinkedAccounts, err = repo.abuse.FindLinkedAccounts(ctx, user.ID, linkedLookupHops, false)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
@@ -0,0 +1,119 @@
+package tasklogs
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	_ "github.com/RedBuld/book_bot_database/repos/tasks"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+
+	defaultKeep      = 200
+	defaultRetention = 14 * 24 * time.Hour
+)
+
+// Line is one structured log line a worker wrote while processing a task.
+type Line struct {
+	ID        int64           `db:"id"`
+	TaskID    int64           `db:"task_id"`
+	WorkerID  string          `db:"worker_id"`
+	Level     string          `db:"level"`
+	Message   string          `db:"message"`
+	Fields    json.RawMessage `db:"fields"`
+	CreatedAt time.Time       `db:"created_at"`
+}
+
+const columns = "id, task_id, worker_id, level, message, fields, created_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140036,
+		Name:    "create_task_logs",
+		Up: `CREATE TABLE task_logs (
+			id         BIGSERIAL PRIMARY KEY,
+			task_id    BIGINT NOT NULL REFERENCES download_tasks (id) ON DELETE CASCADE,
+			worker_id  TEXT NOT NULL DEFAULT '',
+			level      TEXT NOT NULL CHECK (level IN ('debug', 'info', 'warn', 'error')),
+			message    TEXT NOT NULL,
+			fields     JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX task_logs_task_idx ON task_logs (task_id, id);
+		CREATE INDEX task_logs_created_idx ON task_logs (created_at);`,
+		Down: `DROP TABLE task_logs;`,
+	})
+	database.RegisterModel(database.Model{Table: "task_logs", Struct: Line{}, Indexes: []string{"task_logs_task_idx", "task_logs_created_idx"}})
+}
+
+// Repo keeps at most Keep lines per task, dropping the oldest ones, and
+// purges lines older than Retention in Purge.
+type Repo struct {
+	session   *database.DB_Session
+	Keep      int
+	Retention time.Duration
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session, Keep: defaultKeep, Retention: defaultRetention}
+}
+
+// Append writes a log line for taskID. Fields may be nil.
+func (repo *Repo) Append(ctx context.Context, taskID int64, workerID, level, message string, fields map[string]any) error {
+	raw := []byte("{}")
+	if len(fields) > 0 {
+		var err error
+		if raw, err = json.Marshal(fields); err != nil {
+			return err
+		}
+	}
+
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO task_logs (task_id, worker_id, level, message, fields) VALUES ($1, $2, $3, $4, $5)`,
+			taskID, workerID, level, message, raw)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM task_logs WHERE task_id = $1 AND id < (
+				SELECT min(id) FROM (SELECT id FROM task_logs WHERE task_id = $1 ORDER BY id DESC LIMIT $2) kept
+			)`, taskID, repo.Keep)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Postgres keeps only the last lines of a task; the mirror keeps all.
+	repo.session.MirrorRow("task_logs", map[string]any{
+		"task_id": taskID, "worker_id": workerID, "level": level, "message": message, "fields": string(raw),
+		"created_at": repo.session.Clock().Now(),
+	})
+	return nil
+}
+
+// GetTaskLogs returns the log of taskID in the order it was written.
+func (repo *Repo) GetTaskLogs(ctx context.Context, taskID int64) ([]Line, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+columns+" FROM task_logs WHERE task_id = $1 ORDER BY id", taskID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Line])
+}
+
+// Purge drops lines older than Retention, in batches (see
+// database.DeleteInBatches).
+func (repo *Repo) Purge(ctx context.Context) (int64, error) {
+	return repo.session.DeleteInBatches(ctx, "task_logs", "created_at < now() - $1::interval", 0, 0, nil, repo.Retention)
+}
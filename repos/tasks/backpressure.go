@@ -0,0 +1,101 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrQueueFull is matched by errors.Is on a *QueueFullError.
+var ErrQueueFull = errors.New("download queue is full")
+
+const (
+	throughputWindow  = 10 * time.Minute
+	defaultRetryAfter = time.Minute
+	maxRetryAfter     = time.Hour
+)
+
+// Policy sets the high-water marks above which Enqueue rejects new tasks.
+// Zero disables a limit; Sites overrides SiteHighWater per site.
+type Policy struct {
+	HighWater     int
+	SiteHighWater int
+	Sites         map[string]int
+}
+
+func (p Policy) siteLimit(site string) int {
+	if limit, ok := p.Sites[site]; ok {
+		return limit
+	}
+	return p.SiteHighWater
+}
+
+// QueueFullError tells the caller how long the backlog takes to drain back
+// under the limit, so the bot can ask the user to come back later.
+type QueueFullError struct {
+	Site       string
+	Pending    int
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	scope := "global"
+	if e.Site != "" {
+		scope = "site " + e.Site
+	}
+	return fmt.Sprintf("%s: %s has %d pending tasks (limit %d), retry after %s", ErrQueueFull, scope, e.Pending, e.Limit, e.RetryAfter)
+}
+
+func (e *QueueFullError) Is(target error) bool {
+	return target == ErrQueueFull
+}
+
+func (repo *Repo) checkBackpressure(ctx context.Context, site string) error {
+	siteLimit := repo.policy.siteLimit(site)
+	if repo.policy.HighWater <= 0 && siteLimit <= 0 {
+		return nil
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	var pending, sitePending, finished, siteFinished int
+	err = conn.QueryRow(ctx, `SELECT
+			(SELECT count(*) FROM download_tasks WHERE status = 'pending' AND (not_before IS NULL OR not_before <= now())),
+			(SELECT count(*) FROM download_tasks WHERE status = 'pending' AND (not_before IS NULL OR not_before <= now()) AND site = $1),
+			(SELECT count(*) FROM download_tasks WHERE finished_at > now() - $2::interval),
+			(SELECT count(*) FROM download_tasks WHERE finished_at > now() - $2::interval AND site = $1)`,
+		site, throughputWindow).Scan(&pending, &sitePending, &finished, &siteFinished)
+	if err != nil {
+		return err
+	}
+
+	if siteLimit > 0 && sitePending >= siteLimit {
+		return &QueueFullError{Site: site, Pending: sitePending, Limit: siteLimit, RetryAfter: retryAfter(sitePending-siteLimit+1, siteFinished)}
+	}
+	if repo.policy.HighWater > 0 && pending >= repo.policy.HighWater {
+		return &QueueFullError{Pending: pending, Limit: repo.policy.HighWater, RetryAfter: retryAfter(pending-repo.policy.HighWater+1, finished)}
+	}
+	return nil
+}
+
+// retryAfter estimates how long it takes to finish excess tasks at the
+// throughput observed over the last throughputWindow.
+func retryAfter(excess, finished int) time.Duration {
+	if finished <= 0 {
+		return defaultRetryAfter
+	}
+	wait := time.Duration(excess) * throughputWindow / time.Duration(finished)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait.Round(time.Second)
+}
@@ -0,0 +1,131 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Task kinds of a download pipeline. Plain Enqueue creates download tasks;
+// EnqueueChain links any kinds into a dependency chain.
+const (
+	KindDownload = "download"
+	KindConvert  = "convert"
+	KindDeliver  = "deliver"
+)
+
+var ErrEmptyChain = errors.New("task chain is empty")
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140035,
+		Name:    "add_download_tasks_dependencies",
+		Up: `ALTER TABLE download_tasks ADD COLUMN kind TEXT NOT NULL DEFAULT 'download';
+		ALTER TABLE download_tasks ADD COLUMN depends_on BIGINT REFERENCES download_tasks (id) ON DELETE CASCADE;
+		CREATE INDEX download_tasks_depends_idx ON download_tasks (depends_on) WHERE depends_on IS NOT NULL;`,
+		Down: `ALTER TABLE download_tasks DROP COLUMN depends_on;
+		ALTER TABLE download_tasks DROP COLUMN kind;`,
+	})
+}
+
+// EnqueueChain enqueues steps so that each one depends on the previous:
+// a step becomes claimable only after its parent is done, and when a step
+// fails or is cancelled everything after it fails too. Like Enqueue, it
+// fails with books.ErrTakenDown if a step is for a taken down book or
+// site.
+func (repo *Repo) EnqueueChain(ctx context.Context, steps []Task) ([]Task, error) {
+	if len(steps) == 0 {
+		return nil, ErrEmptyChain
+	}
+	for _, step := range steps {
+		if err := repo.checkTakedown(ctx, step); err != nil {
+			return nil, err
+		}
+	}
+	if err := repo.checkBackpressure(ctx, steps[0].Site); err != nil {
+		return nil, err
+	}
+
+	chain := make([]Task, 0, len(steps))
+	err := repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var parent *int64
+		for _, step := range steps {
+			if step.Kind == "" {
+				step.Kind = KindDownload
+			}
+			if step.Requirements == nil {
+				step.Requirements = []string{}
+			}
+			rows, err := tx.Query(ctx, `INSERT INTO download_tasks (user_id, book_id, site, source_url, format, priority, not_before,
+					group_id, group_position, kind, depends_on, requirements)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING `+Columns,
+				step.UserID, step.BookID, step.Site, step.SourceURL, step.Format, step.Priority, step.NotBefore,
+				step.GroupID, step.GroupPos, step.Kind, parent, step.Requirements)
+			if err != nil {
+				return err
+			}
+			task, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Task])
+			if err != nil {
+				return err
+			}
+			chain = append(chain, task)
+			parent = &task.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// Dependents returns the tasks waiting on id.
+func (repo *Repo) Dependents(ctx context.Context, id int64) ([]Task, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+" FROM download_tasks WHERE depends_on = $1 ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Task])
+}
+
+// cascadeFailure fails every unfinished task that directly or transitively
+// depends on id.
+func (repo *Repo) cascadeFailure(ctx context.Context, id int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `WITH RECURSIVE descendants AS (
+			SELECT id FROM download_tasks WHERE depends_on = $1
+			UNION
+			SELECT t.id FROM download_tasks t JOIN descendants d ON t.depends_on = d.id
+		)
+		UPDATE download_tasks SET status = 'failed', error = $2, claimed_until = NULL, updated_at = now(), finished_at = now()
+		WHERE id IN (SELECT id FROM descendants) AND status IN ('pending', 'running')`,
+		id, "dependency "+strconv.FormatInt(id, 10)+" did not complete")
+	return err
+}
+
+// endOfChain reports whether no task depends on id.
+func (repo *Repo) endOfChain(ctx context.Context, id int64) (bool, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var last bool
+	err = conn.QueryRow(ctx, "SELECT NOT EXISTS (SELECT 1 FROM download_tasks WHERE depends_on = $1)", id).Scan(&last)
+	return last, err
+}
@@ -0,0 +1,180 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Directive scopes, from least to most specific. A worker follows the most
+// specific directive that applies to it.
+const (
+	ScopeAll    = "all"
+	ScopeClass  = "class"
+	ScopeWorker = "worker"
+)
+
+// DirectivesChannel is notified with the directive's scope and target
+// whenever a directive changes, for workers that LISTEN instead of polling.
+const DirectivesChannel = "worker_directives"
+
+var ErrInvalidScope = errors.New("invalid directive scope")
+
+// Directive lets operators shed load from the DB side: Concurrency caps
+// the parallel tasks of the matching workers (nil keeps their own
+// setting) and Paused stops them from claiming at all.
+type Directive struct {
+	Scope       string    `db:"scope"`
+	Target      string    `db:"target"`
+	Concurrency *int      `db:"concurrency"`
+	Paused      bool      `db:"paused"`
+	Reason      string    `db:"reason"`
+	UpdatedBy   string    `db:"updated_by"`
+	Version     int64     `db:"version"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+const directiveColumns = "scope, target, concurrency, paused, reason, updated_by, version, updated_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140038,
+		Name:    "create_worker_directives",
+		Up: `ALTER TABLE workers ADD COLUMN class TEXT NOT NULL DEFAULT '';
+		CREATE SEQUENCE worker_directives_version;
+		CREATE TABLE worker_directives (
+			scope       TEXT NOT NULL CHECK (scope IN ('all', 'class', 'worker')),
+			target      TEXT NOT NULL DEFAULT '',
+			concurrency INT CHECK (concurrency >= 0),
+			paused      BOOLEAN NOT NULL DEFAULT false,
+			reason      TEXT NOT NULL DEFAULT '',
+			updated_by  TEXT NOT NULL DEFAULT '',
+			version     BIGINT NOT NULL DEFAULT nextval('worker_directives_version'),
+			updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (scope, target)
+		);
+		CREATE FUNCTION worker_directives_notify() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				PERFORM nextval('worker_directives_version');
+				PERFORM pg_notify('worker_directives', OLD.scope || ':' || OLD.target);
+				RETURN OLD;
+			END IF;
+			PERFORM pg_notify('worker_directives', NEW.scope || ':' || NEW.target);
+			RETURN NEW;
+		END $$;
+		CREATE TRIGGER worker_directives_notify AFTER INSERT OR UPDATE OR DELETE ON worker_directives
+			FOR EACH ROW EXECUTE FUNCTION worker_directives_notify();
+		CREATE FUNCTION worker_paused(worker_id TEXT) RETURNS BOOLEAN LANGUAGE sql STABLE AS $$
+			SELECT COALESCE((
+				SELECT d.paused FROM worker_directives d
+				LEFT JOIN workers w ON w.id = worker_id
+				WHERE d.scope = 'all'
+					OR (d.scope = 'class' AND d.target = w.class)
+					OR (d.scope = 'worker' AND d.target = worker_id)
+				ORDER BY CASE d.scope WHEN 'worker' THEN 0 WHEN 'class' THEN 1 ELSE 2 END
+				LIMIT 1
+			), false)
+		$$;`,
+		Down: `DROP FUNCTION worker_paused(TEXT);
+		DROP TABLE worker_directives;
+		DROP FUNCTION worker_directives_notify();
+		DROP SEQUENCE worker_directives_version;
+		ALTER TABLE workers DROP COLUMN class;`,
+	})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140080,
+		Name:    "touch_worker_directives",
+		Up:      database.TouchUpdatedAtSQL("worker_directives"),
+		Down:    `DROP TRIGGER worker_directives_touch_updated_at ON worker_directives;`,
+	})
+	database.RegisterModel(database.Model{Table: "worker_directives", Struct: Directive{}})
+}
+
+// SetDirective creates or replaces the directive for scope and target;
+// target is ignored for ScopeAll.
+func (repo *Repo) SetDirective(ctx context.Context, d Directive) (*Directive, error) {
+	switch d.Scope {
+	case ScopeAll:
+		d.Target = ""
+	case ScopeClass, ScopeWorker:
+	default:
+		return nil, ErrInvalidScope
+	}
+
+	return database.QueryOne[Directive](ctx, repo.session, `INSERT INTO worker_directives (scope, target, concurrency, paused, reason, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (scope, target) DO UPDATE SET concurrency = EXCLUDED.concurrency, paused = EXCLUDED.paused,
+			reason = EXCLUDED.reason, updated_by = EXCLUDED.updated_by,
+			version = nextval('worker_directives_version'), updated_at = now()
+		RETURNING `+directiveColumns, d.Scope, d.Target, d.Concurrency, d.Paused, d.Reason, d.UpdatedBy)
+}
+
+func (repo *Repo) ClearDirective(ctx context.Context, scope, target string) error {
+	if scope == ScopeAll {
+		target = ""
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM worker_directives WHERE scope = $1 AND target = $2", scope, target)
+	return err
+}
+
+func (repo *Repo) Directives(ctx context.Context) ([]Directive, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+directiveColumns+" FROM worker_directives ORDER BY scope, target")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Directive])
+}
+
+// DirectiveFor returns the directive workerID has to follow, or nil when
+// none applies, and the current directives version. Workers poll it
+// cheaply by passing the version they last saw: when nothing changed
+// since, changed is false and no directive is loaded.
+func (repo *Repo) DirectiveFor(ctx context.Context, workerID string, seenVersion int64) (d *Directive, version int64, changed bool, err error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer conn.Release()
+
+	var latest int64
+	// Deletes advance the sequence too, so its position covers every change.
+	err = conn.QueryRow(ctx, "SELECT last_value FROM worker_directives_version").Scan(&latest)
+	if err != nil || latest == seenVersion {
+		return nil, latest, false, err
+	}
+
+	rows, err := conn.Query(ctx, `SELECT `+directiveColumns+` FROM worker_directives d
+		WHERE d.scope = 'all'
+			OR (d.scope = 'class' AND d.target = (SELECT class FROM workers WHERE id = $1))
+			OR (d.scope = 'worker' AND d.target = $1)
+		ORDER BY CASE d.scope WHEN 'worker' THEN 0 WHEN 'class' THEN 1 ELSE 2 END
+		LIMIT 1`, workerID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	d, err = pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[Directive])
+	if err == pgx.ErrNoRows {
+		return nil, latest, true, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return d, latest, true, nil
+}
@@ -0,0 +1,177 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrEmptySeries = errors.New("series has no downloadable books")
+
+// Group bundles tasks created by one request, like "download all 12 books
+// of a series", so they can be tracked as a single operation.
+type Group struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	Kind      string    `db:"kind"`
+	SeriesID  *int64    `db:"series_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+const GroupKindSeries = "series"
+
+// GroupStatus rolls the states of a group's tasks up.
+type GroupStatus struct {
+	Group
+	Total     int `db:"total"`
+	Pending   int `db:"pending"`
+	Running   int `db:"running"`
+	Done      int `db:"done"`
+	Failed    int `db:"failed"`
+	Cancelled int `db:"cancelled"`
+}
+
+// Status returns running while any task is unfinished, done when all
+// succeeded and failed when at least one failed.
+func (s *GroupStatus) Status() string {
+	switch {
+	case s.Pending+s.Running > 0:
+		return StatusRunning
+	case s.Failed > 0:
+		return StatusFailed
+	case s.Done == 0 && s.Cancelled > 0:
+		return StatusCancelled
+	}
+	return StatusDone
+}
+
+// Progress returns the finished fraction of the group's tasks.
+func (s *GroupStatus) Progress() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Done+s.Failed+s.Cancelled) / float64(s.Total)
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140034,
+		Name:    "create_task_groups",
+		Up: `CREATE TABLE task_groups (
+			id         BIGSERIAL PRIMARY KEY,
+			user_id    BIGINT NOT NULL,
+			kind       TEXT NOT NULL,
+			series_id  BIGINT REFERENCES series (id) ON DELETE SET NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX task_groups_user_idx ON task_groups (user_id, id DESC);
+		ALTER TABLE download_tasks ADD COLUMN group_id BIGINT REFERENCES task_groups (id) ON DELETE SET NULL;
+		ALTER TABLE download_tasks ADD COLUMN group_position INT;
+		CREATE INDEX download_tasks_group_idx ON download_tasks (group_id, group_position) WHERE group_id IS NOT NULL;`,
+		Down: `ALTER TABLE download_tasks DROP COLUMN group_position;
+		ALTER TABLE download_tasks DROP COLUMN group_id;
+		DROP TABLE task_groups;`,
+	})
+	database.RegisterModel(database.Model{Table: "task_groups", Struct: Group{}, Indexes: []string{"task_groups_user_idx"}})
+}
+
+// EnqueueSeries creates a group with one task per visible book of the
+// series in reading order. Tasks are inserted in that order, so workers
+// pick them up in it as well.
+func (repo *Repo) EnqueueSeries(ctx context.Context, userID, seriesID int64, format string) (*GroupStatus, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, "SELECT "+books.Columns+" FROM books WHERE series_id = $1 AND "+books.Visible("books")+
+		" AND "+books.AllowedFor("books", "$2")+" ORDER BY series_position NULLS LAST, id", seriesID, userID)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	list, err := pgx.CollectRows(rows, pgx.RowToStructByName[books.Book])
+	conn.Release()
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrEmptySeries
+	}
+	if err := repo.checkBackpressure(ctx, list[0].SourceSite); err != nil {
+		return nil, err
+	}
+
+	var groupID int64
+	err = repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "INSERT INTO task_groups (user_id, kind, series_id) VALUES ($1, $2, $3) RETURNING id",
+			userID, GroupKindSeries, seriesID).Scan(&groupID)
+		if err != nil {
+			return err
+		}
+		for i, book := range list {
+			_, err = tx.Exec(ctx, `INSERT INTO download_tasks (user_id, book_id, site, source_url, format, group_id, group_position)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`, userID, book.ID, book.SourceSite, book.SourceURL, format, groupID, i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo.GetGroup(ctx, groupID)
+}
+
+func (repo *Repo) GetGroup(ctx context.Context, id int64) (*GroupStatus, error) {
+	status, err := database.QueryOne[GroupStatus](ctx, repo.session, `SELECT g.id, g.user_id, g.kind, g.series_id, g.created_at,
+			count(t.id)::int AS total,
+			count(t.id) FILTER (WHERE t.status = 'pending')::int AS pending,
+			count(t.id) FILTER (WHERE t.status = 'running')::int AS running,
+			count(t.id) FILTER (WHERE t.status = 'done')::int AS done,
+			count(t.id) FILTER (WHERE t.status = 'failed')::int AS failed,
+			count(t.id) FILTER (WHERE t.status = 'cancelled')::int AS cancelled
+		FROM task_groups g
+		LEFT JOIN download_tasks t ON t.group_id = g.id
+		WHERE g.id = $1
+		GROUP BY g.id`, id)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return status, err
+}
+
+// GroupTasks returns the tasks of a group in their original order.
+func (repo *Repo) GroupTasks(ctx context.Context, id int64) ([]Task, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+" FROM download_tasks WHERE group_id = $1 ORDER BY group_position", id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Task])
+}
+
+// CancelGroup cancels every task of the group no worker picked up yet.
+func (repo *Repo) CancelGroup(ctx context.Context, userID, id int64) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `UPDATE download_tasks SET status = 'cancelled', updated_at = now(), finished_at = now()
+		WHERE group_id = $1 AND user_id = $2 AND status = 'pending'`, id, userID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
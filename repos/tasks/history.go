@@ -0,0 +1,94 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// HistoryPoint is one hourly sample of the queue. Depth columns are the
+// backlog when the hour was rolled up; the others count what happened
+// during the hour.
+type HistoryPoint struct {
+	Hour        time.Time `db:"hour"`
+	Pending     int64     `db:"pending"`
+	Running     int64     `db:"running"`
+	Enqueued    int64     `db:"enqueued"`
+	Completed   int64     `db:"completed"`
+	Failed      int64     `db:"failed"`
+	AvgWaitSecs float64   `db:"avg_wait_seconds"`
+}
+
+const historyColumns = "hour, pending, running, enqueued, completed, failed, avg_wait_seconds"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140040,
+		Name:    "create_queue_history",
+		Up: `CREATE TABLE queue_history (
+			hour             TIMESTAMPTZ PRIMARY KEY,
+			pending          BIGINT NOT NULL,
+			running          BIGINT NOT NULL,
+			enqueued         BIGINT NOT NULL,
+			completed        BIGINT NOT NULL,
+			failed           BIGINT NOT NULL,
+			avg_wait_seconds DOUBLE PRECISION NOT NULL
+		);`,
+		Down: `DROP TABLE queue_history;`,
+	})
+	database.RegisterModel(database.Model{Table: "queue_history", Struct: HistoryPoint{}})
+}
+
+// RollupQueueHistory stores the sample of the hour that just ended. It is
+// meant to run shortly after every full hour; running it again for the
+// same hour overwrites the sample.
+func (repo *Repo) RollupQueueHistory(ctx context.Context) (*HistoryPoint, error) {
+	return database.QueryOne[HistoryPoint](ctx, repo.session, `WITH bounds AS (
+			SELECT date_trunc('hour', now()) - interval '1 hour' AS since, date_trunc('hour', now()) AS until
+		)
+		INSERT INTO queue_history (hour, pending, running, enqueued, completed, failed, avg_wait_seconds)
+		SELECT b.since,
+			(SELECT count(*) FROM download_tasks WHERE status = 'pending'),
+			(SELECT count(*) FROM download_tasks WHERE status = 'running'),
+			(SELECT count(*) FROM download_tasks WHERE created_at >= b.since AND created_at < b.until),
+			(SELECT count(*) FROM download_tasks WHERE status = 'done' AND finished_at >= b.since AND finished_at < b.until),
+			(SELECT count(*) FROM download_tasks WHERE status = 'failed' AND finished_at >= b.since AND finished_at < b.until),
+			COALESCE((SELECT avg(EXTRACT(EPOCH FROM finished_at - COALESCE(not_before, created_at)))::float8 FROM download_tasks
+				WHERE status = 'done' AND finished_at >= b.since AND finished_at < b.until), 0)
+		FROM bounds b
+		ON CONFLICT (hour) DO UPDATE SET pending = EXCLUDED.pending, running = EXCLUDED.running, enqueued = EXCLUDED.enqueued,
+			completed = EXCLUDED.completed, failed = EXCLUDED.failed, avg_wait_seconds = EXCLUDED.avg_wait_seconds
+		RETURNING `+historyColumns)
+}
+
+// GetQueueHistory returns the hourly samples in [from, to), oldest first.
+func (repo *Repo) GetQueueHistory(ctx context.Context, from, to time.Time) ([]HistoryPoint, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+historyColumns+" FROM queue_history WHERE hour >= $1 AND hour < $2 ORDER BY hour", from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[HistoryPoint])
+}
+
+// PurgeQueueHistory drops samples older than keep.
+func (repo *Repo) PurgeQueueHistory(ctx context.Context, keep time.Duration) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "DELETE FROM queue_history WHERE hour < now() - $1::interval", keep)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
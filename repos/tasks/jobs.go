@@ -0,0 +1,20 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+// FinishedRetention is how long finished, failed and cancelled tasks are
+// kept before the purge_finished_tasks job drops them; set it before
+// starting RunJobs.
+var FinishedRetention = 30 * 24 * time.Hour
+
+func init() {
+	database.RegisterJob(database.Job{Name: "purge_finished_tasks", Every: 24 * time.Hour, Run: func(ctx context.Context, session *database.DB_Session) (int64, error) {
+		return session.DeleteInBatches(ctx, "download_tasks", "status IN ('done', 'failed', 'cancelled') AND finished_at < now() - $1::interval",
+			0, 0, nil, FinishedRetention)
+	}})
+}
@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsQueryTimeout = 5 * time.Second
+
+// Metrics exports the state of the queue to Prometheus. Gauges are read
+// from the database on every scrape; claim latency and retries are
+// counted by the Repo the metrics were created for.
+type Metrics struct {
+	repo *Repo
+
+	pending     *prometheus.Desc
+	running     *prometheus.Desc
+	oldest      *prometheus.Desc
+	deadLetters *prometheus.Desc
+	openSites   *prometheus.Desc
+
+	claimLatency prometheus.Histogram
+	claims       *prometheus.CounterVec
+	retries      *prometheus.CounterVec
+}
+
+// NewMetrics attaches queue metrics to repo; register the result with a
+// prometheus.Registerer.
+func NewMetrics(repo *Repo) *Metrics {
+	m := &Metrics{
+		repo:        repo,
+		pending:     prometheus.NewDesc("book_bot_queue_pending", "Claimable pending tasks.", []string{"priority", "site"}, nil),
+		running:     prometheus.NewDesc("book_bot_queue_running", "Tasks currently claimed by a worker.", []string{"site"}, nil),
+		oldest:      prometheus.NewDesc("book_bot_queue_oldest_pending_seconds", "Age of the oldest claimable pending task.", nil, nil),
+		deadLetters: prometheus.NewDesc("book_bot_queue_dead_letters", "Tasks that failed after using up their attempts.", nil, nil),
+		openSites:   prometheus.NewDesc("book_bot_queue_open_circuits", "Sites whose failure circuit is open.", nil, nil),
+		claimLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "book_bot_queue_claim_duration_seconds",
+			Help:    "Duration of ClaimNext calls.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		claims: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "book_bot_queue_claims_total",
+			Help: "ClaimNext calls by whether a task was handed out.",
+		}, []string{"result"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "book_bot_queue_retries_total",
+			Help: "Tasks put back into the queue after a failure.",
+		}, []string{"site"}),
+	}
+	repo.metrics = m
+	return m
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.pending
+	ch <- m.running
+	ch <- m.oldest
+	ch <- m.deadLetters
+	ch <- m.openSites
+	m.claimLatency.Describe(ch)
+	m.claims.Describe(ch)
+	m.retries.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.claimLatency.Collect(ch)
+	m.claims.Collect(ch)
+	m.retries.Collect(ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), metricsQueryTimeout)
+	defer cancel()
+	if err := m.collectQueue(ctx, ch); err != nil {
+		ch <- prometheus.NewInvalidMetric(m.pending, err)
+	}
+}
+
+func (m *Metrics) collectQueue(ctx context.Context, ch chan<- prometheus.Metric) error {
+	conn, err := m.repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT status, priority, site, count(*) FROM download_tasks
+		WHERE status = 'running' OR (status = 'pending' AND (not_before IS NULL OR not_before <= now()))
+		GROUP BY status, priority, site`)
+	if err != nil {
+		return err
+	}
+	running := map[string]float64{}
+	for rows.Next() {
+		var status, site string
+		var priority int
+		var count float64
+		if err := rows.Scan(&status, &priority, &site, &count); err != nil {
+			rows.Close()
+			return err
+		}
+		if status == StatusRunning {
+			running[site] += count
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(m.pending, prometheus.GaugeValue, count, strconv.Itoa(priority), site)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for site, count := range running {
+		ch <- prometheus.MustNewConstMetric(m.running, prometheus.GaugeValue, count, site)
+	}
+
+	var oldest, deadLetters, openSites float64
+	err = conn.QueryRow(ctx, `SELECT
+			COALESCE((SELECT EXTRACT(EPOCH FROM now() - min(COALESCE(not_before, created_at)))::float8 FROM download_tasks
+				WHERE status = 'pending' AND (not_before IS NULL OR not_before <= now())), 0),
+			(SELECT count(*) FROM download_tasks WHERE status = 'failed' AND attempts >= $1),
+			(SELECT count(*) FROM site_circuits WHERE open_until > now())`,
+		m.repo.RetryPolicy.MaxAttempts).Scan(&oldest, &deadLetters, &openSites)
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(m.oldest, prometheus.GaugeValue, oldest)
+	ch <- prometheus.MustNewConstMetric(m.deadLetters, prometheus.GaugeValue, deadLetters)
+	ch <- prometheus.MustNewConstMetric(m.openSites, prometheus.GaugeValue, openSites)
+	return nil
+}
+
+func (m *Metrics) observeClaim(started time.Time, err error) {
+	m.claimLatency.Observe(time.Since(started).Seconds())
+	switch err {
+	case nil:
+		m.claims.WithLabelValues("claimed").Inc()
+	case ErrNotFound:
+		m.claims.WithLabelValues("empty").Inc()
+	default:
+		m.claims.WithLabelValues("error").Inc()
+	}
+}
@@ -0,0 +1,150 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultVisibilityTimeout is how long a dequeued task stays invisible to
+// other workers unless the worker extends its lease.
+const DefaultVisibilityTimeout = 10 * time.Minute
+
+// ErrLeaseLost is returned when a worker reports on a task it no longer
+// holds: its lease ran out and the task went back to the queue, so
+// another worker may be processing it already.
+var ErrLeaseLost = errors.New("task lease lost")
+
+// Dequeue claims the next task for workerID with the VisibilityTimeout as
+// lease; see ClaimNext. Claiming uses SKIP LOCKED, so concurrent workers
+// never get the same task. Report the outcome with Ack or Nack.
+func (repo *Repo) Dequeue(ctx context.Context, workerID string) (*Task, error) {
+	return repo.ClaimNext(ctx, workerID, repo.VisibilityTimeout)
+}
+
+// owned runs an update of task id that only applies while workerID still
+// holds its lease.
+func (repo *Repo) owned(ctx context.Context, id int64, workerID string, set string, args ...any) (*Task, error) {
+	task, err := repo.one(ctx, "UPDATE download_tasks SET "+set+`, updated_at = now()
+		WHERE id = $1 AND status = 'running' AND worker_id = $2
+		RETURNING `+Columns, append([]any{id, workerID}, args...)...)
+	if err == ErrNotFound {
+		return nil, ErrLeaseLost
+	}
+	return task, err
+}
+
+// Extend renews the lease of workerID on a long-running task.
+func (repo *Repo) Extend(ctx context.Context, id int64, workerID string) error {
+	_, err := repo.owned(ctx, id, workerID, "claimed_until = now() + $3::interval", repo.VisibilityTimeout)
+	return err
+}
+
+// Ack completes a task workerID holds, as Complete does.
+func (repo *Repo) Ack(ctx context.Context, id int64, workerID string) error {
+	task, err := repo.owned(ctx, id, workerID, "status = 'done', error = NULL, claimed_until = NULL, finished_at = now()")
+	if err != nil {
+		return err
+	}
+	return repo.completed(ctx, task)
+}
+
+// Nack reports that workerID failed a task it holds. The task is retried
+// after the policy's backoff, or moves to the dead letters when it used up
+// its attempts.
+func (repo *Repo) Nack(ctx context.Context, id int64, workerID string, cause error) error {
+	task, err := repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if task.Status != StatusRunning || task.WorkerID == nil || *task.WorkerID != workerID {
+		return ErrLeaseLost
+	}
+
+	msg := cause.Error()
+	if repo.RetryPolicy.Exhausted(task.Attempts) {
+		task, err = repo.owned(ctx, id, workerID, "status = 'failed', error = $3, claimed_until = NULL, finished_at = now()", msg)
+		if err != nil {
+			return err
+		}
+		return repo.failed(ctx, task)
+	}
+	_, err = repo.owned(ctx, id, workerID, "status = 'pending', error = $3, worker_id = NULL, claimed_until = NULL, not_before = now() + $4::interval",
+		msg, repo.RetryPolicy.Delay(task.Attempts))
+	if err != nil {
+		return err
+	}
+	if repo.metrics != nil {
+		repo.metrics.retries.WithLabelValues(task.Site).Inc()
+	}
+	return repo.recordSiteFailure(ctx, task.Site)
+}
+
+// ReapExpired moves tasks whose lease ran out after their last attempt to
+// the dead letters; their worker most likely crashes on them. It returns
+// how many it moved.
+func (repo *Repo) ReapExpired(ctx context.Context) (int64, error) {
+	if repo.RetryPolicy.MaxAttempts <= 0 {
+		return 0, nil
+	}
+
+	ids, err := repo.reapExpired(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if err := repo.cascadeFailure(ctx, id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+func (repo *Repo) reapExpired(ctx context.Context) ([]int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `UPDATE download_tasks SET status = 'failed', error = 'lease expired after the last attempt',
+			claimed_until = NULL, updated_at = now(), finished_at = now()
+		WHERE id IN (
+			SELECT id FROM download_tasks WHERE status = 'running' AND claimed_until < now() AND $1 > 0 AND attempts >= $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id`, repo.RetryPolicy.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int64])
+}
+
+// DeadLetters returns the failed tasks that used up their attempts, most
+// recent first; there are none when MaxAttempts is not positive.
+func (repo *Repo) DeadLetters(ctx context.Context, limit int) ([]Task, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+` FROM download_tasks WHERE status = 'failed' AND $1 > 0 AND attempts >= $1
+		ORDER BY finished_at DESC, id DESC LIMIT $2`, repo.RetryPolicy.MaxAttempts, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Task])
+}
+
+// Redrive puts a dead-lettered task back into the queue with fresh
+// attempts, e.g. after the parser for its site was fixed.
+func (repo *Repo) Redrive(ctx context.Context, id int64) error {
+	_, err := repo.one(ctx, `UPDATE download_tasks SET status = 'pending', attempts = 0, error = NULL, worker_id = NULL,
+			claimed_until = NULL, not_before = NULL, finished_at = NULL, updated_at = now()
+		WHERE id = $1 AND status = 'failed' AND $2 > 0 AND attempts >= $2
+		RETURNING `+Columns, id, repo.RetryPolicy.MaxAttempts)
+	return err
+}
@@ -0,0 +1,165 @@
+package tasks
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// RetryPolicy spreads retries out so a site outage doesn't turn into
+// thousands of synchronized requeues. The delay doubles with every
+// attempt up to MaxDelay and is jittered by ±50%. A site whose tasks fail
+// CircuitThreshold times within CircuitWindow is not claimed from for
+// CircuitCooldown. A MaxAttempts of 0 or less retries forever.
+type RetryPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int
+
+	CircuitThreshold int
+	CircuitWindow    time.Duration
+	CircuitCooldown  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:        30 * time.Second,
+	MaxDelay:         time.Hour,
+	MaxAttempts:      5,
+	CircuitThreshold: 50,
+	CircuitWindow:    5 * time.Minute,
+	CircuitCooldown:  10 * time.Minute,
+}
+
+// Exhausted reports whether a task that ran attempts times used up its
+// attempts.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// Delay returns the jittered backoff before retry number attempt.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+}
+
+// Circuit is the failure state of a site.
+type Circuit struct {
+	Site        string     `db:"site"`
+	Failures    int        `db:"failures"`
+	WindowStart time.Time  `db:"window_start"`
+	OpenUntil   *time.Time `db:"open_until"`
+}
+
+func (c *Circuit) Open(now time.Time) bool {
+	return c.OpenUntil != nil && c.OpenUntil.After(now)
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140039,
+		Name:    "create_site_circuits",
+		Up: `CREATE TABLE site_circuits (
+			site         TEXT PRIMARY KEY,
+			failures     INT NOT NULL DEFAULT 0,
+			window_start TIMESTAMPTZ NOT NULL DEFAULT now(),
+			open_until   TIMESTAMPTZ
+		);`,
+		Down: `DROP TABLE site_circuits;`,
+	})
+	database.RegisterModel(database.Model{Table: "site_circuits", Struct: Circuit{}})
+}
+
+// Retry puts a failed running task back into the queue after the policy's
+// backoff, or fails it for good once it used up MaxAttempts.
+func (repo *Repo) Retry(ctx context.Context, id int64, cause error) error {
+	task, err := repo.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if repo.RetryPolicy.Exhausted(task.Attempts) {
+		return repo.Fail(ctx, id, cause)
+	}
+	if err := repo.recordSiteFailure(ctx, task.Site); err != nil {
+		return err
+	}
+
+	msg := cause.Error()
+	_, err = repo.one(ctx, `UPDATE download_tasks SET status = 'pending', error = $2, worker_id = NULL, claimed_until = NULL,
+			not_before = now() + $3::interval, updated_at = now()
+		WHERE id = $1 AND status = 'running'
+		RETURNING `+Columns, id, msg, repo.RetryPolicy.Delay(task.Attempts))
+	if err == nil && repo.metrics != nil {
+		repo.metrics.retries.WithLabelValues(task.Site).Inc()
+	}
+	return err
+}
+
+// recordSiteFailure counts a failure against site and opens its circuit
+// when the failures in the current window reach the threshold.
+func (repo *Repo) recordSiteFailure(ctx context.Context, site string) error {
+	if repo.RetryPolicy.CircuitThreshold <= 0 {
+		return nil
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// now() is fixed for the statement, so an open_until equal to the
+	// newly computed deadline means this failure opened the circuit.
+	failures := `CASE WHEN c.window_start < now() - $2::interval THEN 1 ELSE c.failures + 1 END`
+	var opened bool
+	err = conn.QueryRow(ctx, `INSERT INTO site_circuits AS c (site, failures, window_start, open_until)
+		VALUES ($1, 1, now(), CASE WHEN 1 >= $3 THEN now() + $4::interval END)
+		ON CONFLICT (site) DO UPDATE SET
+			failures = `+failures+`,
+			window_start = CASE WHEN c.window_start < now() - $2::interval THEN now() ELSE c.window_start END,
+			open_until = CASE WHEN COALESCE(c.open_until, '-infinity') <= now() AND `+failures+` >= $3
+				THEN now() + $4::interval ELSE c.open_until END
+		RETURNING COALESCE(c.open_until = now() + $4::interval, false)`,
+		site, repo.RetryPolicy.CircuitWindow, repo.RetryPolicy.CircuitThreshold, repo.RetryPolicy.CircuitCooldown).Scan(&opened)
+	if err != nil || !opened {
+		return err
+	}
+	repo.session.Logger().Log(database.LevelWarn, "DB queue circuit opened", database.F("site", site), database.F("cooldown", repo.RetryPolicy.CircuitCooldown))
+	return nil
+}
+
+// Circuits returns the failure state of every site seen failing.
+func (repo *Repo) Circuits(ctx context.Context) ([]Circuit, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT site, failures, window_start, open_until FROM site_circuits ORDER BY site")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Circuit])
+}
+
+// ResetCircuit closes the circuit of site, e.g. after an operator checked
+// the site is back.
+func (repo *Repo) ResetCircuit(ctx context.Context, site string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "UPDATE site_circuits SET failures = 0, window_start = now(), open_until = NULL WHERE site = $1", site)
+	return err
+}
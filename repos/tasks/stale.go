@@ -0,0 +1,161 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultHeartbeatTimeout is how long a registered worker may go without
+// a Heartbeat before DetectStaleTasks takes its tasks away.
+const DefaultHeartbeatTimeout = 2 * time.Minute
+
+// Actions of a StaleIncident.
+const (
+	StaleRequeued = "requeued"
+	StaleFailed   = "failed"
+)
+
+var ErrUnknownWorker = errors.New("worker not registered")
+
+// StaleIncident records a task taken from a worker that stopped sending
+// heartbeats, and whether it went back to the queue or, out of attempts,
+// to the dead letters.
+type StaleIncident struct {
+	ID               int64     `db:"id"`
+	TaskID           int64     `db:"task_id"`
+	WorkerID         string    `db:"worker_id"`
+	WorkerLastSeenAt time.Time `db:"worker_last_seen_at"`
+	Action           string    `db:"action"`
+	DetectedAt       time.Time `db:"detected_at"`
+}
+
+const incidentColumns = "id, task_id, worker_id, worker_last_seen_at, action, detected_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140060,
+		Name:    "create_stale_task_incidents",
+		Up: `CREATE TABLE stale_task_incidents (
+			id                  BIGSERIAL PRIMARY KEY,
+			task_id             BIGINT NOT NULL REFERENCES download_tasks (id) ON DELETE CASCADE,
+			worker_id           TEXT NOT NULL,
+			worker_last_seen_at TIMESTAMPTZ NOT NULL,
+			action              TEXT NOT NULL CHECK (action IN ('requeued', 'failed')),
+			detected_at         TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX stale_task_incidents_detected_idx ON stale_task_incidents (detected_at);`,
+		Down: `DROP TABLE stale_task_incidents;`,
+	})
+	database.RegisterModel(database.Model{Table: "stale_task_incidents", Struct: StaleIncident{}, Indexes: []string{"stale_task_incidents_detected_idx"}})
+}
+
+// Heartbeat tells DetectStaleTasks that workerID is alive. Registered
+// workers call it well within HeartbeatTimeout, independently of their
+// task leases, which can be long.
+func (repo *Repo) Heartbeat(ctx context.Context, workerID string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "UPDATE workers SET last_seen_at = now() WHERE id = $1", workerID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUnknownWorker
+	}
+	return nil
+}
+
+// DetectStaleTasks takes the running tasks away from registered workers
+// whose last heartbeat is older than HeartbeatTimeout, most likely
+// crashed, without waiting for the task leases to run out. The tasks go
+// back to the queue for the next worker to claim, or fail for good when
+// they used up their attempts; each is recorded as an incident, in the
+// same statement. Tasks of unregistered workers are left to their
+// leases. It skips tasks locked by a concurrent run, so every bot
+// instance may run it.
+func (repo *Repo) DetectStaleTasks(ctx context.Context) ([]StaleIncident, error) {
+	incidents, err := repo.detectStale(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, incident := range incidents {
+		if incident.Action == StaleFailed {
+			if err := repo.cascadeFailure(ctx, incident.TaskID); err != nil {
+				return incidents, err
+			}
+		}
+	}
+	if len(incidents) > 0 {
+		repo.session.Logger().Log(database.LevelWarn, "DB took tasks from stale workers", database.F("tasks", len(incidents)))
+	}
+	return incidents, nil
+}
+
+func (repo *Repo) detectStale(ctx context.Context) ([]StaleIncident, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `WITH stale AS (
+			SELECT t.id, t.worker_id, w.last_seen_at FROM download_tasks t
+			JOIN workers w ON w.id = t.worker_id
+			WHERE t.status = 'running' AND w.last_seen_at < now() - $1::interval
+			FOR UPDATE OF t SKIP LOCKED
+		), moved AS (
+			UPDATE download_tasks t SET
+				status = CASE WHEN $2 > 0 AND t.attempts >= $2 THEN 'failed' ELSE 'pending' END,
+				error = 'worker ' || s.worker_id || ' stopped sending heartbeats',
+				finished_at = CASE WHEN $2 > 0 AND t.attempts >= $2 THEN now() END,
+				worker_id = NULL, claimed_until = NULL, updated_at = now()
+			FROM stale s WHERE t.id = s.id
+			RETURNING t.id, s.worker_id, s.last_seen_at, t.status
+		)
+		INSERT INTO stale_task_incidents (task_id, worker_id, worker_last_seen_at, action)
+		SELECT id, worker_id, last_seen_at, CASE WHEN status = 'failed' THEN 'failed' ELSE 'requeued' END FROM moved
+		RETURNING `+incidentColumns, repo.HeartbeatTimeout, repo.RetryPolicy.MaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[StaleIncident])
+}
+
+// RunStaleTaskDetector calls DetectStaleTasks every interval until ctx is
+// done. A failed run is logged and tried again at the next tick.
+func (repo *Repo) RunStaleTaskDetector(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := repo.DetectStaleTasks(ctx); err != nil && ctx.Err() == nil {
+			repo.session.Logger().Log(database.LevelWarn, "DB stale task detection failed", database.F("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-repo.session.Clock().After(interval):
+		}
+	}
+}
+
+// StaleIncidents returns the incidents detected since since, newest
+// first.
+func (repo *Repo) StaleIncidents(ctx context.Context, since time.Time) ([]StaleIncident, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+incidentColumns+" FROM stale_task_incidents WHERE detected_at >= $1 ORDER BY id DESC", since)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[StaleIncident])
+}
@@ -0,0 +1,320 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+var ErrNotFound = errors.New("task not found")
+
+// Task is one download requested by a user: fetch SourceURL from Site and
+// convert it to Format.
+type Task struct {
+	ID           int64      `db:"id"`
+	UserID       int64      `db:"user_id"`
+	BookID       *int64     `db:"book_id"`
+	Site         string     `db:"site"`
+	SourceURL    string     `db:"source_url"`
+	Format       string     `db:"format"`
+	Priority     int        `db:"priority"`
+	Status       string     `db:"status"`
+	Attempts     int        `db:"attempts"`
+	WorkerID     *string    `db:"worker_id"`
+	ClaimedUntil *time.Time `db:"claimed_until"`
+	NotBefore    *time.Time `db:"not_before"`
+	GroupID      *int64     `db:"group_id"`
+	GroupPos     *int       `db:"group_position"`
+	Kind         string     `db:"kind"`
+	DependsOn    *int64     `db:"depends_on"`
+	Requirements []string   `db:"requirements"`
+	Error        *string    `db:"error"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+	FinishedAt   *time.Time `db:"finished_at"`
+}
+
+const Columns = "id, user_id, book_id, site, source_url, format, priority, status, attempts, worker_id, claimed_until, not_before, " +
+	"group_id, group_position, kind, depends_on, requirements, error, created_at, updated_at, finished_at"
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140032,
+		Name:    "create_download_tasks",
+		Up: `CREATE TABLE download_tasks (
+			id            BIGSERIAL PRIMARY KEY,
+			user_id       BIGINT NOT NULL,
+			book_id       BIGINT REFERENCES books (id) ON DELETE SET NULL,
+			site          TEXT NOT NULL,
+			source_url    TEXT NOT NULL,
+			format        TEXT NOT NULL,
+			priority      INT NOT NULL DEFAULT 0,
+			status        TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed', 'cancelled')),
+			attempts      INT NOT NULL DEFAULT 0,
+			worker_id     TEXT,
+			claimed_until TIMESTAMPTZ,
+			error         TEXT,
+			created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finished_at   TIMESTAMPTZ
+		);
+		CREATE INDEX download_tasks_pending_idx ON download_tasks (priority DESC, id) WHERE status = 'pending';
+		CREATE INDEX download_tasks_site_idx ON download_tasks (site) WHERE status = 'pending';
+		CREATE INDEX download_tasks_user_idx ON download_tasks (user_id, id DESC);
+		CREATE INDEX download_tasks_finished_idx ON download_tasks (finished_at) WHERE finished_at IS NOT NULL;`,
+		Down: `DROP TABLE download_tasks;`,
+	})
+	database.RegisterModel(database.Model{Table: "download_tasks", Struct: Task{}, Indexes: []string{
+		"download_tasks_pending_idx", "download_tasks_site_idx", "download_tasks_user_idx", "download_tasks_finished_idx",
+		"download_tasks_scheduled_idx",
+	}})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140033,
+		Name:    "add_download_tasks_not_before",
+		Up: `ALTER TABLE download_tasks ADD COLUMN not_before TIMESTAMPTZ;
+		CREATE INDEX download_tasks_scheduled_idx ON download_tasks (user_id, not_before) WHERE status = 'pending' AND not_before IS NOT NULL;`,
+		Down: `ALTER TABLE download_tasks DROP COLUMN not_before;`,
+	})
+	// Claims update every pending row several times, so the queue bloats
+	// and its statistics go stale within minutes at peaks.
+	database.RegisterHotTable(database.HotTable{Table: "download_tasks", AnalyzeEvery: 5 * time.Minute, VacuumEvery: 30 * time.Minute})
+}
+
+// Repo retries and opens site circuits according to RetryPolicy, which
+// starts out as DefaultRetryPolicy. VisibilityTimeout is the lease
+// Dequeue hands out; HeartbeatTimeout is the silence after which
+// DetectStaleTasks deems a worker dead.
+type Repo struct {
+	session           *database.DB_Session
+	books             *books.Repo
+	policy            Policy
+	RetryPolicy       RetryPolicy
+	VisibilityTimeout time.Duration
+	HeartbeatTimeout  time.Duration
+	metrics           *Metrics
+}
+
+func New(session *database.DB_Session, policy Policy) *Repo {
+	return &Repo{session: session, books: books.New(session), policy: policy, RetryPolicy: DefaultRetryPolicy,
+		VisibilityTimeout: DefaultVisibilityTimeout, HeartbeatTimeout: DefaultHeartbeatTimeout}
+}
+
+// NewFromParams configures backpressure and retries from the session's
+// Queue and Retries params.
+func NewFromParams(session *database.DB_Session) *Repo {
+	params := session.Params()
+	repo := New(session, Policy{
+		HighWater:     params.Queue.HighWater,
+		SiteHighWater: params.Queue.SiteHighWater,
+		Sites:         params.Queue.Sites,
+	})
+	repo.RetryPolicy = RetryPolicy{
+		BaseDelay:        time.Duration(params.Retries.TaskBaseDelaySec) * time.Second,
+		MaxDelay:         time.Duration(params.Retries.TaskMaxDelaySec) * time.Second,
+		MaxAttempts:      params.Retries.TaskMaxAttempts,
+		CircuitThreshold: params.Queue.CircuitThreshold,
+		CircuitWindow:    time.Duration(params.Queue.CircuitWindowSec) * time.Second,
+		CircuitCooldown:  time.Duration(params.Queue.CircuitCooldownSec) * time.Second,
+	}
+	return repo
+}
+
+func (repo *Repo) one(ctx context.Context, sql string, args ...any) (*Task, error) {
+	task, err := database.QueryOne[Task](ctx, repo.session, sql, args...)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return task, err
+}
+
+// checkTakedown returns books.ErrTakenDown if task downloads a taken down
+// book or from a taken down site.
+func (repo *Repo) checkTakedown(ctx context.Context, task Task) error {
+	if task.BookID != nil {
+		if err := repo.books.CheckAvailable(ctx, *task.BookID); err != nil {
+			return err
+		}
+	}
+	takenDown, err := repo.books.SiteTakenDown(ctx, task.Site)
+	if err != nil {
+		return err
+	}
+	if takenDown {
+		return books.ErrTakenDown
+	}
+	return nil
+}
+
+// Enqueue adds a pending task, or fails with a *QueueFullError when the
+// backlog is above the policy's high-water mark. A task with NotBefore in
+// the future is only claimable from then on; such deferred tasks skip the
+// backpressure check, since they don't add to the current backlog. Tasks
+// for taken down books or sites fail with books.ErrTakenDown.
+func (repo *Repo) Enqueue(ctx context.Context, task Task) (*Task, error) {
+	if err := repo.checkTakedown(ctx, task); err != nil {
+		return nil, err
+	}
+	if task.NotBefore == nil || !task.NotBefore.After(repo.session.Clock().Now()) {
+		if err := repo.checkBackpressure(ctx, task.Site); err != nil {
+			return nil, err
+		}
+	}
+	if task.Requirements == nil {
+		task.Requirements = []string{}
+	}
+	return repo.one(ctx, `INSERT INTO download_tasks (user_id, book_id, site, source_url, format, priority, not_before, requirements)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING `+Columns,
+		task.UserID, task.BookID, task.Site, task.SourceURL, task.Format, task.Priority, task.NotBefore, task.Requirements)
+}
+
+func (repo *Repo) Get(ctx context.Context, id int64) (*Task, error) {
+	return repo.one(ctx, "SELECT "+Columns+" FROM download_tasks WHERE id = $1", id)
+}
+
+// ClaimNext hands the most urgent pending task to workerID for lease.
+// Tasks whose lease ran out are claimable again, scheduled ones only once
+// their not_before has passed and dependent ones only once their parent is
+// done. Only tasks whose requirements the worker's registered capabilities
+// cover are considered, none of a site with an open circuit, and nothing
+// while a directive pauses the worker. A task whose lease ran out after
+// its last attempt is left for ReapExpired.
+// It returns ErrNotFound when there is nothing to do.
+func (repo *Repo) ClaimNext(ctx context.Context, workerID string, lease time.Duration) (*Task, error) {
+	if repo.metrics != nil {
+		started := time.Now()
+		task, err := repo.claimNext(ctx, workerID, lease)
+		repo.metrics.observeClaim(started, err)
+		return task, err
+	}
+	return repo.claimNext(ctx, workerID, lease)
+}
+
+func (repo *Repo) claimNext(ctx context.Context, workerID string, lease time.Duration) (*Task, error) {
+	return repo.one(ctx, `UPDATE download_tasks SET status = 'running', worker_id = $1, claimed_until = now() + $2::interval,
+			attempts = attempts + 1, updated_at = now()
+		WHERE id = (
+			SELECT t.id FROM download_tasks t
+			WHERE ((t.status = 'pending' AND (t.not_before IS NULL OR t.not_before <= now()))
+					OR (t.status = 'running' AND t.claimed_until < now() AND ($3 <= 0 OR t.attempts < $3)))
+				AND (t.depends_on IS NULL OR EXISTS (SELECT 1 FROM download_tasks p WHERE p.id = t.depends_on AND p.status = 'done'))
+				AND t.requirements <@ COALESCE((SELECT w.capabilities FROM workers w WHERE w.id = $1), '{}')
+				AND NOT worker_paused($1)
+				AND NOT EXISTS (SELECT 1 FROM site_circuits c WHERE c.site = t.site AND c.open_until > now())
+			ORDER BY priority DESC, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+Columns, workerID, lease, repo.RetryPolicy.MaxAttempts)
+}
+
+func (repo *Repo) finish(ctx context.Context, id int64, status string, cause *string) (*Task, error) {
+	return repo.one(ctx, `UPDATE download_tasks SET status = $2, error = $3, claimed_until = NULL, updated_at = now(), finished_at = now()
+		WHERE id = $1 AND status IN ('pending', 'running')
+		RETURNING `+Columns, id, status, cause)
+}
+
+// Complete marks a task done. The last task of a chain counts the
+// download in the book's stats.
+func (repo *Repo) Complete(ctx context.Context, id int64) error {
+	task, err := repo.finish(ctx, id, StatusDone, nil)
+	if err != nil {
+		return err
+	}
+	return repo.completed(ctx, task)
+}
+
+func (repo *Repo) completed(ctx context.Context, task *Task) error {
+	id := task.ID
+	if task.BookID == nil {
+		return nil
+	}
+	last, err := repo.endOfChain(ctx, id)
+	if err != nil || !last {
+		return err
+	}
+	return repo.books.RecordDownload(ctx, *task.BookID, task.Format)
+}
+
+// Fail marks a task failed, together with every task depending on it.
+func (repo *Repo) Fail(ctx context.Context, id int64, cause error) error {
+	msg := cause.Error()
+	task, err := repo.finish(ctx, id, StatusFailed, &msg)
+	if err != nil {
+		return err
+	}
+	return repo.failed(ctx, task)
+}
+
+func (repo *Repo) failed(ctx context.Context, task *Task) error {
+	id := task.ID
+	if err := repo.recordSiteFailure(ctx, task.Site); err != nil {
+		return err
+	}
+	return repo.cascadeFailure(ctx, id)
+}
+
+// Cancel stops a task that hasn't finished yet; its dependents fail.
+func (repo *Repo) Cancel(ctx context.Context, id int64) error {
+	if _, err := repo.finish(ctx, id, StatusCancelled, nil); err != nil {
+		return err
+	}
+	return repo.cascadeFailure(ctx, id)
+}
+
+// CancelForUser cancels a task of userID that no worker picked up yet, e.g.
+// a download the user scheduled for the night.
+func (repo *Repo) CancelForUser(ctx context.Context, userID, id int64) error {
+	_, err := repo.one(ctx, `UPDATE download_tasks SET status = 'cancelled', updated_at = now(), finished_at = now()
+		WHERE id = $1 AND user_id = $2 AND status = 'pending'
+		RETURNING `+Columns, id, userID)
+	if err != nil {
+		return err
+	}
+	return repo.cascadeFailure(ctx, id)
+}
+
+// ListScheduledForUser returns the deferred tasks of userID that are not
+// claimable yet, soonest first.
+func (repo *Repo) ListScheduledForUser(ctx context.Context, userID int64) ([]Task, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT `+Columns+` FROM download_tasks
+		WHERE user_id = $1 AND status = 'pending' AND not_before > now()
+		ORDER BY not_before, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Task])
+}
+
+// ListForUser returns the latest tasks of a user.
+func (repo *Repo) ListForUser(ctx context.Context, userID int64, limit int) ([]Task, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+Columns+" FROM download_tasks WHERE user_id = $1 ORDER BY id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Task])
+}
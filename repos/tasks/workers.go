@@ -0,0 +1,88 @@
+package tasks
+
+import (
+	"context"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Capabilities a task can require and a worker can offer.
+const (
+	CapHeadlessBrowser = "headless_browser"
+	CapLargeMemory     = "large_memory"
+)
+
+// SiteCredentials is the capability of holding login credentials for site.
+func SiteCredentials(site string) string {
+	return "credentials:" + site
+}
+
+// Worker is a registered bot worker and what it is able to process.
+type Worker struct {
+	ID           string    `db:"id"`
+	Class        string    `db:"class"`
+	Capabilities []string  `db:"capabilities"`
+	RegisteredAt time.Time `db:"registered_at"`
+	LastSeenAt   time.Time `db:"last_seen_at"`
+}
+
+const workerColumns = "id, class, capabilities, registered_at, last_seen_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140037,
+		Name:    "create_workers",
+		Up: `CREATE TABLE workers (
+			id            TEXT PRIMARY KEY,
+			capabilities  TEXT[] NOT NULL DEFAULT '{}',
+			registered_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_seen_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		ALTER TABLE download_tasks ADD COLUMN requirements TEXT[] NOT NULL DEFAULT '{}';`,
+		Down: `ALTER TABLE download_tasks DROP COLUMN requirements;
+		DROP TABLE workers;`,
+	})
+	database.RegisterModel(database.Model{Table: "workers", Struct: Worker{}})
+}
+
+// RegisterWorker stores the class and capabilities of workerID, replacing
+// the ones of a previous registration. The class groups workers for
+// directives. ClaimNext only hands a worker tasks whose
+// requirements are all among its capabilities; an unregistered worker
+// gets only tasks without requirements.
+func (repo *Repo) RegisterWorker(ctx context.Context, workerID, class string, capabilities []string) (*Worker, error) {
+	if capabilities == nil {
+		capabilities = []string{}
+	}
+
+	return database.QueryOne[Worker](ctx, repo.session, `INSERT INTO workers (id, class, capabilities) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET class = EXCLUDED.class, capabilities = EXCLUDED.capabilities, last_seen_at = now()
+		RETURNING `+workerColumns, workerID, class, capabilities)
+}
+
+func (repo *Repo) Workers(ctx context.Context) ([]Worker, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+workerColumns+" FROM workers ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Worker])
+}
+
+func (repo *Repo) UnregisterWorker(ctx context.Context, workerID string) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM workers WHERE id = $1", workerID)
+	return err
+}
@@ -0,0 +1,162 @@
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/books"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrTokenNotFound = errors.New("download token not found")
+	ErrTokenExpired  = errors.New("download token expired")
+	ErrTokenUsed     = errors.New("download token already used")
+)
+
+// Token is an issued download link. Only the hash of the token is stored,
+// the plain value is returned once by Issue.
+type Token struct {
+	Hash       string      `db:"token_hash"`
+	FileID     int64       `db:"file_id"`
+	UserID     int64       `db:"user_id"`
+	ExpiresAt  time.Time   `db:"expires_at"`
+	CreatedAt  time.Time   `db:"created_at"`
+	RedeemedAt *time.Time  `db:"redeemed_at"`
+	RedeemedIP *netip.Addr `db:"redeemed_ip"`
+	RedeemedBy *int64      `db:"redeemed_by"`
+}
+
+func init() {
+	database.RegisterJob(database.Job{Name: "purge_expired_tokens", Every: time.Hour, Run: func(ctx context.Context, session *database.DB_Session) (int64, error) {
+		return New(session).PurgeExpired(ctx, 0)
+	}})
+	database.RegisterMigration(database.Migration{
+		Version: 202610140012,
+		Name:    "create_download_tokens",
+		Up: `CREATE TABLE download_tokens (
+			token_hash  TEXT PRIMARY KEY,
+			file_id     BIGINT NOT NULL REFERENCES book_files (id) ON DELETE CASCADE,
+			user_id     BIGINT NOT NULL,
+			expires_at  TIMESTAMPTZ NOT NULL,
+			created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			redeemed_at TIMESTAMPTZ,
+			redeemed_ip INET,
+			redeemed_by BIGINT
+		);
+		CREATE INDEX download_tokens_expires_idx ON download_tokens (expires_at);`,
+		Down: `DROP TABLE download_tokens;`,
+	})
+	database.RegisterModel(database.Model{Table: "download_tokens", Struct: Token{}, Indexes: []string{"download_tokens_expires_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a single-use token for fileID valid for ttl and returns
+// its plain value for the link.
+func (repo *Repo) Issue(ctx context.Context, fileID, userID int64, ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO download_tokens (token_hash, file_id, user_id, expires_at)
+		VALUES ($1, $2, $3, now() + $4::interval)`, hash(token), fileID, userID, ttl)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Redeem atomically consumes token, recording who redeemed it from where,
+// and returns the file it grants. A token can be redeemed only once; one
+// for a book taken down since it was issued gives books.ErrTakenDown and
+// stays unredeemed.
+func (repo *Repo) Redeem(ctx context.Context, token string, ip netip.Addr, userID *int64) (*books.File, error) {
+	var redeemedIP *netip.Addr
+	if ip.IsValid() {
+		redeemedIP = &ip
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `WITH redeemed AS (
+			UPDATE download_tokens SET redeemed_at = now(), redeemed_ip = $2, redeemed_by = $3
+			WHERE token_hash = $1 AND redeemed_at IS NULL AND expires_at > now()
+				AND NOT EXISTS (SELECT 1 FROM book_files f JOIN books b ON b.id = f.book_id
+					WHERE f.id = download_tokens.file_id AND book_is_taken_down(b.id, b.author_id, b.source_site))
+			RETURNING file_id
+		)
+		SELECT f.id, f.book_id, f.format, f.storage_key, f.size_bytes, f.telegram_file_id, f.created_at
+		FROM book_files f JOIN redeemed r ON r.file_id = f.id`, hash(token), redeemedIP, userID)
+	if err != nil {
+		return nil, err
+	}
+	file, err := pgx.CollectOneRow(rows, pgx.RowToAddrOfStructByName[books.File])
+	if err != pgx.ErrNoRows {
+		return file, err
+	}
+
+	var expired, used, takenDown bool
+	err = conn.QueryRow(ctx, `SELECT t.expires_at <= now(), t.redeemed_at IS NOT NULL,
+			COALESCE(book_is_taken_down(b.id, b.author_id, b.source_site), false)
+		FROM download_tokens t LEFT JOIN book_files f ON f.id = t.file_id LEFT JOIN books b ON b.id = f.book_id
+		WHERE t.token_hash = $1`, hash(token)).Scan(&expired, &used, &takenDown)
+	switch {
+	case err == pgx.ErrNoRows:
+		return nil, ErrTokenNotFound
+	case err != nil:
+		return nil, err
+	case used:
+		return nil, ErrTokenUsed
+	case expired:
+		return nil, ErrTokenExpired
+	case takenDown:
+		return nil, books.ErrTakenDown
+	}
+	return nil, ErrTokenNotFound
+}
+
+// PurgeExpired deletes tokens that expired more than keep ago.
+func (repo *Repo) PurgeExpired(ctx context.Context, keep time.Duration) (int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, "DELETE FROM download_tokens WHERE expires_at < now() - $1::interval", keep)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,143 @@
+package users
+
+import (
+	"context"
+	"math"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/RedBuld/book_bot_database/repos/billing"
+	"github.com/jackc/pgx/v5"
+)
+
+// Account is the bot state of a user: premium, today's download quota and
+// whether the user is banned.
+type Account struct {
+	ID             int64      `db:"id"`
+	Username       *string    `db:"username"`
+	ShortID        string     `db:"short_id"`
+	PremiumUntil   *time.Time `db:"premium_until"`
+	DailyQuota     int        `db:"daily_quota"`
+	DownloadsToday int        `db:"downloads_today"`
+	QuotaDay       time.Time  `db:"quota_day"`
+	BannedAt       *time.Time `db:"banned_at"`
+	BanReason      string     `db:"ban_reason"`
+	CreatedAt      time.Time  `db:"created_at"`
+	LastSeenAt     time.Time  `db:"last_seen_at"`
+}
+
+const AccountColumns = "id, username, short_id, premium_until, daily_quota, downloads_today, quota_day, banned_at, ban_reason, created_at, last_seen_at"
+
+// IsPremium reports whether the account has premium at now.
+func (a *Account) IsPremium(now time.Time) bool {
+	return a.PremiumUntil != nil && a.PremiumUntil.After(now)
+}
+
+func (a *Account) IsBanned() bool {
+	return a.BannedAt != nil
+}
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140054,
+		Name:    "add_users_ban",
+		Up: `ALTER TABLE users ADD COLUMN banned_at TIMESTAMPTZ;
+		ALTER TABLE users ADD COLUMN ban_reason TEXT NOT NULL DEFAULT '';`,
+		Down: `ALTER TABLE users DROP COLUMN ban_reason; ALTER TABLE users DROP COLUMN banned_at;`,
+	})
+}
+
+// GetOrCreateUser is Touch returning the whole account.
+func (repo *Repo) GetOrCreateUser(ctx context.Context, id int64, username *string) (*Account, error) {
+	shortID, err := newShortID()
+	if err != nil {
+		return nil, err
+	}
+
+	return database.QueryOne[Account](ctx, repo.session, `INSERT INTO users (id, username, short_id) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET username = EXCLUDED.username, last_seen_at = now()
+		RETURNING `+AccountColumns, id, username, shortID)
+}
+
+func (repo *Repo) GetAccount(ctx context.Context, id int64) (*Account, error) {
+	account, err := database.QueryOne[Account](ctx, repo.session, "SELECT "+AccountColumns+" FROM users WHERE id = $1", id)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return account, err
+}
+
+// IncrementDownloads counts a download against today's quota of userID
+// and reports whether the quota was already used up, in which case
+// nothing is counted. The check and the increment are one statement, so
+// parallel downloads can't overrun the quota; the counter starts over on
+// the first download of a day. Premium users have no quota.
+func (repo *Repo) IncrementDownloads(ctx context.Context, userID int64) (exceeded bool, err error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var counted bool
+	err = conn.QueryRow(ctx, `WITH counted AS (
+			UPDATE users SET
+				downloads_today = CASE WHEN quota_day = current_date THEN downloads_today ELSE 0 END + 1,
+				quota_day = current_date
+			WHERE id = $1 AND (premium_until > now()
+				OR CASE WHEN quota_day = current_date THEN downloads_today ELSE 0 END < daily_quota)
+			RETURNING id
+		)
+		SELECT EXISTS (SELECT FROM counted) FROM users WHERE id = $1`, userID).Scan(&counted)
+	if err == pgx.ErrNoRows {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return !counted, nil
+}
+
+// SetPremium sets when the premium of userID ends, nil to revoke it now.
+// The change is booked in the premium ledger as an adjustment of the
+// whole days it moves.
+func (repo *Repo) SetPremium(ctx context.Context, userID int64, until *time.Time, reference string) error {
+	return repo.session.WithTx(ctx, func(tx pgx.Tx) error {
+		var previous *time.Time
+		var now time.Time
+		err := tx.QueryRow(ctx, "SELECT premium_until, now() FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&previous, &now)
+		if err == pgx.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE users SET premium_until = $2 WHERE id = $1", userID, until)
+		if err != nil {
+			return err
+		}
+
+		remaining := func(t *time.Time) time.Duration {
+			if t == nil || t.Before(now) {
+				return 0
+			}
+			return t.Sub(now)
+		}
+		days := int(math.Round((remaining(until) - remaining(previous)).Hours() / 24))
+		if days == 0 {
+			return nil
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO premium_ledger (user_id, kind, days, reference) VALUES ($1, $2, $3, $4)",
+			userID, billing.KindAdjustment, days, reference)
+		return err
+	})
+}
+
+// Ban blocks userID from the bot with a reason shown to moderators.
+func (repo *Repo) Ban(ctx context.Context, userID int64, reason string) error {
+	return repo.update(ctx, "UPDATE users SET banned_at = COALESCE(banned_at, now()), ban_reason = $2 WHERE id = $1", userID, reason)
+}
+
+func (repo *Repo) Unban(ctx context.Context, userID int64) error {
+	return repo.update(ctx, "UPDATE users SET banned_at = NULL, ban_reason = '' WHERE id = $1", userID)
+}
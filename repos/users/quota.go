@@ -0,0 +1,83 @@
+package users
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+// DefaultDailyQuota is the number of downloads a user gets per day.
+const DefaultDailyQuota = 10
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140041,
+		Name:    "add_users_quota",
+		Up: `ALTER TABLE users ADD COLUMN daily_quota INT NOT NULL DEFAULT 10;
+		ALTER TABLE users ADD COLUMN downloads_today INT NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN quota_day DATE NOT NULL DEFAULT current_date;`,
+		Down: `ALTER TABLE users DROP COLUMN quota_day;
+		ALTER TABLE users DROP COLUMN downloads_today;
+		ALTER TABLE users DROP COLUMN daily_quota;`,
+	})
+}
+
+const (
+	checkQuotaStatement = "users_check_quota"
+	checkQuotaSQL       = `SELECT CASE WHEN quota_day = current_date THEN daily_quota - downloads_today ELSE daily_quota END
+		FROM users WHERE id = $1::bigint`
+)
+
+// quotaArgs holds the encoded parameter of a CheckQuota call; pooling it
+// keeps the call free of per-call allocations.
+type quotaArgs struct {
+	id     [8]byte
+	values [1][]byte
+}
+
+var (
+	quotaArgsPool = sync.Pool{New: func() any { return new(quotaArgs) }}
+	binaryFormats = []int16{1}
+)
+
+// CheckQuota returns how many downloads userID has left today. It runs on
+// every user message, so instead of the reflection based helpers it
+// executes a named prepared statement directly on the wire connection and
+// decodes the binary result by hand. The statement is prepared once per
+// pooled connection on first use.
+func (repo *Repo) CheckQuota(ctx context.Context, userID int64) (int, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Conn().Prepare(ctx, checkQuotaStatement, checkQuotaSQL); err != nil {
+		return 0, err
+	}
+
+	args := quotaArgsPool.Get().(*quotaArgs)
+	defer quotaArgsPool.Put(args)
+	binary.BigEndian.PutUint64(args.id[:], uint64(userID))
+	args.values[0] = args.id[:]
+
+	result := conn.Conn().PgConn().ExecPrepared(ctx, checkQuotaStatement, args.values[:], binaryFormats, binaryFormats)
+	var remaining int32
+	found := false
+	for result.NextRow() {
+		remaining, err = database.RawInt4(result.Values()[0])
+		found = true
+	}
+	if _, closeErr := result.Close(); closeErr != nil {
+		return 0, closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrNotFound
+	}
+	return int(remaining), nil
+}
@@ -0,0 +1,132 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultDeliveryMinute is the local time digests go out at unless the
+// user picks another one: 09:00.
+const DefaultDeliveryMinute = 9 * 60
+
+var (
+	ErrInvalidTimezone       = errors.New("invalid timezone")
+	ErrInvalidDeliveryMinute = errors.New("delivery minute out of range")
+)
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140045,
+		Name:    "add_users_timezone",
+		Up: `ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+		ALTER TABLE users ADD COLUMN delivery_minute SMALLINT NOT NULL DEFAULT 540
+			CHECK (delivery_minute BETWEEN 0 AND 1439);`,
+		Down: `ALTER TABLE users DROP COLUMN delivery_minute;
+		ALTER TABLE users DROP COLUMN timezone;`,
+	})
+}
+
+// SetTimezone stores the IANA timezone of userID, e.g. "Europe/Moscow".
+func (repo *Repo) SetTimezone(ctx context.Context, userID int64, timezone string) error {
+	if _, err := time.LoadLocation(timezone); err != nil || timezone == "" {
+		return ErrInvalidTimezone
+	}
+	return repo.update(ctx, "UPDATE users SET timezone = $2 WHERE id = $1", userID, timezone)
+}
+
+// SetDeliveryMinute sets the local time of day, in minutes after
+// midnight, the user's digests and reminders are sent at.
+func (repo *Repo) SetDeliveryMinute(ctx context.Context, userID int64, minute int) error {
+	if minute < 0 || minute >= 24*60 {
+		return ErrInvalidDeliveryMinute
+	}
+	return repo.update(ctx, "UPDATE users SET delivery_minute = $2 WHERE id = $1", userID, minute)
+}
+
+func (repo *Repo) update(ctx context.Context, sql string, args ...any) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Location returns the timezone of userID, falling back to UTC when the
+// stored one is no longer known to the local tz database.
+func (repo *Repo) Location(ctx context.Context, userID int64) (*time.Location, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var timezone string
+	err = conn.QueryRow(ctx, "SELECT timezone FROM users WHERE id = $1", userID).Scan(&timezone)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// NextDelivery returns the first time after now that is minute past local
+// midnight in loc. Days where that wall time doesn't exist because of a
+// DST jump are delivered at the shifted time Go normalizes it to.
+func NextDelivery(now time.Time, loc *time.Location, minute int) time.Time {
+	local := now.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), minute/60, minute%60, 0, 0, loc)
+	if !next.After(now) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, minute/60, minute%60, 0, 0, loc)
+	}
+	return next
+}
+
+// DueForDelivery returns the users whose local delivery time falls within
+// [tick, tick+step), for a sender that runs every step. Step is rounded
+// down to whole minutes and should stay below a day.
+func (repo *Repo) DueForDelivery(ctx context.Context, tick time.Time, step time.Duration) ([]int64, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT id FROM users,
+			LATERAL (SELECT extract(hour FROM $1::timestamptz AT TIME ZONE timezone) * 60 +
+				extract(minute FROM $1::timestamptz AT TIME ZONE timezone) AS minute) l
+		WHERE ((l.minute - delivery_minute + 1440)::int % 1440) < $2::int
+		ORDER BY id`, tick, int(step/time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,96 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+var ErrNotFound = errors.New("user not found")
+
+// User is a Telegram account known to the bot. ShortID is a short public
+// handle shown in support conversations instead of the Telegram ID.
+type User struct {
+	ID         int64     `db:"id"`
+	Username   *string   `db:"username"`
+	ShortID    string    `db:"short_id"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+}
+
+const Columns = "id, username, short_id, created_at, last_seen_at"
+
+var shortIDEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+func init() {
+	database.RegisterExpectedError(ErrNotFound)
+	database.RegisterMigration(database.Migration{
+		Version: 202610140017,
+		Name:    "create_users",
+		Up: `CREATE TABLE users (
+			id           BIGINT PRIMARY KEY,
+			username     TEXT,
+			short_id     TEXT NOT NULL UNIQUE,
+			created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX users_username_idx ON users (lower(username));`,
+		Down: `DROP TABLE users;`,
+	})
+	database.RegisterModel(database.Model{Table: "users", Struct: User{}, Indexes: []string{"users_username_idx"}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session}
+}
+
+func newShortID() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return shortIDEncoding.EncodeToString(buf), nil
+}
+
+// Touch creates the user on first contact and otherwise refreshes the
+// username and last seen time.
+func (repo *Repo) Touch(ctx context.Context, id int64, username *string) (*User, error) {
+	shortID, err := newShortID()
+	if err != nil {
+		return nil, err
+	}
+
+	return database.QueryOne[User](ctx, repo.session, `INSERT INTO users (id, username, short_id) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET username = EXCLUDED.username, last_seen_at = now()
+		RETURNING `+Columns, id, username, shortID)
+}
+
+func (repo *Repo) get(ctx context.Context, where string, arg any) (*User, error) {
+	user, err := database.QueryOne[User](ctx, repo.session, "SELECT "+Columns+" FROM users WHERE "+where+" LIMIT 1", arg)
+	if database.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	return user, err
+}
+
+func (repo *Repo) Get(ctx context.Context, id int64) (*User, error) {
+	return repo.get(ctx, "id = $1", id)
+}
+
+// GetByUsername matches case-insensitively, with or without the leading @.
+func (repo *Repo) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return repo.get(ctx, "lower(username) = lower($1)", strings.TrimPrefix(username, "@"))
+}
+
+func (repo *Repo) GetByShortID(ctx context.Context, shortID string) (*User, error) {
+	return repo.get(ctx, "short_id = $1", strings.ToLower(shortID))
+}
@@ -0,0 +1,219 @@
+package warehouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+// Export formats.
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+var (
+	ErrUnknownTable = errors.New("table is not exportable")
+	// ErrUnsupportedFormat is returned for Parquet: the module carries no
+	// Parquet encoder, so loaders take CSV, which ClickHouse and BigQuery
+	// both load natively.
+	ErrUnsupportedFormat = errors.New("unsupported export format")
+)
+
+// Table is an append-only analytics table and the timestamp column its
+// rows are exported by.
+type Table struct {
+	Name   string
+	Cursor string
+}
+
+// Tables are the tables Export knows, by name.
+var Tables = map[string]Table{
+	"search_log":        {Name: "search_log", Cursor: "created_at"},
+	"cost_events":       {Name: "cost_events", Cursor: "occurred_at"},
+	"premium_ledger":    {Name: "premium_ledger", Cursor: "created_at"},
+	"promo_redemptions": {Name: "promo_redemptions", Cursor: "redeemed_at"},
+	"share_access_log":  {Name: "share_access_log", Cursor: "accessed_at"},
+	"finished_books":    {Name: "finished_books", Cursor: "finished_at"},
+	"queue_history":     {Name: "queue_history", Cursor: "hour"},
+	"download_events":   {Name: "download_events", Cursor: "created_at"},
+}
+
+// Watermark is how far a consumer has exported a table.
+type Watermark struct {
+	Consumer   string    `db:"consumer"`
+	Table      string    `db:"table_name"`
+	Watermark  time.Time `db:"watermark"`
+	Rows       int64     `db:"rows"`
+	ExportedAt time.Time `db:"exported_at"`
+}
+
+// Snapshot describes one exported slice of a table: the rows with a cursor
+// in (From, To].
+type Snapshot struct {
+	Table string
+	From  time.Time
+	To    time.Time
+	Rows  int64
+}
+
+// Destination opens the output of one table's snapshot. The watermark
+// only moves once the returned writer closed without error, so a failed
+// upload is exported again on the next run.
+type Destination func(snapshot Snapshot) (io.WriteCloser, error)
+
+const watermarkColumns = "consumer, table_name, watermark, rows, exported_at"
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140052,
+		Name:    "create_warehouse_watermarks",
+		Up: `CREATE TABLE warehouse_watermarks (
+			consumer    TEXT NOT NULL,
+			table_name  TEXT NOT NULL,
+			watermark   TIMESTAMPTZ NOT NULL,
+			rows        BIGINT NOT NULL DEFAULT 0,
+			exported_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (consumer, table_name)
+		);`,
+		Down: `DROP TABLE warehouse_watermarks;`,
+	})
+	database.RegisterModel(database.Model{Table: "warehouse_watermarks", Struct: Watermark{}})
+}
+
+type Repo struct {
+	session *database.DB_Session
+	// Consumer names the warehouse the watermarks are kept for, so several
+	// can load the same tables independently.
+	Consumer string
+	Format   string
+	// Lag keeps the newest rows out of a snapshot. Cursor columns default
+	// to the transaction start, so a row can commit after newer ones have
+	// already been exported; a lag longer than any transaction keeps it
+	// from being skipped.
+	Lag time.Duration
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session, Consumer: "default", Format: FormatCSV, Lag: 5 * time.Minute}
+}
+
+// ExportToParquetOrCSV writes a snapshot of every table in tables to dest,
+// starting where the previous export of the consumer stopped, or at since
+// if that is later (zero exports from the beginning). Each table is
+// streamed with COPY and its watermark is stored as soon as its snapshot
+// is written, so an export that fails midway resumes with the table it
+// failed on.
+func (repo *Repo) ExportToParquetOrCSV(ctx context.Context, tables []string, since time.Time, dest Destination) ([]Snapshot, error) {
+	if repo.Format != FormatCSV {
+		return nil, ErrUnsupportedFormat
+	}
+	for _, name := range tables {
+		if _, ok := Tables[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownTable, name)
+		}
+	}
+
+	until := repo.session.Clock().Now().Add(-repo.Lag).UTC()
+	snapshots := make([]Snapshot, 0, len(tables))
+	for _, name := range tables {
+		snapshot, err := repo.exportTable(ctx, Tables[name], since, until, dest)
+		if err != nil {
+			return snapshots, fmt.Errorf("export %s: %w", name, err)
+		}
+		if snapshot != nil {
+			snapshots = append(snapshots, *snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+func (repo *Repo) exportTable(ctx context.Context, table Table, since, until time.Time, dest Destination) (*Snapshot, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	from := since.UTC()
+	var watermark time.Time
+	err = conn.QueryRow(ctx, "SELECT watermark FROM warehouse_watermarks WHERE consumer = $1 AND table_name = $2",
+		repo.Consumer, table.Name).Scan(&watermark)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	if watermark.After(from) {
+		from = watermark.UTC()
+	}
+	if !until.After(from) {
+		return nil, nil
+	}
+
+	snapshot := &Snapshot{Table: table.Name, From: from, To: until}
+	w, err := dest(*snapshot)
+	if err != nil {
+		return nil, err
+	}
+	// COPY takes no parameters; the bounds come from the clock and the
+	// database, never from input, and table and cursor from Tables.
+	query := fmt.Sprintf("COPY (SELECT * FROM %s WHERE %s > '%s'::timestamptz AND %s <= '%s'::timestamptz ORDER BY %s) TO STDOUT WITH (FORMAT csv, HEADER)",
+		pgx.Identifier{table.Name}.Sanitize(), pgx.Identifier{table.Cursor}.Sanitize(), from.Format(time.RFC3339Nano),
+		pgx.Identifier{table.Cursor}.Sanitize(), until.Format(time.RFC3339Nano), pgx.Identifier{table.Cursor}.Sanitize())
+	tag, err := conn.Conn().PgConn().CopyTo(ctx, w, query)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	snapshot.Rows = tag.RowsAffected()
+
+	_, err = conn.Exec(ctx, `INSERT INTO warehouse_watermarks (consumer, table_name, watermark, rows, exported_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (consumer, table_name) DO UPDATE
+		SET watermark = EXCLUDED.watermark, rows = warehouse_watermarks.rows + EXCLUDED.rows, exported_at = now()`,
+		repo.Consumer, table.Name, until, snapshot.Rows)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Watermarks lists how far the consumer has exported each table.
+func (repo *Repo) Watermarks(ctx context.Context) ([]Watermark, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, "SELECT "+watermarkColumns+" FROM warehouse_watermarks WHERE consumer = $1 ORDER BY table_name", repo.Consumer)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Watermark])
+}
+
+// ResetWatermark makes the next export of table start over at since, to
+// reload a table the warehouse lost.
+func (repo *Repo) ResetWatermark(ctx context.Context, table string, since time.Time) error {
+	if _, ok := Tables[table]; !ok {
+		return ErrUnknownTable
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `INSERT INTO warehouse_watermarks (consumer, table_name, watermark) VALUES ($1, $2, $3)
+		ON CONFLICT (consumer, table_name) DO UPDATE SET watermark = EXCLUDED.watermark`, repo.Consumer, table, since)
+	return err
+}
@@ -0,0 +1,268 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+
+	EventNewBookInSeries = "series.new_book"
+
+	defaultMaxAttempts = 8
+	baseBackoff        = 30 * time.Second
+	maxBackoff         = 6 * time.Hour
+)
+
+// Webhook is a callback URL configured by a user (OwnerUserID set) or by an
+// admin (OwnerUserID nil, receives events for everyone).
+type Webhook struct {
+	ID          int64     `db:"id"`
+	OwnerUserID *int64    `db:"owner_user_id"`
+	Event       string    `db:"event"`
+	URL         string    `db:"url"`
+	Secret      string    `db:"secret"`
+	Enabled     bool      `db:"enabled"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type Delivery struct {
+	ID            int64           `db:"id"`
+	WebhookID     int64           `db:"webhook_id"`
+	Event         string          `db:"event"`
+	Payload       json.RawMessage `db:"payload"`
+	Status        string          `db:"status"`
+	Attempts      int             `db:"attempts"`
+	NextAttemptAt time.Time       `db:"next_attempt_at"`
+	LastError     *string         `db:"last_error"`
+	CreatedAt     time.Time       `db:"created_at"`
+	DeliveredAt   *time.Time      `db:"delivered_at"`
+}
+
+// DueDelivery is a claimed delivery together with where and how to sign it.
+type DueDelivery struct {
+	Delivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+const (
+	webhookColumns  = "id, owner_user_id, event, url, secret, enabled, created_at"
+	deliveryColumns = "id, webhook_id, event, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at"
+)
+
+func init() {
+	database.RegisterMigration(database.Migration{
+		Version: 202610140002,
+		Name:    "create_webhooks",
+		Up: `CREATE TABLE webhooks (
+			id            BIGSERIAL PRIMARY KEY,
+			owner_user_id BIGINT,
+			event         TEXT NOT NULL,
+			url           TEXT NOT NULL,
+			secret        TEXT NOT NULL,
+			enabled       BOOLEAN NOT NULL DEFAULT true,
+			created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX webhooks_event_idx ON webhooks (event) WHERE enabled;
+		CREATE TABLE webhook_deliveries (
+			id              BIGSERIAL PRIMARY KEY,
+			webhook_id      BIGINT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+			event           TEXT NOT NULL,
+			payload         JSONB NOT NULL,
+			status          TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+			attempts        INT NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_error      TEXT,
+			created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+			delivered_at    TIMESTAMPTZ
+		);
+		CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';`,
+		Down: `DROP TABLE webhook_deliveries; DROP TABLE webhooks;`,
+	})
+	database.RegisterModel(database.Model{Table: "webhooks", Struct: Webhook{}, Indexes: []string{"webhooks_event_idx"}})
+	database.RegisterModel(database.Model{Table: "webhook_deliveries", Struct: Delivery{}, Indexes: []string{"webhook_deliveries_due_idx"}})
+}
+
+type Repo struct {
+	session     *database.DB_Session
+	MaxAttempts int
+}
+
+func New(session *database.DB_Session) *Repo {
+	return &Repo{session: session, MaxAttempts: defaultMaxAttempts}
+}
+
+// Sign returns the hex HMAC-SHA256 of body, sent by the worker alongside the
+// payload so receivers can verify it.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create registers a webhook with a freshly generated signing secret.
+func (repo *Repo) Create(ctx context.Context, ownerUserID *int64, event, url string) (*Webhook, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	return database.QueryOne[Webhook](ctx, repo.session, `INSERT INTO webhooks (owner_user_id, event, url, secret) VALUES ($1, $2, $3, $4)
+		RETURNING `+webhookColumns, ownerUserID, event, url, secret)
+}
+
+// ListForUser returns the webhooks owned by userID, or the admin ones when
+// userID is nil.
+func (repo *Repo) ListForUser(ctx context.Context, userID *int64) ([]Webhook, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT `+webhookColumns+` FROM webhooks
+		WHERE owner_user_id IS NOT DISTINCT FROM $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Webhook])
+}
+
+func (repo *Repo) SetEnabled(ctx context.Context, id int64, enabled bool) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "UPDATE webhooks SET enabled = $2 WHERE id = $1", id, enabled)
+	return err
+}
+
+func (repo *Repo) Delete(ctx context.Context, id int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "DELETE FROM webhooks WHERE id = $1", id)
+	return err
+}
+
+// Emit queues a delivery of event to every enabled webhook subscribed to it:
+// the admin ones plus those owned by the given users.
+func (repo *Repo) Emit(ctx context.Context, event string, payload any, userIDs ...int64) (int64, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, `INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, event, $2 FROM webhooks
+		WHERE enabled AND event = $1 AND (owner_user_id IS NULL OR owner_user_id = ANY($3))`, event, body, userIDs)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ClaimDueDeliveries hands up to limit due deliveries to the sender worker.
+// Claimed rows are pushed lease into the future so that a crashed worker's
+// deliveries become due again instead of being lost.
+func (repo *Repo) ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]DueDelivery, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d SET next_attempt_at = now() + $2::interval
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at,
+			d.last_error, d.created_at, d.delivered_at, w.url, w.secret`, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DueDelivery])
+}
+
+func (repo *Repo) MarkDelivered(ctx context.Context, id int64) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1,
+		delivered_at = now(), last_error = NULL WHERE id = $1`, id)
+	return err
+}
+
+// MarkFailed records a failed attempt and schedules the next one with
+// exponential backoff, giving up after MaxAttempts; 0 or less retries forever.
+func (repo *Repo) MarkFailed(ctx context.Context, id int64, cause error) error {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `UPDATE webhook_deliveries SET
+			attempts = attempts + 1,
+			last_error = $2,
+			status = CASE WHEN $3 > 0 AND attempts + 1 >= $3 THEN 'failed' ELSE 'pending' END,
+			next_attempt_at = now() + least($4::interval * power(2, least(attempts, 30)), $5::interval)
+		WHERE id = $1`, id, cause.Error(), repo.MaxAttempts, baseBackoff, maxBackoff)
+	return err
+}
+
+// ListDeliveries returns the latest deliveries of a webhook for display.
+func (repo *Repo) ListDeliveries(ctx context.Context, webhookID int64, limit int) ([]Delivery, error) {
+	conn, err := repo.session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries
+		WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[Delivery])
+}
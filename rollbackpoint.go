@@ -0,0 +1,116 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// SmokeCheck verifies the schema after a migration batch, inside the
+// batch's transaction, e.g. by running the bot's hottest queries against
+// it. A returned error rolls the batch back.
+type SmokeCheck struct {
+	Name  string
+	Check func(ctx context.Context, tx pgx.Tx) error
+}
+
+// MigrationBatchError reports why RunWithRollbackPoint rolled back: the
+// migration that failed, with the statement the database pointed at if
+// it did, or the smoke check that failed.
+type MigrationBatchError struct {
+	Version   int64
+	Name      string
+	Statement string
+	Check     string
+	Err       error
+}
+
+func (e *MigrationBatchError) Error() string {
+	if e.Check != "" {
+		return fmt.Sprintf("migration batch rolled back: smoke check %s: %v", e.Check, e.Err)
+	}
+	if e.Statement != "" {
+		return fmt.Sprintf("migration batch rolled back: migration %d %s: %v (at: %s)", e.Version, e.Name, e.Err, e.Statement)
+	}
+	return fmt.Sprintf("migration batch rolled back: migration %d %s: %v", e.Version, e.Name, e.Err)
+}
+
+func (e *MigrationBatchError) Unwrap() error {
+	return e.Err
+}
+
+// RunWithRollbackPoint applies every pending migration in one transaction
+// and then runs checks in it. The batch commits only if all migrations and
+// checks succeed; otherwise nothing of it stays and a
+// *MigrationBatchError says what failed. It returns the migrations
+// applied. Migrations that can't run in a transaction, such as CREATE
+// INDEX CONCURRENTLY, can't be part of a batch.
+func (session *DB_Session) RunWithRollbackPoint(ctx context.Context, checks []SmokeCheck) ([]Migration, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	unlock, err := lockMigrations(ctx, conn.Conn())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	pending, err := session.pendingMigrations(ctx, conn.Conn())
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	session.logger.Log(LevelInfo, "DB applying migration batch", F("migrations", len(pending)), F("checks", len(checks)))
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for _, m := range pending {
+			if _, err := tx.Exec(ctx, m.Up); err != nil {
+				return &MigrationBatchError{Version: m.Version, Name: m.Name, Statement: failedStatement(m.Up, err), Err: err}
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			if err != nil {
+				return err
+			}
+		}
+		for _, check := range checks {
+			if err := check.Check(ctx, tx); err != nil {
+				return &MigrationBatchError{Check: check.Name, Err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		session.logger.Log(LevelError, "DB migration batch rolled back", F("error", err))
+		return nil, err
+	}
+	session.logger.Log(LevelInfo, "DB migration batch committed", F("migrations", len(pending)))
+	return pending, nil
+}
+
+// failedStatement returns the statement of script that the position of a
+// database error points into, or "" if the error has none.
+func failedStatement(script string, err error) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Position <= 0 {
+		return ""
+	}
+	runes := []rune(script)
+	pos := int(pgErr.Position) - 1
+	if pos >= len(runes) {
+		return ""
+	}
+	start, end := pos, pos
+	for start > 0 && runes[start-1] != ';' {
+		start--
+	}
+	for end < len(runes) && runes[end] != ';' {
+		end++
+	}
+	return strings.Join(strings.Fields(string(runes[start:end])), " ")
+}
@@ -0,0 +1,54 @@
+package book_bot_database
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var errRawValue = errors.New("unexpected raw value length")
+
+// CollectRaw is the low-allocation alternative to pgx.CollectRows for hot
+// queries: the result slice is allocated once for sizeHint rows and scan
+// decodes each row straight from its raw wire values, skipping the
+// reflection and per-column boxing of RowToStructByName. values are only
+// valid until scan returns. Queries using it should request their result
+// formats explicitly with pgx.QueryResultFormats.
+func CollectRaw[T any](rows pgx.Rows, sizeHint int, scan func(values [][]byte, dst *T) error) ([]T, error) {
+	defer rows.Close()
+
+	out := make([]T, 0, sizeHint)
+	for rows.Next() {
+		out = append(out, *new(T))
+		if err := scan(rows.RawValues(), &out[len(out)-1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RawInt8 decodes a binary format int8 value; NULL decodes as 0.
+func RawInt8(value []byte) (int64, error) {
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 8 {
+		return 0, errRawValue
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+// RawInt4 decodes a binary format int4 value; NULL decodes as 0.
+func RawInt4(value []byte) (int32, error) {
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 4 {
+		return 0, errRawValue
+	}
+	return int32(binary.BigEndian.Uint32(value)), nil
+}
@@ -0,0 +1,160 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ColumnRef struct {
+	Table  string
+	Column string
+}
+
+func (c ColumnRef) String() string {
+	return c.Table + "." + c.Column
+}
+
+// SchemaDrift lists the differences between the registered models and
+// migrations and the live database.
+type SchemaDrift struct {
+	MissingTables     []string
+	MissingColumns    []ColumnRef
+	ExtraColumns      []ColumnRef
+	MissingIndexes    []string
+	PendingMigrations []Migration
+	UnknownMigrations []int64
+}
+
+// HasDrift reports whether anything the code expects is absent. Extra
+// columns and unknown migrations alone don't count as drift, as they're
+// expected while an older instance still runs.
+func (d *SchemaDrift) HasDrift() bool {
+	return len(d.MissingTables) > 0 || len(d.MissingColumns) > 0 || len(d.MissingIndexes) > 0 || len(d.PendingMigrations) > 0
+}
+
+func (d *SchemaDrift) String() string {
+	var b strings.Builder
+	for _, t := range d.MissingTables {
+		fmt.Fprintf(&b, "missing table: %s\n", t)
+	}
+	for _, c := range d.MissingColumns {
+		fmt.Fprintf(&b, "missing column: %s\n", c)
+	}
+	for _, c := range d.ExtraColumns {
+		fmt.Fprintf(&b, "extra column: %s\n", c)
+	}
+	for _, i := range d.MissingIndexes {
+		fmt.Fprintf(&b, "missing index: %s\n", i)
+	}
+	for _, m := range d.PendingMigrations {
+		fmt.Fprintf(&b, "pending migration: %d %s\n", m.Version, m.Name)
+	}
+	for _, v := range d.UnknownMigrations {
+		fmt.Fprintf(&b, "unknown applied migration: %d\n", v)
+	}
+	return b.String()
+}
+
+// SchemaDiff compares the registered models and migrations against the
+// current schema of the live database.
+func (session *DB_Session) SchemaDiff(ctx context.Context) (*SchemaDrift, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	columns := map[string]map[string]bool{}
+	rows, err := conn.Query(ctx, `SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if columns[table] == nil {
+			columns[table] = map[string]bool{}
+		}
+		columns[table][column] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	indexes := map[string]bool{}
+	rows, err = conn.Query(ctx, `SELECT indexname FROM pg_indexes WHERE schemaname = current_schema()`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		indexes[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	drift := &SchemaDrift{}
+	for _, m := range RegisteredModels() {
+		live, ok := columns[m.Table]
+		if !ok {
+			drift.MissingTables = append(drift.MissingTables, m.Table)
+		} else {
+			declared := map[string]bool{}
+			for _, column := range m.Columns() {
+				declared[column] = true
+				if !live[column] {
+					drift.MissingColumns = append(drift.MissingColumns, ColumnRef{Table: m.Table, Column: column})
+				}
+			}
+			for column := range live {
+				if !declared[column] {
+					drift.ExtraColumns = append(drift.ExtraColumns, ColumnRef{Table: m.Table, Column: column})
+				}
+			}
+		}
+		for _, index := range m.Indexes {
+			if !indexes[index] {
+				drift.MissingIndexes = append(drift.MissingIndexes, index)
+			}
+		}
+	}
+
+	for _, def := range RegisteredIndexes() {
+		if !indexes[def.Name] {
+			drift.MissingIndexes = append(drift.MissingIndexes, def.Name)
+		}
+	}
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	registered := map[int64]bool{}
+	for _, m := range RegisteredMigrations() {
+		registered[m.Version] = true
+		if !applied[m.Version] {
+			drift.PendingMigrations = append(drift.PendingMigrations, m)
+		}
+	}
+	for version := range applied {
+		if !registered[version] {
+			drift.UnknownMigrations = append(drift.UnknownMigrations, version)
+		}
+	}
+	sort.Slice(drift.ExtraColumns, func(i, j int) bool { return drift.ExtraColumns[i].String() < drift.ExtraColumns[j].String() })
+	sort.Slice(drift.UnknownMigrations, func(i, j int) bool { return drift.UnknownMigrations[i] < drift.UnknownMigrations[j] })
+
+	return drift, nil
+}
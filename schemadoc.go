@@ -0,0 +1,234 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// SchemaDoc is the data dictionary of the tables the registered models
+// own, as found in the live database.
+type SchemaDoc struct {
+	Tables []TableDoc
+}
+
+type TableDoc struct {
+	Name        string
+	Comment     string
+	Columns     []ColumnDoc
+	Constraints []ConstraintDoc
+	Indexes     []IndexDoc
+	// Missing is set for a registered table the database doesn't have.
+	Missing bool
+}
+
+type ColumnDoc struct {
+	Name     string
+	Type     string
+	Nullable bool
+	Default  string
+	Comment  string
+}
+
+type ConstraintDoc struct {
+	Name       string
+	Definition string
+}
+
+type IndexDoc struct {
+	Name       string
+	Definition string
+}
+
+// GenerateSchemaDoc describes the columns, constraints, indexes and
+// comments of every table a registered model owns, for an always-current
+// data dictionary; render it with Markdown or HTML.
+func (session *DB_Session) GenerateSchemaDoc(ctx context.Context) (*SchemaDoc, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	registered := RegisteredModels()
+	names := make([]string, 0, len(registered))
+	byName := map[string]*TableDoc{}
+	doc := &SchemaDoc{Tables: make([]TableDoc, len(registered))}
+	for i, m := range registered {
+		names = append(names, m.Table)
+		doc.Tables[i] = TableDoc{Name: m.Table, Missing: true}
+		byName[m.Table] = &doc.Tables[i]
+	}
+
+	rows, err := conn.Query(ctx, `SELECT c.relname, COALESCE(obj_description(c.oid, 'pg_class'), '')
+		FROM pg_class c
+		WHERE c.relnamespace = to_regnamespace(current_schema()) AND c.relkind IN ('r', 'p') AND c.relname = ANY($1::text[])`, names)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byName[name].Missing = false
+		byName[name].Comment = comment
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = conn.Query(ctx, `SELECT c.relname, a.attname, format_type(a.atttypid, a.atttypmod), NOT a.attnotnull,
+			COALESCE(pg_get_expr(d.adbin, d.adrelid), ''), COALESCE(col_description(c.oid, a.attnum), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE c.relnamespace = to_regnamespace(current_schema()) AND c.relname = ANY($1::text[])
+			AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY c.relname, a.attnum`, names)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table string
+		var column ColumnDoc
+		if err := rows.Scan(&table, &column.Name, &column.Type, &column.Nullable, &column.Default, &column.Comment); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byName[table].Columns = append(byName[table].Columns, column)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = conn.Query(ctx, `SELECT c.relname, k.conname, pg_get_constraintdef(k.oid)
+		FROM pg_constraint k
+		JOIN pg_class c ON c.oid = k.conrelid
+		WHERE c.relnamespace = to_regnamespace(current_schema()) AND c.relname = ANY($1::text[])
+		ORDER BY c.relname, k.contype, k.conname`, names)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table string
+		var constraint ConstraintDoc
+		if err := rows.Scan(&table, &constraint.Name, &constraint.Definition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byName[table].Constraints = append(byName[table].Constraints, constraint)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = conn.Query(ctx, `SELECT tablename, indexname, indexdef FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = ANY($1::text[])
+		ORDER BY tablename, indexname`, names)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table string
+		var index IndexDoc
+		if err := rows.Scan(&table, &index.Name, &index.Definition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byName[table].Indexes = append(byName[table].Indexes, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// Markdown renders the dictionary with one section per table.
+func (doc *SchemaDoc) Markdown() string {
+	cell := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(s, "|", `\|`), "\n", " ")
+	}
+	var b strings.Builder
+	b.WriteString("# Schema\n")
+	for _, t := range doc.Tables {
+		fmt.Fprintf(&b, "\n## %s\n\n", t.Name)
+		if t.Missing {
+			b.WriteString("_Missing from the database._\n")
+			continue
+		}
+		if t.Comment != "" {
+			fmt.Fprintf(&b, "%s\n\n", t.Comment)
+		}
+		b.WriteString("| Column | Type | Null | Default | Comment |\n|---|---|---|---|---|\n")
+		for _, c := range t.Columns {
+			null := ""
+			if c.Nullable {
+				null = "yes"
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", cell(c.Name), cell(c.Type), null, cell(c.Default), cell(c.Comment))
+		}
+		if len(t.Constraints) > 0 {
+			b.WriteString("\nConstraints:\n\n")
+			for _, c := range t.Constraints {
+				fmt.Fprintf(&b, "- `%s` %s\n", c.Name, c.Definition)
+			}
+		}
+		if len(t.Indexes) > 0 {
+			b.WriteString("\nIndexes:\n\n")
+			for _, i := range t.Indexes {
+				fmt.Fprintf(&b, "- `%s`\n", i.Definition)
+			}
+		}
+	}
+	return b.String()
+}
+
+// HTML renders the dictionary as an HTML fragment for the admin panel.
+func (doc *SchemaDoc) HTML() string {
+	e := html.EscapeString
+	var b strings.Builder
+	for _, t := range doc.Tables {
+		fmt.Fprintf(&b, "<section id=\"table-%s\">\n<h2>%s</h2>\n", e(t.Name), e(t.Name))
+		if t.Missing {
+			b.WriteString("<p><em>Missing from the database.</em></p>\n</section>\n")
+			continue
+		}
+		if t.Comment != "" {
+			fmt.Fprintf(&b, "<p>%s</p>\n", e(t.Comment))
+		}
+		b.WriteString("<table>\n<tr><th>Column</th><th>Type</th><th>Null</th><th>Default</th><th>Comment</th></tr>\n")
+		for _, c := range t.Columns {
+			null := ""
+			if c.Nullable {
+				null = "yes"
+			}
+			fmt.Fprintf(&b, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+				e(c.Name), e(c.Type), null, e(c.Default), e(c.Comment))
+		}
+		b.WriteString("</table>\n")
+		if len(t.Constraints) > 0 {
+			b.WriteString("<h3>Constraints</h3>\n<ul>\n")
+			for _, c := range t.Constraints {
+				fmt.Fprintf(&b, "<li><code>%s</code> %s</li>\n", e(c.Name), e(c.Definition))
+			}
+			b.WriteString("</ul>\n")
+		}
+		if len(t.Indexes) > 0 {
+			b.WriteString("<h3>Indexes</h3>\n<ul>\n")
+			for _, i := range t.Indexes {
+				fmt.Fprintf(&b, "<li><code>%s</code></li>\n", e(i.Definition))
+			}
+			b.WriteString("</ul>\n")
+		}
+		b.WriteString("</section>\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,236 @@
+package book_bot_database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// selfTestNotifyTimeout bounds the LISTEN/NOTIFY roundtrip of SelfTest.
+const selfTestNotifyTimeout = 5 * time.Second
+
+// SelfTestCheck is the outcome of one check of SelfTest. Detail says what
+// was found, e.g. the server version, also when the check passed.
+type SelfTestCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+	Took   time.Duration
+	Err    error
+}
+
+// SelfTestReport is the result of SelfTest, checks in the order they ran.
+type SelfTestReport struct {
+	Checks []SelfTestCheck
+	Took   time.Duration
+}
+
+// OK reports whether every check passed.
+func (r *SelfTestReport) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the checks that didn't pass.
+func (r *SelfTestReport) Failed() []SelfTestCheck {
+	var failed []SelfTestCheck
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// String renders the report one check per line, for the /diag command
+// and deployment logs.
+func (r *SelfTestReport) String() string {
+	var b strings.Builder
+	for _, c := range r.Checks {
+		status := "ok  "
+		if !c.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s %-12s %6s %s", status, c.Name, c.Took.Round(time.Millisecond), c.Detail)
+		if c.Err != nil {
+			fmt.Fprintf(&b, ": %v", c.Err)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// SelfTest checks that the session can do its work: the primary answers
+// and accepts writes, the RequiredExtensions are installed, the role may
+// use the tables of the registered models, every registered migration is
+// applied, and a notification sent comes back through Listen. Every check
+// runs even when an earlier one failed; the error is only for ctx ending.
+// Writes are rolled back, so it is safe to run against production, e.g.
+// from a deployment smoke test.
+func (session *DB_Session) SelfTest(ctx context.Context) (*SelfTestReport, error) {
+	report := &SelfTestReport{}
+	started := session.clock.Now()
+	checks := []struct {
+		name string
+		run  func(ctx context.Context) (string, error)
+	}{
+		{"connectivity", session.checkConnectivity},
+		{"extensions", session.checkExtensions},
+		{"permissions", session.checkPermissions},
+		{"schema", session.checkSchemaVersion},
+		{"write", session.checkWrite},
+		{"notify", session.checkNotify},
+	}
+	for _, check := range checks {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		at := session.clock.Now()
+		detail, err := check.run(ctx)
+		report.Checks = append(report.Checks, SelfTestCheck{
+			Name: check.name, OK: err == nil, Detail: detail, Took: session.clock.Now().Sub(at), Err: err,
+		})
+	}
+	report.Took = session.clock.Now().Sub(started)
+	if !report.OK() {
+		session.logger.Log(LevelWarn, "DB self-test failed", F("failed", len(report.Failed())))
+	}
+	return report, nil
+}
+
+func (session *DB_Session) checkConnectivity(ctx context.Context) (string, error) {
+	var version string
+	var inRecovery bool
+	if err := session.QueryRow(ctx, "SELECT current_setting('server_version'), pg_is_in_recovery()").Scan(&version, &inRecovery); err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("PostgreSQL %s on %s", version, session.primaryConfig().ConnConfig.Host)
+	if inRecovery {
+		return detail, errNotPrimary
+	}
+	return detail, nil
+}
+
+func (session *DB_Session) checkExtensions(ctx context.Context) (string, error) {
+	required := session.Params().RequiredExtensions
+	if len(required) == 0 {
+		return "none required", nil
+	}
+	var missing []string
+	err := session.QueryRow(ctx, `SELECT coalesce(array_agg(name ORDER BY name), '{}') FROM unnest($1::text[]) name
+		WHERE NOT EXISTS (SELECT 1 FROM pg_extension WHERE extname = name)`, required).Scan(&missing)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "missing " + strings.Join(missing, ", "), fmt.Errorf("%d required extensions not installed", len(missing))
+	}
+	return strings.Join(required, ", "), nil
+}
+
+// checkPermissions checks the privileges the repos need on the tables of
+// the registered models; tables not created yet are left to the schema
+// check.
+func (session *DB_Session) checkPermissions(ctx context.Context) (string, error) {
+	var tables []string
+	for _, m := range RegisteredModels() {
+		tables = append(tables, m.Table)
+	}
+	var denied []string
+	err := session.QueryRow(ctx, `SELECT coalesce(array_agg(t ORDER BY t), '{}') FROM unnest($1::text[]) t
+		WHERE to_regclass(t) IS NOT NULL AND NOT (
+			has_table_privilege(to_regclass(t), 'SELECT') AND has_table_privilege(to_regclass(t), 'INSERT') AND
+			has_table_privilege(to_regclass(t), 'UPDATE') AND has_table_privilege(to_regclass(t), 'DELETE'))`, tables).Scan(&denied)
+	if err != nil {
+		return "", err
+	}
+	if len(denied) > 0 {
+		return "no read/write access to " + strings.Join(denied, ", "), fmt.Errorf("%d tables not writable", len(denied))
+	}
+	return fmt.Sprintf("%d tables writable", len(tables)), nil
+}
+
+func (session *DB_Session) checkSchemaVersion(ctx context.Context) (string, error) {
+	applied, err := session.AppliedMigrations(ctx)
+	if err != nil {
+		return "", err
+	}
+	var latest int64
+	var pending []string
+	for _, m := range RegisteredMigrations() {
+		if applied[m.Version] {
+			if m.Version > latest {
+				latest = m.Version
+			}
+			continue
+		}
+		pending = append(pending, fmt.Sprint(m.Version))
+	}
+	detail := fmt.Sprintf("at %d", latest)
+	if len(pending) > 0 {
+		return detail + ", pending " + strings.Join(pending, ", "), fmt.Errorf("%d migrations not applied", len(pending))
+	}
+	return detail, nil
+}
+
+func (session *DB_Session) checkWrite(ctx context.Context) (string, error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(context.Background())
+	// A real table in the session's schema, unlike a temporary one, also
+	// proves the role may create there; the rollback drops it.
+	if _, err := tx.Exec(ctx, "CREATE TABLE book_bot_selftest (id INT)"); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO book_bot_selftest VALUES (1)"); err != nil {
+		return "", err
+	}
+	return "insert rolled back", nil
+}
+
+func (session *DB_Session) checkNotify(ctx context.Context) (string, error) {
+	b := make([]byte, 6)
+	rand.Read(b)
+	channel := "book_bot_selftest_" + hex.EncodeToString(b)
+	notifications, err := session.Listen(channel)
+	if err != nil {
+		return "", err
+	}
+	defer session.Unlisten(channel, notifications)
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestNotifyTimeout)
+	defer cancel()
+	started := session.clock.Now()
+	// The listener subscribes in the background, so a notification sent
+	// before it did is lost; send until one arrives.
+	for {
+		if _, err := session.Exec(ctx, "SELECT pg_notify($1, 'ping')", channel); err != nil {
+			return "", err
+		}
+		select {
+		case _, ok := <-notifications:
+			if !ok {
+				return "", errShutdown
+			}
+			return fmt.Sprintf("roundtrip in %s", session.clock.Now().Sub(started).Round(time.Millisecond)), nil
+		case <-ctx.Done():
+			return "", fmt.Errorf("no notification within %s", selfTestNotifyTimeout)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package sentry reports unexpected database errors to Sentry over its
+// HTTP store endpoint. Reports are queued in memory and sent by a
+// background goroutine; when Sentry is slow or down the queue fills and
+// further reports are dropped and counted, so queries never wait on it.
+package sentry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	database "github.com/RedBuld/book_bot_database"
+)
+
+var ErrInvalidDSN = errors.New("invalid Sentry DSN")
+
+type Config struct {
+	// DSN of the project, e.g. https://<key>@o1.ingest.sentry.io/42.
+	DSN         string
+	Environment string
+	Release     string
+	// BufferSize is how many reports may wait to be sent before new ones
+	// are dropped.
+	BufferSize int
+	Client     *http.Client
+}
+
+// Reporter is a database.ErrorReporter; set it as DB_Params.ErrorReporter.
+type Reporter struct {
+	config   Config
+	endpoint string
+	auth     string
+	events   chan event
+	stop     chan struct{}
+	done     chan struct{}
+	stopped  sync.Once
+
+	sent    atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// event is the part of the Sentry event payload the reports fill.
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Platform    string            `json:"platform"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Message     string            `json:"message"`
+	Exception   []exception       `json:"exception"`
+	Tags        map[string]string `json:"tags"`
+	Extra       map[string]any    `json:"extra"`
+	Fingerprint []string          `json:"fingerprint"`
+}
+
+type exception struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// New starts a reporter; Close sends the queued reports and stops it.
+func New(config Config) (*Reporter, error) {
+	dsn, err := url.Parse(config.DSN)
+	if err != nil || dsn.User == nil || dsn.Host == "" {
+		return nil, ErrInvalidDSN
+	}
+	project := strings.Trim(dsn.Path, "/")
+	if project == "" {
+		return nil, ErrInvalidDSN
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = 1000
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	r := &Reporter{
+		config:   config,
+		endpoint: fmt.Sprintf("%s://%s/api/%s/store/", dsn.Scheme, dsn.Host, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=book_bot_database/1.0, sentry_key=%s", dsn.User.Username()),
+		events:   make(chan event, config.BufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// ReportError queues report, or drops it if the queue is full or the
+// reporter closed. Reports group in Sentry by label and SQLSTATE.
+func (r *Reporter) ReportError(_ context.Context, report database.ErrorReport) {
+	select {
+	case <-r.stop:
+		r.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case r.events <- r.event(report):
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+func (r *Reporter) event(report database.ErrorReport) event {
+	label := report.Label
+	if label == "" {
+		label = report.SQL
+	}
+	class := report.Code
+	if class == "" {
+		class = fmt.Sprintf("%T", report.Err)
+	}
+	tags := map[string]string{"db.label": label}
+	if report.Code != "" {
+		tags["db.sqlstate"] = report.Code
+		tags["db.sqlstate_class"] = report.Class
+	}
+	if report.Table != "" {
+		tags["db.table"] = report.Table
+	}
+	extra := map[string]any{"sql": report.SQL, "args": report.Args}
+	if report.Constraint != "" {
+		extra["constraint"] = report.Constraint
+	}
+	return event{
+		EventID:     eventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Logger:      "book_bot_database",
+		Platform:    "go",
+		Environment: r.config.Environment,
+		Release:     r.config.Release,
+		Message:     label + ": " + report.Err.Error(),
+		Exception:   []exception{{Type: class, Value: report.Err.Error()}},
+		Tags:        tags,
+		Extra:       extra,
+		Fingerprint: []string{label, class},
+	}
+}
+
+func eventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Stats returns how many reports were sent, dropped on a full queue and
+// lost to failed requests.
+func (r *Reporter) Stats() (sent, dropped, failed int64) {
+	return r.sent.Load(), r.dropped.Load(), r.failed.Load()
+}
+
+// Close sends the queued reports and stops the reporter, giving up when
+// ctx is done.
+func (r *Reporter) Close(ctx context.Context) error {
+	r.stopped.Do(func() { close(r.stop) })
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	for {
+		select {
+		case e := <-r.events:
+			r.send(e)
+		case <-r.stop:
+			for len(r.events) > 0 {
+				r.send(<-r.events)
+			}
+			return
+		}
+	}
+}
+
+func (r *Reporter) send(e event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		r.failed.Add(1)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(body))
+	if err != nil {
+		r.failed.Add(1)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		r.failed.Add(1)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.failed.Add(1)
+		return
+	}
+	r.sent.Add(1)
+}
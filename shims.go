@@ -0,0 +1,150 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var errNotShimSchema = errors.New("schema holds more than views")
+
+// ViewShim is one view of a versioned interface schema for blue/green
+// deploys: each bot version runs with Schema set to its own schema of
+// views over the shared tables, so an old and a new version can run side
+// by side while the tables change underneath. A view selecting plain
+// columns of one table is updatable, so repositories write through it
+// like through the table.
+type ViewShim struct {
+	View  string
+	Table string
+	// Columns are the view's columns in order; Expr is the table column
+	// or expression behind each, the column of the same name if empty.
+	// Expressions make that column read-only.
+	Columns []ShimColumn
+}
+
+type ShimColumn struct {
+	Name string
+	Expr string
+}
+
+func (shim ViewShim) createSQL(schema string) string {
+	columns := make([]string, len(shim.Columns))
+	for i, column := range shim.Columns {
+		expr := column.Expr
+		if expr == "" {
+			expr = QuoteIdentifier(column.Name)
+		}
+		columns[i] = expr + " AS " + QuoteIdentifier(column.Name)
+	}
+	return "CREATE VIEW " + QuoteIdentifier(schema, shim.View) + " AS SELECT " + strings.Join(columns, ", ") +
+		" FROM " + QuoteIdentifier(strings.Split(shim.Table, ".")...)
+}
+
+// CreateViewShims creates schema with the given views, replacing views of
+// the same names, in one transaction.
+func (session *DB_Session) CreateViewShims(ctx context.Context, schema string, shims []ViewShim) error {
+	err := session.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+QuoteIdentifier(schema)); err != nil {
+			return err
+		}
+		for _, shim := range shims {
+			if len(shim.Columns) == 0 {
+				return fmt.Errorf("view %s has no columns", shim.View)
+			}
+			if _, err := tx.Exec(ctx, "DROP VIEW IF EXISTS "+QuoteIdentifier(schema, shim.View)); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, shim.createSQL(schema)); err != nil {
+				return fmt.Errorf("view %s: %w", shim.View, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("view shims %s: %w", schema, err)
+	}
+	session.logger.Log(LevelInfo, "DB view shims created", F("schema", schema), F("views", len(shims)))
+	return nil
+}
+
+// CutOver points the views of the live schema at the views of version in
+// one transaction, so everything running with Schema set to live moves
+// from one version's shape to the next at once. Views of live that
+// version lacks are dropped. Cutting over to the previous version rolls
+// back.
+func (session *DB_Session) CutOver(ctx context.Context, live, version string) error {
+	err := session.WithTx(ctx, func(tx pgx.Tx) error {
+		views, err := shimViews(ctx, tx, version)
+		if err != nil {
+			return err
+		}
+		if len(views) == 0 {
+			return fmt.Errorf("schema %s has no views", version)
+		}
+		current, err := shimViews(ctx, tx, live)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+QuoteIdentifier(live)); err != nil {
+			return err
+		}
+		for _, view := range current {
+			if _, err := tx.Exec(ctx, "DROP VIEW "+QuoteIdentifier(live, view)); err != nil {
+				return err
+			}
+		}
+		for _, view := range views {
+			_, err := tx.Exec(ctx, "CREATE VIEW "+QuoteIdentifier(live, view)+" AS SELECT * FROM "+QuoteIdentifier(version, view))
+			if err != nil {
+				return fmt.Errorf("view %s: %w", view, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cut over %s to %s: %w", live, version, err)
+	}
+	session.logger.Log(LevelInfo, "DB cut over", F("live", live), F("version", version))
+	return nil
+}
+
+// DropViewShims drops a retired version's schema. It refuses if the
+// schema holds anything but views, so tables are never dropped with it,
+// and while the live schema still points at it.
+func (session *DB_Session) DropViewShims(ctx context.Context, schema string) error {
+	return session.WithTx(ctx, func(tx pgx.Tx) error {
+		var others int
+		err := tx.QueryRow(ctx, `SELECT count(*) FROM pg_class
+			WHERE relnamespace = to_regnamespace($1) AND relkind <> 'v'`, schema).Scan(&others)
+		if err != nil {
+			return err
+		}
+		if others > 0 {
+			return fmt.Errorf("%w: %s", errNotShimSchema, schema)
+		}
+		views, err := shimViews(ctx, tx, schema)
+		if err != nil {
+			return err
+		}
+		for _, view := range views {
+			if _, err := tx.Exec(ctx, "DROP VIEW "+QuoteIdentifier(schema, view)); err != nil {
+				return fmt.Errorf("view %s: %w", view, err)
+			}
+		}
+		_, err = tx.Exec(ctx, "DROP SCHEMA IF EXISTS "+QuoteIdentifier(schema))
+		return err
+	})
+}
+
+func shimViews(ctx context.Context, tx pgx.Tx, schema string) ([]string, error) {
+	rows, err := tx.Query(ctx, `SELECT c.relname FROM pg_class c
+		WHERE c.relnamespace = to_regnamespace($1) AND c.relkind = 'v' ORDER BY c.relname`, schema)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,95 @@
+package book_bot_database
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollDelay is how often Shutdown checks for connections that are
+// still in use.
+const drainPollDelay = 50 * time.Millisecond
+
+// Shutdown stops the session gracefully. New acquisitions fail right away
+// with a shutdown error and the background goroutines are stopped, while
+// connections already handed out may finish their work until ctx is done.
+// Then the pools are closed. If ctx ends first, Shutdown returns its error
+// without waiting further; the pools close once the remaining connections
+// are released.
+func (session *DB_Session) Shutdown(ctx context.Context) error {
+	if !session.stop() {
+		return errAlreadyClosed
+	}
+	err := session.drain(ctx)
+	if err != nil {
+		session.logger.Log(LevelWarn, "DB stopping with connections still in use", F("in_use", session.inUse()), F("error", err))
+		go session.closePools()
+		return err
+	}
+	session.closePools()
+	return nil
+}
+
+// Close shuts the session down without draining; like closing a pool, it
+// blocks until connections in use are released.
+func (session *DB_Session) Close() error {
+	if !session.stop() {
+		return errAlreadyClosed
+	}
+	session.closePools()
+	return nil
+}
+
+// stop refuses new acquisitions and waits for the background goroutines
+// to exit, so no reconnect can swap the pool while it is being closed. It
+// reports false if the session was already stopped.
+func (session *DB_Session) stop() bool {
+	first := false
+	session.closeOnce.Do(func() {
+		first = true
+		session.logger.Log(LevelInfo, "DB stopping", F("host", session.primaryConfig().ConnConfig.Host))
+		// Listen checks done under the listener lock, so no listener
+		// can start once it is closed.
+		session.listener.mu.Lock()
+		close(session.done)
+		session.listener.mu.Unlock()
+	})
+	if !first {
+		return false
+	}
+	session.setState(StateClosed, nil)
+	session.background.Wait()
+	return true
+}
+
+func (session *DB_Session) drain(ctx context.Context) error {
+	for session.inUse() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.clock.After(drainPollDelay):
+		}
+	}
+	return nil
+}
+
+// inUse counts the acquired connections of the primary and pinned pools.
+func (session *DB_Session) inUse() int32 {
+	var n int32
+	if pool := session.pool.Load(); pool != nil {
+		n += pool.Stat().AcquiredConns()
+	}
+	session.pinnedMu.Lock()
+	if session.pinned != nil {
+		n += session.pinned.Stat().AcquiredConns()
+	}
+	session.pinnedMu.Unlock()
+	return n
+}
+
+func (session *DB_Session) closePools() {
+	if pool := session.pool.Load(); pool != nil {
+		pool.Close()
+	}
+	session.closePinned()
+	session.closeReplicas()
+}
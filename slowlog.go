@@ -0,0 +1,87 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// slowQueryArgLimit is how much of each argument a slow query log line
+// shows.
+const slowQueryArgLimit = 100
+
+// slowQueryTracer logs the queries that run longer than SlowQueryMs, and
+// hands failed ones to the ErrorReporter; the others cost a context value
+// and a clock read.
+type slowQueryTracer struct {
+	session   *DB_Session
+	threshold time.Duration
+}
+
+type slowQueryKey struct{}
+
+type slowQueryStart struct {
+	at   time.Time
+	sql  string
+	args []any
+}
+
+func (tracer *slowQueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, slowQueryKey{}, &slowQueryStart{at: tracer.session.clock.Now(), sql: data.SQL, args: data.Args})
+}
+
+func (tracer *slowQueryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(slowQueryKey{}).(*slowQueryStart)
+	if !ok {
+		return
+	}
+	if data.Err != nil {
+		tracer.session.ReportError(ctx, data.Err, start.sql, start.args...)
+	}
+	took := tracer.session.clock.Now().Sub(start.at)
+	if tracer.threshold <= 0 || took < tracer.threshold {
+		return
+	}
+	fields := []Field{
+		F("took", took.Round(time.Millisecond)),
+		F("sql", strings.Join(strings.Fields(start.sql), " ")),
+		F("args", tracer.formatArgs(start.args)),
+		F("rows", data.CommandTag.RowsAffected()),
+		F("pid", conn.PgConn().PID()),
+	}
+	if data.Err != nil {
+		fields = append(fields, F("error", data.Err))
+	}
+	tracer.session.logger.Log(LevelWarn, "DB slow query", fields...)
+}
+
+// formatArgs renders the arguments, or only their types with
+// RedactSlowQueryArgs, since they may hold user data.
+func (tracer *slowQueryTracer) formatArgs(args []any) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		var value string
+		if tracer.session.Params().RedactSlowQueryArgs {
+			value = fmt.Sprintf("%T", arg)
+		} else {
+			value = fmt.Sprintf("%v", arg)
+			if len(value) > slowQueryArgLimit {
+				value = value[:slowQueryArgLimit] + "..."
+			}
+		}
+		parts[i] = fmt.Sprintf("$%d=%s", i+1, value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// slowQueryTracer returns the tracer for the pools' connections, nil if
+// SlowQueryMs is off and there is no ErrorReporter.
+func (session *DB_Session) slowQueryTracer(params *DB_Params) pgx.QueryTracer {
+	if params.SlowQueryMs <= 0 && params.ErrorReporter == nil {
+		return nil
+	}
+	return &slowQueryTracer{session: session, threshold: time.Duration(params.SlowQueryMs) * time.Millisecond}
+}
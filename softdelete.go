@@ -0,0 +1,61 @@
+package book_bot_database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SoftDeleteSQL is the migration SQL adding soft deletes to table: a
+// deleted_at column, set while the row is deleted, with an index for
+// purging. Queries showing rows to users filter with NotDeleted.
+func SoftDeleteSQL(table string) string {
+	return "ALTER TABLE " + QuoteIdentifier(table) + " ADD COLUMN deleted_at TIMESTAMPTZ;" +
+		"CREATE INDEX " + QuoteIdentifier(table+"_deleted_idx") + " ON " + QuoteIdentifier(table) + " (deleted_at) WHERE deleted_at IS NOT NULL;"
+}
+
+// NotDeleted returns the SQL condition leaving out the soft-deleted rows
+// of the table aliased alias.
+func NotDeleted(alias string) string {
+	return alias + ".deleted_at IS NULL"
+}
+
+// SoftDelete marks the row of table with id deleted. It runs in WithTx,
+// so the change is audited with the actor of ctx. A row that doesn't
+// exist or is deleted already gives pgx.ErrNoRows.
+func (session *DB_Session) SoftDelete(ctx context.Context, table string, id any) error {
+	return session.softDeleteUpdate(ctx, "UPDATE "+QuoteIdentifier(table)+" SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL", id)
+}
+
+// Restore brings back the soft-deleted row of table with id; a row that
+// isn't deleted gives pgx.ErrNoRows.
+func (session *DB_Session) Restore(ctx context.Context, table string, id any) error {
+	return session.softDeleteUpdate(ctx, "UPDATE "+QuoteIdentifier(table)+" SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL", id)
+}
+
+// Purge deletes the soft-deleted row of table with id for good. Rows not
+// soft-deleted first are left alone and give pgx.ErrNoRows.
+func (session *DB_Session) Purge(ctx context.Context, table string, id any) error {
+	return session.softDeleteUpdate(ctx, "DELETE FROM "+QuoteIdentifier(table)+" WHERE id = $1 AND deleted_at IS NOT NULL", id)
+}
+
+// PurgeDeleted deletes for good the rows of table soft-deleted more than
+// keep ago, in batches; see DeleteInBatches. Their audit_log entries are
+// attributed to the database role.
+func (session *DB_Session) PurgeDeleted(ctx context.Context, table string, keep time.Duration) (int64, error) {
+	return session.DeleteInBatches(ctx, table, "deleted_at < now() - $1::interval", 0, 0, nil, keep)
+}
+
+func (session *DB_Session) softDeleteUpdate(ctx context.Context, sql string, id any) error {
+	return session.WithTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, sql, id)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return nil
+	})
+}
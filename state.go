@@ -0,0 +1,90 @@
+package book_bot_database
+
+// State is where a session is in its connection lifecycle.
+type State int32
+
+const (
+	// StateConnecting is a new session before its first connect succeeds.
+	StateConnecting State = iota
+	// StateReady accepts acquisitions.
+	StateReady
+	// StateReconnecting lost its connection and is connecting again.
+	StateReconnecting
+	// StateClosed is final; see Shutdown.
+	StateClosed
+	// StateFailed gave up connecting after MaxConnectAttempts; only
+	// Close and Shutdown leave it.
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateReady:
+		return "ready"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// State returns the current state of the session. It is safe to call
+// from any goroutine, including the lifecycle hooks.
+func (session *DB_Session) State() State {
+	return State(session.state.Load())
+}
+
+// setState moves the session to next and runs the hooks of the
+// transition. Transitions are serialized, while the hooks run after the
+// lock is dropped so they may use the session; as they run on the connect
+// loop they must not wait for Close or Shutdown, which wait for that loop.
+// Nothing leaves StateClosed.
+func (session *DB_Session) setState(next State, cause error) {
+	session.stateMu.Lock()
+	prev := session.State()
+	if prev == next || prev == StateClosed {
+		session.stateMu.Unlock()
+		return
+	}
+	if next == StateFailed {
+		session.failure = cause
+	}
+	session.state.Store(int32(next))
+	reconnected := false
+	if next == StateReady {
+		reconnected = session.connectedBefore
+		session.connectedBefore = true
+		session.readyOnce.Do(func() { close(session.ready) })
+	}
+	if next == StateFailed {
+		close(session.failed)
+	}
+	session.stateMu.Unlock()
+
+	session.logger.Log(LevelDebug, "DB state changed", F("from", prev), F("to", next))
+	params := session.Params()
+	switch {
+	case next == StateReady:
+		if reconnected && params.OnReconnect != nil {
+			params.OnReconnect()
+		} else if !reconnected && params.OnConnect != nil {
+			params.OnConnect()
+		}
+	case next == StateFailed:
+		if params.OnFailed != nil {
+			params.OnFailed(cause)
+		}
+	case prev == StateReady:
+		if params.OnDisconnect != nil {
+			params.OnDisconnect(cause)
+		}
+	}
+	if (next == StateReady || prev == StateReady) && params.OnReadyChange != nil {
+		params.OnReadyChange(next == StateReady)
+	}
+}
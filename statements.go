@@ -0,0 +1,173 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	statementsMu sync.Mutex
+	statements   = map[string]string{}
+)
+
+var errUnknownStatement = errors.New("unknown statement")
+
+// RegisterStatement adds a named query to the registry run by ExecNamed
+// and QueryNamed. Every connection of the primary pool prepares the
+// registered statements when it is opened, including after a reconnect,
+// and the session checks them all against the migrated schema before it
+// becomes ready, so a broken query shows up at startup rather than on
+// its first call. Call it from init; registering a name twice panics.
+func RegisterStatement(name, sql string) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	if _, ok := statements[name]; ok {
+		panic(fmt.Sprintf("statement %s registered twice", name))
+	}
+	statements[name] = sql
+}
+
+func registeredStatement(name string) (string, error) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+	sql, ok := statements[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errUnknownStatement, name)
+	}
+	return sql, nil
+}
+
+func prepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	statementsMu.Lock()
+	names := make([]string, 0, len(statements))
+	for name := range statements {
+		names = append(names, name)
+	}
+	statementsMu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		sql, _ := registeredStatement(name)
+		if _, err := conn.Prepare(ctx, name, sql); err != nil {
+			return fmt.Errorf("prepare %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// afterConnect prepares the registered statements on a new connection.
+// Connections opened before the first verifyStatements, such as the one
+// running migrations, skip them: the tables may not exist yet.
+func (session *DB_Session) afterConnect(ctx context.Context, conn *pgx.Conn) error {
+	if !session.statementsVerified.Load() {
+		return nil
+	}
+	return prepareStatements(ctx, conn)
+}
+
+// verifyStatements prepares every registered statement on one connection,
+// failing the connect if any of them doesn't match the schema.
+func (session *DB_Session) verifyStatements(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if err := prepareStatements(ctx, conn.Conn()); err != nil {
+		return err
+	}
+	session.statementsVerified.Store(true)
+	return nil
+}
+
+// ExecNamed runs the registered statement name with args.
+func (session *DB_Session) ExecNamed(ctx context.Context, name string, args ...any) (pgconn.CommandTag, error) {
+	ctx = namedLabel(ctx, name)
+	conn, err := session.namedConn(ctx, name)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer conn.Release()
+
+	return conn.Exec(ctx, name, args...)
+}
+
+// QueryNamed runs the registered statement name with args. The rows hold
+// a pooled connection until they are closed.
+func (session *DB_Session) QueryNamed(ctx context.Context, name string, args ...any) (pgx.Rows, error) {
+	ctx = namedLabel(ctx, name)
+	conn, err := session.namedConn(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return queryReleasing(ctx, conn, name, args...)
+}
+
+// namedLabel labels the error reports of a registered statement with its
+// name, unless the caller labelled them.
+func namedLabel(ctx context.Context, name string) context.Context {
+	if _, ok := ctx.Value(queryLabelKey{}).(string); ok {
+		return ctx
+	}
+	return WithQueryLabel(ctx, name)
+}
+
+// namedConn acquires a connection with statement name prepared. Prepare
+// is a no-op on connections that have it already, which after startup
+// are all of them.
+func (session *DB_Session) namedConn(ctx context.Context, name string) (*pgxpool.Conn, error) {
+	sql, err := registeredStatement(name)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Conn().Prepare(ctx, name, sql); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("prepare %s: %w", name, err)
+	}
+	return conn, nil
+}
+
+// queryReleasing runs sql on conn and hands conn to the rows, which
+// release it; conn is released right away if the query fails.
+func queryReleasing(ctx context.Context, conn *pgxpool.Conn, sql string, args ...any) (pgx.Rows, error) {
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return &connRows{Rows: rows, conn: conn}, nil
+}
+
+// connRows releases the connection its rows were read from once they are
+// read to the end or closed.
+type connRows struct {
+	pgx.Rows
+	conn *pgxpool.Conn
+}
+
+func (rows *connRows) Next() bool {
+	if rows.Rows.Next() {
+		return true
+	}
+	rows.Close()
+	return false
+}
+
+func (rows *connRows) Close() {
+	rows.Rows.Close()
+	if rows.conn != nil {
+		rows.conn.Release()
+		rows.conn = nil
+	}
+}
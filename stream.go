@@ -0,0 +1,77 @@
+package book_bot_database
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultStreamBatch is how many rows QueryStream fetches at a time when
+// the caller doesn't say.
+const defaultStreamBatch = 1000
+
+// QueryStream runs sql through a server-side cursor and calls fn for each
+// row, fetching batchSize rows at a time (0 picks a default), so a result
+// far larger than memory, such as a full export of books, is never held
+// at once. Each fetch is its own statement, so statement_timeout bounds a
+// batch rather than the whole scan. The cursor lives in a read-only
+// repeatable read transaction on one connection, which sees a consistent
+// snapshot and holds it until fn has seen the last row; long scans delay
+// vacuum. An error from fn, or ctx ending, stops the scan.
+func (session *DB_Session) QueryStream(ctx context.Context, sql string, batchSize int, fn func(row pgx.CollectableRow) error, args ...any) error {
+	if batchSize <= 0 {
+		batchSize = defaultStreamBatch
+	}
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	// Read-only, so rolling back loses nothing.
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(ctx, "DECLARE book_bot_stream NO SCROLL CURSOR FOR "+sql, args...); err != nil {
+		return err
+	}
+	// FETCH takes no parameters.
+	fetch := "FETCH FORWARD " + strconv.Itoa(batchSize) + " FROM book_bot_stream"
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			n++
+			if err := fn(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if n < batchSize {
+			return nil
+		}
+	}
+}
+
+// ForEachRow is QueryStream decoding each row into a T by column name, as
+// pgx.RowToStructByName does.
+func ForEachRow[T any](ctx context.Context, session *DB_Session, sql string, batchSize int, fn func(row *T) error, args ...any) error {
+	return session.QueryStream(ctx, sql, batchSize, func(row pgx.CollectableRow) error {
+		value, err := pgx.RowToStructByName[T](row)
+		if err != nil {
+			return err
+		}
+		return fn(&value)
+	}, args...)
+}
@@ -0,0 +1,39 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WithTempTable runs ddl, which creates one or more temporary tables (and
+// their indexes), and then fn, both on the same pooled connection so fn
+// sees the tables, e.g. to stage an import and merge it with one INSERT
+// ... SELECT. Afterwards the connection's temporary tables are dropped,
+// whatever fn returned; if that fails the connection is closed instead of
+// going back to the pool with them.
+func (session *DB_Session) WithTempTable(ctx context.Context, ddl string, fn func(conn *pgx.Conn) error) (err error) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, dropErr := conn.Exec(context.Background(), "DISCARD TEMP"); dropErr != nil {
+			session.logger.Log(LevelWarn, "DB dropping temporary tables failed, closing connection", F("error", dropErr))
+			raw := conn.Hijack()
+			session.untrack(raw)
+			raw.Close(context.Background())
+			if err == nil {
+				err = dropErr
+			}
+			return
+		}
+		conn.Release()
+	}()
+
+	if _, err := conn.Exec(ctx, ddl); err != nil {
+		return fmt.Errorf("create temporary table: %w", err)
+	}
+	return fn(conn.Conn())
+}
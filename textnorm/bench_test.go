@@ -0,0 +1,41 @@
+package textnorm
+
+import "testing"
+
+const benchTitle = "Метро 2033: Ёлки-палки, «Пикник на обочине» — Part One"
+
+// Allocation budgets of the benchmarks, enforced by TestAllocBudgets.
+const (
+	normalizeMaxAllocs = 12
+	latinKeyMaxAllocs  = 18
+)
+
+func BenchmarkNormalize(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Normalize(benchTitle)
+	}
+}
+
+func BenchmarkLatinKey(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		LatinKey(benchTitle)
+	}
+}
+
+func TestAllocBudgets(t *testing.T) {
+	budgets := []struct {
+		name string
+		max  float64
+		fn   func()
+	}{
+		{"Normalize", normalizeMaxAllocs, func() { Normalize(benchTitle) }},
+		{"LatinKey", latinKeyMaxAllocs, func() { LatinKey(benchTitle) }},
+	}
+	for _, budget := range budgets {
+		if allocs := testing.AllocsPerRun(100, budget.fn); allocs > budget.max {
+			t.Errorf("%s: %.0f allocs/op, budget %.0f", budget.name, allocs, budget.max)
+		}
+	}
+}
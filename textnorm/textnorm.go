@@ -0,0 +1,123 @@
+// Package textnorm normalizes titles and names into search keys. The same
+// pipeline must be applied to stored keys and to incoming queries, otherwise
+// they stop matching.
+package textnorm
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Step is a single normalization pass.
+type Step func(string) string
+
+// Pipeline applies its steps in order.
+type Pipeline []Step
+
+func (p Pipeline) Apply(s string) string {
+	for _, step := range p {
+		s = step(s)
+	}
+	return s
+}
+
+// Default is the pipeline used for book titles, author names and queries.
+var Default = Pipeline{Lowercase, FoldYo, StripDiacritics, FoldPunctuation, CollapseSpaces}
+
+// Normalize applies the Default pipeline.
+func Normalize(s string) string {
+	return Default.Apply(s)
+}
+
+func Lowercase(s string) string {
+	return strings.ToLower(s)
+}
+
+var yoReplacer = strings.NewReplacer("ё", "е", "Ё", "Е")
+
+// FoldYo replaces ё with е, which Russian texts use interchangeably.
+func FoldYo(s string) string {
+	return yoReplacer.Replace(s)
+}
+
+// StripDiacritics removes combining marks from non-Cyrillic letters
+// (é → e, ß stays). Cyrillic is left alone so that й doesn't become и.
+func StripDiacritics(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if r < 0x80 || unicode.Is(unicode.Cyrillic, r) {
+			b.WriteRune(r)
+			continue
+		}
+		for _, d := range norm.NFD.String(string(r)) {
+			if !unicode.Is(unicode.Mn, d) {
+				b.WriteRune(d)
+			}
+		}
+	}
+	return b.String()
+}
+
+// FoldPunctuation turns punctuation and symbols (quotes, dashes, dots) into
+// spaces so "Метро-2033" and "Метро 2033" produce the same key.
+func FoldPunctuation(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// CollapseSpaces trims the string and squeezes runs of whitespace.
+func CollapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var translitTable = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+}
+
+// Transliterate converts Cyrillic to Latin letters the way names are
+// usually romanized on book covers ("Лукьяненко" → "lukyanenko"). The
+// result is lowercase.
+func Transliterate(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range strings.ToLower(s) {
+		if latin, ok := translitTable[r]; ok {
+			b.WriteString(latin)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var latinFoldReplacer = strings.NewReplacer(
+	"shch", "sch", "kh", "h", "ck", "k", "ph", "f", "w", "v", "j", "i", "y", "i",
+)
+
+// LatinKey is a transliterated, loosely folded key used to match names
+// across scripts and romanization schemes ("Лукьяненко", "Lukyanenko" and
+// "Lukianenko" share one key).
+func LatinKey(s string) string {
+	s = latinFoldReplacer.Replace(Normalize(Transliterate(s)))
+	var b strings.Builder
+	b.Grow(len(s))
+	var prev rune
+	for _, r := range s {
+		if r != prev || r == ' ' {
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+	return b.String()
+}
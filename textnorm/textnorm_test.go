@@ -0,0 +1,60 @@
+package textnorm
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"  Метро   2033 ", "метро 2033"},
+		{"Метро-2033", "метро 2033"},
+		{"«Пикник на обочине»", "пикник на обочине"},
+		{"Ёлки-палки", "елки палки"},
+		{"Les Misérables", "les miserables"},
+		{"Straße", "straße"},
+		{"Йошкар-Ола", "йошкар ола"},
+		{"Tom\tSawyer\n", "tom sawyer"},
+		{"C++ & Go!", "c go"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Лукьяненко", "lukyanenko"},
+		{"Щербаков", "shcherbakov"},
+		{"Хлебников", "khlebnikov"},
+		{"Їжак", "yizhak"},
+		{"Tolkien", "tolkien"},
+		{"Метро 2033", "metro 2033"},
+	}
+	for _, tt := range tests {
+		if got := Transliterate(tt.in); got != tt.want {
+			t.Errorf("Transliterate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLatinKey(t *testing.T) {
+	// Spellings of one name in each group must share a key.
+	groups := [][]string{
+		{"Лукьяненко", "Lukyanenko", "Lukianenko"},
+		{"Хлебников", "Khlebnikov", "Hlebnikov"},
+		{"Щербаков", "Shcherbakov", "Scherbakov"},
+		{"Голованов", "Golovanov", "Gollovanov"},
+	}
+	for _, group := range groups {
+		want := LatinKey(group[0])
+		for _, name := range group[1:] {
+			if got := LatinKey(name); got != want {
+				t.Errorf("LatinKey(%q) = %q, want %q as for %q", name, got, want, group[0])
+			}
+		}
+	}
+	if a, b := LatinKey("Пелевин"), LatinKey("Пелагия"); a == b {
+		t.Errorf("distinct names share key %q", a)
+	}
+}
@@ -0,0 +1,123 @@
+package book_bot_database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// load validates t and reads its certificate files into the TLS config
+// shared by every connection; nil for Mode disable or empty. It runs when
+// the session is created, so certificates can come from a secrets mount.
+func (t TLSParams) load() (*tls.Config, error) {
+	switch t.Mode {
+	case "":
+		if t != (TLSParams{}) {
+			return nil, errors.New("tls: options set without a mode")
+		}
+		return nil, nil
+	case "disable":
+		return nil, nil
+	case "require", "verify-ca", "verify-full":
+	default:
+		return nil, fmt.Errorf("tls: unknown mode %q", t.Mode)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case t.InsecureSkipVerify, t.Mode == "require":
+		config.InsecureSkipVerify = true
+	case t.Mode == "verify-ca":
+		// The chain is checked by hand, skipping only the host name.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChain(config.RootCAs)
+	}
+	return config, nil
+}
+
+// apply sets the TLS config of every host of a parsed connection string.
+// Plain fallback attempts that sslmode=prefer adds are dropped, so a
+// server refusing TLS fails the connect instead of being used unencrypted.
+func (t TLSParams) apply(config *pgxpool.Config, base *tls.Config) {
+	if t.Mode == "" {
+		return
+	}
+	conn := config.ConnConfig
+	conn.TLSConfig = t.forHost(base, conn.Host)
+
+	seen := map[string]bool{net.JoinHostPort(conn.Host, strconv.Itoa(int(conn.Port))): true}
+	fallbacks := conn.Fallbacks
+	conn.Fallbacks = nil
+	for _, fallback := range fallbacks {
+		key := net.JoinHostPort(fallback.Host, strconv.Itoa(int(fallback.Port)))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		fallback.TLSConfig = t.forHost(base, fallback.Host)
+		conn.Fallbacks = append(conn.Fallbacks, fallback)
+	}
+}
+
+// forHost returns the config for connecting to host: none for unix
+// sockets, and with the name verify-full checks.
+func (t TLSParams) forHost(base *tls.Config, host string) *tls.Config {
+	if base == nil || strings.HasPrefix(host, "/") {
+		return nil
+	}
+	config := base.Clone()
+	config.ServerName = host
+	if t.ServerName != "" {
+		config.ServerName = t.ServerName
+	}
+	return config
+}
+
+// verifyChain checks that the server certificate chains to roots, or to
+// the system pool if nil, whatever name it was issued for.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("tls: server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
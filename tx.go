@@ -0,0 +1,184 @@
+package book_bot_database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// WithTx runs fn inside a transaction on a pooled connection, committing if
+// fn returns nil and rolling back otherwise. When LockTimeoutMs is set it is
+// applied to the transaction, and lock timeouts or deadlocks are reported
+// with a snapshot of the blocking sessions. The audited changes of fn are
+// attributed to the actor of WithActor.
+//
+// Serialization failures, deadlocks and lost connections are retried with
+// a jittered, doubling backoff up to Retries.TxMaxAttempts, so fn may run
+// more than once and must not have side effects outside the transaction.
+// A connection lost during COMMIT is not retried, since the transaction
+// may have committed; see IsAmbiguousCommit.
+//
+// Called with a context of WithTxCtx, WithTx runs fn in a savepoint of
+// that transaction instead; see WithTxCtx.
+func (session *DB_Session) WithTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	if outer := session.txFrom(ctx); outer != nil {
+		return withSavepoint(ctx, outer, fn)
+	}
+	retries := session.Params().Retries
+	attempts := retries.TxMaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := time.Duration(retries.TxBaseDelayMs) * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		err, retryable := session.runTx(ctx, fn)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= attempts || ctx.Err() != nil {
+			return session.diagnoseLockError(err)
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+		session.logger.Log(LevelWarn, "DB transaction failed, retrying", F("attempt", attempt), F("max_attempts", attempts), F("delay", wait), F("error", err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-session.clock.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+var errAmbiguousCommit = errors.New("connection lost during commit: the transaction may have committed")
+
+// IsAmbiguousCommit reports whether err was returned by WithTx because the
+// connection failed while committing, so whether fn's changes were
+// applied is unknown; check before running them again.
+func IsAmbiguousCommit(err error) bool {
+	return errors.Is(err, errAmbiguousCommit)
+}
+
+type ambiguousCommitError struct{ err error }
+
+func (e ambiguousCommitError) Error() string {
+	return errAmbiguousCommit.Error() + ": " + e.err.Error()
+}
+
+func (e ambiguousCommitError) Unwrap() error {
+	return e.err
+}
+
+func (e ambiguousCommitError) Is(target error) bool {
+	return target == errAmbiguousCommit
+}
+
+func (session *DB_Session) runTx(ctx context.Context, fn func(pgx.Tx) error) (err error, retryable bool) {
+	conn, err := session.GetConnectionCtx(ctx)
+	if err != nil {
+		return err, false
+	}
+	defer conn.Release()
+	committing := false
+	defer func() {
+		if err != nil && !retryable && !committing {
+			retryable = conn.Conn().IsClosed()
+		}
+	}()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err, false
+	}
+
+	if lockTimeout := session.Params().LockTimeoutMs; lockTimeout > 0 {
+		_, err = tx.Exec(ctx, "SELECT set_config('lock_timeout', $1, true)", strconv.Itoa(lockTimeout)+"ms")
+		if err != nil {
+			tx.Rollback(ctx)
+			return err, false
+		}
+	}
+	if actor := actorFrom(ctx); actor != "" {
+		if err = TagActor(ctx, tx, actor); err != nil {
+			tx.Rollback(ctx)
+			return err, false
+		}
+	}
+
+	err = fn(tx)
+	if err == nil {
+		err = session.injectCommitFault()
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return err, isRetryableTxError(err)
+	}
+	committing = true
+	if err = tx.Commit(ctx); err != nil {
+		// The server answering with an error or a ROLLBACK rolled back;
+		// anything else may have happened after it committed.
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) && !errors.Is(err, pgx.ErrTxCommitRollback) {
+			return ambiguousCommitError{err: err}, false
+		}
+	}
+	return err, isRetryableTxError(err)
+}
+
+// isRetryableTxError reports serialization failures and deadlocks, after
+// which the whole transaction can simply run again.
+func isRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
+
+type txKey struct{}
+
+type ctxTx struct {
+	session *DB_Session
+	tx      pgx.Tx
+}
+
+// WithTxCtx is WithTx handing fn a context that carries the transaction.
+// WithTx and WithTxCtx calls made with that context, including those of
+// the repos fn calls, become savepoints of it: an error of the inner call
+// rolls back to its savepoint and is returned to fn, which may carry on
+// with the transaction, e.g. to skip one bad book of a large import. Only
+// the outermost call commits and retries.
+func (session *DB_Session) WithTxCtx(ctx context.Context, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	return session.WithTx(ctx, func(tx pgx.Tx) error {
+		return fn(context.WithValue(ctx, txKey{}, &ctxTx{session: session, tx: tx}), tx)
+	})
+}
+
+func (session *DB_Session) txFrom(ctx context.Context) pgx.Tx {
+	outer, ok := ctx.Value(txKey{}).(*ctxTx)
+	if !ok || outer.session != session {
+		return nil
+	}
+	return outer.tx
+}
+
+func withSavepoint(ctx context.Context, outer pgx.Tx, fn func(pgx.Tx) error) error {
+	savepoint, err := outer.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(savepoint); err != nil {
+		if rbErr := savepoint.Rollback(ctx); rbErr != nil {
+			return fmt.Errorf("%w (rollback to savepoint: %v)", err, rbErr)
+		}
+		return err
+	}
+	return savepoint.Commit(ctx)
+}
@@ -0,0 +1,85 @@
+// Package v2 is the stable interface layer of the package. New code
+// should depend on Session, Querier and TxRunner instead of the concrete
+// *DB_Session, which keeps evolving; Wrap adapts a session to them.
+package v2
+
+import (
+	"context"
+
+	database "github.com/RedBuld/book_bot_database"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Querier runs statements. It is satisfied by Session, pgx.Tx and pooled
+// connections, so repo code can run either inside or outside a
+// transaction.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type TxRunner interface {
+	WithTx(ctx context.Context, fn func(pgx.Tx) error) error
+}
+
+type Session interface {
+	Querier
+	TxRunner
+	// Acquire returns a dedicated connection; the caller releases it.
+	Acquire(ctx context.Context) (*pgxpool.Conn, error)
+	Logger() database.Logger
+	Clock() database.Clock
+	Close() error
+}
+
+var (
+	_ Querier = pgx.Tx(nil)
+	_ Querier = (*pgxpool.Conn)(nil)
+	_ Session = (*session)(nil)
+)
+
+type session struct {
+	db *database.DB_Session
+}
+
+// Wrap exposes db through the v2 interfaces. Each statement run on the
+// result acquires a connection for its own duration.
+func Wrap(db *database.DB_Session) Session {
+	return &session{db: db}
+}
+
+func (s *session) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	return s.db.GetConnectionCtx(ctx)
+}
+
+func (s *session) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return s.db.Exec(ctx, sql, args...)
+}
+
+// Query keeps the connection until the rows are closed or read to the end.
+func (s *session) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return s.db.Query(ctx, sql, args...)
+}
+
+func (s *session) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return s.db.QueryRow(ctx, sql, args...)
+}
+
+func (s *session) WithTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	return s.db.WithTx(ctx, fn)
+}
+
+func (s *session) Logger() database.Logger {
+	return s.db.Logger()
+}
+
+func (s *session) Clock() database.Clock {
+	return s.db.Clock()
+}
+
+func (s *session) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,182 @@
+package book_bot_database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const validateBatch = 1000
+
+// Violation is a row breaking a validation rule. Key is the id of the
+// row; it is zero for rows not stored yet.
+type Violation struct {
+	Table string
+	Rule  string
+	Key   int64
+	Err   error
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %d: %s: %v", v.Table, v.Key, v.Rule, v.Err)
+}
+
+// ValidationError lists the rules a row breaks. It unwraps to the error
+// of the first, so callers can match rule errors with errors.Is.
+type ValidationError struct {
+	Table      string
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	broken := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		broken[i] = v.Rule + ": " + v.Err.Error()
+	}
+	return "invalid " + e.Table + ": " + strings.Join(broken, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Violations[0].Err
+}
+
+// Validator holds the rules rows of a table must keep. Repositories call
+// Validate before their writes; ValidateExisting runs the same rules over
+// the rows already stored, which may predate them.
+type Validator[T any] struct {
+	table   string
+	columns string
+	key     func(*T) int64
+	rules   []validationRule[T]
+}
+
+type validationRule[T any] struct {
+	name  string
+	check func(*T) error
+}
+
+type existingChecker interface {
+	checkExisting(ctx context.Context, session *DB_Session, report func(Violation) bool) error
+}
+
+var (
+	validatorsMu sync.Mutex
+	validators   = map[string]existingChecker{}
+)
+
+// NewValidator creates the validator of table and registers it for
+// ValidateExisting, which reads columns (matching the db tags of T) in
+// order of the table's id column; key returns the id of a row. Call it from
+// init or a package variable; a table can only have one validator.
+func NewValidator[T any](table, columns string, key func(*T) int64) *Validator[T] {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	if _, ok := validators[table]; ok {
+		panic(fmt.Sprintf("validator of %s registered twice", table))
+	}
+	v := &Validator[T]{table: table, columns: columns, key: key}
+	validators[table] = v
+	return v
+}
+
+// Rule adds a rule named name; check returns why a row breaks it, or nil.
+func (v *Validator[T]) Rule(name string, check func(row *T) error) *Validator[T] {
+	v.rules = append(v.rules, validationRule[T]{name: name, check: check})
+	return v
+}
+
+// Validate checks row against every rule and returns a *ValidationError
+// with the ones it breaks.
+func (v *Validator[T]) Validate(row *T) error {
+	violations := v.violations(row)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Table: v.table, Violations: violations}
+}
+
+func (v *Validator[T]) violations(row *T) []Violation {
+	var violations []Violation
+	for _, rule := range v.rules {
+		if err := rule.check(row); err != nil {
+			violations = append(violations, Violation{Table: v.table, Rule: rule.name, Key: v.key(row), Err: err})
+		}
+	}
+	return violations
+}
+
+func (v *Validator[T]) checkExisting(ctx context.Context, session *DB_Session, report func(Violation) bool) error {
+	sql := "SELECT " + v.columns + " FROM " + QuoteIdentifier(strings.Split(v.table, ".")...) + " WHERE id > $1 ORDER BY id LIMIT $2"
+	after := int64(-1 << 63)
+	for {
+		batch, err := v.batch(ctx, session, sql, after)
+		if err != nil {
+			return fmt.Errorf("validate %s: %w", v.table, err)
+		}
+		for i := range batch {
+			for _, violation := range v.violations(&batch[i]) {
+				if !report(violation) {
+					return nil
+				}
+			}
+		}
+		if len(batch) < validateBatch {
+			return nil
+		}
+		after = v.key(&batch[len(batch)-1])
+	}
+}
+
+func (v *Validator[T]) batch(ctx context.Context, session *DB_Session, sql string, after int64) ([]T, error) {
+	conn, err := session.GetReadConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, sql, after, validateBatch)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[T])
+}
+
+// ValidateExisting runs the registered validators over the stored rows,
+// in batches read from a replica when there is one, and returns the
+// violations found, oldest rows first. Rows written before a rule existed
+// or by other clients skip the checks on write; this reports them so they
+// can be fixed. limit caps the violations returned, 0 returns them all.
+func (session *DB_Session) ValidateExisting(ctx context.Context, limit int) ([]Violation, error) {
+	validatorsMu.Lock()
+	tables := make([]string, 0, len(validators))
+	for table := range validators {
+		tables = append(tables, table)
+	}
+	validatorsMu.Unlock()
+	sort.Strings(tables)
+
+	var found []Violation
+	report := func(v Violation) bool {
+		found = append(found, v)
+		return limit <= 0 || len(found) < limit
+	}
+	for _, table := range tables {
+		validatorsMu.Lock()
+		v := validators[table]
+		validatorsMu.Unlock()
+		if err := v.checkExisting(ctx, session, report); err != nil {
+			return found, err
+		}
+		if limit > 0 && len(found) >= limit {
+			break
+		}
+	}
+	if len(found) > 0 {
+		session.logger.Log(LevelWarn, "DB existing rows break validation rules", F("violations", len(found)))
+	}
+	return found, nil
+}
@@ -0,0 +1,83 @@
+package book_bot_database
+
+import (
+	"errors"
+	"testing"
+)
+
+type widget struct {
+	ID    int64
+	Name  string
+	Count int
+}
+
+var (
+	errNoName   = errors.New("name is empty")
+	errNegative = errors.New("count is negative")
+)
+
+var widgetRules = NewValidator("test_widgets", "id, name, count", func(w *widget) int64 { return w.ID }).
+	Rule("name", func(w *widget) error {
+		if w.Name == "" {
+			return errNoName
+		}
+		return nil
+	}).
+	Rule("count", func(w *widget) error {
+		if w.Count < 0 {
+			return errNegative
+		}
+		return nil
+	})
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		row   widget
+		rules []string
+	}{
+		{widget{Name: "gear", Count: 1}, nil},
+		{widget{ID: 3, Count: 1}, []string{"name"}},
+		{widget{ID: 4, Name: "gear", Count: -1}, []string{"count"}},
+		{widget{ID: 5, Count: -1}, []string{"name", "count"}},
+	}
+	for _, tt := range tests {
+		err := widgetRules.Validate(&tt.row)
+		if tt.rules == nil {
+			if err != nil {
+				t.Errorf("Validate(%+v) = %v, want nil", tt.row, err)
+			}
+			continue
+		}
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("Validate(%+v) = %v, want a *ValidationError", tt.row, err)
+		}
+		if verr.Table != "test_widgets" || len(verr.Violations) != len(tt.rules) {
+			t.Fatalf("Validate(%+v) = %+v, want violations of %v", tt.row, verr, tt.rules)
+		}
+		for i, v := range verr.Violations {
+			if v.Rule != tt.rules[i] || v.Key != tt.row.ID {
+				t.Errorf("violation %d = %v, want rule %s of %d", i, v, tt.rules[i], tt.row.ID)
+			}
+		}
+	}
+}
+
+func TestValidationErrorMatchesFirstRule(t *testing.T) {
+	err := widgetRules.Validate(&widget{Count: -1})
+	if !errors.Is(err, errNoName) {
+		t.Errorf("errors.Is(%v, errNoName) = false", err)
+	}
+	if want := "invalid test_widgets: name: name is empty; count: count is negative"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestNewValidatorTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a second validator of test_widgets didn't panic")
+		}
+	}()
+	NewValidator("test_widgets", "id", func(w *widget) int64 { return w.ID })
+}